@@ -30,6 +30,13 @@ type TokenGenerationRequest struct {
 	Prompt string `protobuf:"bytes,1,opt,name=prompt,proto3" json:"prompt,omitempty"`
 	// DecodingParameters are the parameters to use for token generation
 	DecodingParameters *DecodingParameters `protobuf:"bytes,2,opt,name=decoding_parameters,json=decodingParameters,proto3" json:"decoding_parameters,omitempty"`
+	// SystemPrompt, when set, replaces the system prompt of the server for this request. An empty one disables it.
+	SystemPrompt *string `protobuf:"bytes,3,opt,name=system_prompt,json=systemPrompt,proto3,oneof" json:"system_prompt,omitempty"`
+	// Model is the name of the model to use, among the ones registered on the server. If empty, the default model is used.
+	Model string `protobuf:"bytes,4,opt,name=model,proto3" json:"model,omitempty"`
+	// Session, if true, makes the generation continue when the stream is interrupted, so that the client can reattach to it with ResumeSession.
+	// The first message of the stream has only the session_id set.
+	Session bool `protobuf:"varint,5,opt,name=session,proto3" json:"session,omitempty"`
 }
 
 func (x *TokenGenerationRequest) Reset() {
@@ -78,7 +85,155 @@ func (x *TokenGenerationRequest) GetDecodingParameters() *DecodingParameters {
 	return nil
 }
 
-// DecodingParameters contains the parameters to use for token generation
+func (x *TokenGenerationRequest) GetSystemPrompt() string {
+	if x != nil && x.SystemPrompt != nil {
+		return *x.SystemPrompt
+	}
+	return ""
+}
+
+func (x *TokenGenerationRequest) GetModel() string {
+	if x != nil {
+		return x.Model
+	}
+	return ""
+}
+
+func (x *TokenGenerationRequest) GetSession() bool {
+	if x != nil {
+		return x.Session
+	}
+	return false
+}
+
+// SessionRequest identifies the session to reattach to
+type SessionRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// SessionID is the session_id of the first message of the stream of the session.
+	SessionId string `protobuf:"bytes,1,opt,name=session_id,json=sessionId,proto3" json:"session_id,omitempty"`
+	// Offset is the number of messages of the stream already received, excluding the one with the session_id.
+	Offset int32 `protobuf:"varint,2,opt,name=offset,proto3" json:"offset,omitempty"`
+}
+
+func (x *SessionRequest) Reset() {
+	*x = SessionRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_language_model_proto_msgTypes[1]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *SessionRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SessionRequest) ProtoMessage() {}
+
+func (x *SessionRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_language_model_proto_msgTypes[1]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SessionRequest.ProtoReflect.Descriptor instead.
+func (*SessionRequest) Descriptor() ([]byte, []int) {
+	return file_language_model_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *SessionRequest) GetSessionId() string {
+	if x != nil {
+		return x.SessionId
+	}
+	return ""
+}
+
+func (x *SessionRequest) GetOffset() int32 {
+	if x != nil {
+		return x.Offset
+	}
+	return 0
+}
+
+// ContinuationRequest identifies the generation to resume and the parameters of its continuation
+type ContinuationRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// ContinuationID is the continuation_id of the last message of the generation to resume.
+	// It can only be used once: a resumable continuation returns a new one.
+	ContinuationId string `protobuf:"bytes,1,opt,name=continuation_id,json=continuationId,proto3" json:"continuation_id,omitempty"`
+	// AdditionalLen is the maximum number of tokens to generate. It replaces max_len.
+	AdditionalLen int32 `protobuf:"varint,2,opt,name=additional_len,json=additionalLen,proto3" json:"additional_len,omitempty"`
+	// DecodingParameters are the parameters of the continuation. The prompt-related ones are ignored.
+	DecodingParameters *DecodingParameters `protobuf:"bytes,3,opt,name=decoding_parameters,json=decodingParameters,proto3" json:"decoding_parameters,omitempty"`
+}
+
+func (x *ContinuationRequest) Reset() {
+	*x = ContinuationRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_language_model_proto_msgTypes[2]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ContinuationRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ContinuationRequest) ProtoMessage() {}
+
+func (x *ContinuationRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_language_model_proto_msgTypes[2]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ContinuationRequest.ProtoReflect.Descriptor instead.
+func (*ContinuationRequest) Descriptor() ([]byte, []int) {
+	return file_language_model_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *ContinuationRequest) GetContinuationId() string {
+	if x != nil {
+		return x.ContinuationId
+	}
+	return ""
+}
+
+func (x *ContinuationRequest) GetAdditionalLen() int32 {
+	if x != nil {
+		return x.AdditionalLen
+	}
+	return 0
+}
+
+func (x *ContinuationRequest) GetDecodingParameters() *DecodingParameters {
+	if x != nil {
+		return x.DecodingParameters
+	}
+	return nil
+}
+
+// DecodingParameters contains the parameters to use for token generation.
+// The fields which are not set take the default values of the server, unless they are listed in zero_fields.
 type DecodingParameters struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
@@ -100,14 +255,69 @@ type DecodingParameters struct {
 	EndTokenId int32 `protobuf:"varint,7,opt,name=end_token_id,json=endTokenId,proto3" json:"end_token_id,omitempty"`
 	// SkipEndTokenID when true, the end token is not added to the generated sequence.
 	SkipEndTokenId bool `protobuf:"varint,8,opt,name=skip_end_token_id,json=skipEndTokenId,proto3" json:"skip_end_token_id,omitempty"`
-	// StopSequences are the sequences of token ids that will cause the generation to stop.
+	// StopSequences are the sequences of token ids that will cause the generation to stop, each with its action.
 	StopSequences []*Sequence `protobuf:"bytes,9,rep,name=stop_sequences,json=stopSequences,proto3" json:"stop_sequences,omitempty"`
+	// ForceJSON constrains the generation to produce a valid JSON object or array.
+	ForceJson bool `protobuf:"varint,10,opt,name=force_json,json=forceJson,proto3" json:"force_json,omitempty"`
+	// AddBOS prepends the beginning-of-sequence token to the prompt.
+	AddBos bool `protobuf:"varint,11,opt,name=add_bos,json=addBos,proto3" json:"add_bos,omitempty"`
+	// EchoPrompt streams the tokens of the prompt before the generated ones.
+	EchoPrompt bool `protobuf:"varint,12,opt,name=echo_prompt,json=echoPrompt,proto3" json:"echo_prompt,omitempty"`
+	// ChunkSize, if greater than 1, batches up to this number of tokens in the chunk of a single message.
+	ChunkSize int32 `protobuf:"varint,13,opt,name=chunk_size,json=chunkSize,proto3" json:"chunk_size,omitempty"`
+	// FlushIntervalMs, if positive, batches the tokens in the chunk of a single message,
+	// sent when this number of milliseconds has passed since the first token of the chunk.
+	// It can be combined with chunk_size, in which case a chunk is sent as soon as either limit is reached.
+	FlushIntervalMs int32 `protobuf:"varint,14,opt,name=flush_interval_ms,json=flushIntervalMs,proto3" json:"flush_interval_ms,omitempty"`
+	// Resumable keeps the state of the model at the end of the generation, so that it can be continued with GenerateContinue.
+	// The last message of the stream has only the continuation_id set.
+	Resumable bool `protobuf:"varint,15,opt,name=resumable,proto3" json:"resumable,omitempty"`
+	// MaxChars, if positive, stops the generation when the text of the generated tokens reaches this number of characters
+	// (Unicode code points), trimming the text of the last token if it exceeds it.
+	MaxChars int32 `protobuf:"varint,16,opt,name=max_chars,json=maxChars,proto3" json:"max_chars,omitempty"`
+	// TrimWhitespace removes the leading and trailing whitespace of the generated text.
+	// The tokens are still streamed, but the text of the trimmed ones is empty, and the whitespace
+	// is held back until it is known not to be trailing.
+	TrimWhitespace bool `protobuf:"varint,17,opt,name=trim_whitespace,json=trimWhitespace,proto3" json:"trim_whitespace,omitempty"`
+	// CollapseNewlines replaces the consecutive newlines of the generated text with a single one.
+	CollapseNewlines bool `protobuf:"varint,18,opt,name=collapse_newlines,json=collapseNewlines,proto3" json:"collapse_newlines,omitempty"`
+	// ForcedPrefix is a text the output starts with: its tokens are fed to the model, as if it had generated them,
+	// and streamed before the generated ones, with probability 1.
+	ForcedPrefix string `protobuf:"bytes,19,opt,name=forced_prefix,json=forcedPrefix,proto3" json:"forced_prefix,omitempty"`
+	// LogitClamp, if positive, clips the logits to [-logit_clamp, logit_clamp] before the other controls and the temperature.
+	LogitClamp float32 `protobuf:"fixed32,20,opt,name=logit_clamp,json=logitClamp,proto3" json:"logit_clamp,omitempty"`
+	// MaxTokensPerSecond, if positive, limits the rate at which the tokens are streamed.
+	MaxTokensPerSecond float32 `protobuf:"fixed32,21,opt,name=max_tokens_per_second,json=maxTokensPerSecond,proto3" json:"max_tokens_per_second,omitempty"`
+	// JSONSchema, if not empty, is a JSON schema which the generated text must match. The tokens are sent at the end of the generation,
+	// after the validation. If the text doesn't match, the stream ends with an ABORTED status with a JSON_SCHEMA_MISMATCH ErrorInfo detail.
+	JsonSchema string `protobuf:"bytes,22,opt,name=json_schema,json=jsonSchema,proto3" json:"json_schema,omitempty"`
+	// JSONSchemaRetries is the number of times the generation is repeated when its text doesn't match the json_schema.
+	JsonSchemaRetries int32 `protobuf:"varint,23,opt,name=json_schema_retries,json=jsonSchemaRetries,proto3" json:"json_schema_retries,omitempty"`
+	// FilterSpecialTokens when true, the control tokens of the tokenizer, such as the beginning-of-sequence, padding and
+	// extra special tokens, are not streamed. The end token still stops the generation.
+	FilterSpecialTokens bool `protobuf:"varint,24,opt,name=filter_special_tokens,json=filterSpecialTokens,proto3" json:"filter_special_tokens,omitempty"`
+	// ZeroFields are the names of the fields, such as "temperature", whose zero value is intended. The other fields which
+	// are zero are not set, and take the default value of the server.
+	ZeroFields []string `protobuf:"bytes,25,rep,name=zero_fields,json=zeroFields,proto3" json:"zero_fields,omitempty"`
+	// ReturnStats adds the statistics of the generation to the last message of the stream.
+	ReturnStats bool `protobuf:"varint,26,opt,name=return_stats,json=returnStats,proto3" json:"return_stats,omitempty"`
+	// MinTopProb, if positive, stops the generation, once min_len tokens have been generated, when the probability of the
+	// selected token falls below it. The token is kept.
+	MinTopProb float32 `protobuf:"fixed32,27,opt,name=min_top_prob,json=minTopProb,proto3" json:"min_top_prob,omitempty"`
+	// TypicalP, if between 0 and 1, exclusive, is the probability mass of the locally typical tokens to consider when
+	// sampling the next token: the ones whose information content is the closest to the entropy of the distribution.
+	TypicalP float32 `protobuf:"fixed32,28,opt,name=typical_p,json=typicalP,proto3" json:"typical_p,omitempty"`
+	// Epsilon, if positive, removes the tokens whose probability is below it (epsilon sampling). It must be less than 1.
+	Epsilon float32 `protobuf:"fixed32,29,opt,name=epsilon,proto3" json:"epsilon,omitempty"`
+	// Eta, if positive, removes the tokens whose probability is below min(eta, sqrt(eta) * exp(-entropy)) (eta sampling).
+	// It must be less than 1.
+	Eta float32 `protobuf:"fixed32,30,opt,name=eta,proto3" json:"eta,omitempty"`
 }
 
 func (x *DecodingParameters) Reset() {
 	*x = DecodingParameters{}
 	if protoimpl.UnsafeEnabled {
-		mi := &file_language_model_proto_msgTypes[1]
+		mi := &file_language_model_proto_msgTypes[3]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		ms.StoreMessageInfo(mi)
 	}
@@ -120,7 +330,7 @@ func (x *DecodingParameters) String() string {
 func (*DecodingParameters) ProtoMessage() {}
 
 func (x *DecodingParameters) ProtoReflect() protoreflect.Message {
-	mi := &file_language_model_proto_msgTypes[1]
+	mi := &file_language_model_proto_msgTypes[3]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -133,7 +343,7 @@ func (x *DecodingParameters) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use DecodingParameters.ProtoReflect.Descriptor instead.
 func (*DecodingParameters) Descriptor() ([]byte, []int) {
-	return file_language_model_proto_rawDescGZIP(), []int{1}
+	return file_language_model_proto_rawDescGZIP(), []int{3}
 }
 
 func (x *DecodingParameters) GetMaxLen() int32 {
@@ -199,18 +409,170 @@ func (x *DecodingParameters) GetStopSequences() []*Sequence {
 	return nil
 }
 
+func (x *DecodingParameters) GetForceJson() bool {
+	if x != nil {
+		return x.ForceJson
+	}
+	return false
+}
+
+func (x *DecodingParameters) GetAddBos() bool {
+	if x != nil {
+		return x.AddBos
+	}
+	return false
+}
+
+func (x *DecodingParameters) GetEchoPrompt() bool {
+	if x != nil {
+		return x.EchoPrompt
+	}
+	return false
+}
+
+func (x *DecodingParameters) GetChunkSize() int32 {
+	if x != nil {
+		return x.ChunkSize
+	}
+	return 0
+}
+
+func (x *DecodingParameters) GetFlushIntervalMs() int32 {
+	if x != nil {
+		return x.FlushIntervalMs
+	}
+	return 0
+}
+
+func (x *DecodingParameters) GetResumable() bool {
+	if x != nil {
+		return x.Resumable
+	}
+	return false
+}
+
+func (x *DecodingParameters) GetMaxChars() int32 {
+	if x != nil {
+		return x.MaxChars
+	}
+	return 0
+}
+
+func (x *DecodingParameters) GetTrimWhitespace() bool {
+	if x != nil {
+		return x.TrimWhitespace
+	}
+	return false
+}
+
+func (x *DecodingParameters) GetCollapseNewlines() bool {
+	if x != nil {
+		return x.CollapseNewlines
+	}
+	return false
+}
+
+func (x *DecodingParameters) GetForcedPrefix() string {
+	if x != nil {
+		return x.ForcedPrefix
+	}
+	return ""
+}
+
+func (x *DecodingParameters) GetLogitClamp() float32 {
+	if x != nil {
+		return x.LogitClamp
+	}
+	return 0
+}
+
+func (x *DecodingParameters) GetMaxTokensPerSecond() float32 {
+	if x != nil {
+		return x.MaxTokensPerSecond
+	}
+	return 0
+}
+
+func (x *DecodingParameters) GetJsonSchema() string {
+	if x != nil {
+		return x.JsonSchema
+	}
+	return ""
+}
+
+func (x *DecodingParameters) GetJsonSchemaRetries() int32 {
+	if x != nil {
+		return x.JsonSchemaRetries
+	}
+	return 0
+}
+
+func (x *DecodingParameters) GetFilterSpecialTokens() bool {
+	if x != nil {
+		return x.FilterSpecialTokens
+	}
+	return false
+}
+
+func (x *DecodingParameters) GetZeroFields() []string {
+	if x != nil {
+		return x.ZeroFields
+	}
+	return nil
+}
+
+func (x *DecodingParameters) GetReturnStats() bool {
+	if x != nil {
+		return x.ReturnStats
+	}
+	return false
+}
+
+func (x *DecodingParameters) GetMinTopProb() float32 {
+	if x != nil {
+		return x.MinTopProb
+	}
+	return 0
+}
+
+func (x *DecodingParameters) GetTypicalP() float32 {
+	if x != nil {
+		return x.TypicalP
+	}
+	return 0
+}
+
+func (x *DecodingParameters) GetEpsilon() float32 {
+	if x != nil {
+		return x.Epsilon
+	}
+	return 0
+}
+
+func (x *DecodingParameters) GetEta() float32 {
+	if x != nil {
+		return x.Eta
+	}
+	return 0
+}
+
+// Sequence is a sequence of token ids
 type Sequence struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
+	// Sequence is the sequence of token ids
 	Sequence []int32 `protobuf:"varint,1,rep,packed,name=sequence,proto3" json:"sequence,omitempty"`
+	// Action tells what happens to the output when the sequence stops the generation: "stop-keep" (the default, when
+	// empty) keeps the sequence, while "stop-trim" removes it.
+	Action string `protobuf:"bytes,2,opt,name=action,proto3" json:"action,omitempty"`
 }
 
 func (x *Sequence) Reset() {
 	*x = Sequence{}
 	if protoimpl.UnsafeEnabled {
-		mi := &file_language_model_proto_msgTypes[2]
+		mi := &file_language_model_proto_msgTypes[4]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		ms.StoreMessageInfo(mi)
 	}
@@ -223,7 +585,7 @@ func (x *Sequence) String() string {
 func (*Sequence) ProtoMessage() {}
 
 func (x *Sequence) ProtoReflect() protoreflect.Message {
-	mi := &file_language_model_proto_msgTypes[2]
+	mi := &file_language_model_proto_msgTypes[4]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -236,7 +598,7 @@ func (x *Sequence) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use Sequence.ProtoReflect.Descriptor instead.
 func (*Sequence) Descriptor() ([]byte, []int) {
-	return file_language_model_proto_rawDescGZIP(), []int{2}
+	return file_language_model_proto_rawDescGZIP(), []int{4}
 }
 
 func (x *Sequence) GetSequence() []int32 {
@@ -246,6 +608,13 @@ func (x *Sequence) GetSequence() []int32 {
 	return nil
 }
 
+func (x *Sequence) GetAction() string {
+	if x != nil {
+		return x.Action
+	}
+	return ""
+}
+
 // GeneratedToken contains a generated token, its score, and its encoded representation
 type GeneratedToken struct {
 	state         protoimpl.MessageState
@@ -255,13 +624,36 @@ type GeneratedToken struct {
 	// Token is the generated token
 	Token string `protobuf:"bytes,1,opt,name=token,proto3" json:"token,omitempty"`
 	// Score is the sum of the negative log probabilities up to the current step.
+	// Deprecated: use cumulative_logprob, which has the opposite sign.
+	//
+	// Deprecated: Do not use.
 	Score float32 `protobuf:"fixed32,2,opt,name=score,proto3" json:"score,omitempty"`
+	// CumulativeLogprob is the sum of the log probabilities of the generated tokens up to the current step.
+	// It is the negation of score: it is always <= 0 and never increases along the stream.
+	CumulativeLogprob float32 `protobuf:"fixed32,3,opt,name=cumulative_logprob,json=cumulativeLogprob,proto3" json:"cumulative_logprob,omitempty"`
+	// TokenProb is the probability of the generated token at the current step, in the range (0, 1].
+	TokenProb float32 `protobuf:"fixed32,4,opt,name=token_prob,json=tokenProb,proto3" json:"token_prob,omitempty"`
+	// IsPrompt is true for the tokens of the prompt, streamed when echo_prompt is requested.
+	// Their scores and probabilities are zero.
+	IsPrompt bool `protobuf:"varint,5,opt,name=is_prompt,json=isPrompt,proto3" json:"is_prompt,omitempty"`
+	// Chunk contains the tokens batched in this message, when chunk_size or flush_interval_ms are requested.
+	// In that case, the other fields are unset.
+	Chunk []*GeneratedToken `protobuf:"bytes,6,rep,name=chunk,proto3" json:"chunk,omitempty"`
+	// ContinuationID identifies the saved state of a resumable generation, for GenerateContinue.
+	// It is only set in the last message of the stream, which has the other fields unset, except stats.
+	ContinuationId string `protobuf:"bytes,7,opt,name=continuation_id,json=continuationId,proto3" json:"continuation_id,omitempty"`
+	// SessionID identifies the session of the generation, for ResumeSession.
+	// It is only set in the first message of the stream, which has the other fields unset.
+	SessionId string `protobuf:"bytes,8,opt,name=session_id,json=sessionId,proto3" json:"session_id,omitempty"`
+	// Stats are the statistics of the generation, when return_stats is requested.
+	// They are only set in the last message of the stream, which has the other fields unset, except continuation_id.
+	Stats *GenerationStats `protobuf:"bytes,9,opt,name=stats,proto3" json:"stats,omitempty"`
 }
 
 func (x *GeneratedToken) Reset() {
 	*x = GeneratedToken{}
 	if protoimpl.UnsafeEnabled {
-		mi := &file_language_model_proto_msgTypes[3]
+		mi := &file_language_model_proto_msgTypes[5]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		ms.StoreMessageInfo(mi)
 	}
@@ -274,7 +666,7 @@ func (x *GeneratedToken) String() string {
 func (*GeneratedToken) ProtoMessage() {}
 
 func (x *GeneratedToken) ProtoReflect() protoreflect.Message {
-	mi := &file_language_model_proto_msgTypes[3]
+	mi := &file_language_model_proto_msgTypes[5]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -287,7 +679,7 @@ func (x *GeneratedToken) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use GeneratedToken.ProtoReflect.Descriptor instead.
 func (*GeneratedToken) Descriptor() ([]byte, []int) {
-	return file_language_model_proto_rawDescGZIP(), []int{3}
+	return file_language_model_proto_rawDescGZIP(), []int{5}
 }
 
 func (x *GeneratedToken) GetToken() string {
@@ -297,6 +689,7 @@ func (x *GeneratedToken) GetToken() string {
 	return ""
 }
 
+// Deprecated: Do not use.
 func (x *GeneratedToken) GetScore() float32 {
 	if x != nil {
 		return x.Score
@@ -304,53 +697,402 @@ func (x *GeneratedToken) GetScore() float32 {
 	return 0
 }
 
+func (x *GeneratedToken) GetCumulativeLogprob() float32 {
+	if x != nil {
+		return x.CumulativeLogprob
+	}
+	return 0
+}
+
+func (x *GeneratedToken) GetTokenProb() float32 {
+	if x != nil {
+		return x.TokenProb
+	}
+	return 0
+}
+
+func (x *GeneratedToken) GetIsPrompt() bool {
+	if x != nil {
+		return x.IsPrompt
+	}
+	return false
+}
+
+func (x *GeneratedToken) GetChunk() []*GeneratedToken {
+	if x != nil {
+		return x.Chunk
+	}
+	return nil
+}
+
+func (x *GeneratedToken) GetContinuationId() string {
+	if x != nil {
+		return x.ContinuationId
+	}
+	return ""
+}
+
+func (x *GeneratedToken) GetSessionId() string {
+	if x != nil {
+		return x.SessionId
+	}
+	return ""
+}
+
+func (x *GeneratedToken) GetStats() *GenerationStats {
+	if x != nil {
+		return x.Stats
+	}
+	return nil
+}
+
+// GenerationStats contains the statistics of a generation
+type GenerationStats struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// PromptTokens is the number of tokens of the prompt, including the system prompt and the beginning-of-sequence token.
+	// It is zero for GenerateContinue, which encodes no prompt.
+	PromptTokens int32 `protobuf:"varint,1,opt,name=prompt_tokens,json=promptTokens,proto3" json:"prompt_tokens,omitempty"`
+	// GeneratedTokens is the number of generated tokens sent in the stream, either on their own or in chunks.
+	GeneratedTokens int32 `protobuf:"varint,2,opt,name=generated_tokens,json=generatedTokens,proto3" json:"generated_tokens,omitempty"`
+	// TotalTimeMs is the time taken by the generation, in milliseconds, including the encoding of the prompt.
+	TotalTimeMs float32 `protobuf:"fixed32,3,opt,name=total_time_ms,json=totalTimeMs,proto3" json:"total_time_ms,omitempty"`
+	// TokensPerSecond is the number of generated tokens divided by the total time.
+	TokensPerSecond float32 `protobuf:"fixed32,4,opt,name=tokens_per_second,json=tokensPerSecond,proto3" json:"tokens_per_second,omitempty"`
+}
+
+func (x *GenerationStats) Reset() {
+	*x = GenerationStats{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_language_model_proto_msgTypes[6]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *GenerationStats) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GenerationStats) ProtoMessage() {}
+
+func (x *GenerationStats) ProtoReflect() protoreflect.Message {
+	mi := &file_language_model_proto_msgTypes[6]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GenerationStats.ProtoReflect.Descriptor instead.
+func (*GenerationStats) Descriptor() ([]byte, []int) {
+	return file_language_model_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *GenerationStats) GetPromptTokens() int32 {
+	if x != nil {
+		return x.PromptTokens
+	}
+	return 0
+}
+
+func (x *GenerationStats) GetGeneratedTokens() int32 {
+	if x != nil {
+		return x.GeneratedTokens
+	}
+	return 0
+}
+
+func (x *GenerationStats) GetTotalTimeMs() float32 {
+	if x != nil {
+		return x.TotalTimeMs
+	}
+	return 0
+}
+
+func (x *GenerationStats) GetTokensPerSecond() float32 {
+	if x != nil {
+		return x.TokensPerSecond
+	}
+	return 0
+}
+
+// LoadRequest is the request of GetLoad.
+type LoadRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+}
+
+func (x *LoadRequest) Reset() {
+	*x = LoadRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_language_model_proto_msgTypes[7]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *LoadRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*LoadRequest) ProtoMessage() {}
+
+func (x *LoadRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_language_model_proto_msgTypes[7]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use LoadRequest.ProtoReflect.Descriptor instead.
+func (*LoadRequest) Descriptor() ([]byte, []int) {
+	return file_language_model_proto_rawDescGZIP(), []int{7}
+}
+
+// Load is the load of the server.
+type Load struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// InFlight is the number of generations running.
+	InFlight int32 `protobuf:"varint,1,opt,name=in_flight,json=inFlight,proto3" json:"in_flight,omitempty"`
+	// Queued is the number of generations waiting to run, since the server runs at most max_concurrent of them at once.
+	Queued int32 `protobuf:"varint,2,opt,name=queued,proto3" json:"queued,omitempty"`
+	// MaxConcurrent is the maximum number of generations running at once, or zero if there is no limit.
+	MaxConcurrent int32 `protobuf:"varint,3,opt,name=max_concurrent,json=maxConcurrent,proto3" json:"max_concurrent,omitempty"`
+}
+
+func (x *Load) Reset() {
+	*x = Load{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_language_model_proto_msgTypes[8]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *Load) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Load) ProtoMessage() {}
+
+func (x *Load) ProtoReflect() protoreflect.Message {
+	mi := &file_language_model_proto_msgTypes[8]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Load.ProtoReflect.Descriptor instead.
+func (*Load) Descriptor() ([]byte, []int) {
+	return file_language_model_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *Load) GetInFlight() int32 {
+	if x != nil {
+		return x.InFlight
+	}
+	return 0
+}
+
+func (x *Load) GetQueued() int32 {
+	if x != nil {
+		return x.Queued
+	}
+	return 0
+}
+
+func (x *Load) GetMaxConcurrent() int32 {
+	if x != nil {
+		return x.MaxConcurrent
+	}
+	return 0
+}
+
 var File_language_model_proto protoreflect.FileDescriptor
 
 var file_language_model_proto_rawDesc = []byte{
 	0x0a, 0x14, 0x6c, 0x61, 0x6e, 0x67, 0x75, 0x61, 0x67, 0x65, 0x5f, 0x6d, 0x6f, 0x64, 0x65, 0x6c,
-	0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12, 0x03, 0x61, 0x70, 0x69, 0x22, 0x7a, 0x0a, 0x16, 0x54,
-	0x6f, 0x6b, 0x65, 0x6e, 0x47, 0x65, 0x6e, 0x65, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x52, 0x65,
-	0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x16, 0x0a, 0x06, 0x70, 0x72, 0x6f, 0x6d, 0x70, 0x74, 0x18,
-	0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x06, 0x70, 0x72, 0x6f, 0x6d, 0x70, 0x74, 0x12, 0x48, 0x0a,
-	0x13, 0x64, 0x65, 0x63, 0x6f, 0x64, 0x69, 0x6e, 0x67, 0x5f, 0x70, 0x61, 0x72, 0x61, 0x6d, 0x65,
-	0x74, 0x65, 0x72, 0x73, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x17, 0x2e, 0x61, 0x70, 0x69,
-	0x2e, 0x44, 0x65, 0x63, 0x6f, 0x64, 0x69, 0x6e, 0x67, 0x50, 0x61, 0x72, 0x61, 0x6d, 0x65, 0x74,
-	0x65, 0x72, 0x73, 0x52, 0x12, 0x64, 0x65, 0x63, 0x6f, 0x64, 0x69, 0x6e, 0x67, 0x50, 0x61, 0x72,
-	0x61, 0x6d, 0x65, 0x74, 0x65, 0x72, 0x73, 0x22, 0xb8, 0x02, 0x0a, 0x12, 0x44, 0x65, 0x63, 0x6f,
-	0x64, 0x69, 0x6e, 0x67, 0x50, 0x61, 0x72, 0x61, 0x6d, 0x65, 0x74, 0x65, 0x72, 0x73, 0x12, 0x17,
-	0x0a, 0x07, 0x6d, 0x61, 0x78, 0x5f, 0x6c, 0x65, 0x6e, 0x18, 0x01, 0x20, 0x01, 0x28, 0x05, 0x52,
-	0x06, 0x6d, 0x61, 0x78, 0x4c, 0x65, 0x6e, 0x12, 0x17, 0x0a, 0x07, 0x6d, 0x69, 0x6e, 0x5f, 0x6c,
-	0x65, 0x6e, 0x18, 0x02, 0x20, 0x01, 0x28, 0x05, 0x52, 0x06, 0x6d, 0x69, 0x6e, 0x4c, 0x65, 0x6e,
-	0x12, 0x20, 0x0a, 0x0b, 0x74, 0x65, 0x6d, 0x70, 0x65, 0x72, 0x61, 0x74, 0x75, 0x72, 0x65, 0x18,
-	0x03, 0x20, 0x01, 0x28, 0x02, 0x52, 0x0b, 0x74, 0x65, 0x6d, 0x70, 0x65, 0x72, 0x61, 0x74, 0x75,
-	0x72, 0x65, 0x12, 0x13, 0x0a, 0x05, 0x74, 0x6f, 0x70, 0x5f, 0x6b, 0x18, 0x04, 0x20, 0x01, 0x28,
-	0x05, 0x52, 0x04, 0x74, 0x6f, 0x70, 0x4b, 0x12, 0x13, 0x0a, 0x05, 0x74, 0x6f, 0x70, 0x5f, 0x70,
-	0x18, 0x05, 0x20, 0x01, 0x28, 0x02, 0x52, 0x04, 0x74, 0x6f, 0x70, 0x50, 0x12, 0x21, 0x0a, 0x0c,
-	0x75, 0x73, 0x65, 0x5f, 0x73, 0x61, 0x6d, 0x70, 0x6c, 0x69, 0x6e, 0x67, 0x18, 0x06, 0x20, 0x01,
-	0x28, 0x08, 0x52, 0x0b, 0x75, 0x73, 0x65, 0x53, 0x61, 0x6d, 0x70, 0x6c, 0x69, 0x6e, 0x67, 0x12,
-	0x20, 0x0a, 0x0c, 0x65, 0x6e, 0x64, 0x5f, 0x74, 0x6f, 0x6b, 0x65, 0x6e, 0x5f, 0x69, 0x64, 0x18,
-	0x07, 0x20, 0x01, 0x28, 0x05, 0x52, 0x0a, 0x65, 0x6e, 0x64, 0x54, 0x6f, 0x6b, 0x65, 0x6e, 0x49,
-	0x64, 0x12, 0x29, 0x0a, 0x11, 0x73, 0x6b, 0x69, 0x70, 0x5f, 0x65, 0x6e, 0x64, 0x5f, 0x74, 0x6f,
-	0x6b, 0x65, 0x6e, 0x5f, 0x69, 0x64, 0x18, 0x08, 0x20, 0x01, 0x28, 0x08, 0x52, 0x0e, 0x73, 0x6b,
-	0x69, 0x70, 0x45, 0x6e, 0x64, 0x54, 0x6f, 0x6b, 0x65, 0x6e, 0x49, 0x64, 0x12, 0x34, 0x0a, 0x0e,
-	0x73, 0x74, 0x6f, 0x70, 0x5f, 0x73, 0x65, 0x71, 0x75, 0x65, 0x6e, 0x63, 0x65, 0x73, 0x18, 0x09,
-	0x20, 0x03, 0x28, 0x0b, 0x32, 0x0d, 0x2e, 0x61, 0x70, 0x69, 0x2e, 0x53, 0x65, 0x71, 0x75, 0x65,
-	0x6e, 0x63, 0x65, 0x52, 0x0d, 0x73, 0x74, 0x6f, 0x70, 0x53, 0x65, 0x71, 0x75, 0x65, 0x6e, 0x63,
-	0x65, 0x73, 0x22, 0x26, 0x0a, 0x08, 0x53, 0x65, 0x71, 0x75, 0x65, 0x6e, 0x63, 0x65, 0x12, 0x1a,
-	0x0a, 0x08, 0x73, 0x65, 0x71, 0x75, 0x65, 0x6e, 0x63, 0x65, 0x18, 0x01, 0x20, 0x03, 0x28, 0x05,
-	0x52, 0x08, 0x73, 0x65, 0x71, 0x75, 0x65, 0x6e, 0x63, 0x65, 0x22, 0x3c, 0x0a, 0x0e, 0x47, 0x65,
-	0x6e, 0x65, 0x72, 0x61, 0x74, 0x65, 0x64, 0x54, 0x6f, 0x6b, 0x65, 0x6e, 0x12, 0x14, 0x0a, 0x05,
-	0x74, 0x6f, 0x6b, 0x65, 0x6e, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x05, 0x74, 0x6f, 0x6b,
-	0x65, 0x6e, 0x12, 0x14, 0x0a, 0x05, 0x73, 0x63, 0x6f, 0x72, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28,
-	0x02, 0x52, 0x05, 0x73, 0x63, 0x6f, 0x72, 0x65, 0x32, 0x55, 0x0a, 0x0d, 0x4c, 0x61, 0x6e, 0x67,
-	0x75, 0x61, 0x67, 0x65, 0x4d, 0x6f, 0x64, 0x65, 0x6c, 0x12, 0x44, 0x0a, 0x0e, 0x47, 0x65, 0x6e,
-	0x65, 0x72, 0x61, 0x74, 0x65, 0x54, 0x6f, 0x6b, 0x65, 0x6e, 0x73, 0x12, 0x1b, 0x2e, 0x61, 0x70,
-	0x69, 0x2e, 0x54, 0x6f, 0x6b, 0x65, 0x6e, 0x47, 0x65, 0x6e, 0x65, 0x72, 0x61, 0x74, 0x69, 0x6f,
-	0x6e, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x13, 0x2e, 0x61, 0x70, 0x69, 0x2e, 0x47,
-	0x65, 0x6e, 0x65, 0x72, 0x61, 0x74, 0x65, 0x64, 0x54, 0x6f, 0x6b, 0x65, 0x6e, 0x30, 0x01, 0x42,
-	0x25, 0x5a, 0x23, 0x67, 0x69, 0x74, 0x68, 0x75, 0x62, 0x2e, 0x63, 0x6f, 0x6d, 0x2f, 0x6e, 0x6c,
-	0x70, 0x6f, 0x64, 0x79, 0x73, 0x73, 0x65, 0x79, 0x2f, 0x76, 0x65, 0x72, 0x62, 0x61, 0x66, 0x6c,
-	0x6f, 0x77, 0x2f, 0x61, 0x70, 0x69, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+	0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12, 0x03, 0x61, 0x70, 0x69, 0x22, 0xe6, 0x01, 0x0a, 0x16,
+	0x54, 0x6f, 0x6b, 0x65, 0x6e, 0x47, 0x65, 0x6e, 0x65, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x52,
+	0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x16, 0x0a, 0x06, 0x70, 0x72, 0x6f, 0x6d, 0x70, 0x74,
+	0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x06, 0x70, 0x72, 0x6f, 0x6d, 0x70, 0x74, 0x12, 0x48,
+	0x0a, 0x13, 0x64, 0x65, 0x63, 0x6f, 0x64, 0x69, 0x6e, 0x67, 0x5f, 0x70, 0x61, 0x72, 0x61, 0x6d,
+	0x65, 0x74, 0x65, 0x72, 0x73, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x17, 0x2e, 0x61, 0x70,
+	0x69, 0x2e, 0x44, 0x65, 0x63, 0x6f, 0x64, 0x69, 0x6e, 0x67, 0x50, 0x61, 0x72, 0x61, 0x6d, 0x65,
+	0x74, 0x65, 0x72, 0x73, 0x52, 0x12, 0x64, 0x65, 0x63, 0x6f, 0x64, 0x69, 0x6e, 0x67, 0x50, 0x61,
+	0x72, 0x61, 0x6d, 0x65, 0x74, 0x65, 0x72, 0x73, 0x12, 0x28, 0x0a, 0x0d, 0x73, 0x79, 0x73, 0x74,
+	0x65, 0x6d, 0x5f, 0x70, 0x72, 0x6f, 0x6d, 0x70, 0x74, 0x18, 0x03, 0x20, 0x01, 0x28, 0x09, 0x48,
+	0x00, 0x52, 0x0c, 0x73, 0x79, 0x73, 0x74, 0x65, 0x6d, 0x50, 0x72, 0x6f, 0x6d, 0x70, 0x74, 0x88,
+	0x01, 0x01, 0x12, 0x14, 0x0a, 0x05, 0x6d, 0x6f, 0x64, 0x65, 0x6c, 0x18, 0x04, 0x20, 0x01, 0x28,
+	0x09, 0x52, 0x05, 0x6d, 0x6f, 0x64, 0x65, 0x6c, 0x12, 0x18, 0x0a, 0x07, 0x73, 0x65, 0x73, 0x73,
+	0x69, 0x6f, 0x6e, 0x18, 0x05, 0x20, 0x01, 0x28, 0x08, 0x52, 0x07, 0x73, 0x65, 0x73, 0x73, 0x69,
+	0x6f, 0x6e, 0x42, 0x10, 0x0a, 0x0e, 0x5f, 0x73, 0x79, 0x73, 0x74, 0x65, 0x6d, 0x5f, 0x70, 0x72,
+	0x6f, 0x6d, 0x70, 0x74, 0x22, 0x47, 0x0a, 0x0e, 0x53, 0x65, 0x73, 0x73, 0x69, 0x6f, 0x6e, 0x52,
+	0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x1d, 0x0a, 0x0a, 0x73, 0x65, 0x73, 0x73, 0x69, 0x6f,
+	0x6e, 0x5f, 0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x09, 0x73, 0x65, 0x73, 0x73,
+	0x69, 0x6f, 0x6e, 0x49, 0x64, 0x12, 0x16, 0x0a, 0x06, 0x6f, 0x66, 0x66, 0x73, 0x65, 0x74, 0x18,
+	0x02, 0x20, 0x01, 0x28, 0x05, 0x52, 0x06, 0x6f, 0x66, 0x66, 0x73, 0x65, 0x74, 0x22, 0xaf, 0x01,
+	0x0a, 0x13, 0x43, 0x6f, 0x6e, 0x74, 0x69, 0x6e, 0x75, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x52, 0x65,
+	0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x27, 0x0a, 0x0f, 0x63, 0x6f, 0x6e, 0x74, 0x69, 0x6e, 0x75,
+	0x61, 0x74, 0x69, 0x6f, 0x6e, 0x5f, 0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0e,
+	0x63, 0x6f, 0x6e, 0x74, 0x69, 0x6e, 0x75, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x49, 0x64, 0x12, 0x25,
+	0x0a, 0x0e, 0x61, 0x64, 0x64, 0x69, 0x74, 0x69, 0x6f, 0x6e, 0x61, 0x6c, 0x5f, 0x6c, 0x65, 0x6e,
+	0x18, 0x02, 0x20, 0x01, 0x28, 0x05, 0x52, 0x0d, 0x61, 0x64, 0x64, 0x69, 0x74, 0x69, 0x6f, 0x6e,
+	0x61, 0x6c, 0x4c, 0x65, 0x6e, 0x12, 0x48, 0x0a, 0x13, 0x64, 0x65, 0x63, 0x6f, 0x64, 0x69, 0x6e,
+	0x67, 0x5f, 0x70, 0x61, 0x72, 0x61, 0x6d, 0x65, 0x74, 0x65, 0x72, 0x73, 0x18, 0x03, 0x20, 0x01,
+	0x28, 0x0b, 0x32, 0x17, 0x2e, 0x61, 0x70, 0x69, 0x2e, 0x44, 0x65, 0x63, 0x6f, 0x64, 0x69, 0x6e,
+	0x67, 0x50, 0x61, 0x72, 0x61, 0x6d, 0x65, 0x74, 0x65, 0x72, 0x73, 0x52, 0x12, 0x64, 0x65, 0x63,
+	0x6f, 0x64, 0x69, 0x6e, 0x67, 0x50, 0x61, 0x72, 0x61, 0x6d, 0x65, 0x74, 0x65, 0x72, 0x73, 0x22,
+	0x9a, 0x08, 0x0a, 0x12, 0x44, 0x65, 0x63, 0x6f, 0x64, 0x69, 0x6e, 0x67, 0x50, 0x61, 0x72, 0x61,
+	0x6d, 0x65, 0x74, 0x65, 0x72, 0x73, 0x12, 0x17, 0x0a, 0x07, 0x6d, 0x61, 0x78, 0x5f, 0x6c, 0x65,
+	0x6e, 0x18, 0x01, 0x20, 0x01, 0x28, 0x05, 0x52, 0x06, 0x6d, 0x61, 0x78, 0x4c, 0x65, 0x6e, 0x12,
+	0x17, 0x0a, 0x07, 0x6d, 0x69, 0x6e, 0x5f, 0x6c, 0x65, 0x6e, 0x18, 0x02, 0x20, 0x01, 0x28, 0x05,
+	0x52, 0x06, 0x6d, 0x69, 0x6e, 0x4c, 0x65, 0x6e, 0x12, 0x20, 0x0a, 0x0b, 0x74, 0x65, 0x6d, 0x70,
+	0x65, 0x72, 0x61, 0x74, 0x75, 0x72, 0x65, 0x18, 0x03, 0x20, 0x01, 0x28, 0x02, 0x52, 0x0b, 0x74,
+	0x65, 0x6d, 0x70, 0x65, 0x72, 0x61, 0x74, 0x75, 0x72, 0x65, 0x12, 0x13, 0x0a, 0x05, 0x74, 0x6f,
+	0x70, 0x5f, 0x6b, 0x18, 0x04, 0x20, 0x01, 0x28, 0x05, 0x52, 0x04, 0x74, 0x6f, 0x70, 0x4b, 0x12,
+	0x13, 0x0a, 0x05, 0x74, 0x6f, 0x70, 0x5f, 0x70, 0x18, 0x05, 0x20, 0x01, 0x28, 0x02, 0x52, 0x04,
+	0x74, 0x6f, 0x70, 0x50, 0x12, 0x21, 0x0a, 0x0c, 0x75, 0x73, 0x65, 0x5f, 0x73, 0x61, 0x6d, 0x70,
+	0x6c, 0x69, 0x6e, 0x67, 0x18, 0x06, 0x20, 0x01, 0x28, 0x08, 0x52, 0x0b, 0x75, 0x73, 0x65, 0x53,
+	0x61, 0x6d, 0x70, 0x6c, 0x69, 0x6e, 0x67, 0x12, 0x20, 0x0a, 0x0c, 0x65, 0x6e, 0x64, 0x5f, 0x74,
+	0x6f, 0x6b, 0x65, 0x6e, 0x5f, 0x69, 0x64, 0x18, 0x07, 0x20, 0x01, 0x28, 0x05, 0x52, 0x0a, 0x65,
+	0x6e, 0x64, 0x54, 0x6f, 0x6b, 0x65, 0x6e, 0x49, 0x64, 0x12, 0x29, 0x0a, 0x11, 0x73, 0x6b, 0x69,
+	0x70, 0x5f, 0x65, 0x6e, 0x64, 0x5f, 0x74, 0x6f, 0x6b, 0x65, 0x6e, 0x5f, 0x69, 0x64, 0x18, 0x08,
+	0x20, 0x01, 0x28, 0x08, 0x52, 0x0e, 0x73, 0x6b, 0x69, 0x70, 0x45, 0x6e, 0x64, 0x54, 0x6f, 0x6b,
+	0x65, 0x6e, 0x49, 0x64, 0x12, 0x34, 0x0a, 0x0e, 0x73, 0x74, 0x6f, 0x70, 0x5f, 0x73, 0x65, 0x71,
+	0x75, 0x65, 0x6e, 0x63, 0x65, 0x73, 0x18, 0x09, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x0d, 0x2e, 0x61,
+	0x70, 0x69, 0x2e, 0x53, 0x65, 0x71, 0x75, 0x65, 0x6e, 0x63, 0x65, 0x52, 0x0d, 0x73, 0x74, 0x6f,
+	0x70, 0x53, 0x65, 0x71, 0x75, 0x65, 0x6e, 0x63, 0x65, 0x73, 0x12, 0x1d, 0x0a, 0x0a, 0x66, 0x6f,
+	0x72, 0x63, 0x65, 0x5f, 0x6a, 0x73, 0x6f, 0x6e, 0x18, 0x0a, 0x20, 0x01, 0x28, 0x08, 0x52, 0x09,
+	0x66, 0x6f, 0x72, 0x63, 0x65, 0x4a, 0x73, 0x6f, 0x6e, 0x12, 0x17, 0x0a, 0x07, 0x61, 0x64, 0x64,
+	0x5f, 0x62, 0x6f, 0x73, 0x18, 0x0b, 0x20, 0x01, 0x28, 0x08, 0x52, 0x06, 0x61, 0x64, 0x64, 0x42,
+	0x6f, 0x73, 0x12, 0x1f, 0x0a, 0x0b, 0x65, 0x63, 0x68, 0x6f, 0x5f, 0x70, 0x72, 0x6f, 0x6d, 0x70,
+	0x74, 0x18, 0x0c, 0x20, 0x01, 0x28, 0x08, 0x52, 0x0a, 0x65, 0x63, 0x68, 0x6f, 0x50, 0x72, 0x6f,
+	0x6d, 0x70, 0x74, 0x12, 0x1d, 0x0a, 0x0a, 0x63, 0x68, 0x75, 0x6e, 0x6b, 0x5f, 0x73, 0x69, 0x7a,
+	0x65, 0x18, 0x0d, 0x20, 0x01, 0x28, 0x05, 0x52, 0x09, 0x63, 0x68, 0x75, 0x6e, 0x6b, 0x53, 0x69,
+	0x7a, 0x65, 0x12, 0x2a, 0x0a, 0x11, 0x66, 0x6c, 0x75, 0x73, 0x68, 0x5f, 0x69, 0x6e, 0x74, 0x65,
+	0x72, 0x76, 0x61, 0x6c, 0x5f, 0x6d, 0x73, 0x18, 0x0e, 0x20, 0x01, 0x28, 0x05, 0x52, 0x0f, 0x66,
+	0x6c, 0x75, 0x73, 0x68, 0x49, 0x6e, 0x74, 0x65, 0x72, 0x76, 0x61, 0x6c, 0x4d, 0x73, 0x12, 0x1c,
+	0x0a, 0x09, 0x72, 0x65, 0x73, 0x75, 0x6d, 0x61, 0x62, 0x6c, 0x65, 0x18, 0x0f, 0x20, 0x01, 0x28,
+	0x08, 0x52, 0x09, 0x72, 0x65, 0x73, 0x75, 0x6d, 0x61, 0x62, 0x6c, 0x65, 0x12, 0x1b, 0x0a, 0x09,
+	0x6d, 0x61, 0x78, 0x5f, 0x63, 0x68, 0x61, 0x72, 0x73, 0x18, 0x10, 0x20, 0x01, 0x28, 0x05, 0x52,
+	0x08, 0x6d, 0x61, 0x78, 0x43, 0x68, 0x61, 0x72, 0x73, 0x12, 0x27, 0x0a, 0x0f, 0x74, 0x72, 0x69,
+	0x6d, 0x5f, 0x77, 0x68, 0x69, 0x74, 0x65, 0x73, 0x70, 0x61, 0x63, 0x65, 0x18, 0x11, 0x20, 0x01,
+	0x28, 0x08, 0x52, 0x0e, 0x74, 0x72, 0x69, 0x6d, 0x57, 0x68, 0x69, 0x74, 0x65, 0x73, 0x70, 0x61,
+	0x63, 0x65, 0x12, 0x2b, 0x0a, 0x11, 0x63, 0x6f, 0x6c, 0x6c, 0x61, 0x70, 0x73, 0x65, 0x5f, 0x6e,
+	0x65, 0x77, 0x6c, 0x69, 0x6e, 0x65, 0x73, 0x18, 0x12, 0x20, 0x01, 0x28, 0x08, 0x52, 0x10, 0x63,
+	0x6f, 0x6c, 0x6c, 0x61, 0x70, 0x73, 0x65, 0x4e, 0x65, 0x77, 0x6c, 0x69, 0x6e, 0x65, 0x73, 0x12,
+	0x23, 0x0a, 0x0d, 0x66, 0x6f, 0x72, 0x63, 0x65, 0x64, 0x5f, 0x70, 0x72, 0x65, 0x66, 0x69, 0x78,
+	0x18, 0x13, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0c, 0x66, 0x6f, 0x72, 0x63, 0x65, 0x64, 0x50, 0x72,
+	0x65, 0x66, 0x69, 0x78, 0x12, 0x1f, 0x0a, 0x0b, 0x6c, 0x6f, 0x67, 0x69, 0x74, 0x5f, 0x63, 0x6c,
+	0x61, 0x6d, 0x70, 0x18, 0x14, 0x20, 0x01, 0x28, 0x02, 0x52, 0x0a, 0x6c, 0x6f, 0x67, 0x69, 0x74,
+	0x43, 0x6c, 0x61, 0x6d, 0x70, 0x12, 0x31, 0x0a, 0x15, 0x6d, 0x61, 0x78, 0x5f, 0x74, 0x6f, 0x6b,
+	0x65, 0x6e, 0x73, 0x5f, 0x70, 0x65, 0x72, 0x5f, 0x73, 0x65, 0x63, 0x6f, 0x6e, 0x64, 0x18, 0x15,
+	0x20, 0x01, 0x28, 0x02, 0x52, 0x12, 0x6d, 0x61, 0x78, 0x54, 0x6f, 0x6b, 0x65, 0x6e, 0x73, 0x50,
+	0x65, 0x72, 0x53, 0x65, 0x63, 0x6f, 0x6e, 0x64, 0x12, 0x1f, 0x0a, 0x0b, 0x6a, 0x73, 0x6f, 0x6e,
+	0x5f, 0x73, 0x63, 0x68, 0x65, 0x6d, 0x61, 0x18, 0x16, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0a, 0x6a,
+	0x73, 0x6f, 0x6e, 0x53, 0x63, 0x68, 0x65, 0x6d, 0x61, 0x12, 0x2e, 0x0a, 0x13, 0x6a, 0x73, 0x6f,
+	0x6e, 0x5f, 0x73, 0x63, 0x68, 0x65, 0x6d, 0x61, 0x5f, 0x72, 0x65, 0x74, 0x72, 0x69, 0x65, 0x73,
+	0x18, 0x17, 0x20, 0x01, 0x28, 0x05, 0x52, 0x11, 0x6a, 0x73, 0x6f, 0x6e, 0x53, 0x63, 0x68, 0x65,
+	0x6d, 0x61, 0x52, 0x65, 0x74, 0x72, 0x69, 0x65, 0x73, 0x12, 0x32, 0x0a, 0x15, 0x66, 0x69, 0x6c,
+	0x74, 0x65, 0x72, 0x5f, 0x73, 0x70, 0x65, 0x63, 0x69, 0x61, 0x6c, 0x5f, 0x74, 0x6f, 0x6b, 0x65,
+	0x6e, 0x73, 0x18, 0x18, 0x20, 0x01, 0x28, 0x08, 0x52, 0x13, 0x66, 0x69, 0x6c, 0x74, 0x65, 0x72,
+	0x53, 0x70, 0x65, 0x63, 0x69, 0x61, 0x6c, 0x54, 0x6f, 0x6b, 0x65, 0x6e, 0x73, 0x12, 0x1f, 0x0a,
+	0x0b, 0x7a, 0x65, 0x72, 0x6f, 0x5f, 0x66, 0x69, 0x65, 0x6c, 0x64, 0x73, 0x18, 0x19, 0x20, 0x03,
+	0x28, 0x09, 0x52, 0x0a, 0x7a, 0x65, 0x72, 0x6f, 0x46, 0x69, 0x65, 0x6c, 0x64, 0x73, 0x12, 0x21,
+	0x0a, 0x0c, 0x72, 0x65, 0x74, 0x75, 0x72, 0x6e, 0x5f, 0x73, 0x74, 0x61, 0x74, 0x73, 0x18, 0x1a,
+	0x20, 0x01, 0x28, 0x08, 0x52, 0x0b, 0x72, 0x65, 0x74, 0x75, 0x72, 0x6e, 0x53, 0x74, 0x61, 0x74,
+	0x73, 0x12, 0x20, 0x0a, 0x0c, 0x6d, 0x69, 0x6e, 0x5f, 0x74, 0x6f, 0x70, 0x5f, 0x70, 0x72, 0x6f,
+	0x62, 0x18, 0x1b, 0x20, 0x01, 0x28, 0x02, 0x52, 0x0a, 0x6d, 0x69, 0x6e, 0x54, 0x6f, 0x70, 0x50,
+	0x72, 0x6f, 0x62, 0x12, 0x1b, 0x0a, 0x09, 0x74, 0x79, 0x70, 0x69, 0x63, 0x61, 0x6c, 0x5f, 0x70,
+	0x18, 0x1c, 0x20, 0x01, 0x28, 0x02, 0x52, 0x08, 0x74, 0x79, 0x70, 0x69, 0x63, 0x61, 0x6c, 0x50,
+	0x12, 0x18, 0x0a, 0x07, 0x65, 0x70, 0x73, 0x69, 0x6c, 0x6f, 0x6e, 0x18, 0x1d, 0x20, 0x01, 0x28,
+	0x02, 0x52, 0x07, 0x65, 0x70, 0x73, 0x69, 0x6c, 0x6f, 0x6e, 0x12, 0x10, 0x0a, 0x03, 0x65, 0x74,
+	0x61, 0x18, 0x1e, 0x20, 0x01, 0x28, 0x02, 0x52, 0x03, 0x65, 0x74, 0x61, 0x22, 0x3e, 0x0a, 0x08,
+	0x53, 0x65, 0x71, 0x75, 0x65, 0x6e, 0x63, 0x65, 0x12, 0x1a, 0x0a, 0x08, 0x73, 0x65, 0x71, 0x75,
+	0x65, 0x6e, 0x63, 0x65, 0x18, 0x01, 0x20, 0x03, 0x28, 0x05, 0x52, 0x08, 0x73, 0x65, 0x71, 0x75,
+	0x65, 0x6e, 0x63, 0x65, 0x12, 0x16, 0x0a, 0x06, 0x61, 0x63, 0x74, 0x69, 0x6f, 0x6e, 0x18, 0x02,
+	0x20, 0x01, 0x28, 0x09, 0x52, 0x06, 0x61, 0x63, 0x74, 0x69, 0x6f, 0x6e, 0x22, 0xca, 0x02, 0x0a,
+	0x0e, 0x47, 0x65, 0x6e, 0x65, 0x72, 0x61, 0x74, 0x65, 0x64, 0x54, 0x6f, 0x6b, 0x65, 0x6e, 0x12,
+	0x14, 0x0a, 0x05, 0x74, 0x6f, 0x6b, 0x65, 0x6e, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x05,
+	0x74, 0x6f, 0x6b, 0x65, 0x6e, 0x12, 0x18, 0x0a, 0x05, 0x73, 0x63, 0x6f, 0x72, 0x65, 0x18, 0x02,
+	0x20, 0x01, 0x28, 0x02, 0x42, 0x02, 0x18, 0x01, 0x52, 0x05, 0x73, 0x63, 0x6f, 0x72, 0x65, 0x12,
+	0x2d, 0x0a, 0x12, 0x63, 0x75, 0x6d, 0x75, 0x6c, 0x61, 0x74, 0x69, 0x76, 0x65, 0x5f, 0x6c, 0x6f,
+	0x67, 0x70, 0x72, 0x6f, 0x62, 0x18, 0x03, 0x20, 0x01, 0x28, 0x02, 0x52, 0x11, 0x63, 0x75, 0x6d,
+	0x75, 0x6c, 0x61, 0x74, 0x69, 0x76, 0x65, 0x4c, 0x6f, 0x67, 0x70, 0x72, 0x6f, 0x62, 0x12, 0x1d,
+	0x0a, 0x0a, 0x74, 0x6f, 0x6b, 0x65, 0x6e, 0x5f, 0x70, 0x72, 0x6f, 0x62, 0x18, 0x04, 0x20, 0x01,
+	0x28, 0x02, 0x52, 0x09, 0x74, 0x6f, 0x6b, 0x65, 0x6e, 0x50, 0x72, 0x6f, 0x62, 0x12, 0x1b, 0x0a,
+	0x09, 0x69, 0x73, 0x5f, 0x70, 0x72, 0x6f, 0x6d, 0x70, 0x74, 0x18, 0x05, 0x20, 0x01, 0x28, 0x08,
+	0x52, 0x08, 0x69, 0x73, 0x50, 0x72, 0x6f, 0x6d, 0x70, 0x74, 0x12, 0x29, 0x0a, 0x05, 0x63, 0x68,
+	0x75, 0x6e, 0x6b, 0x18, 0x06, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x13, 0x2e, 0x61, 0x70, 0x69, 0x2e,
+	0x47, 0x65, 0x6e, 0x65, 0x72, 0x61, 0x74, 0x65, 0x64, 0x54, 0x6f, 0x6b, 0x65, 0x6e, 0x52, 0x05,
+	0x63, 0x68, 0x75, 0x6e, 0x6b, 0x12, 0x27, 0x0a, 0x0f, 0x63, 0x6f, 0x6e, 0x74, 0x69, 0x6e, 0x75,
+	0x61, 0x74, 0x69, 0x6f, 0x6e, 0x5f, 0x69, 0x64, 0x18, 0x07, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0e,
+	0x63, 0x6f, 0x6e, 0x74, 0x69, 0x6e, 0x75, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x49, 0x64, 0x12, 0x1d,
+	0x0a, 0x0a, 0x73, 0x65, 0x73, 0x73, 0x69, 0x6f, 0x6e, 0x5f, 0x69, 0x64, 0x18, 0x08, 0x20, 0x01,
+	0x28, 0x09, 0x52, 0x09, 0x73, 0x65, 0x73, 0x73, 0x69, 0x6f, 0x6e, 0x49, 0x64, 0x12, 0x2a, 0x0a,
+	0x05, 0x73, 0x74, 0x61, 0x74, 0x73, 0x18, 0x09, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x14, 0x2e, 0x61,
+	0x70, 0x69, 0x2e, 0x47, 0x65, 0x6e, 0x65, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x53, 0x74, 0x61,
+	0x74, 0x73, 0x52, 0x05, 0x73, 0x74, 0x61, 0x74, 0x73, 0x22, 0xb1, 0x01, 0x0a, 0x0f, 0x47, 0x65,
+	0x6e, 0x65, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x53, 0x74, 0x61, 0x74, 0x73, 0x12, 0x23, 0x0a,
+	0x0d, 0x70, 0x72, 0x6f, 0x6d, 0x70, 0x74, 0x5f, 0x74, 0x6f, 0x6b, 0x65, 0x6e, 0x73, 0x18, 0x01,
+	0x20, 0x01, 0x28, 0x05, 0x52, 0x0c, 0x70, 0x72, 0x6f, 0x6d, 0x70, 0x74, 0x54, 0x6f, 0x6b, 0x65,
+	0x6e, 0x73, 0x12, 0x29, 0x0a, 0x10, 0x67, 0x65, 0x6e, 0x65, 0x72, 0x61, 0x74, 0x65, 0x64, 0x5f,
+	0x74, 0x6f, 0x6b, 0x65, 0x6e, 0x73, 0x18, 0x02, 0x20, 0x01, 0x28, 0x05, 0x52, 0x0f, 0x67, 0x65,
+	0x6e, 0x65, 0x72, 0x61, 0x74, 0x65, 0x64, 0x54, 0x6f, 0x6b, 0x65, 0x6e, 0x73, 0x12, 0x22, 0x0a,
+	0x0d, 0x74, 0x6f, 0x74, 0x61, 0x6c, 0x5f, 0x74, 0x69, 0x6d, 0x65, 0x5f, 0x6d, 0x73, 0x18, 0x03,
+	0x20, 0x01, 0x28, 0x02, 0x52, 0x0b, 0x74, 0x6f, 0x74, 0x61, 0x6c, 0x54, 0x69, 0x6d, 0x65, 0x4d,
+	0x73, 0x12, 0x2a, 0x0a, 0x11, 0x74, 0x6f, 0x6b, 0x65, 0x6e, 0x73, 0x5f, 0x70, 0x65, 0x72, 0x5f,
+	0x73, 0x65, 0x63, 0x6f, 0x6e, 0x64, 0x18, 0x04, 0x20, 0x01, 0x28, 0x02, 0x52, 0x0f, 0x74, 0x6f,
+	0x6b, 0x65, 0x6e, 0x73, 0x50, 0x65, 0x72, 0x53, 0x65, 0x63, 0x6f, 0x6e, 0x64, 0x22, 0x0d, 0x0a,
+	0x0b, 0x4c, 0x6f, 0x61, 0x64, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x22, 0x62, 0x0a, 0x04,
+	0x4c, 0x6f, 0x61, 0x64, 0x12, 0x1b, 0x0a, 0x09, 0x69, 0x6e, 0x5f, 0x66, 0x6c, 0x69, 0x67, 0x68,
+	0x74, 0x18, 0x01, 0x20, 0x01, 0x28, 0x05, 0x52, 0x08, 0x69, 0x6e, 0x46, 0x6c, 0x69, 0x67, 0x68,
+	0x74, 0x12, 0x16, 0x0a, 0x06, 0x71, 0x75, 0x65, 0x75, 0x65, 0x64, 0x18, 0x02, 0x20, 0x01, 0x28,
+	0x05, 0x52, 0x06, 0x71, 0x75, 0x65, 0x75, 0x65, 0x64, 0x12, 0x25, 0x0a, 0x0e, 0x6d, 0x61, 0x78,
+	0x5f, 0x63, 0x6f, 0x6e, 0x63, 0x75, 0x72, 0x72, 0x65, 0x6e, 0x74, 0x18, 0x03, 0x20, 0x01, 0x28,
+	0x05, 0x52, 0x0d, 0x6d, 0x61, 0x78, 0x43, 0x6f, 0x6e, 0x63, 0x75, 0x72, 0x72, 0x65, 0x6e, 0x74,
+	0x32, 0xff, 0x01, 0x0a, 0x0d, 0x4c, 0x61, 0x6e, 0x67, 0x75, 0x61, 0x67, 0x65, 0x4d, 0x6f, 0x64,
+	0x65, 0x6c, 0x12, 0x44, 0x0a, 0x0e, 0x47, 0x65, 0x6e, 0x65, 0x72, 0x61, 0x74, 0x65, 0x54, 0x6f,
+	0x6b, 0x65, 0x6e, 0x73, 0x12, 0x1b, 0x2e, 0x61, 0x70, 0x69, 0x2e, 0x54, 0x6f, 0x6b, 0x65, 0x6e,
+	0x47, 0x65, 0x6e, 0x65, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73,
+	0x74, 0x1a, 0x13, 0x2e, 0x61, 0x70, 0x69, 0x2e, 0x47, 0x65, 0x6e, 0x65, 0x72, 0x61, 0x74, 0x65,
+	0x64, 0x54, 0x6f, 0x6b, 0x65, 0x6e, 0x30, 0x01, 0x12, 0x43, 0x0a, 0x10, 0x47, 0x65, 0x6e, 0x65,
+	0x72, 0x61, 0x74, 0x65, 0x43, 0x6f, 0x6e, 0x74, 0x69, 0x6e, 0x75, 0x65, 0x12, 0x18, 0x2e, 0x61,
+	0x70, 0x69, 0x2e, 0x43, 0x6f, 0x6e, 0x74, 0x69, 0x6e, 0x75, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x52,
+	0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x13, 0x2e, 0x61, 0x70, 0x69, 0x2e, 0x47, 0x65, 0x6e,
+	0x65, 0x72, 0x61, 0x74, 0x65, 0x64, 0x54, 0x6f, 0x6b, 0x65, 0x6e, 0x30, 0x01, 0x12, 0x3b, 0x0a,
+	0x0d, 0x52, 0x65, 0x73, 0x75, 0x6d, 0x65, 0x53, 0x65, 0x73, 0x73, 0x69, 0x6f, 0x6e, 0x12, 0x13,
+	0x2e, 0x61, 0x70, 0x69, 0x2e, 0x53, 0x65, 0x73, 0x73, 0x69, 0x6f, 0x6e, 0x52, 0x65, 0x71, 0x75,
+	0x65, 0x73, 0x74, 0x1a, 0x13, 0x2e, 0x61, 0x70, 0x69, 0x2e, 0x47, 0x65, 0x6e, 0x65, 0x72, 0x61,
+	0x74, 0x65, 0x64, 0x54, 0x6f, 0x6b, 0x65, 0x6e, 0x30, 0x01, 0x12, 0x26, 0x0a, 0x07, 0x47, 0x65,
+	0x74, 0x4c, 0x6f, 0x61, 0x64, 0x12, 0x10, 0x2e, 0x61, 0x70, 0x69, 0x2e, 0x4c, 0x6f, 0x61, 0x64,
+	0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x09, 0x2e, 0x61, 0x70, 0x69, 0x2e, 0x4c, 0x6f,
+	0x61, 0x64, 0x42, 0x25, 0x5a, 0x23, 0x67, 0x69, 0x74, 0x68, 0x75, 0x62, 0x2e, 0x63, 0x6f, 0x6d,
+	0x2f, 0x6e, 0x6c, 0x70, 0x6f, 0x64, 0x79, 0x73, 0x73, 0x65, 0x79, 0x2f, 0x76, 0x65, 0x72, 0x62,
+	0x61, 0x66, 0x6c, 0x6f, 0x77, 0x2f, 0x61, 0x70, 0x69, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f,
+	0x33,
 }
 
 var (
@@ -365,23 +1107,37 @@ func file_language_model_proto_rawDescGZIP() []byte {
 	return file_language_model_proto_rawDescData
 }
 
-var file_language_model_proto_msgTypes = make([]protoimpl.MessageInfo, 4)
+var file_language_model_proto_msgTypes = make([]protoimpl.MessageInfo, 9)
 var file_language_model_proto_goTypes = []interface{}{
 	(*TokenGenerationRequest)(nil), // 0: api.TokenGenerationRequest
-	(*DecodingParameters)(nil),     // 1: api.DecodingParameters
-	(*Sequence)(nil),               // 2: api.Sequence
-	(*GeneratedToken)(nil),         // 3: api.GeneratedToken
+	(*SessionRequest)(nil),         // 1: api.SessionRequest
+	(*ContinuationRequest)(nil),    // 2: api.ContinuationRequest
+	(*DecodingParameters)(nil),     // 3: api.DecodingParameters
+	(*Sequence)(nil),               // 4: api.Sequence
+	(*GeneratedToken)(nil),         // 5: api.GeneratedToken
+	(*GenerationStats)(nil),        // 6: api.GenerationStats
+	(*LoadRequest)(nil),            // 7: api.LoadRequest
+	(*Load)(nil),                   // 8: api.Load
 }
 var file_language_model_proto_depIdxs = []int32{
-	1, // 0: api.TokenGenerationRequest.decoding_parameters:type_name -> api.DecodingParameters
-	2, // 1: api.DecodingParameters.stop_sequences:type_name -> api.Sequence
-	0, // 2: api.LanguageModel.GenerateTokens:input_type -> api.TokenGenerationRequest
-	3, // 3: api.LanguageModel.GenerateTokens:output_type -> api.GeneratedToken
-	3, // [3:4] is the sub-list for method output_type
-	2, // [2:3] is the sub-list for method input_type
-	2, // [2:2] is the sub-list for extension type_name
-	2, // [2:2] is the sub-list for extension extendee
-	0, // [0:2] is the sub-list for field type_name
+	3, // 0: api.TokenGenerationRequest.decoding_parameters:type_name -> api.DecodingParameters
+	3, // 1: api.ContinuationRequest.decoding_parameters:type_name -> api.DecodingParameters
+	4, // 2: api.DecodingParameters.stop_sequences:type_name -> api.Sequence
+	5, // 3: api.GeneratedToken.chunk:type_name -> api.GeneratedToken
+	6, // 4: api.GeneratedToken.stats:type_name -> api.GenerationStats
+	0, // 5: api.LanguageModel.GenerateTokens:input_type -> api.TokenGenerationRequest
+	2, // 6: api.LanguageModel.GenerateContinue:input_type -> api.ContinuationRequest
+	1, // 7: api.LanguageModel.ResumeSession:input_type -> api.SessionRequest
+	7, // 8: api.LanguageModel.GetLoad:input_type -> api.LoadRequest
+	5, // 9: api.LanguageModel.GenerateTokens:output_type -> api.GeneratedToken
+	5, // 10: api.LanguageModel.GenerateContinue:output_type -> api.GeneratedToken
+	5, // 11: api.LanguageModel.ResumeSession:output_type -> api.GeneratedToken
+	8, // 12: api.LanguageModel.GetLoad:output_type -> api.Load
+	9, // [9:13] is the sub-list for method output_type
+	5, // [5:9] is the sub-list for method input_type
+	5, // [5:5] is the sub-list for extension type_name
+	5, // [5:5] is the sub-list for extension extendee
+	0, // [0:5] is the sub-list for field type_name
 }
 
 func init() { file_language_model_proto_init() }
@@ -403,7 +1159,7 @@ func file_language_model_proto_init() {
 			}
 		}
 		file_language_model_proto_msgTypes[1].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*DecodingParameters); i {
+			switch v := v.(*SessionRequest); i {
 			case 0:
 				return &v.state
 			case 1:
@@ -415,7 +1171,7 @@ func file_language_model_proto_init() {
 			}
 		}
 		file_language_model_proto_msgTypes[2].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*Sequence); i {
+			switch v := v.(*ContinuationRequest); i {
 			case 0:
 				return &v.state
 			case 1:
@@ -427,6 +1183,30 @@ func file_language_model_proto_init() {
 			}
 		}
 		file_language_model_proto_msgTypes[3].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*DecodingParameters); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_language_model_proto_msgTypes[4].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*Sequence); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_language_model_proto_msgTypes[5].Exporter = func(v interface{}, i int) interface{} {
 			switch v := v.(*GeneratedToken); i {
 			case 0:
 				return &v.state
@@ -438,14 +1218,51 @@ func file_language_model_proto_init() {
 				return nil
 			}
 		}
+		file_language_model_proto_msgTypes[6].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*GenerationStats); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_language_model_proto_msgTypes[7].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*LoadRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_language_model_proto_msgTypes[8].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*Load); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
 	}
+	file_language_model_proto_msgTypes[0].OneofWrappers = []interface{}{}
 	type x struct{}
 	out := protoimpl.TypeBuilder{
 		File: protoimpl.DescBuilder{
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: file_language_model_proto_rawDesc,
 			NumEnums:      0,
-			NumMessages:   4,
+			NumMessages:   9,
 			NumExtensions: 0,
 			NumServices:   1,
 		},
@@ -25,6 +25,15 @@ type LanguageModelClient interface {
 	// GenerateTokens generates tokens for the given prompt using the specified decoding parameters.
 	// The response is a stream of GeneratedToken messages, each containing a generated token and its score and encoded representation.
 	GenerateTokens(ctx context.Context, in *TokenGenerationRequest, opts ...grpc.CallOption) (LanguageModel_GenerateTokensClient, error)
+	// GenerateContinue resumes a resumable generation from its saved state, without encoding the prompt and the generated tokens again.
+	// The response is a stream of GeneratedToken messages, like for GenerateTokens.
+	GenerateContinue(ctx context.Context, in *ContinuationRequest, opts ...grpc.CallOption) (LanguageModel_GenerateContinueClient, error)
+	// ResumeSession reattaches to the generation of a session, after the stream of the client was interrupted.
+	// The response is the rest of the stream of the session, from the given offset.
+	ResumeSession(ctx context.Context, in *SessionRequest, opts ...grpc.CallOption) (LanguageModel_ResumeSessionClient, error)
+	// GetLoad returns the number of generations running and waiting to run, for example to let an autoscaler react to the
+	// queue depth.
+	GetLoad(ctx context.Context, in *LoadRequest, opts ...grpc.CallOption) (*Load, error)
 }
 
 type languageModelClient struct {
@@ -67,6 +76,79 @@ func (x *languageModelGenerateTokensClient) Recv() (*GeneratedToken, error) {
 	return m, nil
 }
 
+func (c *languageModelClient) GenerateContinue(ctx context.Context, in *ContinuationRequest, opts ...grpc.CallOption) (LanguageModel_GenerateContinueClient, error) {
+	stream, err := c.cc.NewStream(ctx, &LanguageModel_ServiceDesc.Streams[1], "/api.LanguageModel/GenerateContinue", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &languageModelGenerateContinueClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type LanguageModel_GenerateContinueClient interface {
+	Recv() (*GeneratedToken, error)
+	grpc.ClientStream
+}
+
+type languageModelGenerateContinueClient struct {
+	grpc.ClientStream
+}
+
+func (x *languageModelGenerateContinueClient) Recv() (*GeneratedToken, error) {
+	m := new(GeneratedToken)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *languageModelClient) ResumeSession(ctx context.Context, in *SessionRequest, opts ...grpc.CallOption) (LanguageModel_ResumeSessionClient, error) {
+	stream, err := c.cc.NewStream(ctx, &LanguageModel_ServiceDesc.Streams[2], "/api.LanguageModel/ResumeSession", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &languageModelResumeSessionClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type LanguageModel_ResumeSessionClient interface {
+	Recv() (*GeneratedToken, error)
+	grpc.ClientStream
+}
+
+type languageModelResumeSessionClient struct {
+	grpc.ClientStream
+}
+
+func (x *languageModelResumeSessionClient) Recv() (*GeneratedToken, error) {
+	m := new(GeneratedToken)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *languageModelClient) GetLoad(ctx context.Context, in *LoadRequest, opts ...grpc.CallOption) (*Load, error) {
+	out := new(Load)
+	err := c.cc.Invoke(ctx, "/api.LanguageModel/GetLoad", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // LanguageModelServer is the server API for LanguageModel service.
 // All implementations must embed UnimplementedLanguageModelServer
 // for forward compatibility
@@ -74,6 +156,15 @@ type LanguageModelServer interface {
 	// GenerateTokens generates tokens for the given prompt using the specified decoding parameters.
 	// The response is a stream of GeneratedToken messages, each containing a generated token and its score and encoded representation.
 	GenerateTokens(*TokenGenerationRequest, LanguageModel_GenerateTokensServer) error
+	// GenerateContinue resumes a resumable generation from its saved state, without encoding the prompt and the generated tokens again.
+	// The response is a stream of GeneratedToken messages, like for GenerateTokens.
+	GenerateContinue(*ContinuationRequest, LanguageModel_GenerateContinueServer) error
+	// ResumeSession reattaches to the generation of a session, after the stream of the client was interrupted.
+	// The response is the rest of the stream of the session, from the given offset.
+	ResumeSession(*SessionRequest, LanguageModel_ResumeSessionServer) error
+	// GetLoad returns the number of generations running and waiting to run, for example to let an autoscaler react to the
+	// queue depth.
+	GetLoad(context.Context, *LoadRequest) (*Load, error)
 	mustEmbedUnimplementedLanguageModelServer()
 }
 
@@ -84,6 +175,15 @@ type UnimplementedLanguageModelServer struct {
 func (UnimplementedLanguageModelServer) GenerateTokens(*TokenGenerationRequest, LanguageModel_GenerateTokensServer) error {
 	return status.Errorf(codes.Unimplemented, "method GenerateTokens not implemented")
 }
+func (UnimplementedLanguageModelServer) GenerateContinue(*ContinuationRequest, LanguageModel_GenerateContinueServer) error {
+	return status.Errorf(codes.Unimplemented, "method GenerateContinue not implemented")
+}
+func (UnimplementedLanguageModelServer) ResumeSession(*SessionRequest, LanguageModel_ResumeSessionServer) error {
+	return status.Errorf(codes.Unimplemented, "method ResumeSession not implemented")
+}
+func (UnimplementedLanguageModelServer) GetLoad(context.Context, *LoadRequest) (*Load, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetLoad not implemented")
+}
 func (UnimplementedLanguageModelServer) mustEmbedUnimplementedLanguageModelServer() {}
 
 // UnsafeLanguageModelServer may be embedded to opt out of forward compatibility for this service.
@@ -118,19 +218,94 @@ func (x *languageModelGenerateTokensServer) Send(m *GeneratedToken) error {
 	return x.ServerStream.SendMsg(m)
 }
 
+func _LanguageModel_GenerateContinue_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ContinuationRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(LanguageModelServer).GenerateContinue(m, &languageModelGenerateContinueServer{stream})
+}
+
+type LanguageModel_GenerateContinueServer interface {
+	Send(*GeneratedToken) error
+	grpc.ServerStream
+}
+
+type languageModelGenerateContinueServer struct {
+	grpc.ServerStream
+}
+
+func (x *languageModelGenerateContinueServer) Send(m *GeneratedToken) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _LanguageModel_ResumeSession_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(SessionRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(LanguageModelServer).ResumeSession(m, &languageModelResumeSessionServer{stream})
+}
+
+type LanguageModel_ResumeSessionServer interface {
+	Send(*GeneratedToken) error
+	grpc.ServerStream
+}
+
+type languageModelResumeSessionServer struct {
+	grpc.ServerStream
+}
+
+func (x *languageModelResumeSessionServer) Send(m *GeneratedToken) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _LanguageModel_GetLoad_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(LoadRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LanguageModelServer).GetLoad(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/api.LanguageModel/GetLoad",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LanguageModelServer).GetLoad(ctx, req.(*LoadRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // LanguageModel_ServiceDesc is the grpc.ServiceDesc for LanguageModel service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
 var LanguageModel_ServiceDesc = grpc.ServiceDesc{
 	ServiceName: "api.LanguageModel",
 	HandlerType: (*LanguageModelServer)(nil),
-	Methods:     []grpc.MethodDesc{},
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetLoad",
+			Handler:    _LanguageModel_GetLoad_Handler,
+		},
+	},
 	Streams: []grpc.StreamDesc{
 		{
 			StreamName:    "GenerateTokens",
 			Handler:       _LanguageModel_GenerateTokens_Handler,
 			ServerStreams: true,
 		},
+		{
+			StreamName:    "GenerateContinue",
+			Handler:       _LanguageModel_GenerateContinue_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "ResumeSession",
+			Handler:       _LanguageModel_ResumeSession_Handler,
+			ServerStreams: true,
+		},
 	},
 	Metadata: "language_model.proto",
 }
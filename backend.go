@@ -0,0 +1,123 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package verbaflow
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"runtime"
+	"strings"
+
+	"github.com/nlpodyssey/spago/mat"
+)
+
+// MathBackend describes the implementation of the vector operations of
+// spago, such as the dot products of the matrix multiplications, which
+// dominate the time of the forward of the model.
+//
+// The assembly implementations are only available on amd64: there, spago
+// uses the AVX and FMA instructions when the CPU supports them, and SSE
+// otherwise. On the other architectures, or when building with the purego
+// tag, the pure-Go fallback is used, which works on every CPU.
+type MathBackend struct {
+	// Arch is the architecture of the build.
+	Arch string
+	// PureGo reports whether the pure-Go fallback is used.
+	PureGo bool
+	// Features are the detected CPU features relevant to the assembly
+	// implementations.
+	Features []string
+}
+
+// DetectMathBackend returns the MathBackend selected for this build and CPU.
+func DetectMathBackend() MathBackend {
+	return MathBackend{
+		Arch:     runtime.GOARCH,
+		PureGo:   !asmBackend,
+		Features: cpuFeatures(),
+	}
+}
+
+// Path returns the name of the implementation of the dot products: "AVX+FMA",
+// "SSE" or "pure Go".
+func (b MathBackend) Path() string {
+	switch {
+	case b.PureGo:
+		return "pure Go"
+	case b.has("avx") && b.has("fma"):
+		return "AVX+FMA"
+	default:
+		return "SSE"
+	}
+}
+
+// String satisfies the fmt.Stringer interface.
+func (b MathBackend) String() string {
+	if len(b.Features) == 0 {
+		return fmt.Sprintf("%s (%s)", b.Path(), b.Arch)
+	}
+	return fmt.Sprintf("%s (%s: %s)", b.Path(), b.Arch, strings.Join(b.Features, " "))
+}
+
+func (b MathBackend) has(feature string) bool {
+	for _, f := range b.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyTolerance is the maximum relative difference between the results of
+// the math backend and of the reference implementation: they can differ
+// slightly, since the former sums the products in a different order, and
+// can fuse the multiplications and the additions.
+const verifyTolerance = 1e-4
+
+// VerifyMathBackend checks that the matrix multiplications of the math
+// backend match a plain reference implementation on small random matrices,
+// whose sizes are not multiples of the SIMD widths, to detect a backend
+// which is broken on this CPU.
+func VerifyMathBackend() error {
+	r := rand.New(rand.NewSource(42))
+	for _, cols := range []int{1, 3} {
+		a := randomMatrix(r, 13, 37)
+		b := randomMatrix(r, 37, cols)
+		actual := a.Mul(b).Data().F64()
+		expected := referenceMatMul(a, b)
+		for i, v := range expected {
+			if diff := math.Abs(actual[i] - v); diff > verifyTolerance*math.Max(1, math.Abs(v)) {
+				return fmt.Errorf("the %s math backend is inconsistent: element %d of the product is %g, expected %g", DetectMathBackend().Path(), i, actual[i], v)
+			}
+		}
+	}
+	return nil
+}
+
+// referenceMatMul returns the data of the product of a and b, computed in
+// pure Go with float64 precision.
+func referenceMatMul(a, b mat.Matrix) []float64 {
+	rows, inner, cols := a.Rows(), a.Columns(), b.Columns()
+	out := make([]float64, rows*cols)
+	for i := 0; i < rows; i++ {
+		for j := 0; j < cols; j++ {
+			var sum float64
+			for k := 0; k < inner; k++ {
+				sum += a.ScalarAt(i, k).F64() * b.ScalarAt(k, j).F64()
+			}
+			out[i*cols+j] = sum
+		}
+	}
+	return out
+}
+
+func randomMatrix(r *rand.Rand, rows, cols int) mat.Matrix {
+	data := make([]float32, rows*cols)
+	for i := range data {
+		data[i] = r.Float32()*2 - 1
+	}
+	return mat.NewDense[float32](rows, cols, data)
+}
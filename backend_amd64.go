@@ -0,0 +1,32 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build amd64 && gc && !purego
+
+package verbaflow
+
+import "golang.org/x/sys/cpu"
+
+// asmBackend reports whether spago uses its assembly implementations, with
+// the same build constraints.
+const asmBackend = true
+
+// cpuFeatures returns the x86 features used by the assembly implementations.
+func cpuFeatures() []string {
+	var features []string
+	for _, f := range []struct {
+		name string
+		has  bool
+	}{
+		{"sse2", cpu.X86.HasSSE2},
+		{"avx", cpu.X86.HasAVX},
+		{"avx2", cpu.X86.HasAVX2},
+		{"fma", cpu.X86.HasFMA},
+	} {
+		if f.has {
+			features = append(features, f.name)
+		}
+	}
+	return features
+}
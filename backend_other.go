@@ -0,0 +1,16 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !amd64 || !gc || purego
+
+package verbaflow
+
+// asmBackend reports whether spago uses its assembly implementations, with
+// the same build constraints.
+const asmBackend = false
+
+// cpuFeatures returns nil, since only the pure-Go fallback is available.
+func cpuFeatures() []string {
+	return nil
+}
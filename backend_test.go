@@ -0,0 +1,38 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package verbaflow
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyMathBackend(t *testing.T) {
+	assert.NoError(t, VerifyMathBackend())
+
+	// the reference implementation matches the backend on a small product
+	r := rand.New(rand.NewSource(1))
+	a := randomMatrix(r, 5, 19)
+	b := randomMatrix(r, 19, 1)
+	expected := referenceMatMul(a, b)
+	actual := a.Mul(b).Data().F64()
+	require.Len(t, actual, len(expected))
+	assert.InDeltaSlice(t, expected, actual, verifyTolerance)
+}
+
+func TestDetectMathBackend(t *testing.T) {
+	b := DetectMathBackend()
+	assert.NotEmpty(t, b.Arch)
+	assert.Equal(t, !asmBackend, b.PureGo)
+	assert.Contains(t, []string{"AVX+FMA", "SSE", "pure Go"}, b.Path())
+	assert.Contains(t, b.String(), b.Path())
+
+	assert.Equal(t, "pure Go", MathBackend{Arch: "arm64", PureGo: true}.Path())
+	assert.Equal(t, "SSE", MathBackend{Arch: "amd64", Features: []string{"sse2", "avx"}}.Path())
+	assert.Equal(t, "AVX+FMA", MathBackend{Arch: "amd64", Features: []string{"sse2", "avx", "fma"}}.Path())
+}
@@ -0,0 +1,78 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/nlpodyssey/verbaflow"
+	"github.com/nlpodyssey/verbaflow/decoder"
+)
+
+const (
+	// chatTurnFormat is the format of the user turns.
+	// The replies of the model end on a blank line.
+	chatTurnFormat = "User: %s\n\nBot:"
+	chatStopText   = "\n\n"
+	// chatResetCommand clears the conversation.
+	chatResetCommand = "/reset"
+)
+
+// runChat reads the user turns from in, one per line, and writes the
+// replies of the model to out, keeping the conversation across the turns.
+func runChat(ctx context.Context, vf *verbaflow.VerbaFlow, in io.Reader, out io.Writer, maxLen int) error {
+	stop, err := vf.TokenizePrompt(chatStopText, false)
+	if err != nil {
+		return err
+	}
+	opts := decoder.DecodingOptions{
+		MaxLen:           maxLen,
+		TrimStopSequence: true,
+		EndTokenID:       vf.Tokenizer.ControlTokens().EosTokenID,
+		SkipEndTokenID:   true,
+		Temp:             1,
+		TopP:             1,
+	}
+	// a tokenizer unable to encode the blank line has no stop sequence
+	if len(stop) > 0 {
+		opts.StopSequencesIDs = [][]int{stop}
+	}
+
+	conv := vf.NewConversation()
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch line {
+		case "":
+			continue
+		case chatResetCommand:
+			conv.Reset()
+			fmt.Fprintln(out, "Conversation reset.")
+			continue
+		}
+
+		// the buffer can hold the whole reply, which is collected at the end
+		chGen := make(chan decoder.GeneratedToken, opts.MaxLen)
+		if err := conv.Reply(ctx, fmt.Sprintf(chatTurnFormat, line), chGen, opts); err != nil {
+			return err
+		}
+		var reply []int
+		for gen := range chGen {
+			if gen.TokenID != opts.EndTokenID {
+				reply = append(reply, gen.TokenID)
+			}
+		}
+		text, err := vf.Tokenizer.ReconstructText(reply)
+		if err != nil {
+			return fmt.Errorf("failed to reconstruct the reply: %w", err)
+		}
+		fmt.Fprintln(out, strings.TrimSpace(text))
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,36 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/nlpodyssey/verbaflow"
+	"github.com/nlpodyssey/verbaflow/rwkvlm/rwkvlmtest"
+	"github.com/nlpodyssey/verbaflow/tokenizer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunChat(t *testing.T) {
+	tk, err := tokenizer.Load("../../testdata/tiny-model")
+	require.NoError(t, err)
+	vf := &verbaflow.VerbaFlow{
+		Model:     rwkvlmtest.NewModel(rwkvlmtest.DefaultConfig, 1),
+		Tokenizer: tk,
+	}
+
+	in := strings.NewReader("unrelated\n\nunrelated\n/reset\nunrelated\n")
+	var out strings.Builder
+	require.NoError(t, runChat(context.Background(), vf, in, &out, 4))
+
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	require.Len(t, lines, 4)
+	assert.Equal(t, "Conversation reset.", lines[2])
+	// after the reset, the first turn is replied to as before
+	assert.Equal(t, lines[0], lines[3])
+}
@@ -11,8 +11,8 @@ import (
 	"os/signal"
 	"path/filepath"
 	"strings"
+	"time"
 
-	"github.com/nlpodyssey/spago/ag"
 	"github.com/nlpodyssey/verbaflow"
 	"github.com/nlpodyssey/verbaflow/downloader"
 	"github.com/nlpodyssey/verbaflow/rwkvlm"
@@ -25,9 +25,23 @@ import (
 func main() {
 	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr}).Level(zerolog.InfoLevel)
 
-	app := &cli.App{
+	if err := newApp().Run(os.Args); err != nil {
+		log.Fatal().Err(err).Send()
+	}
+}
+
+// newApp returns the command-line application.
+// Each flag can also be set by an environment variable, named after the flag
+// with the envPrefix, such as VERBAFLOW_MODEL_DIR for -model-dir: the flag
+// takes precedence over the environment variable.
+func newApp() *cli.App {
+	return &cli.App{
 		Name:  "verbaflow",
 		Usage: "Perform various operations with a language model",
+		Before: func(c *cli.Context) error {
+			log.Info().Msgf("Math backend: %v", verbaflow.DetectMathBackend())
+			return nil
+		},
 		Flags: []cli.Flag{
 			&cli.StringFlag{
 				Name:  "log-level",
@@ -36,46 +50,156 @@ func main() {
 					return setDebugLevel(s)
 				},
 				Value:   "info",
-				EnvVars: []string{"VERBAFLOW_LOGLEVEL"},
+				EnvVars: envVars("log-level", "VERBAFLOW_LOGLEVEL"),
 			},
 			&cli.StringFlag{
 				Name:     "model-dir",
 				Usage:    "directory of the model to operate on",
+				EnvVars:  envVars("model-dir"),
 				Required: true,
 			},
+			&cli.IntFlag{
+				Name:    "threads",
+				Usage:   "the maximum number of CPUs running the model simultaneously, 0 for all",
+				Value:   0,
+				EnvVars: envVars("threads"),
+			},
+			&cli.BoolFlag{
+				Name:    "sync-execution",
+				Usage:   "run the operations of the model one at a time, to ease profiling and debugging",
+				EnvVars: envVars("sync-execution"),
+			},
+			&cli.BoolFlag{
+				Name:    "add-prefix-space",
+				Usage:   "add a space at the beginning of the prompts, as expected by some tokenizers",
+				EnvVars: envVars("add-prefix-space"),
+			},
+			&cli.IntFlag{
+				Name:    "tokenizer-cache-size",
+				Usage:   "the number of prompts whose tokenization is cached, 0 to disable the cache",
+				Value:   0,
+				EnvVars: envVars("tokenizer-cache-size"),
+			},
+			&cli.IntFlag{
+				Name:    "encode-chunk-size",
+				Usage:   "the maximum number of tokens of the prompt encoded at once, to bound the memory, 0 to encode it at once",
+				Value:   0,
+				EnvVars: envVars("encode-chunk-size"),
+			},
 		},
 		Commands: []*cli.Command{
 			{
 				Name:  "download",
 				Usage: "Download model to directory",
 				Action: func(c *cli.Context) error {
-					if err := download(c.String("model-dir")); err != nil {
-						log.Err(err).Send()
+					if err := download(c.String("model-dir"), c.String("hf-token"), c.String("hf-endpoint")); err != nil {
+						log.Fatal().Err(err).Send()
 					}
 					return nil
 				},
+				Flags: []cli.Flag{
+					hfTokenFlag(),
+					hfEndpointFlag(),
+				},
+			},
+			{
+				Name:  "verify",
+				Usage: "Verify that the downloaded files in directory are complete and unmodified",
+				Action: func(c *cli.Context) error {
+					if err := downloader.Verify(c.String("model-dir")); err != nil {
+						log.Fatal().Err(err).Send()
+					}
+					log.Info().Msg("The downloaded files match the manifest.")
+					return nil
+				},
 			},
 			{
 				Name:  "convert",
 				Usage: "Convert model in directory",
 				Action: func(c *cli.Context) error {
-					if err := convert(c.String("model-dir")); err != nil {
+					modelDir, modelFile := c.String("model-dir"), c.String("model-file")
+					if err := convert(modelDir, modelFile, c.String("dtype"), c.Bool("streaming"), c.Bool("overwrite")); err != nil {
 						log.Fatal().Err(err).Send()
 					}
+					if c.Bool("cleanup") {
+						if err := cleanup(modelDir, modelFile); err != nil {
+							log.Fatal().Err(err).Send()
+						}
+					}
 					return nil
 				},
+				Flags: []cli.Flag{
+					modelFileFlag("The name of the converted model file to write"),
+					overwriteFlag(),
+					&cli.StringFlag{
+						Name:     "dtype",
+						Usage:    "The floating-point type of the converted model (float32, float64)",
+						Value:    "float32",
+						EnvVars:  envVars("dtype"),
+						Required: false,
+					},
+					&cli.BoolFlag{
+						Name:     "streaming",
+						Usage:    "Write each block as soon as it is converted, to reduce the memory usage",
+						EnvVars:  envVars("streaming"),
+						Required: false,
+					},
+					&cli.BoolFlag{
+						Name:     "cleanup",
+						Usage:    "Remove the PyTorch model and the download manifest once the converted model is verified",
+						EnvVars:  envVars("cleanup"),
+						Required: false,
+					},
+				},
+			},
+			{
+				Name:  "prepare",
+				Usage: "Download and convert model to directory",
+				Action: func(c *cli.Context) error {
+					err := prepare(c.String("model-dir"), c.String("model-file"), c.String("hf-token"), c.String("hf-endpoint"), c.Bool("overwrite"))
+					if err != nil {
+						log.Fatal().Err(err).Send()
+					}
+					return nil
+				},
+				Flags: []cli.Flag{
+					hfTokenFlag(),
+					hfEndpointFlag(),
+					modelFileFlag("The name of the converted model file to write"),
+					overwriteFlag(),
+				},
 			},
 			{
 				Name:  "inference",
 				Usage: "Serve a gRPC inference endpoint",
 				Action: func(c *cli.Context) error {
 					modelDir := c.String("model-dir")
+					modelFile := c.String("model-file")
 					address := c.String("address")
+					serverOpts := []service.ServerOption{
+						service.WithMaxPromptTokens(c.Int("max-prompt-tokens")),
+						service.WithMaxContinuations(c.Int("max-continuations")),
+						service.WithGenerationTimeout(c.Duration("generation-timeout")),
+						service.WithSessions(c.Duration("session-ttl")),
+						service.WithMaxConcurrentGenerations(c.Int("max-concurrent")),
+					}
+					if c.Bool("validate-on-start") {
+						serverOpts = append(serverOpts, service.WithStartupValidation())
+					}
+					if size := c.Int("response-cache-size"); size > 0 {
+						serverOpts = append(serverOpts, service.WithResponseCache(size))
+					}
+					if systemPrompt := c.String("system-prompt"); systemPrompt != "" {
+						serverOpts = append(serverOpts, service.WithSystemPrompt(systemPrompt))
+					}
+					if window := c.Duration("batch-window"); window > 0 {
+						serverOpts = append(serverOpts, service.WithContinuousBatching(window, c.Int("max-batch")))
+					}
 
 					ctx, stop := signal.NotifyContext(c.Context, os.Interrupt, os.Kill)
 					defer stop()
 
-					if err := inference(ctx, modelDir, address); err != nil {
+					if err := inference(ctx, modelDir, modelFile, loadOptions(c), address, c.StringSlice("extra-model"), c.Duration("model-idle-ttl"), serverOpts...); err != nil {
 						fmt.Print(err)
 						log.Err(err).Send()
 					}
@@ -86,15 +210,198 @@ func main() {
 						Name:     "address",
 						Usage:    "The address to listen on for gRPC connections",
 						Value:    ":50051",
+						EnvVars:  envVars("address"),
+						Required: false,
+					},
+					&cli.IntFlag{
+						Name:     "max-prompt-tokens",
+						Usage:    "The maximum number of tokens of a prompt, 0 for no limit",
+						Value:    0,
+						EnvVars:  envVars("max-prompt-tokens"),
+						Required: false,
+					},
+					&cli.BoolFlag{
+						Name:     "validate-on-start",
+						Usage:    "Generate a token on start, reporting the service as not serving if the model is broken",
+						Value:    false,
+						EnvVars:  envVars("validate-on-start"),
+						Required: false,
+					},
+					&cli.IntFlag{
+						Name:     "max-continuations",
+						Usage:    "The number of resumable generations whose state is kept, discarding the oldest ones, 0 to disable them",
+						Value:    16,
+						EnvVars:  envVars("max-continuations"),
+						Required: false,
+					},
+					&cli.StringSliceFlag{
+						Name:     "extra-model",
+						Usage:    "An additional model to serve, as name=dir, which the requests select with their model field (can be repeated)",
+						EnvVars:  envVars("extra-model"),
+						Required: false,
+					},
+					&cli.IntFlag{
+						Name:     "response-cache-size",
+						Usage:    "The number of responses of the deterministic generations kept to serve the identical requests, 0 to disable the cache",
+						Value:    0,
+						EnvVars:  envVars("response-cache-size"),
+						Required: false,
+					},
+					&cli.DurationFlag{
+						Name:     "model-idle-ttl",
+						Usage:    "If positive, the extra models are loaded on their first request, and unloaded when unused for longer",
+						EnvVars:  envVars("model-idle-ttl"),
+						Required: false,
+					},
+					&cli.DurationFlag{
+						Name:     "generation-timeout",
+						Usage:    "If positive, the maximum duration of a generation, after which it is cancelled",
+						EnvVars:  envVars("generation-timeout"),
+						Required: false,
+					},
+					&cli.DurationFlag{
+						Name:     "session-ttl",
+						Usage:    "If positive, enables the sessions, which the clients can reattach to until nobody follows them for this time",
+						EnvVars:  envVars("session-ttl"),
+						Required: false,
+					},
+					&cli.StringFlag{
+						Name:     "system-prompt",
+						Usage:    "A prompt template prepended to the prompt of every request, unless the request sets its own",
+						EnvVars:  envVars("system-prompt"),
+						Required: false,
+					},
+					&cli.DurationFlag{
+						Name:     "batch-window",
+						Usage:    "If positive, the concurrent generations run their steps together, waiting up to this time for each other",
+						EnvVars:  envVars("batch-window"),
+						Required: false,
+					},
+					&cli.IntFlag{
+						Name:     "max-batch",
+						Usage:    "The maximum number of steps run together with --batch-window, 0 for no limit",
+						Value:    8,
+						EnvVars:  envVars("max-batch"),
 						Required: false,
 					},
+					&cli.IntFlag{
+						Name:     "max-concurrent",
+						Usage:    "The maximum number of generations running at once, queuing the others, 0 for no limit",
+						Value:    0,
+						EnvVars:  envVars("max-concurrent"),
+						Required: false,
+					},
+					modelFileFlag("The name of the converted model file to load"),
+				},
+			},
+			{
+				Name:  "chat",
+				Usage: "Chat with the model in directory, reading one turn per line from the standard input (type /reset to start over)",
+				Action: func(c *cli.Context) error {
+					ctx, stop := signal.NotifyContext(c.Context, os.Interrupt, os.Kill)
+					defer stop()
+
+					if err := chat(ctx, c.String("model-dir"), c.String("model-file"), loadOptions(c), c.Int("max-len")); err != nil {
+						log.Fatal().Err(err).Send()
+					}
+					return nil
+				},
+				Flags: []cli.Flag{
+					&cli.IntFlag{
+						Name:     "max-len",
+						Usage:    "The maximum number of tokens of each reply",
+						Value:    100,
+						EnvVars:  envVars("max-len"),
+						Required: false,
+					},
+					modelFileFlag("The name of the converted model file to load"),
+				},
+			},
+			{
+				Name:  "selftest",
+				Usage: "Check that the model in directory generates sensible text",
+				Action: func(c *cli.Context) error {
+					if err := selftest(c.Context, c.String("model-dir"), c.String("model-file"), loadOptions(c), c.String("prompt")); err != nil {
+						log.Fatal().Err(err).Send()
+					}
+					return nil
+				},
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "prompt",
+						Usage:    "The prompt to generate from",
+						Value:    defaultSelfTestPrompt,
+						EnvVars:  envVars("prompt"),
+						Required: false,
+					},
+					modelFileFlag("The name of the converted model file to load"),
 				},
 			},
 		},
 	}
+}
 
-	if err := app.Run(os.Args); err != nil {
-		log.Fatal().Err(err).Send()
+// envPrefix is the prefix of the environment variables setting the flags.
+const envPrefix = "VERBAFLOW_"
+
+// envVars returns the environment variables which set the flag with the given
+// name: the one derived from the name, such as VERBAFLOW_MODEL_DIR for
+// model-dir, followed by the given fallbacks.
+func envVars(flagName string, fallbacks ...string) []string {
+	name := envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+	return append([]string{name}, fallbacks...)
+}
+
+// modelFileFlag returns the flag for the name of the converted model file,
+// relative to the model directory.
+func modelFileFlag(usage string) cli.Flag {
+	return &cli.StringFlag{
+		Name:     "model-file",
+		Usage:    usage,
+		Value:    rwkvlm.DefaultOutputFilename,
+		EnvVars:  envVars("model-file"),
+		Required: false,
+	}
+}
+
+// overwriteFlag returns the flag to convert a model even if the converted
+// model file already exists.
+func overwriteFlag() cli.Flag {
+	return &cli.BoolFlag{
+		Name:     "overwrite",
+		Usage:    "Convert the model even if the converted model file already exists",
+		EnvVars:  envVars("overwrite"),
+		Required: false,
+	}
+}
+
+func hfTokenFlag() cli.Flag {
+	return &cli.StringFlag{
+		Name:     "hf-token",
+		Usage:    "The Hugging Face access token, required by private and gated models",
+		EnvVars:  envVars("hf-token", "HF_TOKEN", "HUGGING_FACE_HUB_TOKEN"),
+		Required: false,
+	}
+}
+
+func hfEndpointFlag() cli.Flag {
+	return &cli.StringFlag{
+		Name:     "hf-endpoint",
+		Usage:    "The base URL of the Hugging Face Hub, to download from a mirror",
+		Value:    downloader.DefaultEndpoint,
+		EnvVars:  envVars("hf-endpoint", "HF_ENDPOINT"),
+		Required: false,
+	}
+}
+
+// loadOptions returns the options to load the model from the global flags.
+func loadOptions(c *cli.Context) verbaflow.LoadOptions {
+	return verbaflow.LoadOptions{
+		NumThreads:         c.Int("threads"),
+		SyncExecution:      c.Bool("sync-execution"),
+		AddPrefixSpace:     c.Bool("add-prefix-space"),
+		TokenizerCacheSize: c.Int("tokenizer-cache-size"),
+		EncodeChunkSize:    c.Int("encode-chunk-size"),
 	}
 }
 
@@ -107,47 +414,147 @@ func setDebugLevel(debugLevel string) error {
 	return nil
 }
 
-func download(modelDir string) error {
+func download(modelDir, accessToken, endpoint string) error {
 	log.Debug().Msgf("Downloading model in dir: %s", modelDir)
 	dir, name, err := splitPathAndModelName(modelDir)
 	if err != nil {
-		log.Fatal().Err(err).Send()
+		return err
 	}
-	err = downloader.Download(dir, name, false, "")
-	if err != nil {
-		log.Fatal().Err(err).Send()
+	if err = downloader.Download(dir, name, false, accessToken, endpoint); err != nil {
+		return err
 	}
 	log.Debug().Msg("Done.")
 	return nil
 }
 
-func convert(modelDir string) error {
+func convert(modelDir, modelFile, dtype string, streaming, overwrite bool) error {
 	log.Debug().Msgf("Converting model in dir: %s", modelDir)
-	err := rwkvlm.ConvertPickledModelToRWKVLM[float32](rwkvlm.ConverterConfig{
+	config := rwkvlm.ConverterConfig{
 		ModelDir:         modelDir,
-		OverwriteIfExist: false,
-	})
+		GoModelFilename:  modelFile,
+		OverwriteIfExist: overwrite,
+		Streaming:        streaming,
+	}
+	var err error
+	switch dtype {
+	case "float32":
+		err = rwkvlm.ConvertPickledModelToRWKVLM[float32](config)
+	case "float64":
+		err = rwkvlm.ConvertPickledModelToRWKVLM[float64](config)
+	default:
+		err = fmt.Errorf("unsupported dtype %q: must be float32 or float64", dtype)
+	}
 	if err != nil {
-		log.Fatal().Err(err).Send()
+		return err
 	}
 	log.Debug().Msg("Done.")
 	return nil
 }
 
-func inference(ctx context.Context, modelDir string, address string) error {
+// cleanup removes the PyTorch model, which is redundant after the conversion,
+// and the download manifest, which no longer describes the directory.
+// It only does so after checking that the converted model can be loaded.
+func cleanup(modelDir, modelFile string) error {
+	if _, err := rwkvlm.LoadFile(filepath.Join(modelDir, modelFile)); err != nil {
+		return fmt.Errorf("the converted model can't be loaded, the source files are kept: %w", err)
+	}
+	for _, name := range []string{rwkvlm.DefaultPyModelFilename, downloader.ManifestFilename} {
+		err := os.Remove(filepath.Join(modelDir, name))
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove %s: %w", name, err)
+		}
+	}
+	log.Debug().Msgf("Removed the source files in dir: %s", modelDir)
+	return nil
+}
+
+// prepare downloads the model and converts it with the default settings.
+// The conversion is skipped if the converted model file already exists,
+// unless overwrite is true.
+func prepare(modelDir, modelFile, accessToken, endpoint string, overwrite bool) error {
+	if err := download(modelDir, accessToken, endpoint); err != nil {
+		return err
+	}
+	return convert(modelDir, modelFile, "float32", false, overwrite)
+}
+
+func inference(ctx context.Context, modelDir, modelFile string, opts verbaflow.LoadOptions, address string, extraModels []string, idleTTL time.Duration, serverOpts ...service.ServerOption) error {
 	log.Debug().Msgf("Starting inference server for model in dir: %s", modelDir)
 	log.Debug().Msgf("Loading model...")
-	vf, err := verbaflow.Load(modelDir)
+	vf, err := verbaflow.LoadFile(modelDir, modelFile, opts)
 	if err != nil {
 		return err
 	}
 	defer vf.Close()
 
+	if len(extraModels) > 0 {
+		registry := service.NewRegistry(service.WithIdleTTL(idleTTL))
+		for _, spec := range extraModels {
+			name, dir, ok := strings.Cut(spec, "=")
+			if !ok {
+				return fmt.Errorf("invalid extra model %q: must be name=dir", spec)
+			}
+			if idleTTL > 0 {
+				load := func() (*verbaflow.VerbaFlow, error) {
+					return verbaflow.LoadFile(dir, modelFile, opts)
+				}
+				if err := registry.RegisterLazy(name, load); err != nil {
+					return err
+				}
+				continue
+			}
+			log.Debug().Msgf("Loading model %q in dir: %s", name, dir)
+			m, err := verbaflow.LoadFile(dir, modelFile, opts)
+			if err != nil {
+				return fmt.Errorf("failed to load model %q: %w", name, err)
+			}
+			defer m.Close()
+			if err := registry.Register(name, m); err != nil {
+				return err
+			}
+		}
+		serverOpts = append(serverOpts, service.WithRegistry(registry))
+	}
+
 	log.Debug().Msgf("Server listening on %s", address)
-	server := service.NewServer(vf)
+	server := service.NewServer(vf, serverOpts...)
 	return server.Start(ctx, address)
 }
 
+func selftest(ctx context.Context, modelDir, modelFile string, opts verbaflow.LoadOptions, prompt string) error {
+	log.Debug().Msgf("Running self-test for model in dir: %s", modelDir)
+	if err := verbaflow.VerifyMathBackend(); err != nil {
+		fmt.Printf("FAIL: %v\n", err)
+		return fmt.Errorf("self-test failed: %w", err)
+	}
+	vf, err := verbaflow.LoadFile(modelDir, modelFile, opts)
+	if err != nil {
+		return err
+	}
+	defer vf.Close()
+
+	fmt.Printf("Tokenizer: %d tokens, %d merges. Model: %d tokens\n",
+		vf.Tokenizer.VocabularySize(), vf.Tokenizer.MergeCount(), vf.Model.Config.VocabSize)
+	sample, err := runSelfTest(ctx, vf, prompt)
+	if err != nil {
+		fmt.Printf("FAIL: %v\n", err)
+		return fmt.Errorf("self-test failed: %w", err)
+	}
+	fmt.Printf("PASS\n%s%s\n", prompt, sample)
+	return nil
+}
+
+func chat(ctx context.Context, modelDir, modelFile string, opts verbaflow.LoadOptions, maxLen int) error {
+	log.Debug().Msgf("Starting chat with model in dir: %s", modelDir)
+	vf, err := verbaflow.LoadFile(modelDir, modelFile, opts)
+	if err != nil {
+		return err
+	}
+	defer vf.Close()
+
+	return runChat(ctx, vf, os.Stdin, os.Stdout, maxLen)
+}
+
 // splitPathAndModelName separate the models directory from the model name, which format is "organization/model"
 func splitPathAndModelName(path string) (string, string, error) {
 	dirs := strings.Split(strings.TrimSuffix(path, "/"), "/")
@@ -160,7 +567,3 @@ func splitPathAndModelName(path string) (string, string, error) {
 	pathExceptLastTwo := strings.Join(dirs[:len(dirs)-2], "/")
 	return pathExceptLastTwo, filepath.Join(secondLastDir, lastDir), nil
 }
-
-func init() {
-	ag.SetDebugMode(false)
-}
@@ -0,0 +1,169 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nlpodyssey/verbaflow"
+	"github.com/nlpodyssey/verbaflow/downloader"
+	"github.com/nlpodyssey/verbaflow/rwkvlm"
+	"github.com/nlpodyssey/verbaflow/rwkvlm/rwkvlmtest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli/v2"
+)
+
+// newHubServer returns a server which serves the files of a tiny model, for
+// any model name, like the Hugging Face Hub.
+func newHubServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	dir := t.TempDir()
+	require.NoError(t, rwkvlmtest.WriteTorchModel(dir, rwkvlmtest.DefaultConfig, 1))
+	for _, name := range []string{"vocab.json", "merges.txt"} {
+		data, err := os.ReadFile(filepath.Join("../../testdata/tiny-model", name))
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), data, 0o644))
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, filepath.Join(dir, filepath.Base(r.URL.Path)))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestPrepare(t *testing.T) {
+	srv := newHubServer(t)
+	modelDir := filepath.Join(t.TempDir(), "models", "org", "model")
+
+	require.NoError(t, prepare(modelDir, rwkvlm.DefaultOutputFilename, "", srv.URL, false))
+	for _, name := range []string{"config.json", "pytorch_model.pt", "vocab.json", "merges.txt", downloader.ManifestFilename, rwkvlm.DefaultOutputFilename} {
+		assert.FileExists(t, filepath.Join(modelDir, name))
+	}
+	require.NoError(t, downloader.Verify(modelDir))
+
+	vf, err := verbaflow.Load(modelDir, verbaflow.LoadOptions{})
+	require.NoError(t, err)
+	require.NoError(t, vf.Close())
+
+	// the existing model is kept, unless overwrite is requested
+	modelFile := filepath.Join(modelDir, rwkvlm.DefaultOutputFilename)
+	before, err := os.Stat(modelFile)
+	require.NoError(t, err)
+	require.NoError(t, prepare(modelDir, rwkvlm.DefaultOutputFilename, "", srv.URL, false))
+	after, err := os.Stat(modelFile)
+	require.NoError(t, err)
+	assert.Equal(t, before.ModTime(), after.ModTime())
+
+	require.NoError(t, prepare(modelDir, rwkvlm.DefaultOutputFilename, "", srv.URL, true))
+	after, err = os.Stat(modelFile)
+	require.NoError(t, err)
+	assert.NotEqual(t, before.ModTime(), after.ModTime())
+}
+
+func TestPrepare_DownloadError(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+	modelDir := filepath.Join(t.TempDir(), "models", "org", "model")
+
+	err := prepare(modelDir, rwkvlm.DefaultOutputFilename, "", srv.URL, false)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "404")
+	assert.NoFileExists(t, filepath.Join(modelDir, rwkvlm.DefaultOutputFilename))
+}
+
+func TestCleanup(t *testing.T) {
+	newConvertedModel := func(t *testing.T) string {
+		dir := t.TempDir()
+		require.NoError(t, rwkvlmtest.WriteTorchModel(dir, rwkvlmtest.DefaultConfig, 1))
+		require.NoError(t, convert(dir, rwkvlm.DefaultOutputFilename, "float32", false, false))
+		return dir
+	}
+
+	t.Run("converted model", func(t *testing.T) {
+		dir := newConvertedModel(t)
+		require.NoError(t, cleanup(dir, rwkvlm.DefaultOutputFilename))
+		assert.NoFileExists(t, filepath.Join(dir, rwkvlm.DefaultPyModelFilename))
+		assert.FileExists(t, filepath.Join(dir, rwkvlm.DefaultOutputFilename))
+		assert.FileExists(t, filepath.Join(dir, "config.json"))
+	})
+
+	t.Run("without cleanup", func(t *testing.T) {
+		dir := newConvertedModel(t)
+		assert.FileExists(t, filepath.Join(dir, rwkvlm.DefaultPyModelFilename))
+	})
+
+	t.Run("invalid converted model", func(t *testing.T) {
+		dir := newConvertedModel(t)
+		require.NoError(t, os.Truncate(filepath.Join(dir, rwkvlm.DefaultOutputFilename), 10))
+		require.Error(t, cleanup(dir, rwkvlm.DefaultOutputFilename))
+		assert.FileExists(t, filepath.Join(dir, rwkvlm.DefaultPyModelFilename))
+	})
+}
+
+func TestNewApp_EnvVars(t *testing.T) {
+	t.Setenv("VERBAFLOW_MODEL_DIR", "models/org/model")
+	t.Setenv("VERBAFLOW_THREADS", "3")
+	t.Setenv("VERBAFLOW_ADDRESS", ":6000")
+	t.Setenv("VERBAFLOW_MAX_PROMPT_TOKENS", "128")
+	t.Setenv("VERBAFLOW_VALIDATE_ON_START", "true")
+	t.Setenv("VERBAFLOW_MODEL_FILE", "other.bin")
+
+	var resolved map[string]any
+	run := func(args ...string) {
+		resolved = nil
+		app := newApp()
+		for _, cmd := range app.Commands {
+			if cmd.Name == "inference" {
+				cmd.Action = func(c *cli.Context) error {
+					resolved = map[string]any{
+						"model-dir":         c.String("model-dir"),
+						"threads":           c.Int("threads"),
+						"address":           c.String("address"),
+						"max-prompt-tokens": c.Int("max-prompt-tokens"),
+						"validate-on-start": c.Bool("validate-on-start"),
+						"model-file":        c.String("model-file"),
+					}
+					return nil
+				}
+			}
+		}
+		require.NoError(t, app.Run(append([]string{"verbaflow"}, args...)))
+	}
+
+	run("inference")
+	assert.Equal(t, map[string]any{
+		"model-dir":         "models/org/model",
+		"threads":           3,
+		"address":           ":6000",
+		"max-prompt-tokens": 128,
+		"validate-on-start": true,
+		"model-file":        "other.bin",
+	}, resolved)
+
+	// the flags take precedence over the environment variables
+	run("-model-dir", "models/org/other", "inference", "-address", ":7000")
+	assert.Equal(t, "models/org/other", resolved["model-dir"])
+	assert.Equal(t, ":7000", resolved["address"])
+	assert.Equal(t, 128, resolved["max-prompt-tokens"])
+}
+
+func TestNewApp_AllFlagsHaveEnvVars(t *testing.T) {
+	app := newApp()
+	flags := app.Flags
+	for _, cmd := range app.Commands {
+		flags = append(flags, cmd.Flags...)
+	}
+	for _, f := range flags {
+		name := f.Names()[0]
+		vars := f.(cli.DocGenerationFlag).GetEnvVars()
+		require.NotEmpty(t, vars, name)
+		assert.Equal(t, envVars(name)[0], vars[0])
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"unicode/utf8"
+
+	"github.com/nlpodyssey/spago/ag"
+	"github.com/nlpodyssey/verbaflow"
+	"github.com/nlpodyssey/verbaflow/decoder"
+)
+
+const (
+	defaultSelfTestPrompt = "The capital of France is"
+	// selfTestMinLen prevents an early end of the generation, so that
+	// there are enough tokens to detect a degenerate output.
+	selfTestMinLen = 8
+	selfTestMaxLen = 32
+)
+
+// runSelfTest generates a continuation of the prompt twice with greedy
+// decoding, and checks that the output is deterministic and non-degenerate:
+// it must not be made of a single repeated token, and it must be valid UTF-8.
+// It returns the generated text.
+func runSelfTest(ctx context.Context, vf *verbaflow.VerbaFlow, prompt string) (string, error) {
+	opts := decoder.DecodingOptions{
+		MaxLen:         selfTestMaxLen,
+		MinLen:         selfTestMinLen,
+		EndTokenID:     vf.Tokenizer.ControlTokens().EosTokenID,
+		SkipEndTokenID: true,
+		Temp:           1,
+		TopP:           1,
+	}
+
+	first, err := selfTestGenerate(ctx, vf, prompt, opts)
+	if err != nil {
+		return "", err
+	}
+	second, err := selfTestGenerate(ctx, vf, prompt, opts)
+	if err != nil {
+		return "", err
+	}
+	if !reflect.DeepEqual(first, second) {
+		return "", fmt.Errorf("greedy decoding is not deterministic: %v != %v", first, second)
+	}
+
+	if last := len(first) - 1; last >= 0 && first[last] == opts.EndTokenID {
+		first = first[:last]
+	}
+	if isRepeatedToken(first) {
+		return "", fmt.Errorf("degenerate output: token %d repeated %d times", first[0], len(first))
+	}
+
+	text, err := vf.Tokenizer.ReconstructText(first)
+	if err != nil {
+		return "", fmt.Errorf("failed to reconstruct the generated text: %w", err)
+	}
+	if !utf8.ValidString(text) {
+		return "", fmt.Errorf("the generated text is not valid UTF-8: %q", text)
+	}
+	return text, nil
+}
+
+func selfTestGenerate(ctx context.Context, vf *verbaflow.VerbaFlow, prompt string, opts decoder.DecodingOptions) ([]int, error) {
+	nt := &ag.NodesTracker{}
+	defer nt.ReleaseNodes()
+
+	chGen := make(chan decoder.GeneratedToken, opts.MaxLen)
+	if err := vf.Generate(ctx, nt, prompt, chGen, opts); err != nil {
+		return nil, err
+	}
+	var ids []int
+	for gen := range chGen {
+		ids = append(ids, gen.TokenID)
+	}
+	return ids, nil
+}
+
+// isRepeatedToken reports whether the sequence is made of more than one
+// token, all equal.
+func isRepeatedToken(ids []int) bool {
+	if len(ids) < 2 {
+		return false
+	}
+	for _, id := range ids[1:] {
+		if id != ids[0] {
+			return false
+		}
+	}
+	return true
+}
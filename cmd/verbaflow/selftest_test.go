@@ -0,0 +1,36 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nlpodyssey/verbaflow"
+	"github.com/nlpodyssey/verbaflow/rwkvlm/rwkvlmtest"
+	"github.com/nlpodyssey/verbaflow/tokenizer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunSelfTest(t *testing.T) {
+	tk, err := tokenizer.Load("../../testdata/tiny-model")
+	require.NoError(t, err)
+	vf := &verbaflow.VerbaFlow{
+		Model:     rwkvlmtest.NewModel(rwkvlmtest.DefaultConfig, 1),
+		Tokenizer: tk,
+	}
+
+	sample, err := runSelfTest(context.Background(), vf, "unrelated")
+	require.NoError(t, err)
+	assert.NotEmpty(t, sample)
+}
+
+func TestIsRepeatedToken(t *testing.T) {
+	assert.False(t, isRepeatedToken(nil))
+	assert.False(t, isRepeatedToken([]int{3}))
+	assert.False(t, isRepeatedToken([]int{3, 3, 4}))
+	assert.True(t, isRepeatedToken([]int{3, 3, 3}))
+}
@@ -0,0 +1,131 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package verbaflow
+
+import (
+	"context"
+	"fmt"
+	"math"
+
+	"github.com/nlpodyssey/rwkv"
+	"github.com/nlpodyssey/spago/ag"
+	"github.com/nlpodyssey/spago/mat"
+	"github.com/nlpodyssey/verbaflow/decoder"
+)
+
+// Divergence reports where the greedy outputs of two models for a prompt
+// start to differ.
+type Divergence struct {
+	// PromptIndex is the index of the prompt among the compared ones.
+	PromptIndex int
+	// Position is the index of the first generated token which differs.
+	Position int
+	// TokenA and TokenB are the tokens generated at Position by each model.
+	TokenA, TokenB int
+	// MaxLogitDiff is the maximum absolute difference between the logits
+	// predicted by the two models at Position.
+	MaxLogitDiff float64
+	// MaxProbDiff is the maximum absolute difference between the
+	// probabilities predicted by the two models at Position.
+	MaxProbDiff float64
+}
+
+// CompareModels runs the greedy decoding of each prompt on both models,
+// reporting where their outputs diverge, if they do. It is meant to validate
+// a new conversion of a model, such as a float16 one, against a reference.
+//
+// The prompts are tokenized by a, so the models must share the vocabulary.
+// Only the MaxLen, EndTokenID and AddBOS options are used: the decoding of a
+// prompt stops after MaxLen tokens, or when both models predict the end token.
+func CompareModels(ctx context.Context, a, b *VerbaFlow, prompts []string, opts decoder.DecodingOptions) ([]Divergence, error) {
+	if a.Model.Config.VocabSize != b.Model.Config.VocabSize {
+		return nil, fmt.Errorf("the models have different vocabulary sizes: %d and %d",
+			a.Model.Config.VocabSize, b.Model.Config.VocabSize)
+	}
+	if opts.MaxLen <= 0 {
+		return nil, fmt.Errorf("invalid MaxLen value: %d. Must be > 0", opts.MaxLen)
+	}
+
+	var divergences []Divergence
+	for i, prompt := range prompts {
+		tokenized, err := a.TokenizePrompt(prompt, opts.AddBOS)
+		if err != nil {
+			return nil, err
+		}
+		if len(tokenized) == 0 {
+			return nil, fmt.Errorf("prompt %d is empty", i)
+		}
+		div, err := compareGreedy(ctx, a, b, tokenized, opts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compare the models on prompt %d: %w", i, err)
+		}
+		if div != nil {
+			div.PromptIndex = i
+			divergences = append(divergences, *div)
+		}
+	}
+	return divergences, nil
+}
+
+// compareGreedy decodes the tokenized prompt on both models, returning the
+// first divergence, or nil.
+func compareGreedy(ctx context.Context, a, b *VerbaFlow, tokenized []int, opts decoder.DecodingOptions) (*Divergence, error) {
+	xa, sa := a.Model.Encode(ctx, nil, tokenized...)
+	xb, sb := b.Model.Encode(ctx, nil, tokenized...)
+
+	nt := &ag.NodesTracker{}
+	defer func() {
+		// the whole graph is released, so the last step must be computed
+		waitForValues(xa, sa)
+		waitForValues(xb, sb)
+		nt.ReleaseNodes()
+	}()
+
+	for pos := 0; pos < opts.MaxLen; pos++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		la := nt.TrackNode(a.Model.Predict(xa)).Value()
+		lb := nt.TrackNode(b.Model.Predict(xb)).Value()
+		ta, tb := la.ArgMax(), lb.ArgMax()
+		if ta != tb {
+			return &Divergence{
+				Position:     pos,
+				TokenA:       ta,
+				TokenB:       tb,
+				MaxLogitDiff: maxAbsDiff(la, lb),
+				MaxProbDiff:  maxAbsDiff(decoder.TemperedSoftmax(la, 1), decoder.TemperedSoftmax(lb, 1)),
+			}, nil
+		}
+		if ta == opts.EndTokenID {
+			break
+		}
+		xa, sa = a.Model.StepToken(ctx, ta, sa)
+		xb, sb = b.Model.StepToken(ctx, tb, sb)
+	}
+	return nil, nil
+}
+
+// waitForValues waits for the values of the hidden representation and the
+// state to be computed.
+func waitForValues(x ag.Node, s rwkv.State) {
+	x.Value()
+	for _, layer := range s {
+		for _, n := range []ag.Node{layer.FfnXX, layer.AttXX, layer.AttAA, layer.AttBB, layer.AttPP} {
+			n.Value()
+		}
+	}
+}
+
+// maxAbsDiff returns the maximum absolute difference between the values of
+// two vectors of the same size.
+func maxAbsDiff(a, b mat.Matrix) float64 {
+	bData := b.Data().F64()
+	diff := 0.0
+	for i, v := range a.Data().F64() {
+		diff = math.Max(diff, math.Abs(v-bData[i]))
+	}
+	return diff
+}
@@ -0,0 +1,76 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package verbaflow
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nlpodyssey/spago/ag"
+	"github.com/nlpodyssey/verbaflow/decoder"
+	"github.com/nlpodyssey/verbaflow/rwkvlm/rwkvlmtest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompareModels(t *testing.T) {
+	ctx := context.Background()
+	opts := decoder.DecodingOptions{MaxLen: 8, EndTokenID: -1, Temp: 1, TopP: 1}
+	prompts := []string{"unrelated", "related unrelated"}
+
+	a := newTestVerbaFlow(t)
+	b := newTestVerbaFlow(t)
+	divergences, err := CompareModels(ctx, a, b, prompts, opts)
+	require.NoError(t, err)
+	assert.Empty(t, divergences)
+
+	// the greedy output of the first prompt
+	tokenized, err := a.TokenizePrompt(prompts[0], false)
+	require.NoError(t, err)
+	nt := &ag.NodesTracker{}
+	defer nt.ReleaseNodes()
+	chGen := make(chan decoder.GeneratedToken, opts.MaxLen)
+	require.NoError(t, a.GenerateFromTokens(ctx, nt, tokenized, chGen, opts))
+	var output []int
+	for gen := range chGen {
+		output = append(output, gen.TokenID)
+	}
+
+	// the output rows of the first generated token differing from the
+	// initial one and of an unused token are swapped, so that the outputs
+	// diverge where it is generated
+	pos := 1
+	for output[pos] == output[0] {
+		pos++
+	}
+	unused := 0
+	for unused == output[0] || unused == output[pos] {
+		unused++
+	}
+	b.Model = rwkvlmtest.NewModel(rwkvlmtest.DefaultConfig, 1)
+	w := b.Model.Linear.Value()
+	for c := 0; c < w.Columns(); c++ {
+		v, u := w.ScalarAt(output[pos], c), w.ScalarAt(unused, c)
+		w.SetScalar(output[pos], c, u)
+		w.SetScalar(unused, c, v)
+	}
+
+	divergences, err = CompareModels(ctx, a, b, prompts[:1], opts)
+	require.NoError(t, err)
+	require.Len(t, divergences, 1)
+	div := divergences[0]
+	assert.Equal(t, 0, div.PromptIndex)
+	assert.Equal(t, pos, div.Position)
+	assert.Equal(t, output[pos], div.TokenA)
+	assert.Equal(t, unused, div.TokenB)
+	assert.Greater(t, div.MaxLogitDiff, 0.0)
+	assert.Greater(t, div.MaxProbDiff, 0.0)
+
+	b.Model = rwkvlmtest.NewModel(rwkvlmtest.DefaultConfig, 2)
+	_, err = CompareModels(ctx, a, b, []string{""}, opts)
+	assert.Error(t, err)
+	_, err = CompareModels(ctx, a, b, prompts, decoder.DecodingOptions{})
+	assert.Error(t, err)
+}
@@ -0,0 +1,67 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package verbaflow
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/nlpodyssey/verbaflow/decoder"
+)
+
+// Continuation is an opaque handle to the saved state of a generation, such
+// as one stopped by MaxLen, which allows GenerateContinue to generate more
+// tokens without encoding the prompt and the generated tokens again.
+//
+// A Continuation is not safe for concurrent use.
+type Continuation struct {
+	conv *Conversation
+}
+
+// GenerateResumable is like GenerateFromTokens, but keeps the state of the
+// model at the end of the generation, returning a Continuation of it.
+func (vf *VerbaFlow) GenerateResumable(ctx context.Context, tokenized []int, chGen chan decoder.GeneratedToken, opts decoder.DecodingOptions) (*Continuation, error) {
+	c := vf.NewConversation()
+	if err := c.reply(ctx, tokenized, chGen, opts); err != nil {
+		return nil, err
+	}
+	return &Continuation{conv: c}, nil
+}
+
+// GenerateContinue resumes the generation of the handle from its saved
+// state, sending at most additionalLen more tokens to chGen, which is closed
+// at the end, even in case of error. With greedy decoding, the tokens are the
+// same that a larger MaxLen would have generated in the first place.
+//
+// The other options apply to the continuation alone: for example, MinLen
+// counts only the new tokens, while AddBOS is ignored.
+// The handle is advanced to the end of the continuation, so it can be
+// continued again. In case of error, it can't be used anymore.
+func (vf *VerbaFlow) GenerateContinue(ctx context.Context, handle *Continuation, additionalLen int, chGen chan decoder.GeneratedToken, opts decoder.DecodingOptions) error {
+	if err := vf.checkContinuation(handle, additionalLen); err != nil {
+		close(chGen)
+		return err
+	}
+	opts.MaxLen = additionalLen
+	return handle.conv.reply(ctx, nil, chGen, opts)
+}
+
+// checkContinuation checks that the handle can be continued by the given
+// number of tokens.
+func (vf *VerbaFlow) checkContinuation(handle *Continuation, additionalLen int) error {
+	if handle == nil || handle.conv.vf != vf {
+		return fmt.Errorf("invalid continuation: it must be returned by the same VerbaFlow")
+	}
+	if handle.conv.state == nil {
+		return fmt.Errorf("invalid continuation: its generation failed")
+	}
+	if len(handle.conv.pending) == 0 {
+		return fmt.Errorf("invalid continuation: no token was generated")
+	}
+	if additionalLen <= 0 {
+		return fmt.Errorf("invalid additional length %d: must be > 0", additionalLen)
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package verbaflow
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nlpodyssey/spago/ag"
+	"github.com/nlpodyssey/verbaflow/decoder"
+	"github.com/nlpodyssey/verbaflow/rwkvlm/rwkvlmtest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerbaFlow_GenerateContinue(t *testing.T) {
+	vf := newTestVerbaFlow(t)
+	vf.Model = rwkvlmtest.NewModel(rwkvlmtest.DefaultConfig, 2)
+	opts := decoder.DecodingOptions{
+		MaxLen:     8,
+		EndTokenID: -1,
+		Temp:       1,
+		TopP:       1,
+		AddBOS:     true,
+	}
+	ctx := context.Background()
+	collect := func(chGen chan decoder.GeneratedToken) []int {
+		var ids []int
+		for gen := range chGen {
+			ids = append(ids, gen.TokenID)
+		}
+		return ids
+	}
+
+	tokenized, err := vf.TokenizePrompt("unrelated", opts.AddBOS)
+	require.NoError(t, err)
+
+	nt := &ag.NodesTracker{}
+	defer nt.ReleaseNodes()
+	chGen := make(chan decoder.GeneratedToken, opts.MaxLen)
+	require.NoError(t, vf.GenerateFromTokens(ctx, nt, tokenized, chGen, opts))
+	expected := collect(chGen)
+	require.Len(t, expected, 8)
+
+	short := opts
+	short.MaxLen = 3
+	chGen = make(chan decoder.GeneratedToken, opts.MaxLen)
+	handle, err := vf.GenerateResumable(ctx, tokenized, chGen, short)
+	require.NoError(t, err)
+	actual := collect(chGen)
+	assert.Equal(t, expected[:3], actual)
+
+	// the handle can be continued more than once
+	for _, n := range []int{4, 1} {
+		chGen = make(chan decoder.GeneratedToken, opts.MaxLen)
+		require.NoError(t, vf.GenerateContinue(ctx, handle, n, chGen, opts))
+		actual = append(actual, collect(chGen)...)
+	}
+	assert.Equal(t, expected, actual)
+
+	assert.Error(t, vf.GenerateContinue(ctx, handle, 0, make(chan decoder.GeneratedToken), opts))
+	assert.Error(t, newTestVerbaFlow(t).GenerateContinue(ctx, handle, 1, make(chan decoder.GeneratedToken), opts))
+}
@@ -0,0 +1,117 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package verbaflow
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/nlpodyssey/rwkv"
+	"github.com/nlpodyssey/spago/ag"
+	"github.com/nlpodyssey/verbaflow/decoder"
+)
+
+// Conversation generates the replies to a sequence of turns, keeping the
+// RWKV state across them, so that the model remembers the previous turns
+// and replies without encoding the whole history again.
+//
+// A Conversation is not safe for concurrent use.
+type Conversation struct {
+	vf    *VerbaFlow
+	state rwkv.State
+	// pending contains the last token generated in the previous reply,
+	// which the decoder doesn't encode.
+	pending []int
+	// encoded is the number of tokens encoded by the last call to Reply.
+	encoded int
+}
+
+// NewConversation returns a new empty Conversation.
+func (vf *VerbaFlow) NewConversation() *Conversation {
+	return &Conversation{vf: vf}
+}
+
+// Reply appends the given text to the conversation and generates the reply,
+// which is sent to chGen, closed at the end even in case of error, and
+// appended as well.
+// The beginning-of-sequence token is only added to the first turn, if
+// requested by the options.
+//
+// In case of error, the conversation is reset.
+func (c *Conversation) Reply(ctx context.Context, text string, chGen chan decoder.GeneratedToken, opts decoder.DecodingOptions) error {
+	tokenized, err := c.vf.TokenizePrompt(text, opts.AddBOS && c.state == nil)
+	if err != nil {
+		close(chGen)
+		return err
+	}
+	return c.reply(ctx, tokenized, chGen, opts)
+}
+
+// reply is like Reply, but takes an already tokenized turn.
+func (c *Conversation) reply(ctx context.Context, tokenized []int, chGen chan decoder.GeneratedToken, opts decoder.DecodingOptions) error {
+	tokens := append(c.pending, tokenized...)
+	if len(tokens) == 0 {
+		close(chGen)
+		return fmt.Errorf("the first turn of a conversation can't be empty")
+	}
+
+	d, err := c.vf.newDecoder(opts)
+	if err != nil {
+		close(chGen)
+		return err
+	}
+
+	// the nodes of the previous turns must not be released, so the final
+	// state is detached from the graph before the release
+	nt := &ag.NodesTracker{}
+	defer nt.ReleaseNodes()
+
+	input, err := c.vf.encode(ctx, c.state, tokens)
+	if err != nil {
+		close(chGen)
+		c.Reset()
+		return err
+	}
+	c.encoded = len(tokens)
+
+	err = d.DecodeToChannel(ctx, nt, input, chGen)
+	if err != nil {
+		c.Reset()
+		return err
+	}
+
+	c.state = detachState(input.State)
+	c.pending = nil
+	if seq := d.Sequence(); len(seq) > 0 {
+		c.pending = []int{seq[len(seq)-1]}
+	}
+	return nil
+}
+
+// Reset clears the conversation, so that the next turn is the first one.
+func (c *Conversation) Reset() {
+	c.state = nil
+	c.pending = nil
+	c.encoded = 0
+}
+
+// detachState returns a copy of the state made of the values of its nodes,
+// which is not affected by the release of the graph that computed it.
+func detachState(s rwkv.State) rwkv.State {
+	detach := func(n ag.Node) ag.Node {
+		return ag.Var(n.Value().Clone())
+	}
+	out := make(rwkv.State, len(s))
+	for i, layer := range s {
+		out[i] = &rwkv.LayerState{
+			FfnXX: detach(layer.FfnXX),
+			AttXX: detach(layer.AttXX),
+			AttAA: detach(layer.AttAA),
+			AttBB: detach(layer.AttBB),
+			AttPP: detach(layer.AttPP),
+		}
+	}
+	return out
+}
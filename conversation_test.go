@@ -0,0 +1,79 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package verbaflow
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nlpodyssey/spago/ag"
+	"github.com/nlpodyssey/verbaflow/decoder"
+	"github.com/nlpodyssey/verbaflow/rwkvlm/rwkvlmtest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConversation_Reply(t *testing.T) {
+	vf := newTestVerbaFlow(t)
+	// a model whose replies depend on the previous turns
+	vf.Model = rwkvlmtest.NewModel(rwkvlmtest.DefaultConfig, 2)
+	opts := decoder.DecodingOptions{
+		MaxLen:     4,
+		MinLen:     4,
+		EndTokenID: vf.Tokenizer.ControlTokens().EosTokenID,
+		Temp:       1,
+		TopP:       1,
+	}
+	reply := func(c *Conversation, text string) []int {
+		chGen := make(chan decoder.GeneratedToken, opts.MaxLen)
+		require.NoError(t, c.Reply(context.Background(), text, chGen, opts))
+		var ids []int
+		for gen := range chGen {
+			ids = append(ids, gen.TokenID)
+		}
+		require.Len(t, ids, opts.MaxLen)
+		return ids
+	}
+
+	turn, err := vf.TokenizePrompt("unrelated", false)
+	require.NoError(t, err)
+
+	c := vf.NewConversation()
+	first := reply(c, "unrelated")
+	assert.Equal(t, len(turn), c.encoded)
+
+	second := reply(c, "unrelated")
+	// only the last token of the first reply and the new turn are encoded
+	assert.Equal(t, 1+len(turn), c.encoded)
+
+	// the second reply is the same as encoding the whole history at once
+	var history []int
+	history = append(history, turn...)
+	history = append(history, first...)
+	history = append(history, turn...)
+	nt := &ag.NodesTracker{}
+	defer nt.ReleaseNodes()
+	chGen := make(chan decoder.GeneratedToken, opts.MaxLen)
+	require.NoError(t, vf.GenerateFromTokens(context.Background(), nt, history, chGen, opts))
+	var expected []int
+	for gen := range chGen {
+		expected = append(expected, gen.TokenID)
+	}
+	assert.Equal(t, expected, second)
+	assert.NotEqual(t, first, second)
+
+	c.Reset()
+	assert.Equal(t, first, reply(c, "unrelated"))
+	assert.Equal(t, len(turn), c.encoded)
+}
+
+func TestConversation_EmptyFirstTurn(t *testing.T) {
+	vf := newTestVerbaFlow(t)
+	chGen := make(chan decoder.GeneratedToken, 1)
+	err := vf.NewConversation().Reply(context.Background(), "", chGen, decoder.DecodingOptions{MaxLen: 1})
+	assert.Error(t, err)
+	_, ok := <-chGen
+	assert.False(t, ok, "chGen must be closed")
+}
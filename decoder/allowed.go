@@ -0,0 +1,36 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package decoder
+
+import (
+	"github.com/nlpodyssey/spago/mat"
+)
+
+var _ LogitsProcessor = &AllowedTokens{}
+
+// AllowedTokens is a LogitsProcessor which restricts the generation to a
+// fixed set of tokens, for example the labels of a classification.
+type AllowedTokens struct {
+	allowed map[int]struct{}
+}
+
+// NewAllowedTokens returns a new AllowedTokens allowing only the given
+// token IDs. The end token must be among them for the generation to stop
+// before MaxLen.
+func NewAllowedTokens(tokenIDs []int) *AllowedTokens {
+	allowed := make(map[int]struct{}, len(tokenIDs))
+	for _, id := range tokenIDs {
+		allowed[id] = struct{}{}
+	}
+	return &AllowedTokens{allowed: allowed}
+}
+
+// Process satisfies the LogitsProcessor interface.
+func (p *AllowedTokens) Process(_ []int, logits mat.Matrix) (mat.Matrix, error) {
+	return maskLogits(logits, func(id int) bool {
+		_, ok := p.allowed[id]
+		return ok
+	}), nil
+}
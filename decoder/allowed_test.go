@@ -0,0 +1,41 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package decoder
+
+import (
+	"testing"
+
+	"github.com/nlpodyssey/verbaflow/rwkvlm/rwkvlmtest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAllowedTokens_Decode(t *testing.T) {
+	m := rwkvlmtest.NewModel(rwkvlmtest.DefaultConfig, 1)
+	allowed := []int{3, 5, 9}
+	opts := DecodingOptions{MaxLen: 50, EndTokenID: -1, Temp: 1, TopP: 1, UseSampling: true, AllowedTokenIDs: allowed}
+	d, err := New(m, opts)
+	require.NoError(t, err)
+
+	ids := tokenIDs(decodeAll(t, m, d, []int{1, 2}))
+	require.Len(t, ids, 50)
+	for _, id := range ids {
+		assert.Contains(t, allowed, id)
+	}
+
+	// with greedy decoding, the most probable allowed token is generated
+	opts.UseSampling = false
+	opts.AllowedTokenIDs = []int{4}
+	d, err = New(m, opts)
+	require.NoError(t, err)
+	assert.Equal(t, []int{4, 4, 4}, tokenIDs(decodeAll(t, m, d, []int{1, 2}))[:3])
+}
+
+func TestNew_InvalidAllowedTokenIDs(t *testing.T) {
+	for _, id := range []int{-1, 4} {
+		_, err := New(newFlatModel(4), DecodingOptions{Temp: 1, TopP: 1, AllowedTokenIDs: []int{0, id}})
+		assert.Error(t, err)
+	}
+}
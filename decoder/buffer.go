@@ -0,0 +1,117 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package decoder
+
+import (
+	"context"
+	"fmt"
+)
+
+// Buffer receives the tokens generated by the decoder, one per step.
+type Buffer interface {
+	// Put adds the token generated at the current step.
+	// It may block until the token can be accepted, but it must return
+	// the context error as soon as the context is done.
+	Put(ctx context.Context, token GeneratedToken) error
+	// Close is called once, when the generation is over.
+	Close() error
+}
+
+var _ Buffer = ChannelBuffer(nil)
+
+// ChannelBuffer is a Buffer which streams the generated tokens through a
+// channel, closing it at the end of the generation.
+//
+// The channel is meant to have a small capacity: once it is full, the decoder
+// blocks until the receiver catches up, so that a slow consumer slows down
+// the generation, instead of letting the tokens pile up in memory.
+type ChannelBuffer chan GeneratedToken
+
+// NewChannelBuffer returns a new ChannelBuffer with the given capacity.
+func NewChannelBuffer(size int) ChannelBuffer {
+	return make(ChannelBuffer, size)
+}
+
+// Put sends the token to the channel, waiting for the receiver if the channel
+// is full. It returns the context error if the context is done first.
+func (b ChannelBuffer) Put(ctx context.Context, token GeneratedToken) error {
+	select {
+	case b <- token:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close closes the channel.
+func (b ChannelBuffer) Close() error {
+	close(b)
+	return nil
+}
+
+var _ Buffer = DropOldestChannelBuffer(nil)
+
+// DropOldestChannelBuffer is like ChannelBuffer, but when the channel is full
+// it discards the oldest token in the channel instead of waiting, so that a
+// slow receiver, such as a live view only interested in the latest tokens,
+// never slows down the generation. The memory is bounded by the capacity of
+// the channel, which must be greater than zero.
+type DropOldestChannelBuffer chan GeneratedToken
+
+// Put sends the token to the channel, discarding the oldest one if the
+// channel is full. It only returns an error if the context is done.
+func (b DropOldestChannelBuffer) Put(ctx context.Context, token GeneratedToken) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	for {
+		select {
+		case b <- token:
+			return nil
+		default:
+		}
+		// the channel is full: discard the oldest token, unless the
+		// receiver has just taken it
+		select {
+		case <-b:
+		default:
+		}
+	}
+}
+
+// Close closes the channel.
+func (b DropOldestChannelBuffer) Close() error {
+	close(b)
+	return nil
+}
+
+// DropPolicy tells how a channel of generated tokens handles a slow receiver.
+type DropPolicy string
+
+const (
+	// DropPolicyBlock waits for the receiver, slowing down the generation,
+	// so that no token is lost. See ChannelBuffer.
+	DropPolicyBlock DropPolicy = "block"
+	// DropPolicyDropOldest discards the oldest token in the channel when it
+	// is full, so that the receiver only gets the latest tokens.
+	// See DropOldestChannelBuffer.
+	DropPolicyDropOldest DropPolicy = "drop-oldest"
+)
+
+// channelBuffer returns the Buffer which sends the tokens to ch according
+// to the policy.
+func (p DropPolicy) channelBuffer(ch chan GeneratedToken) (Buffer, error) {
+	switch p {
+	case DropPolicyBlock:
+		return ChannelBuffer(ch), nil
+	case DropPolicyDropOldest:
+		if cap(ch) == 0 {
+			return nil, fmt.Errorf("the %q drop policy requires a buffered channel", p)
+		}
+		return DropOldestChannelBuffer(ch), nil
+	default:
+		return nil, fmt.Errorf("invalid drop policy %q: must be %q or %q", p, DropPolicyBlock, DropPolicyDropOldest)
+	}
+}
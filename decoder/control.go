@@ -5,7 +5,6 @@
 package decoder
 
 import (
-	"container/heap"
 	"fmt"
 	"math"
 	"sort"
@@ -20,48 +19,190 @@ import (
 // before using greedy decoding or multinomial sampling to generate the final output.
 type OutputDiversityControlFunc func(logits mat.Matrix) (mat.Matrix, error)
 
-// OutputDiversityControl returns a function used to select the next token.
-func OutputDiversityControl(temp float64, topK int, topP float64) (OutputDiversityControlFunc, error) {
-	if temp < 0 || temp > 1 {
-		return nil, fmt.Errorf("invalid temperature value: %f. Must be between 0 and 1", temp)
+// OutputDiversityControl returns a function used to select the next token,
+// applying the controls set by the options: Temp, TopK, TopP, MinKeep,
+// LogitClamp, TypicalP, Epsilon and Eta.
+//
+// The temperature is not applied to the returned logits: it only affects the
+// probabilities used by the top-p filter. The OutputSelection applies it,
+// together with the normalization, so that the logits are scaled only once.
+//
+// If LogitClamp is positive, the logits are first clipped to the range
+// [-LogitClamp, LogitClamp], so that a few outliers, as predicted by some
+// borderline conversions, can't take all the probability. The logits removed
+// by the logits processors, that is -Inf, are kept as they are.
+//
+// If TypicalP is between 0 and 1, exclusive, the locally typical sampling
+// filter follows top-k and top-p: see TypicalFunc. Then, if positive,
+// Epsilon and Eta apply the cutoffs of EpsilonFunc and EtaFunc.
+//
+// The filters keep at least MinKeep candidates (or one, if MinKeep is zero):
+// TopK is raised to MinKeep, and if the filters leave fewer candidates, for
+// example because of a tiny TopP, the most probable ones are restored.
+//
+// The logits are copied once, since they can be the value of a node of the
+// graph, and the controls are applied in place on the copy, reusing the same
+// buffers at each call. Therefore, the returned matrix is only valid until
+// the next call, and the function is not safe for concurrent use.
+func OutputDiversityControl(opts DecodingOptions) (OutputDiversityControlFunc, error) {
+	if err := validateOutputDiversityControl(opts); err != nil {
+		return nil, err
 	}
-	if topK < 0 {
-		return nil, fmt.Errorf("invalid topK value: %d. Must be >= 0", topK)
+	temp, topK, topP, minKeep := opts.Temp, opts.TopK, opts.TopP, opts.MinKeep
+	logitClamp, typicalP, epsilon, eta := opts.LogitClamp, opts.TypicalP, opts.Epsilon, opts.Eta
+
+	if temp == 0 {
+		log.Trace().Msgf("Temperature is 0, setting it to %v to avoid division by zero", minTemperature)
+	}
+	temp = effectiveTemperature(temp)
+
+	if minKeep == 0 {
+		minKeep = 1
 	}
-	if topP < 0 || topP > 1 {
-		return nil, fmt.Errorf("invalid topP value: %f. Must be between 0 and 1", topP)
+	if topK != 0 && topK < minKeep {
+		log.Trace().Int("topK", topK).Int("minKeep", minKeep).Msg("Raising topK to minKeep")
+		topK = minKeep
 	}
 
-	result := make([]OutputDiversityControlFunc, 0, 3)
-	if temp != 1 {
-		log.Trace().Float64("temperature", temp).Msg("Applying temperature control")
-		if temp == 0 {
-			log.Trace().Msg("Temperature is 0, setting it to 0.01 to avoid division by zero")
-			temp = 0.01 // avoid division by zero
-		}
-		result = append(result, TemperatureFunc(temp))
+	steps := make([]func(scores mat.Matrix), 0, 6)
+	if logitClamp > 0 {
+		log.Trace().Float64("logitClamp", logitClamp).Msg("Applying logit clamp")
+		steps = append(steps, clampInPlace(logitClamp))
 	}
 	if topK != 0 {
 		log.Trace().Int("topK", topK).Msg("Applying topK control")
-		result = append(result, TopKFunc(topK, math.Inf(-1)))
+		steps = append(steps, topKInPlace(topK, math.Inf(-1)))
 	}
 	if topP != 1 {
 		log.Trace().Float64("topP", topP).Msg("Applying topP control")
-		result = append(result, TopPFunc(topP, math.Inf(-1), 1)) // minSize = 2 if beam search is enabled
+		steps = append(steps, topPInPlace(topP, temp, math.Inf(-1), 1)) // minSize = 2 if beam search is enabled
+	}
+	if typicalP > 0 && typicalP < 1 {
+		log.Trace().Float64("typicalP", typicalP).Msg("Applying typical control")
+		steps = append(steps, typicalInPlace(typicalP, temp, math.Inf(-1)))
+	}
+	if epsilon > 0 {
+		log.Trace().Float64("epsilon", epsilon).Msg("Applying epsilon control")
+		steps = append(steps, cutoffInPlace(epsilonCutoff(epsilon), temp, math.Inf(-1)))
+	}
+	if eta > 0 {
+		log.Trace().Float64("eta", eta).Msg("Applying eta control")
+		steps = append(steps, cutoffInPlace(etaCutoff(eta), temp, math.Inf(-1)))
 	}
 
-	return func(logits mat.Matrix) (mat.Matrix, error) {
-		var err error
-		for _, p := range result {
-			logits, err = p(logits)
-			if err != nil {
-				return nil, err
+	if len(steps) == 0 {
+		return func(logits mat.Matrix) (mat.Matrix, error) {
+			if !hasCandidates(logits) {
+				return nil, errNoCandidates
 			}
+			return logits, nil
+		}, nil
+	}
+
+	var buf []float64
+
+	var out mat.Matrix
+	return func(logits mat.Matrix) (mat.Matrix, error) {
+		if out == nil || !mat.SameDims(out, logits) {
+			out = logits.Clone()
+		} else {
+			out.SetData(logits.Data())
 		}
-		return logits, err
+		for _, step := range steps {
+			step(out)
+		}
+		buf = copyScores(buf, out)
+		kept := countCandidates(buf)
+		if kept >= minKeep {
+			return out, nil
+		}
+
+		buf = copyScores(buf, logits)
+		available := countCandidates(buf)
+		if available == 0 {
+			return nil, errNoCandidates
+		}
+		if kept == available {
+			// the filters removed nothing, there are just fewer candidates
+			return out, nil
+		}
+		log.Warn().Int("kept", kept).Int("minKeep", minKeep).Msg("The output diversity controls removed too many tokens, restoring the most probable ones")
+		minScore := kthLargest(buf, minKeep)
+		out.SetData(logits.Data())
+		out.ApplyInPlace(func(_, _ int, v float64) float64 {
+			if v < minScore || math.IsInf(v, -1) {
+				return math.Inf(-1)
+			}
+			return v
+		}, out)
+		return out, nil
 	}, nil
 }
 
+// validateOutputDiversityControl checks the options of the output diversity
+// controls.
+func validateOutputDiversityControl(opts DecodingOptions) error {
+	if opts.Temp < 0 || opts.Temp > 1 {
+		return fmt.Errorf("invalid temperature value: %f. Must be between 0 and 1", opts.Temp)
+	}
+	if opts.TopK < 0 {
+		return fmt.Errorf("invalid topK value: %d. Must be >= 0", opts.TopK)
+	}
+	if opts.TopP < 0 || opts.TopP > 1 {
+		return fmt.Errorf("invalid topP value: %f. Must be between 0 and 1", opts.TopP)
+	}
+	if opts.MinKeep < 0 {
+		return fmt.Errorf("invalid minKeep value: %d. Must be >= 0", opts.MinKeep)
+	}
+	if opts.LogitClamp < 0 {
+		return fmt.Errorf("invalid logitClamp value: %f. Must be >= 0", opts.LogitClamp)
+	}
+	if opts.TypicalP < 0 || opts.TypicalP > 1 {
+		return fmt.Errorf("invalid typicalP value: %f. Must be between 0 and 1", opts.TypicalP)
+	}
+	if opts.Epsilon < 0 || opts.Epsilon >= 1 {
+		return fmt.Errorf("invalid epsilon value: %f. Must be >= 0 and < 1", opts.Epsilon)
+	}
+	if opts.Eta < 0 || opts.Eta >= 1 {
+		return fmt.Errorf("invalid eta value: %f. Must be >= 0 and < 1", opts.Eta)
+	}
+	return nil
+}
+
+// errNoCandidates is returned when no token can be selected, since all the
+// logits are -Inf.
+var errNoCandidates = fmt.Errorf("no candidate tokens: all the logits have been filtered out, likely by conflicting logits processors")
+
+// countCandidates returns the number of scores greater than -Inf, that is, of
+// the tokens which can still be selected.
+func countCandidates(scores []float64) int {
+	n := 0
+	for _, v := range scores {
+		if v > math.Inf(-1) {
+			n++
+		}
+	}
+	return n
+}
+
+// hasCandidates reports whether any of the scores is greater than -Inf,
+// reading them in place, without copying them.
+func hasCandidates(scores mat.Matrix) bool {
+	if d, ok := scores.(*mat.Dense[float32]); ok {
+		return anyCandidate(mat.Data[float32](d))
+	}
+	return anyCandidate(mat.Data[float64](scores))
+}
+
+func anyCandidate[T float.DType](scores []T) bool {
+	for _, v := range scores {
+		if float64(v) > math.Inf(-1) {
+			return true
+		}
+	}
+	return false
+}
+
 // TemperatureFunc applies a temperature to a matrix of scores.
 func TemperatureFunc(temperature float64) OutputDiversityControlFunc {
 	if temperature == 1 {
@@ -76,27 +217,13 @@ func TemperatureFunc(temperature float64) OutputDiversityControlFunc {
 }
 
 // TopKFunc applies a top-k filter to a matrix of scores.
+// The scores already filtered out, that is -Inf, for example by a previous
+// top-p filter, are not counted among the k, and are kept as they are.
 func TopKFunc(topK int, filterValue float64) OutputDiversityControlFunc {
 	return func(scores mat.Matrix) (mat.Matrix, error) {
-		topK := topK
-		if size := scores.Size(); size <= topK {
-			topK = size
-		}
-
-		inScores := scores.Data().F64()
-
-		rawTopScores := make(sliceutils.OrderedHeap[float64], len(inScores))
-		copy(rawTopScores, inScores)
-
-		topScores := sliceutils.ReverseHeap(&rawTopScores)
-		heap.Init(topScores)
-		for i := 1; i < topK; i++ {
-			heap.Pop(topScores)
-		}
-		minScore := heap.Pop(topScores).(float64)
-
+		minScore := kthLargestCandidate(copyScores(nil, scores), topK)
 		return scores.Apply(func(_, _ int, v float64) float64 {
-			if v < minScore {
+			if v < minScore && !math.IsInf(v, -1) {
 				return filterValue
 			}
 			return v
@@ -105,45 +232,464 @@ func TopKFunc(topK int, filterValue float64) OutputDiversityControlFunc {
 }
 
 // TopPFunc applies a top-p filter to a matrix of scores.
+// The tokens with the same score as the last kept one are all kept, so that
+// the result doesn't depend on the order of the tied tokens, like TopKFunc.
 // Note that when using beam decoding (with beam > 1) then minSize must be at least 2.
 func TopPFunc[T float.DType](topP, filterValue T, minSize int) OutputDiversityControlFunc {
 	return func(scores mat.Matrix) (mat.Matrix, error) {
-		dataCopy := make([]T, scores.Size())
-		copy(dataCopy, mat.Data[T](scores))
-		sortedData := sliceutils.NewIndexedSlice[T](dataCopy)
-		sort.Stable(sort.Reverse(sortedData))
-
-		cumulativeProbs := mat.NewVecDense(sortedData.Slice).Softmax().CumSum()
-		cumProbData := mat.Data[T](cumulativeProbs)
+		f := &topPFilter{topP: float64(topP), invTemperature: 1, minSize: minSize}
+		removed := f.removedTokens(scores)
 
-		indicesToRemove := make([]bool, len(cumProbData))
-		for i, cp := range cumProbData {
-			indicesToRemove[i] = cp > topP
+		outData := make([]T, scores.Size())
+		copy(outData, mat.Data[T](scores))
+		for i, r := range removed {
+			if r {
+				outData[i] = filterValue
+			}
 		}
+		return mat.NewVecDense[T](outData), nil
+	}
+}
+
+// TypicalFunc applies a locally typical sampling filter to a matrix of scores.
+// The tokens are sorted by the absolute difference between their information
+// content, -log p, and the entropy of the distribution, and the ones after the
+// cumulative probability exceeds mass are removed, keeping the first one above
+// it. The tokens tied with the last kept one are kept too, like TopPFunc.
+func TypicalFunc[T float.DType](mass T, filterValue T) OutputDiversityControlFunc {
+	return func(scores mat.Matrix) (mat.Matrix, error) {
+		f := &typicalFilter{mass: float64(mass), invTemperature: 1}
+		removed := f.removedTokens(scores)
 
-		if minSize > 1 {
-			// Keep at least minSize (minSize-1 because we add the first one below)
-			for i := minSize - 1; i >= 0; i-- {
-				indicesToRemove[i] = false
+		outData := make([]T, scores.Size())
+		copy(outData, mat.Data[T](scores))
+		for i, r := range removed {
+			if r {
+				outData[i] = filterValue
 			}
 		}
+		return mat.NewVecDense[T](outData), nil
+	}
+}
 
-		// Shift the indices to the right to keep also the first token above the threshold
-		copy(indicesToRemove[1:], indicesToRemove[:len(indicesToRemove)-1])
-		indicesToRemove[0] = false
+// EpsilonFunc applies an epsilon sampling filter to a matrix of scores,
+// removing the tokens whose probability is below epsilon. The most probable
+// tokens are always kept.
+func EpsilonFunc[T float.DType](epsilon, filterValue T) OutputDiversityControlFunc {
+	return cutoffFunc(epsilonCutoff(float64(epsilon)), filterValue)
+}
 
-		// Scatter sorted tensors to original indexing
+// EtaFunc applies an eta sampling filter to a matrix of scores, removing the
+// tokens whose probability is below min(eta, sqrt(eta) * exp(-entropy)): the
+// cutoff is lower when the distribution has a high entropy, so that the many
+// plausible tokens are kept. The most probable tokens are always kept.
+func EtaFunc[T float.DType](eta, filterValue T) OutputDiversityControlFunc {
+	return cutoffFunc(etaCutoff(float64(eta)), filterValue)
+}
+
+// cutoffFunc returns the function applying the probability cutoff, like
+// TopPFunc.
+func cutoffFunc[T float.DType](cutoff func(probs []float64) float64, filterValue T) OutputDiversityControlFunc {
+	return func(scores mat.Matrix) (mat.Matrix, error) {
+		f := &cutoffFilter{cutoff: cutoff, invTemperature: 1}
+		removed := f.removedTokens(scores)
 
 		outData := make([]T, scores.Size())
 		copy(outData, mat.Data[T](scores))
-		for maskIndex, toRemove := range indicesToRemove {
-			if !toRemove {
-				continue
+		for i, r := range removed {
+			if r {
+				outData[i] = filterValue
 			}
-			index := sortedData.Indices[maskIndex]
-			outData[index] = filterValue
 		}
-
 		return mat.NewVecDense[T](outData), nil
 	}
 }
+
+// epsilonCutoff returns the cutoff of epsilon sampling, which is constant.
+func epsilonCutoff(epsilon float64) func(probs []float64) float64 {
+	return func([]float64) float64 {
+		return epsilon
+	}
+}
+
+// etaCutoff returns the cutoff of eta sampling, which depends on the entropy
+// of the probabilities.
+func etaCutoff(eta float64) func(probs []float64) float64 {
+	return func(probs []float64) float64 {
+		return math.Min(eta, math.Sqrt(eta)*math.Exp(-entropy(probs)))
+	}
+}
+
+// entropy returns the entropy of the probabilities, in nats.
+func entropy(probs []float64) float64 {
+	h := 0.0
+	for _, p := range probs {
+		if p > 0 {
+			h -= p * math.Log(p)
+		}
+	}
+	return h
+}
+
+// kthLargest returns the k-th largest of the values, or the smallest one if
+// k exceeds their number. The values are rearranged: the first k are used as
+// a min-heap of the largest values seen so far, so that each of the others
+// only costs a comparison with the root, unless it enters the heap.
+func kthLargest(values []float64, k int) float64 {
+	if k > len(values) {
+		k = len(values)
+	}
+	h := values[:k]
+	for i := k/2 - 1; i >= 0; i-- {
+		siftDownMin(h, i)
+	}
+	for _, v := range values[k:] {
+		if v > h[0] {
+			h[0] = v
+			siftDownMin(h, 0)
+		}
+	}
+	return h[0]
+}
+
+// kthLargestCandidate is like kthLargest, but only considers the values
+// greater than -Inf, that is, the candidates left by the previous filters, so
+// that the ones already filtered out can't lower the cutoff. It returns -Inf
+// if there are no candidates. The values are rearranged.
+func kthLargestCandidate(values []float64, k int) float64 {
+	n := 0
+	for _, v := range values {
+		if v > math.Inf(-1) {
+			values[n] = v
+			n++
+		}
+	}
+	if n == 0 {
+		return math.Inf(-1)
+	}
+	return kthLargest(values[:n], k)
+}
+
+// siftDownMin restores the min-heap property of h from the root i.
+func siftDownMin(h []float64, i int) {
+	for {
+		child := 2*i + 1
+		if child >= len(h) {
+			return
+		}
+		if child+1 < len(h) && h[child+1] < h[child] {
+			child++
+		}
+		if h[i] <= h[child] {
+			return
+		}
+		h[i], h[child] = h[child], h[i]
+		i = child
+	}
+}
+
+// topPInitialCandidates is the number of most probable tokens first sorted
+// by the top-p filter, doubled until their cumulative probability is enough.
+const topPInitialCandidates = 64
+
+// topPFilter finds the tokens removed by a top-p filter, reusing its buffers.
+//
+// Only the most probable tokens are sorted, which is much cheaper than
+// sorting the whole vocabulary, since the probability is usually
+// concentrated in a few of them.
+type topPFilter struct {
+	topP float64
+	// invTemperature is the inverse of the temperature of the probabilities.
+	invTemperature float64
+	minSize        int
+	scores         []float64
+	indices        []int
+	removed        []bool
+}
+
+// removedTokens returns a mask of the tokens to remove, indexed like the
+// scores. The tokens are sorted by decreasing probability, and the ones after
+// the cumulative probability exceeds topP are removed, keeping the first one
+// above the threshold and, if minSize > 1, at least minSize+1 tokens.
+// The tokens tied with the last kept one are kept too, whatever their
+// position in the sorting: ties at the cutoff are never split.
+// The mask is only valid until the next call.
+func (f *topPFilter) removedTokens(scores mat.Matrix) []bool {
+	f.scores = copyScores(f.scores, scores)
+	n := len(f.scores)
+	f.indices = f.indices[:0]
+	for i := 0; i < n; i++ {
+		f.indices = append(f.indices, i)
+	}
+
+	max, sum := softmaxMaxAndSum(f.scores, 1/f.invTemperature)
+	invSum := 1 / sum
+
+	keep := n
+	order := byScoreDesc{scores: f.scores, indices: f.indices}
+	for m := topPInitialCandidates; ; m *= 2 {
+		if m > n {
+			m = n
+		}
+		sliceutils.PartialSort(order, m)
+		if k, ok := f.cutoff(m, max, invSum); ok {
+			keep = k
+			break
+		}
+		if m == n {
+			break
+		}
+	}
+
+	f.removed = append(f.removed[:0], make([]bool, n)...)
+	if keep == 0 {
+		return f.removed
+	}
+	// the tokens after the first keep ones are not sorted, but none of them
+	// has a higher score than the last kept one
+	threshold := f.scores[f.indices[keep-1]]
+	for _, i := range f.indices[keep:] {
+		if f.scores[i] < threshold {
+			f.removed[i] = true
+		}
+	}
+	return f.removed
+}
+
+// cutoff returns the number of tokens to keep, if it can be told from the
+// first m sorted tokens.
+func (f *topPFilter) cutoff(m int, max, invSum float64) (int, bool) {
+	cp := 0.0
+	for i, index := range f.indices[:m] {
+		cp += math.Exp((f.scores[index]-max)*f.invTemperature) * invSum
+		if cp > f.topP && (f.minSize <= 1 || i >= f.minSize) {
+			return i + 1, true
+		}
+	}
+	return 0, false
+}
+
+// byScoreDesc sorts the indices of the tokens by decreasing score, and by
+// increasing index among equal scores, like a stable sort.
+type byScoreDesc struct {
+	scores  []float64
+	indices []int
+}
+
+func (s byScoreDesc) Len() int {
+	return len(s.indices)
+}
+
+func (s byScoreDesc) Less(i, j int) bool {
+	a, b := s.indices[i], s.indices[j]
+	return s.scores[a] > s.scores[b] || (s.scores[a] == s.scores[b] && a < b)
+}
+
+func (s byScoreDesc) Swap(i, j int) {
+	s.indices[i], s.indices[j] = s.indices[j], s.indices[i]
+}
+
+// typicalFilter finds the tokens removed by a locally typical sampling
+// filter, reusing its buffers.
+type typicalFilter struct {
+	mass float64
+	// invTemperature is the inverse of the temperature of the probabilities.
+	invTemperature float64
+	scores         []float64
+	probs          []float64
+	deviations     []float64
+	indices        []int
+	removed        []bool
+}
+
+// removedTokens returns a mask of the tokens to remove, indexed like the
+// scores, as described by TypicalFunc. The tokens already filtered out, that
+// is -Inf, have probability zero and are always removed.
+// The mask is only valid until the next call.
+func (f *typicalFilter) removedTokens(scores mat.Matrix) []bool {
+	f.scores = copyScores(f.scores, scores)
+	n := len(f.scores)
+	max, sum := softmaxMaxAndSum(f.scores, 1/f.invTemperature)
+	logSum := math.Log(sum)
+
+	// the log-probabilities are kept in deviations until the entropy is known
+	f.probs = append(f.probs[:0], make([]float64, n)...)
+	f.deviations = append(f.deviations[:0], make([]float64, n)...)
+	entropy := 0.0
+	for i, v := range f.scores {
+		logProb := (v-max)*f.invTemperature - logSum
+		f.deviations[i] = logProb
+		f.probs[i] = math.Exp(logProb)
+		if f.probs[i] > 0 {
+			entropy -= f.probs[i] * logProb
+		}
+	}
+	f.indices = f.indices[:0]
+	for i := range f.deviations {
+		f.deviations[i] = math.Abs(-f.deviations[i] - entropy)
+		f.indices = append(f.indices, i)
+	}
+	sort.Sort(byDeviationAsc{deviations: f.deviations, indices: f.indices})
+
+	keep := n
+	cp := 0.0
+	for i, index := range f.indices {
+		cp += f.probs[index]
+		if cp > f.mass {
+			keep = i + 1
+			break
+		}
+	}
+
+	f.removed = append(f.removed[:0], make([]bool, n)...)
+	threshold := f.deviations[f.indices[keep-1]]
+	for _, i := range f.indices[keep:] {
+		if f.deviations[i] > threshold || f.probs[i] == 0 {
+			f.removed[i] = true
+		}
+	}
+	return f.removed
+}
+
+// byDeviationAsc sorts the indices of the tokens by increasing deviation, and
+// by increasing index among equal deviations, like a stable sort.
+type byDeviationAsc struct {
+	deviations []float64
+	indices    []int
+}
+
+func (s byDeviationAsc) Len() int {
+	return len(s.indices)
+}
+
+func (s byDeviationAsc) Less(i, j int) bool {
+	a, b := s.indices[i], s.indices[j]
+	return s.deviations[a] < s.deviations[b] || (s.deviations[a] == s.deviations[b] && a < b)
+}
+
+func (s byDeviationAsc) Swap(i, j int) {
+	s.indices[i], s.indices[j] = s.indices[j], s.indices[i]
+}
+
+// cutoffFilter finds the tokens whose probability is below a cutoff, which
+// can depend on the probabilities, reusing its buffers.
+type cutoffFilter struct {
+	cutoff func(probs []float64) float64
+	// invTemperature is the inverse of the temperature of the probabilities.
+	invTemperature float64
+	probs          []float64
+	removed        []bool
+}
+
+// removedTokens returns a mask of the tokens to remove, indexed like the
+// scores. The tokens with the highest probability are never removed, so
+// that there is always a candidate. The mask is only valid until the next
+// call.
+func (f *cutoffFilter) removedTokens(scores mat.Matrix) []bool {
+	f.probs = copyScores(f.probs, scores)
+	max, sum := softmaxMaxAndSum(f.probs, 1/f.invTemperature)
+	maxProb := 0.0
+	for i, v := range f.probs {
+		f.probs[i] = math.Exp((v-max)*f.invTemperature) / sum
+		maxProb = math.Max(maxProb, f.probs[i])
+	}
+	cutoff := f.cutoff(f.probs)
+
+	f.removed = append(f.removed[:0], make([]bool, len(f.probs))...)
+	for i, p := range f.probs {
+		f.removed[i] = p < cutoff && p < maxProb
+	}
+	return f.removed
+}
+
+// clampInPlace clips the finite scores to [-clamp, clamp], in place.
+func clampInPlace(clamp float64) func(scores mat.Matrix) {
+	return func(scores mat.Matrix) {
+		scores.ApplyInPlace(func(_, _ int, v float64) float64 {
+			switch {
+			case v > clamp:
+				return clamp
+			case v < -clamp && !math.IsInf(v, -1):
+				return -clamp
+			default:
+				return v
+			}
+		}, scores)
+	}
+}
+
+// topKInPlace is like TopKFunc, but modifies the scores in place.
+func topKInPlace(topK int, filterValue float64) func(scores mat.Matrix) {
+	var buf []float64
+	return func(scores mat.Matrix) {
+		buf = copyScores(buf, scores)
+		minScore := kthLargestCandidate(buf, topK)
+		scores.ApplyInPlace(func(_, _ int, v float64) float64 {
+			if v < minScore && !math.IsInf(v, -1) {
+				return filterValue
+			}
+			return v
+		}, scores)
+	}
+}
+
+// topPInPlace is like TopPFunc, but modifies the scores in place, and
+// computes the probabilities with the given temperature.
+func topPInPlace(topP, temperature, filterValue float64, minSize int) func(scores mat.Matrix) {
+	f := &topPFilter{topP: topP, invTemperature: 1 / temperature, minSize: minSize}
+	return func(scores mat.Matrix) {
+		removed := f.removedTokens(scores)
+		scores.ApplyInPlace(func(r, c int, v float64) float64 {
+			// scores are vectors, so one of the two indices is always zero
+			if removed[r+c] {
+				return filterValue
+			}
+			return v
+		}, scores)
+	}
+}
+
+// typicalInPlace is like TypicalFunc, but modifies the scores in place, and
+// computes the probabilities with the given temperature.
+func typicalInPlace(mass, temperature, filterValue float64) func(scores mat.Matrix) {
+	f := &typicalFilter{mass: mass, invTemperature: 1 / temperature}
+	return func(scores mat.Matrix) {
+		removed := f.removedTokens(scores)
+		scores.ApplyInPlace(func(r, c int, v float64) float64 {
+			// scores are vectors, so one of the two indices is always zero
+			if removed[r+c] {
+				return filterValue
+			}
+			return v
+		}, scores)
+	}
+}
+
+// cutoffInPlace is like cutoffFunc, but modifies the scores in place, and
+// computes the probabilities with the given temperature.
+func cutoffInPlace(cutoff func(probs []float64) float64, temperature, filterValue float64) func(scores mat.Matrix) {
+	f := &cutoffFilter{cutoff: cutoff, invTemperature: 1 / temperature}
+	return func(scores mat.Matrix) {
+		removed := f.removedTokens(scores)
+		scores.ApplyInPlace(func(r, c int, v float64) float64 {
+			// scores are vectors, so one of the two indices is always zero
+			if removed[r+c] {
+				return filterValue
+			}
+			return v
+		}, scores)
+	}
+}
+
+// copyScores copies the scores to buf as float64 values, reusing its
+// capacity, and returns the resulting slice.
+func copyScores(buf []float64, scores mat.Matrix) []float64 {
+	buf = buf[:0]
+	if d, ok := scores.(*mat.Dense[float32]); ok {
+		for _, v := range mat.Data[float32](d) {
+			buf = append(buf, float64(v))
+		}
+		return buf
+	}
+	return append(buf, mat.Data[float64](scores)...)
+}
@@ -0,0 +1,576 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package decoder
+
+import (
+	"container/heap"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/nlpodyssey/spago/mat"
+	"github.com/nlpodyssey/spago/mat/float"
+	"github.com/nlpodyssey/verbaflow/sliceutils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// randomLogits returns a vector of random logits.
+func randomLogits(r *rand.Rand, size int) mat.Matrix {
+	data := make([]float32, size)
+	for i := range data {
+		data[i] = float32(r.NormFloat64() * 4)
+	}
+	return mat.NewVecDense(data)
+}
+
+// copyingOutputControl applies the copying controls like OutputDiversityControl.
+func copyingOutputControl(temp float64, topK int, topP float64) OutputDiversityControlFunc {
+	var funcs []OutputDiversityControlFunc
+	if temp != 1 {
+		funcs = append(funcs, TemperatureFunc(temp))
+	}
+	if topK != 0 {
+		funcs = append(funcs, TopKFunc(topK, math.Inf(-1)))
+	}
+	if topP != 1 {
+		funcs = append(funcs, TopPFunc(topP, math.Inf(-1), 1))
+	}
+	return func(logits mat.Matrix) (mat.Matrix, error) {
+		for _, fn := range funcs {
+			logits, _ = fn(logits)
+		}
+		return logits, nil
+	}
+}
+
+func TestOutputDiversityControl_SameAsCopying(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for _, tc := range []struct {
+		temp float64
+		topK int
+		topP float64
+	}{
+		{temp: 1, topK: 0, topP: 1},
+		{temp: 0.5, topK: 0, topP: 1},
+		{temp: 1, topK: 10, topP: 1},
+		{temp: 1, topK: 0, topP: 0.7},
+		{temp: 0.7, topK: 40, topP: 0.9},
+		{temp: 1, topK: 2000, topP: 0.5},
+	} {
+		name := fmt.Sprintf("temp=%v,topK=%v,topP=%v", tc.temp, tc.topK, tc.topP)
+		t.Run(name, func(t *testing.T) {
+			fn, err := OutputDiversityControl(DecodingOptions{Temp: tc.temp, TopK: tc.topK, TopP: tc.topP})
+			require.NoError(t, err)
+			expectedFn := copyingOutputControl(tc.temp, tc.topK, tc.topP)
+
+			// the buffers are reused across the calls
+			for i := 0; i < 3; i++ {
+				logits := randomLogits(r, 1000)
+				original := logits.Clone()
+
+				expected, err := expectedFn(logits)
+				require.NoError(t, err)
+				actual, err := fn(logits)
+				require.NoError(t, err)
+
+				// the temperature is applied with the normalization
+				assert.Equal(t, filtered(expected), filtered(actual))
+				assert.InDeltaSlice(t, expected.Softmax().Data().F64(), TemperedSoftmax(actual, tc.temp).Data().F64(), 1e-6)
+				assert.Equal(t, original.Data().F64(), logits.Data().F64(), "the logits must not be modified")
+			}
+		})
+	}
+}
+
+// peakedLogits returns a vector of logits where almost all the probability
+// is concentrated in the token peak.
+func TestOutputDiversityControl_NoControls(t *testing.T) {
+	fn, err := OutputDiversityControl(DecodingOptions{Temp: 1, TopP: 1})
+	require.NoError(t, err)
+
+	logits := mat.NewVecDense([]float32{1, 2, 3})
+	out, err := fn(logits)
+	require.NoError(t, err)
+	assert.Same(t, logits, out, "the logits must not be copied")
+
+	_, err = fn(mat.NewVecDense([]float32{float32(math.Inf(-1))}))
+	assert.ErrorIs(t, err, errNoCandidates)
+}
+
+func peakedLogits(size, peak int) mat.Matrix {
+	data := make([]float64, size)
+	for i := range data {
+		data[i] = -float64(i) / 10
+	}
+	data[peak] = 100
+	return mat.NewVecDense(data)
+}
+
+func TestOutputDiversityControl_MinKeep(t *testing.T) {
+	logits := peakedLogits(1000, 42)
+
+	t.Run("aggressive topK and topP", func(t *testing.T) {
+		fn, err := OutputDiversityControl(DecodingOptions{Temp: 0.1, TopK: 1})
+		require.NoError(t, err)
+		out, err := fn(logits)
+		require.NoError(t, err)
+		assert.Equal(t, 1, countCandidates(out.Data().F64()))
+		assert.Equal(t, 100.0, out.ScalarAt(42, 0).F64())
+	})
+
+	t.Run("topK raised to minKeep", func(t *testing.T) {
+		fn, err := OutputDiversityControl(DecodingOptions{Temp: 1, TopK: 1, TopP: 1, MinKeep: 3})
+		require.NoError(t, err)
+		out, err := fn(logits)
+		require.NoError(t, err)
+		assert.Equal(t, 3, countCandidates(out.Data().F64()))
+	})
+
+	t.Run("top candidates restored after topP", func(t *testing.T) {
+		fn, err := OutputDiversityControl(DecodingOptions{Temp: 1, TopP: 0.5, MinKeep: 3})
+		require.NoError(t, err)
+		out, err := fn(logits)
+		require.NoError(t, err)
+		assert.Equal(t, 3, countCandidates(out.Data().F64()))
+		assert.Equal(t, 100.0, out.ScalarAt(42, 0).F64())
+		assert.Equal(t, 0.0, out.ScalarAt(0, 0).F64())
+		assert.Equal(t, -0.1, out.ScalarAt(1, 0).F64())
+	})
+
+	t.Run("fewer candidates than minKeep", func(t *testing.T) {
+		data := make([]float64, 10)
+		for i := range data {
+			data[i] = math.Inf(-1)
+		}
+		data[3], data[5] = 1, 2
+		fn, err := OutputDiversityControl(DecodingOptions{Temp: 1, MinKeep: 4})
+		require.NoError(t, err)
+		out, err := fn(mat.NewVecDense(data))
+		require.NoError(t, err)
+		assert.Equal(t, []float64{1, 2}, []float64{out.ScalarAt(3, 0).F64(), out.ScalarAt(5, 0).F64()})
+		assert.Equal(t, 2, countCandidates(out.Data().F64()))
+	})
+
+	t.Run("no candidates", func(t *testing.T) {
+		data := []float64{math.Inf(-1), math.Inf(-1)}
+		for _, topK := range []int{0, 1} {
+			fn, err := OutputDiversityControl(DecodingOptions{Temp: 1, TopK: topK, TopP: 1})
+			require.NoError(t, err)
+			_, err = fn(mat.NewVecDense(data))
+			assert.ErrorIs(t, err, errNoCandidates)
+		}
+	})
+
+	t.Run("invalid minKeep", func(t *testing.T) {
+		_, err := OutputDiversityControl(DecodingOptions{Temp: 1, TopP: 1, MinKeep: -1})
+		assert.Error(t, err)
+	})
+}
+
+func TestOutputDiversityControl_LogitClamp(t *testing.T) {
+	logits := mat.NewVecDense([]float32{1, 2, 1000, 0.5, float32(math.Inf(-1))})
+	fn, err := OutputDiversityControl(DecodingOptions{Temp: 1, TopP: 1, LogitClamp: 10})
+	require.NoError(t, err)
+	out, err := fn(logits)
+	require.NoError(t, err)
+	assert.Equal(t, []float64{1, 2, 10, 0.5, math.Inf(-1)}, out.Data().F64())
+	assert.Equal(t, 1000.0, logits.ScalarAt(2, 0).F64(), "the logits must not be modified")
+
+	// without the clamp, the outlier takes all the probability
+	probs := TemperedSoftmax(logits, 1).Data().F64()
+	assert.Equal(t, 1.0, probs[2])
+	probs = TemperedSoftmax(out, 1).Data().F64()
+	assert.Less(t, probs[2], 1.0)
+	assert.Greater(t, probs[1], 1e-4)
+	assert.Equal(t, 0.0, probs[4])
+	assert.InDelta(t, 1.0, probs[0]+probs[1]+probs[2]+probs[3], 1e-9)
+
+	out, err = fn(mat.NewVecDense([]float64{-50, -20}))
+	require.NoError(t, err)
+	assert.Equal(t, []float64{-10, -10}, out.Data().F64())
+
+	_, err = OutputDiversityControl(DecodingOptions{Temp: 1, TopP: 1, LogitClamp: -1})
+	assert.Error(t, err)
+}
+
+// filtered returns the indices of the filtered out logits.
+func filtered(logits mat.Matrix) []int {
+	var indices []int
+	for i, v := range logits.Data().F64() {
+		if math.IsInf(v, -1) {
+			indices = append(indices, i)
+		}
+	}
+	return indices
+}
+
+// tiedLogits returns a vector of random logits with many equal values.
+func tiedLogits(r *rand.Rand, size int) mat.Matrix {
+	data := make([]float64, size)
+	for i := range data {
+		data[i] = float64(r.Intn(8))
+	}
+	return mat.NewVecDense(data)
+}
+
+func TestTopKFunc_SameAsReference(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for _, logits := range []mat.Matrix{randomLogits(r, 1000), tiedLogits(r, 1000)} {
+		for _, topK := range []int{1, 2, 40, 999, 1000, 2000} {
+			expected, err := referenceTopKFunc(topK, math.Inf(-1))(logits)
+			require.NoError(t, err)
+			actual, err := TopKFunc(topK, math.Inf(-1))(logits)
+			require.NoError(t, err)
+			assert.Equal(t, expected.Data().F64(), actual.Data().F64(), "topK %d", topK)
+		}
+	}
+}
+
+func TestTopPFunc_SameAsReference(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for _, logits := range []mat.Matrix{randomLogits(r, 1000), randomLogits(r, 5), tiedLogits(r, 1000)} {
+		for _, topP := range []float64{0, 0.1, 0.5, 0.9, 0.999, 1} {
+			for _, minSize := range []int{1, 2, 100} {
+				if minSize >= logits.Size() {
+					continue
+				}
+				expected, err := referenceTopPFunc(topP, math.Inf(-1), minSize)(logits)
+				require.NoError(t, err)
+				actual, err := TopPFunc(topP, math.Inf(-1), minSize)(logits)
+				require.NoError(t, err)
+				assert.Equal(t, expected.Data().F64(), actual.Data().F64(), "topP %v, minSize %d", topP, minSize)
+			}
+		}
+	}
+}
+
+func TestTopPFunc_Ties(t *testing.T) {
+	// five tokens with probability 0.1 straddle the threshold: 0.5 is
+	// reached in the middle of them
+	probs := []float64{0.1, 0.25, 0.1, 0.05, 0.1, 0.1, 0.2, 0.1}
+	logits := make([]float64, len(probs))
+	for i, p := range probs {
+		logits[i] = math.Log(p)
+	}
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 10; i++ {
+		// the tied tokens are all kept, whatever their order
+		perm := r.Perm(len(probs))
+		data := make([]float64, len(probs))
+		for j, k := range perm {
+			data[j] = logits[k]
+		}
+		out, err := TopPFunc(0.5, math.Inf(-1), 1)(mat.NewVecDense(data))
+		require.NoError(t, err)
+		for j, k := range perm {
+			if k == 3 {
+				assert.True(t, math.IsInf(out.ScalarAt(j, 0).F64(), -1), "the least probable token must be removed")
+			} else {
+				assert.Equal(t, data[j], out.ScalarAt(j, 0).F64(), "token %d must be kept", k)
+			}
+		}
+	}
+
+	// the tied tokens are all removed when the cutoff comes before them
+	out, err := TopPFunc(0.4, math.Inf(-1), 1)(mat.NewVecDense(logits))
+	require.NoError(t, err)
+	assert.Equal(t, []int{0, 2, 3, 4, 5, 7}, filtered(out))
+}
+
+func TestTypicalFunc(t *testing.T) {
+	// the entropy is 1.349, and the deviations of the information contents
+	// from it are 0.433, 0.145, 0.260, 1.646 and 1.646
+	probs := []float64{0.4, 0.3, 0.2, 0.05, 0.05}
+	logits := make([]float64, len(probs))
+	for i, p := range probs {
+		logits[i] = math.Log(p)
+	}
+	for _, tt := range []struct {
+		mass     float64
+		expected []int
+	}{
+		{mass: 0.2, expected: []int{0, 2, 3, 4}},
+		// the most probable token is not typical enough
+		{mass: 0.4, expected: []int{0, 3, 4}},
+		{mass: 0.85, expected: []int{3, 4}},
+		// the tied tokens are all kept
+		{mass: 0.92, expected: nil},
+		{mass: 1, expected: nil},
+	} {
+		out, err := TypicalFunc(tt.mass, math.Inf(-1))(mat.NewVecDense(logits))
+		require.NoError(t, err)
+		assert.Equal(t, tt.expected, filtered(out), "mass %v", tt.mass)
+
+		fn, err := OutputDiversityControl(DecodingOptions{Temp: 1, TopP: 1, TypicalP: tt.mass})
+		require.NoError(t, err)
+		out, err = fn(mat.NewVecDense(logits))
+		require.NoError(t, err)
+		assert.Equal(t, tt.expected, filtered(out), "mass %v", tt.mass)
+	}
+
+	_, err := OutputDiversityControl(DecodingOptions{Temp: 1, TopP: 1, TypicalP: 1.5})
+	assert.Error(t, err)
+}
+
+func TestEpsilonFunc(t *testing.T) {
+	probs := []float64{0.5, 0.25, 0.15, 0.06, 0.03, 0.01}
+	logits := make([]float64, len(probs))
+	for i, p := range probs {
+		logits[i] = math.Log(p)
+	}
+	for _, tt := range []struct {
+		epsilon  float64
+		expected []int
+	}{
+		{epsilon: 0.001, expected: nil},
+		{epsilon: 0.05, expected: []int{4, 5}},
+		{epsilon: 0.2, expected: []int{2, 3, 4, 5}},
+		// the most probable token is always kept
+		{epsilon: 0.9, expected: []int{1, 2, 3, 4, 5}},
+	} {
+		out, err := EpsilonFunc(tt.epsilon, math.Inf(-1))(mat.NewVecDense(logits))
+		require.NoError(t, err)
+		assert.Equal(t, tt.expected, filtered(out), "epsilon %v", tt.epsilon)
+
+		fn, err := OutputDiversityControl(DecodingOptions{Temp: 1, TopP: 1, Epsilon: tt.epsilon})
+		require.NoError(t, err)
+		out, err = fn(mat.NewVecDense(logits))
+		require.NoError(t, err)
+		assert.Equal(t, tt.expected, filtered(out), "epsilon %v", tt.epsilon)
+	}
+
+	for _, epsilon := range []float64{-0.1, 1} {
+		_, err := OutputDiversityControl(DecodingOptions{Temp: 1, TopP: 1, Epsilon: epsilon})
+		assert.Error(t, err, "epsilon %v", epsilon)
+	}
+}
+
+func TestEtaFunc(t *testing.T) {
+	// the entropy is 1.298, so sqrt(eta) is scaled by exp(-1.298) = 0.273
+	probs := []float64{0.5, 0.25, 0.15, 0.06, 0.03, 0.01}
+	logits := make([]float64, len(probs))
+	for i, p := range probs {
+		logits[i] = math.Log(p)
+	}
+	for _, tt := range []struct {
+		eta      float64
+		cutoff   float64
+		expected []int
+	}{
+		// the cutoff is eta itself
+		{eta: 0.005, cutoff: 0.005, expected: nil},
+		{eta: 0.04, cutoff: 0.04, expected: []int{4, 5}},
+		// the cutoff depends on the entropy: 0.447 * 0.273
+		{eta: 0.2, cutoff: 0.1221, expected: []int{3, 4, 5}},
+		{eta: 0.9, cutoff: 0.2591, expected: []int{1, 2, 3, 4, 5}},
+	} {
+		assert.InDelta(t, tt.cutoff, etaCutoff(tt.eta)(probs), 1e-4, "eta %v", tt.eta)
+
+		out, err := EtaFunc(tt.eta, math.Inf(-1))(mat.NewVecDense(logits))
+		require.NoError(t, err)
+		assert.Equal(t, tt.expected, filtered(out), "eta %v", tt.eta)
+
+		fn, err := OutputDiversityControl(DecodingOptions{Temp: 1, TopP: 1, Eta: tt.eta})
+		require.NoError(t, err)
+		out, err = fn(mat.NewVecDense(logits))
+		require.NoError(t, err)
+		assert.Equal(t, tt.expected, filtered(out), "eta %v", tt.eta)
+	}
+
+	// the cutoff is lower for a distribution with a higher entropy
+	uniform := []float64{0.25, 0.25, 0.25, 0.25}
+	assert.Less(t, etaCutoff(0.2)(uniform), etaCutoff(0.2)(probs))
+
+	for _, eta := range []float64{-0.1, 1} {
+		_, err := OutputDiversityControl(DecodingOptions{Temp: 1, TopP: 1, Eta: eta})
+		assert.Error(t, err, "eta %v", eta)
+	}
+}
+
+func TestTopKFunc_AfterTopP(t *testing.T) {
+	// the top-p filter keeps the four most probable tokens
+	probs := []float64{0.3, 0.01, 0.2, 0.15, 0.01, 0.12, 0.1, 0.01, 0.1}
+	logits := make([]float64, len(probs))
+	for i, p := range probs {
+		logits[i] = math.Log(p)
+	}
+	topP, err := TopPFunc(0.7, math.Inf(-1), 1)(mat.NewVecDense(logits))
+	require.NoError(t, err)
+	require.Equal(t, 4, countCandidates(topP.Data().F64()))
+
+	for _, tt := range []struct {
+		topK     int
+		expected int
+	}{
+		{1, 1},
+		{3, 3},
+		{4, 4},
+		{5, 4},
+		{len(probs), 4},
+	} {
+		out, err := TopKFunc(tt.topK, math.Inf(-1))(topP)
+		require.NoError(t, err)
+		assert.Equal(t, tt.expected, countCandidates(out.Data().F64()), "topK %d", tt.topK)
+	}
+
+	// the tokens removed by the top-p filter are not given the filter value
+	out, err := TopKFunc(3, -100)(topP)
+	require.NoError(t, err)
+	assert.Equal(t, []float64{
+		logits[0], math.Inf(-1), logits[2], logits[3], math.Inf(-1), -100, math.Inf(-1), math.Inf(-1), math.Inf(-1),
+	}, out.Data().F64())
+}
+
+func BenchmarkTopKFunc(b *testing.B) {
+	logits := randomLogits(rand.New(rand.NewSource(1)), 50277)
+	for _, bc := range []struct {
+		name string
+		fn   OutputDiversityControlFunc
+	}{
+		{"heap", referenceTopKFunc(40, math.Inf(-1))},
+		{"bounded-heap", TopKFunc(40, math.Inf(-1))},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := bc.fn(logits); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkTopPFunc(b *testing.B) {
+	logits := randomLogits(rand.New(rand.NewSource(1)), 50277)
+	for _, bc := range []struct {
+		name string
+		fn   OutputDiversityControlFunc
+	}{
+		{"sort", referenceTopPFunc(0.9, math.Inf(-1), 1)},
+		{"partial-sort", TopPFunc(0.9, math.Inf(-1), 1)},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := bc.fn(logits); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkOutputDiversityControl(b *testing.B) {
+	const temp, topK, topP = 0.7, 40, 0.9
+	logits := randomLogits(rand.New(rand.NewSource(1)), 50277)
+
+	inPlace, err := OutputDiversityControl(DecodingOptions{Temp: temp, TopK: topK, TopP: topP})
+	require.NoError(b, err)
+
+	for _, bc := range []struct {
+		name string
+		fn   OutputDiversityControlFunc
+	}{
+		{"copying", copyingOutputControl(temp, topK, topP)},
+		{"in-place", inPlace},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := bc.fn(logits); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// referenceTopKFunc is the previous TopKFunc, based on a heap of all the scores.
+func referenceTopKFunc(topK int, filterValue float64) OutputDiversityControlFunc {
+	return func(scores mat.Matrix) (mat.Matrix, error) {
+		topK := topK
+		if size := scores.Size(); size <= topK {
+			topK = size
+		}
+
+		inScores := scores.Data().F64()
+
+		rawTopScores := make(sliceutils.OrderedHeap[float64], len(inScores))
+		copy(rawTopScores, inScores)
+
+		topScores := sliceutils.ReverseHeap(&rawTopScores)
+		heap.Init(topScores)
+		for i := 1; i < topK; i++ {
+			heap.Pop(topScores)
+		}
+		minScore := heap.Pop(topScores).(float64)
+
+		return scores.Apply(func(_, _ int, v float64) float64 {
+			if v < minScore {
+				return filterValue
+			}
+			return v
+		}), nil
+	}
+}
+
+// referenceTopPFunc is the previous TopPFunc, based on a stable sort of all the
+// scores, amended to keep the tokens tied with the last kept one.
+func referenceTopPFunc[T float.DType](topP, filterValue T, minSize int) OutputDiversityControlFunc {
+	return func(scores mat.Matrix) (mat.Matrix, error) {
+		dataCopy := make([]T, scores.Size())
+		copy(dataCopy, mat.Data[T](scores))
+		sortedData := sliceutils.NewIndexedSlice[T](dataCopy)
+		sort.Stable(sort.Reverse(sortedData))
+
+		cumulativeProbs := mat.NewVecDense(sortedData.Slice).Softmax().CumSum()
+		cumProbData := mat.Data[T](cumulativeProbs)
+
+		indicesToRemove := make([]bool, len(cumProbData))
+		for i, cp := range cumProbData {
+			indicesToRemove[i] = cp > topP
+		}
+
+		if minSize > 1 {
+			// Keep at least minSize (minSize-1 because we add the first one below)
+			for i := minSize - 1; i >= 0; i-- {
+				indicesToRemove[i] = false
+			}
+		}
+
+		// Shift the indices to the right to keep also the first token above the threshold
+		copy(indicesToRemove[1:], indicesToRemove[:len(indicesToRemove)-1])
+		indicesToRemove[0] = false
+
+		// Keep the ties at the cutoff
+		last := 0
+		for i, toRemove := range indicesToRemove {
+			if !toRemove {
+				last = i
+			}
+		}
+		for i := last + 1; i < len(indicesToRemove); i++ {
+			if sortedData.Slice[i] == sortedData.Slice[last] {
+				indicesToRemove[i] = false
+			}
+		}
+
+		// Scatter sorted tensors to original indexing
+
+		outData := make([]T, scores.Size())
+		copy(outData, mat.Data[T](scores))
+		for maskIndex, toRemove := range indicesToRemove {
+			if !toRemove {
+				continue
+			}
+			index := sortedData.Indices[maskIndex]
+			outData[index] = filterValue
+		}
+
+		return mat.NewVecDense[T](outData), nil
+	}
+}
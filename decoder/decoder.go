@@ -8,7 +8,7 @@ import (
 	"context"
 	"fmt"
 	"math"
-	"reflect"
+	"unicode/utf8"
 
 	"github.com/nlpodyssey/rwkv"
 	"github.com/nlpodyssey/spago/ag"
@@ -16,6 +16,7 @@ import (
 	"github.com/nlpodyssey/spago/mat/float"
 	"github.com/nlpodyssey/verbaflow/encoder"
 	"github.com/nlpodyssey/verbaflow/rwkvlm"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
@@ -25,7 +26,30 @@ type Decoder struct {
 	model              *rwkvlm.Model
 	applyOutputControl OutputDiversityControlFunc
 	applySelection     OutputSelectionFunc
+	processors         []LogitsProcessor
 	opts               DecodingOptions
+	// sequence contains the tokens generated by the last call to Decode.
+	sequence []int
+	// stopTrace records why the last call to Decode stopped.
+	stopTrace StopTrace
+	// vocabulary maps each token ID to its text, to count the characters.
+	vocabulary []string
+	// chars is the number of characters generated by the current call to Decode.
+	chars int
+	// partial contains the bytes of a rune split between the generated
+	// tokens, held back until the next token completes it.
+	partial string
+	// forcedPrefix contains the tokens of the ForcedPrefix.
+	forcedPrefix []int
+	// stops matches the StopSequencesIDs, followed by the StopSequences, if
+	// any.
+	stops *stopMatcher
+	// stopTrim tells whether each stop sequence is removed from the output.
+	stopTrim []bool
+	// batcher runs the steps of the decoding, if set, instead of the model.
+	batcher *rwkvlm.Batcher
+	// logger is the logger of the context of the current call to Decode.
+	logger *zerolog.Logger
 }
 
 // DecodingOptions contains the options for the conditional text generation.
@@ -36,18 +60,111 @@ type DecodingOptions struct {
 	MinLen int `json:"min_len" yaml:"min_len"`
 	// StopSequencesIDs is a list of token ids that if generated, the generation process will stop.
 	StopSequencesIDs [][]int `json:"stop_sequences_ids" yaml:"stop_sequences_ids"`
+	// TrimStopSequence removes the matched stop sequence of the
+	// StopSequencesIDs from the generated tokens.
+	// To do so, the last tokens which could be part of a stop sequence are held
+	// back until it is known whether they are.
+	TrimStopSequence bool `json:"trim_stop_sequence" yaml:"trim_stop_sequence"`
+	// StopSequences are more stop sequences, each with its own action, which
+	// tells whether it is removed from the generated tokens, regardless of
+	// TrimStopSequence.
+	StopSequences []StopSequence `json:"stop_sequences" yaml:"stop_sequences"`
+	// StopMatchMode tells where the StopSequencesIDs and StopSequences are
+	// matched in the generated tokens: StopMatchSuffix (the default, when
+	// empty) or StopMatchAnywhere. In the latter case, a stop sequence is only
+	// removed if the generated tokens end with it.
+	StopMatchMode StopMatchMode `json:"stop_match_mode" yaml:"stop_match_mode"`
 	// EndTokenID is the end-of-sequence token (default: 0).
 	EndTokenID int `json:"end_token_id" yaml:"end_token_id"`
 	// SkipEndTokenID when true, the end token is not added to the generated sequence.
 	SkipEndTokenID bool `json:"skip_end_token_id" yaml:"skip_end_token_id"`
+	// FilterSpecialTokens, when true, the control tokens of the tokenizer,
+	// such as the beginning-of-sequence, padding and extra special tokens,
+	// are not streamed. They are still generated, so the end token stops the
+	// generation. It is honored by the gRPC service.
+	FilterSpecialTokens bool `json:"filter_special_tokens" yaml:"filter_special_tokens"`
+	// MaxChars, if positive, stops the generation when the text of the
+	// generated tokens reaches this number of characters (Unicode code
+	// points), trimming the text of the last token if it exceeds it.
+	// It requires the token-to-text mapping, so it is honored by VerbaFlow.Generate.
+	MaxChars int `json:"max_chars" yaml:"max_chars"`
+	// MinTopProb, if positive, stops the generation, once MinLen tokens have
+	// been generated, when the probability of the selected token falls below
+	// it, since the model is no longer confident. The token is kept.
+	MinTopProb float64 `json:"min_top_prob" yaml:"min_top_prob"`
 	// Temperature is the temperature used to control the randomness of the generated text.
 	Temp float64 `json:"temp" yaml:"temp"`
 	// TopK is the number of tokens to consider when sampling the next token.
 	TopK int `json:"top_k" yaml:"top_k"`
 	// TopP is the cumulative probability of the tokens to consider when sampling the next token.
 	TopP float64 `json:"top_p" yaml:"top_p"`
+	// LogitClamp, if positive, clips the logits to [-LogitClamp, LogitClamp]
+	// before the other output diversity controls and the temperature.
+	LogitClamp float64 `json:"logit_clamp" yaml:"logit_clamp"`
+	// TypicalP, if between 0 and 1, exclusive, is the probability mass of the
+	// locally typical tokens to consider when sampling the next token: the
+	// ones whose information content is the closest to the entropy of the
+	// distribution.
+	TypicalP float64 `json:"typical_p" yaml:"typical_p"`
+	// Epsilon, if positive, removes the tokens whose probability is below it
+	// (epsilon sampling). It must be less than 1.
+	Epsilon float64 `json:"epsilon" yaml:"epsilon"`
+	// Eta, if positive, removes the tokens whose probability is below
+	// min(Eta, sqrt(Eta) * exp(-entropy)) (eta sampling). It must be less
+	// than 1.
+	Eta float64 `json:"eta" yaml:"eta"`
+	// MinKeep is the minimum number of candidate tokens left by the top-k,
+	// top-p, typical, epsilon and eta filters (default: 1).
+	MinKeep int `json:"min_keep" yaml:"min_keep"`
 	// UseSampling uses sampling to generate the next token.
 	UseSampling bool `json:"use_sampling" yaml:"use_sampling"`
+	// NoRepeatNGramSize, if greater than zero, prevents the generation of any
+	// n-gram of this size that has already been generated.
+	NoRepeatNGramSize int `json:"no_repeat_ngram_size" yaml:"no_repeat_ngram_size"`
+	// RepetitionPenalty, if greater than 1, discourages the repetition of the
+	// generated tokens, dividing their positive logits by it and multiplying
+	// the negative ones.
+	RepetitionPenalty float64 `json:"repetition_penalty" yaml:"repetition_penalty"`
+	// PenaltyWindow, if greater than zero, limits the RepetitionPenalty to
+	// the tokens generated in the last PenaltyWindow steps.
+	PenaltyWindow int `json:"penalty_window" yaml:"penalty_window"`
+	// AllowedTokenIDs, if not empty, restricts the generation to these
+	// tokens, for example for a classification over a closed set of labels.
+	// The end token must be among them for the generation to stop before
+	// MaxLen.
+	AllowedTokenIDs []int `json:"allowed_token_ids" yaml:"allowed_token_ids"`
+	// AddBOS prepends the tokenizer's beginning-of-sequence token to the prompt.
+	// It is honored by VerbaFlow.Generate.
+	AddBOS bool `json:"add_bos" yaml:"add_bos"`
+	// ForcedPrefix is a text the output starts with: its tokens are fed to
+	// the model, as if it had generated them, before the free generation.
+	// They count as generated, for example for MaxLen, with probability 1.
+	// It requires the tokenizer, so it is honored by VerbaFlow.Generate.
+	ForcedPrefix string `json:"forced_prefix" yaml:"forced_prefix"`
+	// ForceJSON constrains the generation to produce a valid JSON object or array.
+	// It requires the token-to-text mapping, so it is honored by VerbaFlow.Generate.
+	ForceJSON bool `json:"force_json" yaml:"force_json"`
+	// EchoPrompt streams the tokens of the prompt before the generated ones.
+	// It is honored by the gRPC service.
+	EchoPrompt bool `json:"echo_prompt" yaml:"echo_prompt"`
+	// TrimWhitespace removes the leading and trailing whitespace of the
+	// generated text. It is honored by the gRPC service.
+	TrimWhitespace bool `json:"trim_whitespace" yaml:"trim_whitespace"`
+	// CollapseNewlines replaces the consecutive newlines of the generated text
+	// with a single one. It is honored by the gRPC service.
+	CollapseNewlines bool `json:"collapse_newlines" yaml:"collapse_newlines"`
+	// MaxTokensPerSecond, if positive, limits the rate at which the tokens
+	// are streamed, for example to simulate typing. It is honored by the
+	// gRPC service.
+	MaxTokensPerSecond float64 `json:"max_tokens_per_second" yaml:"max_tokens_per_second"`
+	// JSONSchema, if not empty, is a JSON schema which the generated text
+	// must match, checked at the end of the generation, whose tokens are
+	// held back until then. It is honored by the gRPC service.
+	JSONSchema string `json:"json_schema" yaml:"json_schema"`
+	// JSONSchemaRetries is the number of times the generation is repeated
+	// when its text doesn't match the JSONSchema. It is only useful with
+	// sampling, since a greedy generation always produces the same text.
+	JSONSchemaRetries int `json:"json_schema_retries" yaml:"json_schema_retries"`
 }
 
 // GeneratedToken is the result of a single step of the decoder.
@@ -56,52 +173,181 @@ type GeneratedToken struct {
 	TokenID int
 	// SumNegLogProbs is the sum of the negative log probabilities up to the current step.
 	SumNegLogProbs float64
+	// TokenProb is the probability of the token at the current step, as
+	// computed by the softmax over the candidates.
+	TokenProb float64
+	// Text is the text of the token, only set when MaxChars is positive.
+	// The bytes of a rune split between tokens are part of the text of the
+	// token which completes it. The text of the last token is trimmed if it
+	// exceeds MaxChars.
+	Text string
 }
 
-func New(m *rwkvlm.Model, opts DecodingOptions) (*Decoder, error) {
-	dc, err := OutputDiversityControl(opts.Temp, opts.TopK, opts.TopP)
+// Validate checks the decoding options which don't depend on the model,
+// returning the same errors as New.
+func (opts DecodingOptions) Validate() error {
+	if err := validateOutputDiversityControl(opts); err != nil {
+		return err
+	}
+	for i, seq := range opts.StopSequencesIDs {
+		if len(seq) == 0 {
+			return fmt.Errorf("invalid StopSequencesIDs value: the sequence %d is empty", i)
+		}
+	}
+	switch opts.StopMatchMode {
+	case "", StopMatchSuffix, StopMatchAnywhere:
+	default:
+		return fmt.Errorf("invalid StopMatchMode value: %q. Must be %q or %q", opts.StopMatchMode, StopMatchSuffix, StopMatchAnywhere)
+	}
+	for i, seq := range opts.StopSequences {
+		if len(seq.IDs) == 0 {
+			return fmt.Errorf("invalid StopSequences value: the sequence %d is empty", i)
+		}
+		switch seq.Action {
+		case "", StopKeep, StopTrim:
+		default:
+			return fmt.Errorf("invalid StopSequences action: %q. Must be %q or %q", seq.Action, StopKeep, StopTrim)
+		}
+	}
+	if opts.MinTopProb < 0 || opts.MinTopProb > 1 {
+		return fmt.Errorf("invalid MinTopProb value: %f. Must be between 0 and 1", opts.MinTopProb)
+	}
+	if opts.NoRepeatNGramSize < 0 {
+		return fmt.Errorf("invalid NoRepeatNGramSize value: %d. Must be >= 0", opts.NoRepeatNGramSize)
+	}
+	if opts.RepetitionPenalty < 0 {
+		return fmt.Errorf("invalid RepetitionPenalty value: %f. Must be >= 0", opts.RepetitionPenalty)
+	}
+	if opts.PenaltyWindow < 0 {
+		return fmt.Errorf("invalid PenaltyWindow value: %d. Must be >= 0", opts.PenaltyWindow)
+	}
+	return nil
+}
+
+// New returns a new Decoder.
+// The optional processors are applied, in order, to the logits of each step.
+func New(m *rwkvlm.Model, opts DecodingOptions, processors ...LogitsProcessor) (*Decoder, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	dc, err := OutputDiversityControl(opts)
 	if err != nil {
 		return nil, err
 	}
+	if opts.NoRepeatNGramSize > 0 {
+		processors = append([]LogitsProcessor{NewNoRepeatNGram(opts.NoRepeatNGramSize)}, processors...)
+	}
+	for _, id := range opts.AllowedTokenIDs {
+		if id < 0 || id >= m.Config.VocabSize {
+			return nil, fmt.Errorf("invalid AllowedTokenIDs value: %d. Must be between 0 and %d", id, m.Config.VocabSize-1)
+		}
+	}
+	if len(opts.AllowedTokenIDs) > 0 {
+		processors = append([]LogitsProcessor{NewAllowedTokens(opts.AllowedTokenIDs)}, processors...)
+	}
+	if opts.RepetitionPenalty != 0 && opts.RepetitionPenalty != 1 {
+		// the penalty is applied last, to the logits adjusted by the others
+		processors = append(processors, NewRepetitionPenalty(opts.RepetitionPenalty, opts.PenaltyWindow))
+	}
+	stops, stopTrim := stopSequences(opts)
 	return &Decoder{
 		model:              m,
 		opts:               opts,
+		processors:         processors,
 		applyOutputControl: dc,
-		applySelection:     OutputSelection(opts.UseSampling),
+		applySelection:     OutputSelection(opts.UseSampling, opts.Temp),
+		stops:              newStopMatcher(stops),
+		stopTrim:           stopTrim,
 	}, nil
 }
 
-func (d *Decoder) Decode(ctx context.Context, nt *ag.NodesTracker, input encoder.Result, chGen chan GeneratedToken) error {
-	defer close(chGen)
+// Decode generates the tokens following the encoded input, putting them into
+// the buffer, which is closed at the end.
+// When the buffer blocks, the decoding waits for it, unless the context is done,
+// which stops the generation.
+// The decoder is reset at the beginning, so it can be reused for many generations,
+// although not concurrently.
+// The trace of the decoding is logged by the logger attached to the context
+// with zerolog.Logger.WithContext, if any, or by the global logger.
+func (d *Decoder) Decode(ctx context.Context, nt *ag.NodesTracker, input encoder.Result, buf Buffer) (err error) {
+	defer func() {
+		if e := buf.Close(); e != nil && err == nil {
+			err = fmt.Errorf("failed to close the buffer: %w", e)
+		}
+	}()
+	d.Reset()
+	d.logger = loggerFromContext(ctx)
 
 	x, s := input.Encoding, input.State
 	if x == nil || s == nil {
 		return fmt.Errorf("invalid input: hidden representation and state are required")
 	}
+	if d.opts.MaxChars > 0 && d.vocabulary == nil {
+		return fmt.Errorf("MaxChars requires the vocabulary of the decoder")
+	}
 
 	var sequence []int
 	var sumNegLogProbs float64
 
+	// tail contains the generated tokens not yet put into the buffer
+	var tail []GeneratedToken
+	holdBack := d.holdBack()
+
 Loop:
 	for i := 0; ; i++ {
 		select {
 		case <-ctx.Done():
-			log.Trace().Msgf("Generation cancelled after %d steps due to context cancellation", i)
+			d.logger.Trace().Msgf("Generation cancelled after %d steps due to context cancellation", i)
+			d.stopTrace = StopTrace{Reason: StopReasonCancelled, Step: i, StopSequenceIndex: -1}
 			break Loop
 		default:
-			tokenID, tokenScore, err := d.generateToken(ctx, x, i, nt)
+			tokenID, tokenScore, err := d.generateToken(ctx, x, sequence, nt)
 			if err != nil {
 				return err
 			}
 			sequence = append(sequence, tokenID)
+			d.sequence = sequence
+			d.stops.feed(tokenID)
 			sumNegLogProbs -= math.Log(tokenScore)
 
-			chGen <- GeneratedToken{
+			tail = append(tail, GeneratedToken{
 				TokenID:        tokenID,
 				SumNegLogProbs: sumNegLogProbs,
+				TokenProb:      tokenScore,
+			})
+			if d.opts.MaxChars > 0 {
+				d.countChars(&tail[len(tail)-1])
 			}
 
-			if d.checkStopConditions(sequence) {
+			stop := d.checkStopConditions(sequence, tokenScore)
+			if stop && d.opts.MaxChars > 0 {
+				d.flushChars(&tail[len(tail)-1])
+			}
+			n := len(tail) - holdBack
+			if stop {
+				if index, stopSeq := d.stops.matched(); stopSeq != nil && d.stopTrim[index] && len(sequence) >= d.opts.MinLen {
+					tail = tail[:len(tail)-len(stopSeq)]
+				}
+				n = len(tail)
+			}
+			if n > 0 {
+				for _, gen := range tail[:n] {
+					if err = buf.Put(ctx, gen); err != nil {
+						break
+					}
+				}
+				tail = tail[n:]
+			}
+			if err != nil {
+				if ctx.Err() != nil {
+					d.logger.Trace().Msgf("Generation cancelled after %d steps while waiting for the buffer", i+1)
+					d.stopTrace = StopTrace{Reason: StopReasonCancelled, Step: i + 1, StopSequenceIndex: -1}
+					break Loop
+				}
+				return fmt.Errorf("failed to put the generated token in the buffer: %w", err)
+			}
+
+			if stop {
 				break Loop
 			}
 
@@ -114,64 +360,291 @@ Loop:
 		}
 	}
 
-	log.Trace().Msgf("[%.2f] Generated token IDs: %v", sumNegLogProbs, sequence)
+	d.logger.Trace().Msgf("[%.2f] Generated token IDs: %v", sumNegLogProbs, sequence)
+	d.logger.Trace().Stringer("stop", d.stopTrace).Msg("Generation stopped")
 
 	return nil
 }
 
+// DecodeToChannel is like Decode, sending the generated tokens to chGen,
+// which is closed at the end.
+func (d *Decoder) DecodeToChannel(ctx context.Context, nt *ag.NodesTracker, input encoder.Result, chGen chan GeneratedToken) error {
+	return d.Decode(ctx, nt, input, ChannelBuffer(chGen))
+}
+
+// DecodeWithPolicy is like DecodeToChannel, but when chGen is full the
+// tokens are handled according to the policy: DropPolicyBlock waits for the
+// receiver, while DropPolicyDropOldest discards the oldest tokens, keeping at
+// most cap(chGen) of them. Like Decode, chGen is closed at the end, even in
+// case of error.
+func (d *Decoder) DecodeWithPolicy(ctx context.Context, nt *ag.NodesTracker, input encoder.Result, chGen chan GeneratedToken, policy DropPolicy) error {
+	buf, err := policy.channelBuffer(chGen)
+	if err != nil {
+		close(chGen)
+		return err
+	}
+	return d.Decode(ctx, nt, input, buf)
+}
+
+// Sequence returns the IDs of the tokens generated by the last call to Decode,
+// including any stop sequence trimmed from the output.
+func (d *Decoder) Sequence() []int {
+	return d.sequence
+}
+
+// SetVocabulary sets the text of each token, indexed by token ID, which is
+// required by MaxChars.
+func (d *Decoder) SetVocabulary(vocabulary []string) {
+	d.vocabulary = vocabulary
+}
+
+// SetBatcher makes the decoder run its steps with the batcher, together with
+// the ones of the other decoders using it. Nil runs them on the model alone.
+func (d *Decoder) SetBatcher(b *rwkvlm.Batcher) {
+	d.batcher = b
+}
+
+// SetForcedPrefix sets the tokens of the ForcedPrefix, which the output
+// starts with.
+func (d *Decoder) SetForcedPrefix(ids []int) {
+	d.forcedPrefix = ids
+}
+
+// StopTrace returns which stop condition ended the last call to Decode, to
+// audit why a generation stopped.
+func (d *Decoder) StopTrace() StopTrace {
+	return d.stopTrace
+}
+
+// Reset clears the generated sequence, the stop trace and the state of the
+// logits processors implementing Resetter.
+func (d *Decoder) Reset() {
+	d.sequence = nil
+	d.stopTrace = StopTrace{}
+	d.chars = 0
+	d.partial = ""
+	d.stops.reset()
+	for _, p := range d.processors {
+		if r, ok := p.(Resetter); ok {
+			r.Reset()
+		}
+	}
+}
+
 // generateToken performs a single step of the decoding process.
-// It returns the selected output token ID and its score.
-func (d *Decoder) generateToken(_ context.Context, x ag.Node, seqLen int, nt *ag.NodesTracker) (int, float64, error) {
+// It returns the selected output token ID and its score, or the next token
+// of the forced prefix.
+func (d *Decoder) generateToken(_ context.Context, x ag.Node, sequence []int, nt *ag.NodesTracker) (int, float64, error) {
+	if n := len(sequence); n < len(d.forcedPrefix) {
+		// the token is given, so the model only has to encode it
+		return d.forcedPrefix[n], 1, nil
+	}
 	logits := nt.TrackNode(d.model.Predict(x))
-	candidates, err := d.applyOutputControl(d.adjustLogits(logits.Value(), seqLen))
+	if err := checkLogits(logits.Value()); err != nil {
+		return 0, 0, err
+	}
+	adjusted, err := d.processLogits(sequence, d.adjustLogits(logits.Value(), len(sequence)))
+	if err != nil {
+		return 0, 0, err
+	}
+	candidates, err := d.applyOutputControl(adjusted)
 	if err != nil {
 		return 0, 0, err
 	}
 	return d.applySelection(candidates)
 }
 
-// adjustLogits checks if the sequence is too short and if so, set the logits of the end token to a very low value.
+// checkLogits returns an error if the logits predicted by the model contain
+// NaN or infinite values, which would otherwise silently produce garbage.
+func checkLogits(logits mat.Matrix) error {
+	for i, v := range logits.Data().F64() {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return fmt.Errorf("the model predicted an invalid logit (%v) for token %d: "+
+				"the weights are likely corrupted, try to convert the model again", v, i)
+		}
+	}
+	return nil
+}
+
+// processLogits applies the logits processors in order.
+func (d *Decoder) processLogits(sequence []int, logits mat.Matrix) (mat.Matrix, error) {
+	var err error
+	for _, p := range d.processors {
+		logits, err = p.Process(sequence, logits)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return logits, nil
+}
+
+// adjustLogits checks if the sequence is too short and if so, returns a copy
+// of the logits where the end token is set to -inf: the given logits are the
+// value of a node of the graph, which must not be modified.
+// Once the sequence has MinLen tokens, the end token can be generated.
+// Without a valid end token, for example -1, the logits are not adjusted.
 func (d *Decoder) adjustLogits(logits mat.Matrix, sequenceLength int) mat.Matrix {
 	if sequenceLength >= d.opts.MinLen {
 		return logits
 	}
-	log.Trace().Msgf("Sequence too short (%d), setting end token (%d) logits to -inf", sequenceLength, d.opts.EndTokenID)
-	logits.SetVecScalar(d.opts.EndTokenID, floatNegInf)
-	return logits
+	if d.opts.EndTokenID < 0 || d.opts.EndTokenID >= logits.Size() {
+		return logits
+	}
+	d.logger.Trace().Msgf("Sequence too short (%d), setting end token (%d) logits to -inf", sequenceLength, d.opts.EndTokenID)
+	adjusted := logits.Clone()
+	adjusted.SetVecScalar(d.opts.EndTokenID, floatNegInf)
+	return adjusted
 }
 
-func (d *Decoder) checkStopConditions(sequence []int) bool {
+// checkStopConditions reports whether the generation must stop after the
+// last token of the sequence, whose probability is tokenProb, recording the
+// condition in the stop trace.
+func (d *Decoder) checkStopConditions(sequence []int, tokenProb float64) bool {
+	step := len(sequence) - 1
 	if len(sequence) >= d.opts.MaxLen {
-		log.Trace().Msgf("Reached max length (%d)", d.opts.MaxLen)
+		d.logger.Trace().Msgf("Reached max length (%d)", d.opts.MaxLen)
+		d.stopTrace = StopTrace{Reason: StopReasonMaxLen, Step: step, StopSequenceIndex: -1}
 		return true
 	}
-	last := sequence[len(sequence)-1]
-	if last == d.opts.EndTokenID {
-		log.Trace().Msgf("Reached end token (%d)", d.opts.EndTokenID)
+	if sequence[step] == d.opts.EndTokenID {
+		d.logger.Trace().Msgf("Reached end token (%d)", d.opts.EndTokenID)
+		d.stopTrace = StopTrace{Reason: StopReasonEndToken, Step: step, StopSequenceIndex: -1}
 		return true
 	}
-	if len(sequence) >= d.opts.MinLen && hasStopSequence(sequence, d.opts.StopSequencesIDs) {
+	if d.opts.MaxChars > 0 && d.chars >= d.opts.MaxChars {
+		d.logger.Trace().Msgf("Reached max characters (%d)", d.opts.MaxChars)
+		d.stopTrace = StopTrace{Reason: StopReasonMaxChars, Step: step, StopSequenceIndex: -1}
 		return true
 	}
+	if len(sequence) >= d.opts.MinLen {
+		if index, stopSeq := d.matchedStopSequence(); stopSeq != nil {
+			d.logger.Trace().Msgf("Reached stop sequence %v", stopSeq)
+			d.stopTrace = StopTrace{Reason: StopReasonStopSequence, Step: step, StopSequenceIndex: index, StopSequence: stopSeq}
+			return true
+		}
+		if tokenProb < d.opts.MinTopProb {
+			d.logger.Trace().Msgf("Token probability %f below min top probability (%f)", tokenProb, d.opts.MinTopProb)
+			d.stopTrace = StopTrace{Reason: StopReasonMinTopProb, Step: step, StopSequenceIndex: -1}
+			return true
+		}
+	}
 	return false
 }
 
-func hasStopSequence(sequence []int, stopSequences [][]int) bool {
-	for _, stopSeq := range stopSequences {
-		if len(sequence) < len(stopSeq) {
-			continue
+// matchedStopSequence returns the stop sequence matched by the generated
+// tokens, according to the StopMatchMode, and its index, or -1 and nil.
+func (d *Decoder) matchedStopSequence() (int, []int) {
+	if d.opts.StopMatchMode == StopMatchAnywhere {
+		return d.stops.seen()
+	}
+	return d.stops.matched()
+}
+
+// countChars sets the text of the generated token, adding its characters to
+// the count, and trims it to respect MaxChars.
+// The bytes of a rune split between tokens are held back, so that the rune
+// is counted once, when it is complete.
+func (d *Decoder) countChars(gen *GeneratedToken) {
+	text := d.partial
+	if gen.TokenID >= 0 && gen.TokenID < len(d.vocabulary) {
+		text += d.vocabulary[gen.TokenID]
+	}
+	text, d.partial = splitIncompleteRune(text)
+	n := utf8.RuneCountInString(text)
+	if remaining := d.opts.MaxChars - d.chars; n > remaining {
+		text = trimChars(text, remaining)
+		n = remaining
+	}
+	gen.Text = text
+	d.chars += n
+}
+
+// flushChars adds the bytes held back by countChars to the text of the last
+// generated token, since no token can complete them anymore, as long as
+// they don't exceed MaxChars.
+func (d *Decoder) flushChars(gen *GeneratedToken) {
+	text := trimChars(d.partial, d.opts.MaxChars-d.chars)
+	gen.Text += text
+	d.chars += utf8.RuneCountInString(text)
+	d.partial = ""
+}
+
+// splitIncompleteRune splits the text before the incomplete rune it ends
+// with, if any, which the following text could complete.
+func splitIncompleteRune(text string) (string, string) {
+	for i := len(text) - 1; i >= 0 && len(text)-i < utf8.UTFMax; i-- {
+		if utf8.RuneStart(text[i]) {
+			if !utf8.FullRuneInString(text[i:]) {
+				return text[:i], text[i:]
+			}
+			break
 		}
+	}
+	return text, ""
+}
 
-		if reflect.DeepEqual(stopSeq, sequence[len(sequence)-len(stopSeq):]) {
-			log.Trace().Msgf("Reached stop sequence %v", stopSeq)
-			return true
+// trimChars returns the first n characters of the text, never splitting a
+// multi-byte character.
+func trimChars(text string, n int) string {
+	for i := range text {
+		if n == 0 {
+			return text[:i]
 		}
+		n--
 	}
-	return false
+	return text
+}
+
+// loggerFromContext returns the logger attached to the context, or the
+// global logger if there is none.
+func loggerFromContext(ctx context.Context) *zerolog.Logger {
+	if l := zerolog.Ctx(ctx); l.GetLevel() != zerolog.Disabled {
+		return l
+	}
+	return &log.Logger
+}
+
+// stopSequences returns the StopSequencesIDs followed by the StopSequences,
+// and whether each of them is removed from the output, or nil if there are
+// none.
+func stopSequences(opts DecodingOptions) ([][]int, []bool) {
+	n := len(opts.StopSequencesIDs) + len(opts.StopSequences)
+	if n == 0 {
+		return nil, nil
+	}
+	sequences := make([][]int, 0, n)
+	trim := make([]bool, 0, n)
+	for _, seq := range opts.StopSequencesIDs {
+		sequences = append(sequences, seq)
+		trim = append(trim, opts.TrimStopSequence)
+	}
+	for _, seq := range opts.StopSequences {
+		sequences = append(sequences, seq.IDs)
+		trim = append(trim, seq.Action == StopTrim)
+	}
+	return sequences, trim
+}
+
+// holdBack returns the number of the last generated tokens which are held
+// back, because they could be the beginning of a stop sequence to remove.
+func (d *Decoder) holdBack() int {
+	n := 0
+	for i, trim := range d.stopTrim {
+		if seq := d.stops.sequences[i]; trim && len(seq)-1 > n {
+			n = len(seq) - 1
+		}
+	}
+	return n
 }
 
 func (d *Decoder) encode(ctx context.Context, nt *ag.NodesTracker, tokenID int, state rwkv.State) (ag.Node, error) {
-	x, s := d.model.Encode(ctx, state, tokenID)
+	var x ag.Node
+	var s rwkv.State
+	if d.batcher != nil {
+		x, s = d.batcher.StepToken(ctx, tokenID, state)
+	} else {
+		x, s = d.model.StepToken(ctx, tokenID, state)
+	}
 	nt.TrackNodes(waitForNodes(extractNodesToRelease(x, s))...)
 	return x, nil
 }
@@ -0,0 +1,648 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package decoder
+
+import (
+	"context"
+	"errors"
+	"math"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/nlpodyssey/spago/ag"
+	"github.com/nlpodyssey/spago/mat"
+	"github.com/nlpodyssey/spago/mat/float"
+	"github.com/nlpodyssey/verbaflow/encoder"
+	"github.com/nlpodyssey/verbaflow/rwkvlm"
+	"github.com/nlpodyssey/verbaflow/rwkvlm/rwkvlmtest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// decodeAll runs the decoder on the given prompt, returning all the
+// generated tokens.
+func decodeAll(t *testing.T, m *rwkvlm.Model, d *Decoder, prompt []int) []GeneratedToken {
+	t.Helper()
+	ctx := context.Background()
+
+	input, err := encoder.New(m).Encode(ctx, prompt)
+	require.NoError(t, err)
+
+	nt := &ag.NodesTracker{}
+	defer nt.ReleaseNodes()
+
+	buf := &sliceBuffer{}
+	require.NoError(t, d.Decode(ctx, nt, input, buf))
+	require.True(t, buf.closed, "the buffer must be closed at the end")
+	return buf.tokens
+}
+
+// sliceBuffer is a Buffer which collects the generated tokens in memory.
+type sliceBuffer struct {
+	tokens []GeneratedToken
+	closed bool
+}
+
+func (b *sliceBuffer) Put(_ context.Context, token GeneratedToken) error {
+	b.tokens = append(b.tokens, token)
+	return nil
+}
+
+func (b *sliceBuffer) Close() error {
+	b.closed = true
+	return nil
+}
+
+func tokenIDs(generated []GeneratedToken) []int {
+	ids := make([]int, len(generated))
+	for i, gen := range generated {
+		ids[i] = gen.TokenID
+	}
+	return ids
+}
+
+// processorFunc adapts a function to the LogitsProcessor interface.
+type processorFunc func(sequence []int, logits mat.Matrix) (mat.Matrix, error)
+
+func (f processorFunc) Process(sequence []int, logits mat.Matrix) (mat.Matrix, error) {
+	return f(sequence, logits)
+}
+
+// newFlatModel returns a tiny model whose logits are always zero.
+func newFlatModel(vocabSize int) *rwkvlm.Model {
+	conf := rwkvlmtest.DefaultConfig
+	conf.VocabSize = vocabSize
+	m := rwkvlmtest.NewModel(conf, 1)
+	m.Linear.ReplaceValue(mat.NewEmptyDense[float32](conf.VocabSize, conf.DModel))
+	return m
+}
+
+// boostTokens returns a processor which adds a large bonus to the logit of
+// the token returned by preferred for the current sequence.
+func boostTokens(preferred func(sequence []int) int) LogitsProcessor {
+	return processorFunc(func(sequence []int, logits mat.Matrix) (mat.Matrix, error) {
+		id := preferred(sequence)
+		return logits.Apply(func(r, c int, v float64) float64 {
+			if r+c == id {
+				return v + 10
+			}
+			return v
+		}), nil
+	})
+}
+
+func TestDecoder_Decode_Scores(t *testing.T) {
+	m := rwkvlmtest.NewModel(rwkvlmtest.DefaultConfig, 1)
+	d, err := New(m, DecodingOptions{MaxLen: 10, EndTokenID: -1, Temp: 1, TopP: 1, UseSampling: true})
+	require.NoError(t, err)
+
+	generated := decodeAll(t, m, d, []int{1, 2, 3})
+	require.Len(t, generated, 10)
+
+	prevSum := 0.0
+	for _, gen := range generated {
+		assert.Greater(t, gen.TokenProb, 0.0)
+		assert.LessOrEqual(t, gen.TokenProb, 1.0)
+		assert.GreaterOrEqual(t, gen.SumNegLogProbs, prevSum)
+		assert.InDelta(t, prevSum-math.Log(gen.TokenProb), gen.SumNegLogProbs, 1e-9)
+		prevSum = gen.SumNegLogProbs
+	}
+}
+
+func TestDecoder_Decode_InvalidLogits(t *testing.T) {
+	for _, v := range []float32{float32(math.Inf(1)), float32(math.NaN())} {
+		m := newFlatModel(rwkvlmtest.DefaultConfig.VocabSize)
+		m.Linear.Value().SetScalar(3, 0, float.Interface(v))
+
+		d, err := New(m, DecodingOptions{MaxLen: 5, EndTokenID: -1, Temp: 1, TopP: 1})
+		require.NoError(t, err)
+
+		input, err := encoder.New(m).Encode(context.Background(), []int{1, 2})
+		require.NoError(t, err)
+
+		err = d.Decode(context.Background(), &ag.NodesTracker{}, input, &sliceBuffer{})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "token 3")
+		assert.Contains(t, err.Error(), "convert the model again")
+	}
+}
+
+func TestDecoder_Decode_Backpressure(t *testing.T) {
+	m := newFlatModel(8)
+	var steps atomic.Int32
+	countSteps := processorFunc(func(_ []int, logits mat.Matrix) (mat.Matrix, error) {
+		steps.Add(1)
+		return logits, nil
+	})
+	const maxLen = 50
+	d, err := New(m, DecodingOptions{MaxLen: maxLen, EndTokenID: -1, Temp: 1, TopP: 1}, countSteps)
+	require.NoError(t, err)
+
+	input, err := encoder.New(m).Encode(context.Background(), []int{1})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	nt := &ag.NodesTracker{}
+	defer nt.ReleaseNodes()
+
+	chGen := NewChannelBuffer(2)
+	done := make(chan error, 1)
+	go func() {
+		done <- d.Decode(ctx, nt, input, chGen)
+	}()
+
+	// slow consumer: the decoder can only be ahead by the buffer capacity,
+	// plus the token waiting to be sent
+	for received := 1; received <= 5; received++ {
+		<-chGen
+		time.Sleep(10 * time.Millisecond)
+		assert.LessOrEqual(t, int(steps.Load()), received+cap(chGen)+1)
+	}
+
+	// stop consuming, then cancel while the decoder is blocked
+	cancel()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("decoding did not stop after the context cancellation")
+	}
+	assert.Less(t, int(steps.Load()), maxLen)
+}
+
+func TestDecoder_Decode_MinLen(t *testing.T) {
+	const eos = 7
+	m := newFlatModel(8)
+	// without MinLen, the model would generate the end token right away
+	preferEOS := boostTokens(func([]int) int { return eos })
+
+	for _, minLen := range []int{0, 1, 3} {
+		d, err := New(m, DecodingOptions{MaxLen: 10, MinLen: minLen, EndTokenID: eos, Temp: 1, TopP: 1}, preferEOS)
+		require.NoError(t, err)
+		ids := tokenIDs(decodeAll(t, m, d, []int{1}))
+		// the end token is selectable precisely once the sequence has MinLen tokens
+		require.Len(t, ids, minLen+1, "MinLen %d", minLen)
+		assert.NotContains(t, ids[:minLen], eos)
+		assert.Equal(t, eos, ids[minLen])
+	}
+
+	// the logits predicted by the model are not modified
+	d, err := New(m, DecodingOptions{MinLen: 2, EndTokenID: eos, Temp: 1, TopP: 1})
+	require.NoError(t, err)
+	d.logger = loggerFromContext(context.Background())
+	logits := mat.NewVecDense(make([]float64, 8))
+	adjusted := d.adjustLogits(logits, 1)
+	assert.Equal(t, 0.0, logits.ScalarAt(eos, 0).F64())
+	assert.True(t, math.IsInf(adjusted.ScalarAt(eos, 0).F64(), -1))
+	assert.Same(t, logits, d.adjustLogits(logits, 2))
+
+	// without a valid end token, the logits are not adjusted
+	d, err = New(m, DecodingOptions{MaxLen: 3, MinLen: 2, EndTokenID: -1, Temp: 1, TopP: 1})
+	require.NoError(t, err)
+	assert.Len(t, decodeAll(t, m, d, []int{1}), 3)
+}
+
+func TestDecoder_Decode_Buffer(t *testing.T) {
+	m := newFlatModel(8)
+	alternate := boostTokens(func(sequence []int) int {
+		return 1 + len(sequence)%2
+	})
+	d, err := New(m, DecodingOptions{MaxLen: 6, EndTokenID: 7, Temp: 1, TopP: 1}, alternate)
+	require.NoError(t, err)
+
+	generated := decodeAll(t, m, d, []int{3})
+	assert.Equal(t, []int{1, 2, 1, 2, 1, 2}, tokenIDs(generated))
+
+	input, err := encoder.New(m).Encode(context.Background(), []int{3})
+	require.NoError(t, err)
+	chGen := make(chan GeneratedToken, 6)
+	require.NoError(t, d.DecodeToChannel(context.Background(), &ag.NodesTracker{}, input, chGen))
+
+	var fromChannel []GeneratedToken
+	for gen := range chGen {
+		fromChannel = append(fromChannel, gen)
+	}
+	assert.Equal(t, generated, fromChannel)
+}
+
+func TestDecoder_Decode_BufferError(t *testing.T) {
+	m := newFlatModel(8)
+	d, err := New(m, DecodingOptions{MaxLen: 6, EndTokenID: 7, Temp: 1, TopP: 1})
+	require.NoError(t, err)
+
+	input, err := encoder.New(m).Encode(context.Background(), []int{3})
+	require.NoError(t, err)
+
+	buf := &failingBuffer{}
+	err = d.Decode(context.Background(), &ag.NodesTracker{}, input, buf)
+	assert.ErrorIs(t, err, errBufferFull)
+	assert.True(t, buf.closed)
+}
+
+var errBufferFull = errors.New("buffer full")
+
+// failingBuffer is a Buffer which refuses any token.
+type failingBuffer struct {
+	closed bool
+}
+
+func (b *failingBuffer) Put(context.Context, GeneratedToken) error {
+	return errBufferFull
+}
+
+func (b *failingBuffer) Close() error {
+	b.closed = true
+	return nil
+}
+
+func TestDecoder_DecodeWithPolicy(t *testing.T) {
+	m := newFlatModel(8)
+	count := boostTokens(func(sequence []int) int {
+		return len(sequence) % 7
+	})
+	const maxLen = 30
+	d, err := New(m, DecodingOptions{MaxLen: maxLen, EndTokenID: -1, Temp: 1, TopP: 1}, count)
+	require.NoError(t, err)
+	expected := decodeAll(t, m, d, []int{1})
+	require.Len(t, expected, maxLen)
+
+	decode := func(policy DropPolicy, chGen chan GeneratedToken) chan error {
+		// the state is updated by the decoding, so the input is encoded each time
+		input, err := encoder.New(m).Encode(context.Background(), []int{1})
+		require.NoError(t, err)
+		done := make(chan error, 1)
+		go func() {
+			nt := &ag.NodesTracker{}
+			defer nt.ReleaseNodes()
+			done <- d.DecodeWithPolicy(context.Background(), nt, input, chGen, policy)
+		}()
+		return done
+	}
+
+	t.Run("block", func(t *testing.T) {
+		chGen := make(chan GeneratedToken, 2)
+		done := decode(DropPolicyBlock, chGen)
+
+		// slow consumer: every token is received anyway
+		var received []GeneratedToken
+		for gen := range chGen {
+			received = append(received, gen)
+			time.Sleep(time.Millisecond)
+		}
+		require.NoError(t, <-done)
+		assert.Equal(t, expected, received)
+	})
+
+	t.Run("drop-oldest", func(t *testing.T) {
+		chGen := make(chan GeneratedToken, 4)
+		done := decode(DropPolicyDropOldest, chGen)
+
+		// the consumer doesn't receive anything until the end of the
+		// generation, which doesn't wait for it
+		select {
+		case err := <-done:
+			require.NoError(t, err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("the decoding waited for the consumer")
+		}
+		var received []GeneratedToken
+		for gen := range chGen {
+			received = append(received, gen)
+		}
+		assert.Equal(t, expected[maxLen-cap(chGen):], received)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		chGen := make(chan GeneratedToken)
+		require.Error(t, <-decode(DropPolicyDropOldest, chGen), "unbuffered channel")
+		_, ok := <-chGen
+		assert.False(t, ok, "the channel must be closed")
+
+		chGen = make(chan GeneratedToken, 1)
+		require.Error(t, <-decode("drop-newest", chGen))
+	})
+}
+
+func TestDecoder_Decode_TrimStopSequence(t *testing.T) {
+	m := newFlatModel(8)
+	increasing := boostTokens(func(sequence []int) int {
+		return 1 + len(sequence)
+	})
+	tests := []struct {
+		name      string
+		opts      DecodingOptions
+		expected  []int
+		generated int
+	}{
+		{
+			name:      "not trimmed",
+			opts:      DecodingOptions{StopSequencesIDs: [][]int{{4, 5}, {7}}},
+			expected:  []int{1, 2, 3, 4, 5},
+			generated: 5,
+		},
+		{
+			name:      "trimmed",
+			opts:      DecodingOptions{StopSequencesIDs: [][]int{{4, 5}, {7}}, TrimStopSequence: true},
+			expected:  []int{1, 2, 3},
+			generated: 5,
+		},
+		{
+			name:      "partial match",
+			opts:      DecodingOptions{StopSequencesIDs: [][]int{{5, 1}}, TrimStopSequence: true},
+			expected:  []int{1, 2, 3, 4, 5, 6},
+			generated: 6,
+		},
+		{
+			name:      "end token",
+			opts:      DecodingOptions{StopSequencesIDs: [][]int{{3, 4}}, TrimStopSequence: true, EndTokenID: 3},
+			expected:  []int{1, 2, 3},
+			generated: 3,
+		},
+		{
+			name:      "stop-keep action",
+			opts:      DecodingOptions{StopSequences: []StopSequence{{IDs: []int{4, 5}, Action: StopKeep}}},
+			expected:  []int{1, 2, 3, 4, 5},
+			generated: 5,
+		},
+		{
+			name:      "stop-trim action",
+			opts:      DecodingOptions{StopSequences: []StopSequence{{IDs: []int{4, 5}, Action: StopTrim}}},
+			expected:  []int{1, 2, 3},
+			generated: 5,
+		},
+		{
+			name: "action of the matched sequence",
+			opts: DecodingOptions{
+				StopSequencesIDs: [][]int{{7}},
+				TrimStopSequence: true,
+				StopSequences:    []StopSequence{{IDs: []int{3, 4}}, {IDs: []int{6}, Action: StopTrim}},
+			},
+			expected:  []int{1, 2, 3, 4},
+			generated: 4,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := tt.opts
+			opts.MaxLen, opts.Temp, opts.TopP = 6, 1, 1
+			if opts.EndTokenID == 0 {
+				opts.EndTokenID = -1
+			}
+			d, err := New(m, opts, increasing)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, tokenIDs(decodeAll(t, m, d, []int{3})))
+			assert.Len(t, d.Sequence(), tt.generated)
+		})
+	}
+
+	t.Run("empty stop sequence", func(t *testing.T) {
+		opts := DecodingOptions{MaxLen: 6, Temp: 1, TopP: 1, StopSequencesIDs: [][]int{{4}, {}}}
+		_, err := New(m, opts)
+		assert.Error(t, err)
+		opts = DecodingOptions{MaxLen: 6, Temp: 1, TopP: 1, StopSequences: []StopSequence{{IDs: []int{4}}, {Action: StopTrim}}}
+		_, err = New(m, opts)
+		assert.Error(t, err)
+	})
+}
+
+func TestNew_InvalidStopAction(t *testing.T) {
+	opts := DecodingOptions{
+		MaxLen:        1,
+		Temp:          1,
+		TopP:          1,
+		StopSequences: []StopSequence{{IDs: []int{1}, Action: "stop-discard"}},
+	}
+	_, err := New(newFlatModel(8), opts)
+	assert.Error(t, err)
+}
+
+func TestDecoder_StopTrace(t *testing.T) {
+	m := newFlatModel(8)
+	increasing := boostTokens(func(sequence []int) int {
+		return 1 + len(sequence)
+	})
+	tests := []struct {
+		name     string
+		opts     DecodingOptions
+		expected StopTrace
+	}{
+		{
+			name:     "max length",
+			opts:     DecodingOptions{StopSequencesIDs: [][]int{{5, 1}}},
+			expected: StopTrace{Reason: StopReasonMaxLen, Step: 5, StopSequenceIndex: -1},
+		},
+		{
+			name:     "end token",
+			opts:     DecodingOptions{EndTokenID: 3},
+			expected: StopTrace{Reason: StopReasonEndToken, Step: 2, StopSequenceIndex: -1},
+		},
+		{
+			name: "stop sequence",
+			opts: DecodingOptions{StopSequencesIDs: [][]int{{7}, {2, 4}, {3, 4}, {4}}},
+			expected: StopTrace{
+				Reason:            StopReasonStopSequence,
+				Step:              3,
+				StopSequenceIndex: 2,
+				StopSequence:      []int{3, 4},
+			},
+		},
+		{
+			name: "stop sequence ignored before min length",
+			opts: DecodingOptions{StopSequencesIDs: [][]int{{4}, {5}}, MinLen: 5, EndTokenID: 7},
+			expected: StopTrace{
+				Reason:            StopReasonStopSequence,
+				Step:              4,
+				StopSequenceIndex: 1,
+				StopSequence:      []int{5},
+			},
+		},
+		{
+			name:     "suffix match mode",
+			opts:     DecodingOptions{StopSequencesIDs: [][]int{{2, 3}}, MinLen: 5, StopMatchMode: StopMatchSuffix},
+			expected: StopTrace{Reason: StopReasonMaxLen, Step: 5, StopSequenceIndex: -1},
+		},
+		{
+			name: "anywhere match mode",
+			opts: DecodingOptions{StopSequencesIDs: [][]int{{4, 6}, {2, 3}}, MinLen: 5, StopMatchMode: StopMatchAnywhere},
+			expected: StopTrace{
+				Reason:            StopReasonStopSequence,
+				Step:              4,
+				StopSequenceIndex: 1,
+				StopSequence:      []int{2, 3},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := tt.opts
+			opts.MaxLen, opts.Temp, opts.TopP = 6, 1, 1
+			if opts.EndTokenID == 0 {
+				opts.EndTokenID = -1
+			}
+			d, err := New(m, opts, increasing)
+			require.NoError(t, err)
+			decodeAll(t, m, d, []int{3})
+			assert.Equal(t, tt.expected, d.StopTrace())
+		})
+	}
+
+	t.Run("cancelled", func(t *testing.T) {
+		d, err := New(m, DecodingOptions{MaxLen: 6, EndTokenID: -1, Temp: 1, TopP: 1}, increasing)
+		require.NoError(t, err)
+		input, err := encoder.New(m).Encode(context.Background(), []int{3})
+		require.NoError(t, err)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		require.NoError(t, d.Decode(ctx, &ag.NodesTracker{}, input, &sliceBuffer{}))
+		assert.Equal(t, StopTrace{Reason: StopReasonCancelled, Step: 0, StopSequenceIndex: -1}, d.StopTrace())
+		assert.Equal(t, "cancelled at step 0", d.StopTrace().String())
+
+		d.Reset()
+		assert.Equal(t, StopTrace{}, d.StopTrace())
+	})
+}
+
+func TestDecoder_Decode_MinTopProb(t *testing.T) {
+	m := newFlatModel(8)
+	// the bonus of token 1 decreases at each step, and so does its
+	// probability: 0.955, 0.886, 0.742, 0.513, 0.280, 0.125
+	decaying := processorFunc(func(sequence []int, logits mat.Matrix) (mat.Matrix, error) {
+		return logits.Apply(func(r, c int, v float64) float64 {
+			if r+c == 1 {
+				return v + float64(5-len(sequence))
+			}
+			return v
+		}), nil
+	})
+	tests := []struct {
+		minTopProb float64
+		minLen     int
+		expected   StopTrace
+	}{
+		{minTopProb: 0.6, expected: StopTrace{Reason: StopReasonMinTopProb, Step: 3, StopSequenceIndex: -1}},
+		{minTopProb: 0.9, expected: StopTrace{Reason: StopReasonMinTopProb, Step: 1, StopSequenceIndex: -1}},
+		{minTopProb: 0.6, minLen: 5, expected: StopTrace{Reason: StopReasonMinTopProb, Step: 4, StopSequenceIndex: -1}},
+		{minTopProb: 0, expected: StopTrace{Reason: StopReasonMaxLen, Step: 5, StopSequenceIndex: -1}},
+	}
+	for _, tt := range tests {
+		opts := DecodingOptions{MaxLen: 6, MinLen: tt.minLen, MinTopProb: tt.minTopProb, EndTokenID: -1, Temp: 1, TopP: 1}
+		d, err := New(m, opts, decaying)
+		require.NoError(t, err)
+
+		generated := decodeAll(t, m, d, []int{3})
+		assert.Equal(t, tt.expected, d.StopTrace(), "minTopProb %v, minLen %d", tt.minTopProb, tt.minLen)
+		require.Len(t, generated, tt.expected.Step+1)
+		if tt.minTopProb > 0 {
+			// the token below the threshold is kept
+			last := generated[len(generated)-1]
+			assert.Equal(t, 1, last.TokenID)
+			assert.Less(t, last.TokenProb, tt.minTopProb)
+		}
+	}
+
+	_, err := New(m, DecodingOptions{MaxLen: 6, MinTopProb: 1.5, Temp: 1, TopP: 1})
+	assert.Error(t, err)
+}
+
+func TestDecoder_Decode_MaxChars(t *testing.T) {
+	m := newFlatModel(8)
+	increasing := boostTokens(func(sequence []int) int {
+		return 1 + len(sequence)
+	})
+	vocabulary := []string{"", "ab", "çé", "日本語", "!", "?", "x", "y"}
+	tests := []struct {
+		maxChars int
+		expected []string
+		reason   StopReason
+	}{
+		{maxChars: 5, expected: []string{"ab", "çé", "日"}, reason: StopReasonMaxChars},
+		{maxChars: 4, expected: []string{"ab", "çé"}, reason: StopReasonMaxChars},
+		{maxChars: 1, expected: []string{"a"}, reason: StopReasonMaxChars},
+		{maxChars: 100, expected: []string{"ab", "çé", "日本語", "!"}, reason: StopReasonMaxLen},
+	}
+	for _, tt := range tests {
+		d, err := New(m, DecodingOptions{MaxLen: 4, MaxChars: tt.maxChars, EndTokenID: -1, Temp: 1, TopP: 1}, increasing)
+		require.NoError(t, err)
+		d.SetVocabulary(vocabulary)
+
+		var text []string
+		for _, gen := range decodeAll(t, m, d, []int{3}) {
+			text = append(text, gen.Text)
+		}
+		assert.Equal(t, tt.expected, text, "maxChars %d", tt.maxChars)
+		assert.Equal(t, tt.reason, d.StopTrace().Reason)
+
+		joined := strings.Join(text, "")
+		assert.True(t, utf8.ValidString(joined))
+		assert.LessOrEqual(t, utf8.RuneCountInString(joined), tt.maxChars)
+	}
+
+	t.Run("rune split between tokens", func(t *testing.T) {
+		// "日" is split between the second and the third token
+		vocabulary := []string{"", "ab", "\xe6\x97", "\xa5本", "!"}
+		tests := []struct {
+			maxLen   int
+			maxChars int
+			expected []string
+		}{
+			{maxLen: 4, maxChars: 3, expected: []string{"ab", "", "日"}},
+			{maxLen: 4, maxChars: 100, expected: []string{"ab", "", "日本", "!"}},
+			{maxLen: 2, maxChars: 100, expected: []string{"ab", "\xe6\x97"}},
+			{maxLen: 2, maxChars: 3, expected: []string{"ab", "\xe6"}},
+		}
+		for _, tt := range tests {
+			d, err := New(m, DecodingOptions{MaxLen: tt.maxLen, MaxChars: tt.maxChars, EndTokenID: -1, Temp: 1, TopP: 1}, increasing)
+			require.NoError(t, err)
+			d.SetVocabulary(vocabulary)
+
+			var text []string
+			for _, gen := range decodeAll(t, m, d, []int{3}) {
+				text = append(text, gen.Text)
+			}
+			assert.Equal(t, tt.expected, text, "maxLen %d, maxChars %d", tt.maxLen, tt.maxChars)
+		}
+	})
+
+	d, err := New(m, DecodingOptions{MaxLen: 4, MaxChars: 5, EndTokenID: -1, Temp: 1, TopP: 1})
+	require.NoError(t, err)
+	input, err := encoder.New(m).Encode(context.Background(), []int{3})
+	require.NoError(t, err)
+	assert.Error(t, d.Decode(context.Background(), &ag.NodesTracker{}, input, &sliceBuffer{}), "the vocabulary is required")
+}
+
+func TestDecodingOptions_Validate(t *testing.T) {
+	m := newFlatModel(8)
+	valid := DecodingOptions{MaxLen: 4, Temp: 1, TopP: 1}
+	require.NoError(t, valid.Validate())
+
+	for _, update := range []func(opts *DecodingOptions){
+		func(opts *DecodingOptions) { opts.Temp = 2 },
+		func(opts *DecodingOptions) { opts.TopK = -1 },
+		func(opts *DecodingOptions) { opts.MinKeep = -1 },
+		func(opts *DecodingOptions) { opts.LogitClamp = -1 },
+		func(opts *DecodingOptions) { opts.TypicalP = 2 },
+		func(opts *DecodingOptions) { opts.Epsilon = 1 },
+		func(opts *DecodingOptions) { opts.Eta = -1 },
+		func(opts *DecodingOptions) { opts.StopSequencesIDs = [][]int{{}} },
+		func(opts *DecodingOptions) { opts.StopMatchMode = "bogus" },
+		func(opts *DecodingOptions) { opts.StopSequences = []StopSequence{{IDs: []int{1}, Action: "bogus"}} },
+		func(opts *DecodingOptions) { opts.MinTopProb = 2 },
+		func(opts *DecodingOptions) { opts.NoRepeatNGramSize = -1 },
+		func(opts *DecodingOptions) { opts.RepetitionPenalty = -1 },
+		func(opts *DecodingOptions) { opts.PenaltyWindow = -1 },
+	} {
+		opts := valid
+		update(&opts)
+		err := opts.Validate()
+		require.Error(t, err, "%+v", opts)
+		// New returns the same error
+		_, newErr := New(m, opts)
+		assert.Equal(t, err, newErr)
+	}
+}
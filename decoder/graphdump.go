@@ -0,0 +1,74 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package decoder
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/nlpodyssey/spago/ag"
+	"github.com/nlpodyssey/verbaflow/rwkvlm"
+)
+
+// StepGraph summarizes the computational graph of a step of the decoding.
+type StepGraph struct {
+	// Nodes is the number of operators of the graph.
+	Nodes int
+	// Leaves is the number of the other nodes, such as the parameters, the
+	// constants and the detached states.
+	Leaves int
+	// Ops maps the name of each operation, such as "Mul", to the number of
+	// its operators.
+	Ops map[string]int
+}
+
+// DumpStepGraph runs the prediction of the next token from the encoding x,
+// like a step of the decoding, and returns the summary of the graph which
+// computes the logits, including the graph of x.
+//
+// It is meant for performance debugging, together with ag.SetDebugMode
+// (LoadOptions.SyncExecution), which makes the operators run in the order
+// they are created. The graph is not released: x belongs to the caller.
+func DumpStepGraph(m *rwkvlm.Model, x ag.Node) StepGraph {
+	logits := m.Predict(x)
+	logits.Value()
+	g := StepGraph{Ops: make(map[string]int)}
+	visited := map[ag.Node]bool{logits: true}
+	stack := []ag.Node{logits}
+	for len(stack) > 0 {
+		n := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		op, ok := n.(*ag.Operator)
+		if !ok {
+			g.Leaves++
+			continue
+		}
+		g.Nodes++
+		g.Ops[op.Name()]++
+		for _, operand := range op.Operands() {
+			if !visited[operand] {
+				visited[operand] = true
+				stack = append(stack, operand)
+			}
+		}
+	}
+	return g
+}
+
+// String returns the summary on a single line, for the logs, with the
+// operations sorted by name.
+func (g StepGraph) String() string {
+	names := make([]string, 0, len(g.Ops))
+	for name := range g.Ops {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	ops := make([]string, len(names))
+	for i, name := range names {
+		ops[i] = fmt.Sprintf("%s=%d", name, g.Ops[name])
+	}
+	return fmt.Sprintf("%d nodes, %d leaves: %s", g.Nodes, g.Leaves, strings.Join(ops, " "))
+}
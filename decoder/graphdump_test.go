@@ -0,0 +1,35 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package decoder
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nlpodyssey/spago/ag"
+	"github.com/nlpodyssey/verbaflow/rwkvlm/rwkvlmtest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDumpStepGraph(t *testing.T) {
+	m := rwkvlmtest.NewModel(rwkvlmtest.DefaultConfig, 1)
+	x, _ := m.StepToken(context.Background(), 11, nil)
+
+	g := DumpStepGraph(m, x)
+	assert.Greater(t, g.Nodes, 0)
+	assert.Greater(t, g.Leaves, 0)
+	// the final linear projection, and the ones of the layers
+	assert.Greater(t, g.Ops["Mul"], rwkvlmtest.DefaultConfig.NumHiddenLayers)
+	total := 0
+	for _, n := range g.Ops {
+		total += n
+	}
+	assert.Equal(t, g.Nodes, total)
+	assert.Contains(t, g.String(), "Mul=")
+
+	// a detached encoding leaves only the prediction in the graph
+	g = DumpStepGraph(m, ag.Var(x.Value()))
+	assert.Equal(t, 1, g.Ops["Mul"])
+}
@@ -0,0 +1,422 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package decoder
+
+import (
+	"fmt"
+
+	"github.com/nlpodyssey/spago/mat"
+)
+
+var (
+	_ LogitsProcessor = &JSONConstraint{}
+	_ Resetter        = &JSONConstraint{}
+)
+
+// JSONConstraint is a LogitsProcessor which only allows the generation of
+// tokens that keep the output a valid prefix of a JSON document.
+//
+// The top-level value must be an object or an array. Once it is complete,
+// the end token is the only token allowed, and it is not allowed before.
+type JSONConstraint struct {
+	// vocabulary maps each token ID to its text.
+	vocabulary []string
+	// tokens is the trie of the texts of the vocabulary, built once, so
+	// that each step checks the common prefixes of the tokens only once.
+	tokens     *tokenTrie
+	endTokenID int
+	// allowed is reused at each step to mark the tokens which continue the
+	// output.
+	allowed []bool
+	state   jsonState
+	// consumed is the number of tokens of the sequence already fed to the state.
+	consumed int
+}
+
+// NewJSONConstraint returns a new JSONConstraint.
+// The vocabulary maps each token ID to its reconstructed text.
+func NewJSONConstraint(vocabulary []string, endTokenID int) *JSONConstraint {
+	return &JSONConstraint{
+		vocabulary: vocabulary,
+		tokens:     newTokenTrie(vocabulary, endTokenID),
+		endTokenID: endTokenID,
+		allowed:    make([]bool, len(vocabulary)),
+	}
+}
+
+// Process satisfies the LogitsProcessor interface.
+func (c *JSONConstraint) Process(sequence []int, logits mat.Matrix) (mat.Matrix, error) {
+	for _, id := range sequence[c.consumed:] {
+		if !c.state.feed(c.tokenText(id)) {
+			return nil, fmt.Errorf("token %d (%q) makes the output invalid JSON", id, c.tokenText(id))
+		}
+	}
+	c.consumed = len(sequence)
+
+	for i := range c.allowed {
+		c.allowed[i] = false
+	}
+	done := c.state.mode == jsonDone
+	if !done {
+		c.tokens.allow(c.state, c.allowed)
+	}
+	anyAllowed := false
+	out := maskLogits(logits, func(id int) bool {
+		var ok bool
+		if id == c.endTokenID {
+			ok = done
+		} else if id >= 0 && id < len(c.allowed) {
+			ok = c.allowed[id]
+		}
+		anyAllowed = anyAllowed || ok
+		return ok
+	})
+	if !anyAllowed {
+		return nil, fmt.Errorf("no token can continue the JSON output")
+	}
+	return out, nil
+}
+
+// Reset satisfies the Resetter interface.
+func (c *JSONConstraint) Reset() {
+	c.state = jsonState{}
+	c.consumed = 0
+}
+
+func (c *JSONConstraint) tokenText(id int) string {
+	if id < 0 || id >= len(c.vocabulary) {
+		return ""
+	}
+	return c.vocabulary[id]
+}
+
+// tokenTrie is a trie of the texts of the tokens, by rune.
+type tokenTrie struct {
+	// ids are the tokens whose text ends at this node.
+	ids      []int
+	children map[rune]*tokenTrie
+}
+
+// newTokenTrie returns the trie of the texts of the vocabulary, except the
+// end token and the tokens without text, which are never allowed by it.
+func newTokenTrie(vocabulary []string, endTokenID int) *tokenTrie {
+	root := &tokenTrie{}
+	for id, text := range vocabulary {
+		if id == endTokenID || text == "" {
+			continue
+		}
+		node := root
+		for _, r := range text {
+			child, ok := node.children[r]
+			if !ok {
+				if node.children == nil {
+					node.children = make(map[rune]*tokenTrie)
+				}
+				child = &tokenTrie{}
+				node.children[r] = child
+			}
+			node = child
+		}
+		node.ids = append(node.ids, id)
+	}
+	return root
+}
+
+// allow marks the tokens of the trie whose text keeps the state a valid JSON
+// prefix, skipping the whole subtree of any prefix which doesn't.
+func (t *tokenTrie) allow(s jsonState, allowed []bool) {
+	for _, id := range t.ids {
+		allowed[id] = true
+	}
+	for r, child := range t.children {
+		next := s
+		if next.step(r) {
+			child.allow(next, allowed)
+		}
+	}
+}
+
+type jsonMode uint8
+
+const (
+	jsonStart         jsonMode = iota // expecting the top-level object or array
+	jsonValue                         // expecting a value
+	jsonArrayFirst                    // after '[': expecting a value or ']'
+	jsonObjectFirst                   // after '{': expecting a key or '}'
+	jsonKey                           // after ',' in an object: expecting a key
+	jsonColon                         // after a key: expecting ':'
+	jsonAfterValue                    // expecting ',' or a closing bracket
+	jsonString                        // inside a string
+	jsonStringEscape                  // after '\' in a string
+	jsonStringUnicode                 // inside a \uXXXX escape
+	jsonNumber                        // inside a number
+	jsonLiteral                       // inside true, false or null
+	jsonDone                          // the top-level value is complete
+)
+
+type jsonNumberMode uint8
+
+const (
+	numMinus jsonNumberMode = iota // after '-'
+	numZero                        // after a leading '0'
+	numInt                         // inside the integer part
+	numDot                         // after '.'
+	numFrac                        // inside the fraction part
+	numE                           // after 'e' or 'E'
+	numESign                       // after the exponent sign
+	numExp                         // inside the exponent
+)
+
+// jsonState is a minimal incremental JSON scanner.
+//
+// It is a value type: copying it is enough to explore a continuation
+// without affecting the original, since the stack is never modified in place.
+type jsonState struct {
+	// stack of the open containers, each one either '{' or '['.
+	stack   []byte
+	mode    jsonMode
+	isKey   bool   // the string being scanned is an object key
+	hex     int    // remaining hex digits of a \u escape
+	literal string // remaining characters of a literal
+	num     jsonNumberMode
+}
+
+// feed advances the state with the given text, reporting whether the
+// result is still a valid JSON prefix.
+func (s *jsonState) feed(text string) bool {
+	for _, c := range text {
+		if !s.step(c) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *jsonState) step(c rune) bool {
+	switch s.mode {
+	case jsonString:
+		switch {
+		case c == '"':
+			s.endString()
+		case c == '\\':
+			s.mode = jsonStringEscape
+		case c < 0x20:
+			return false
+		}
+		return true
+	case jsonStringEscape:
+		switch c {
+		case '"', '\\', '/', 'b', 'f', 'n', 'r', 't':
+			s.mode = jsonString
+		case 'u':
+			s.mode = jsonStringUnicode
+			s.hex = 4
+		default:
+			return false
+		}
+		return true
+	case jsonStringUnicode:
+		if !isHexDigit(c) {
+			return false
+		}
+		if s.hex--; s.hex == 0 {
+			s.mode = jsonString
+		}
+		return true
+	case jsonLiteral:
+		if c != rune(s.literal[0]) {
+			return false
+		}
+		if s.literal = s.literal[1:]; s.literal == "" {
+			s.endValue()
+		}
+		return true
+	case jsonNumber:
+		if s.stepNumber(c) {
+			return true
+		}
+		if !s.numberComplete() {
+			return false
+		}
+		s.endValue() // the character is handled below
+	}
+
+	if isJSONSpace(c) {
+		return true
+	}
+
+	switch s.mode {
+	case jsonStart:
+		return (c == '{' || c == '[') && s.beginValue(c)
+	case jsonArrayFirst:
+		if c == ']' {
+			return s.close(c)
+		}
+		return s.beginValue(c)
+	case jsonValue:
+		return s.beginValue(c)
+	case jsonObjectFirst:
+		if c == '}' {
+			return s.close(c)
+		}
+		return s.beginKey(c)
+	case jsonKey:
+		return s.beginKey(c)
+	case jsonColon:
+		if c != ':' {
+			return false
+		}
+		s.mode = jsonValue
+		return true
+	case jsonAfterValue:
+		switch c {
+		case ',':
+			if s.stack[len(s.stack)-1] == '{' {
+				s.mode = jsonKey
+			} else {
+				s.mode = jsonValue
+			}
+			return true
+		case '}', ']':
+			return s.close(c)
+		}
+	}
+	return false
+}
+
+func (s *jsonState) beginKey(c rune) bool {
+	if c != '"' {
+		return false
+	}
+	s.mode = jsonString
+	s.isKey = true
+	return true
+}
+
+func (s *jsonState) beginValue(c rune) bool {
+	switch {
+	case c == '{':
+		s.push('{')
+		s.mode = jsonObjectFirst
+	case c == '[':
+		s.push('[')
+		s.mode = jsonArrayFirst
+	case c == '"':
+		s.mode = jsonString
+	case c == '-':
+		s.mode, s.num = jsonNumber, numMinus
+	case c == '0':
+		s.mode, s.num = jsonNumber, numZero
+	case c >= '1' && c <= '9':
+		s.mode, s.num = jsonNumber, numInt
+	case c == 't':
+		s.mode, s.literal = jsonLiteral, "rue"
+	case c == 'f':
+		s.mode, s.literal = jsonLiteral, "alse"
+	case c == 'n':
+		s.mode, s.literal = jsonLiteral, "ull"
+	default:
+		return false
+	}
+	return true
+}
+
+func (s *jsonState) stepNumber(c rune) bool {
+	isDigit := c >= '0' && c <= '9'
+	isExp := c == 'e' || c == 'E'
+	switch s.num {
+	case numMinus:
+		switch {
+		case c == '0':
+			s.num = numZero
+		case isDigit:
+			s.num = numInt
+		default:
+			return false
+		}
+	case numZero, numInt:
+		switch {
+		case isDigit && s.num == numInt:
+		case c == '.':
+			s.num = numDot
+		case isExp:
+			s.num = numE
+		default:
+			return false
+		}
+	case numDot, numFrac:
+		switch {
+		case isDigit:
+			s.num = numFrac
+		case isExp && s.num == numFrac:
+			s.num = numE
+		default:
+			return false
+		}
+	case numE:
+		switch {
+		case c == '+' || c == '-':
+			s.num = numESign
+		case isDigit:
+			s.num = numExp
+		default:
+			return false
+		}
+	case numESign, numExp:
+		if !isDigit {
+			return false
+		}
+		s.num = numExp
+	}
+	return true
+}
+
+func (s *jsonState) numberComplete() bool {
+	return s.num == numZero || s.num == numInt || s.num == numFrac || s.num == numExp
+}
+
+func (s *jsonState) endString() {
+	if s.isKey {
+		s.isKey = false
+		s.mode = jsonColon
+		return
+	}
+	s.endValue()
+}
+
+func (s *jsonState) endValue() {
+	if len(s.stack) == 0 {
+		s.mode = jsonDone
+		return
+	}
+	s.mode = jsonAfterValue
+}
+
+func (s *jsonState) close(c rune) bool {
+	open := byte('{')
+	if c == ']' {
+		open = '['
+	}
+	if len(s.stack) == 0 || s.stack[len(s.stack)-1] != open {
+		return false
+	}
+	s.stack = s.stack[:len(s.stack)-1]
+	s.endValue()
+	return true
+}
+
+// push appends a container to the stack, always allocating a new backing
+// array so that copies of the state are never affected.
+func (s *jsonState) push(c byte) {
+	s.stack = append(s.stack[:len(s.stack):len(s.stack)], c)
+}
+
+func isJSONSpace(c rune) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+func isHexDigit(c rune) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
@@ -0,0 +1,158 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package decoder
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/nlpodyssey/spago/mat"
+	"github.com/nlpodyssey/verbaflow/rwkvlm/rwkvlmtest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJSONState_Feed(t *testing.T) {
+	tests := []struct {
+		text  string
+		valid bool
+		done  bool
+	}{
+		{``, true, false},
+		{` {`, true, false},
+		{`{}`, true, true},
+		{`[]`, true, true},
+		{`[1, -2.5e+3, 0, true, false, null, "x"]`, true, true},
+		{`{"a": {"b": [1, {"c": "è\n"}]}}`, true, true},
+		{`{"a": 1`, true, false},
+		{`{"a": 12.`, true, false},
+		{`"a"`, false, false},
+		{`1`, false, false},
+		{`{1`, false, false},
+		{`{"a" 1`, false, false},
+		{`{"a": 01`, false, false},
+		{`{"a": 1]`, false, false},
+		{`[1,]`, false, false},
+		{`[tru]`, false, false},
+		{`["\x"]`, false, false},
+		{`{} {`, false, false},
+	}
+	for _, tt := range tests {
+		var s jsonState
+		assert.Equalf(t, tt.valid, s.feed(tt.text), "valid %q", tt.text)
+		if tt.valid {
+			assert.Equalf(t, tt.done, s.mode == jsonDone, "done %q", tt.text)
+		}
+	}
+}
+
+func TestJSONState_CopyIsIndependent(t *testing.T) {
+	var s jsonState
+	require.True(t, s.feed(`[[`))
+
+	c := s
+	require.True(t, c.feed(`]]`))
+	assert.Equal(t, jsonDone, c.mode)
+
+	require.True(t, s.feed(`{}]]`))
+	assert.Equal(t, jsonDone, s.mode)
+}
+
+func TestJSONConstraint_Process(t *testing.T) {
+	vocab := []string{"", "{", "}", "x", `"a"`, ":", "1"}
+	c := NewJSONConstraint(vocab, 0)
+
+	logits := mat.NewVecDense([]float32{1, 1, 1, 1, 1, 1, 1})
+
+	out, err := c.Process(nil, logits)
+	require.NoError(t, err)
+	assert.Equal(t, []bool{false, true, false, false, false, false, false}, finiteMask(out))
+
+	out, err = c.Process([]int{1}, logits)
+	require.NoError(t, err)
+	assert.Equal(t, []bool{false, false, true, false, true, false, false}, finiteMask(out))
+
+	out, err = c.Process([]int{1, 4, 5, 6, 2}, logits)
+	require.NoError(t, err)
+	assert.Equal(t, []bool{true, false, false, false, false, false, false}, finiteMask(out))
+
+	assert.Equal(t, []float32{1, 1, 1, 1, 1, 1, 1}, logits.Data().F32(), "the input logits must not be modified")
+}
+
+func TestJSONConstraint_SharedPrefixes(t *testing.T) {
+	// the tokens sharing a prefix are checked together, which must allow
+	// the same tokens as checking each text on its own
+	vocab := []string{"", "{", `{"`, `{"a`, `{"a"`, `{"a":`, `{"a":1`, `{"a":1}`, `{}`, `{]`, "[", "[1", "[1,", "[1]", "]", "}", `"`, `"a"`, `"a":`, "1", "12", "1x", ":", ",", "x", "è"}
+	logits := mat.NewVecDense(make([]float32, len(vocab)))
+
+	for _, prefix := range [][]int{nil, {1}, {2}, {4}, {5}, {10}, {11}, {1, 17, 22, 19}} {
+		out, err := NewJSONConstraint(vocab, 0).Process(prefix, logits)
+		require.NoError(t, err)
+
+		var state jsonState
+		require.True(t, state.feed(reconstruct(vocab, prefix)))
+		expected := make([]bool, len(vocab))
+		for id, text := range vocab {
+			s := state
+			expected[id] = text != "" && s.feed(text)
+		}
+		assert.Equal(t, expected, finiteMask(out), "after %q", reconstruct(vocab, prefix))
+	}
+}
+
+func TestJSONConstraint_Decode(t *testing.T) {
+	// Closing tokens come first, so that on equal logits the greedy
+	// decoding always picks them when allowed.
+	vocab := []string{"", "x", "]", "}", "1", `{"a":`, "[", ",", `"b":`}
+	conf := rwkvlmtest.DefaultConfig
+	conf.VocabSize = len(vocab)
+
+	t.Run("greedy decoding on equal logits", func(t *testing.T) {
+		m := newFlatModel(len(vocab))
+		d, err := New(m, DecodingOptions{MaxLen: 20, Temp: 1, TopP: 1}, NewJSONConstraint(vocab, 0))
+		require.NoError(t, err)
+
+		out := reconstruct(vocab, tokenIDs(decodeAll(t, m, d, []int{1})))
+		assert.Equal(t, `{"a":1}`, out)
+
+		out = reconstruct(vocab, tokenIDs(decodeAll(t, m, d, []int{1})))
+		assert.Equal(t, `{"a":1}`, out, "the decoder must be reusable")
+	})
+
+	t.Run("sampling on a random model", func(t *testing.T) {
+		for seed := int64(1); seed <= 5; seed++ {
+			m := rwkvlmtest.NewModel(conf, seed)
+			d, err := New(m, DecodingOptions{MaxLen: 100, Temp: 1, TopP: 1, UseSampling: true}, NewJSONConstraint(vocab, 0))
+			require.NoError(t, err)
+
+			ids := tokenIDs(decodeAll(t, m, d, []int{1}))
+			out := reconstruct(vocab, ids)
+			if ids[len(ids)-1] == 0 {
+				assert.Truef(t, json.Valid([]byte(out)), "output %q must be valid JSON", out)
+				continue
+			}
+			var s jsonState
+			assert.Truef(t, s.feed(out), "output %q must be a valid JSON prefix", out)
+		}
+	})
+}
+
+func finiteMask(m mat.Matrix) []bool {
+	data := m.Data().F64()
+	mask := make([]bool, len(data))
+	for i, v := range data {
+		mask[i] = v > floatNegInf.F64()
+	}
+	return mask
+}
+
+func reconstruct(vocab []string, ids []int) string {
+	var sb strings.Builder
+	for _, id := range ids {
+		sb.WriteString(vocab[id])
+	}
+	return sb.String()
+}
@@ -0,0 +1,80 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package decoder
+
+import (
+	"encoding/binary"
+
+	"github.com/nlpodyssey/spago/mat"
+)
+
+var (
+	_ LogitsProcessor = &NoRepeatNGram{}
+	_ Resetter        = &NoRepeatNGram{}
+)
+
+// NoRepeatNGram is a LogitsProcessor which prevents the generation of any
+// n-gram of tokens that has already been generated.
+type NoRepeatNGram struct {
+	size int
+	// forbidden maps each (n-1)-gram to the tokens that already followed it.
+	forbidden map[string]map[int]struct{}
+	// consumed is the number of tokens of the sequence already indexed.
+	consumed int
+}
+
+// NewNoRepeatNGram returns a new NoRepeatNGram for n-grams of the given size.
+func NewNoRepeatNGram(size int) *NoRepeatNGram {
+	return &NoRepeatNGram{
+		size:      size,
+		forbidden: make(map[string]map[int]struct{}),
+	}
+}
+
+// Process satisfies the LogitsProcessor interface.
+func (p *NoRepeatNGram) Process(sequence []int, logits mat.Matrix) (mat.Matrix, error) {
+	n := p.size
+	start := p.consumed
+	if start < n-1 {
+		start = n - 1
+	}
+	for end := start; end < len(sequence); end++ {
+		key := ngramKey(sequence[end-n+1 : end])
+		next, ok := p.forbidden[key]
+		if !ok {
+			next = make(map[int]struct{})
+			p.forbidden[key] = next
+		}
+		next[sequence[end]] = struct{}{}
+	}
+	p.consumed = len(sequence)
+
+	if len(sequence) < n-1 {
+		return logits, nil
+	}
+	next := p.forbidden[ngramKey(sequence[len(sequence)-n+1:])]
+	if len(next) == 0 {
+		return logits, nil
+	}
+	return maskLogits(logits, func(id int) bool {
+		_, isForbidden := next[id]
+		return !isForbidden
+	}), nil
+}
+
+// Reset satisfies the Resetter interface.
+func (p *NoRepeatNGram) Reset() {
+	p.forbidden = make(map[string]map[int]struct{})
+	p.consumed = 0
+}
+
+// ngramKey returns a map key representing the given sequence of tokens.
+func ngramKey(tokens []int) string {
+	b := make([]byte, 0, len(tokens)*binary.MaxVarintLen64)
+	for _, t := range tokens {
+		b = binary.AppendVarint(b, int64(t))
+	}
+	return string(b)
+}
@@ -0,0 +1,63 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package decoder
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNoRepeatNGram_Decode(t *testing.T) {
+	const a, b = 1, 2
+	m := newFlatModel(8)
+	// without constraints, the model would generate "a b a b a b"
+	alternate := boostTokens(func(sequence []int) int {
+		return a + len(sequence)%2
+	})
+
+	t.Run("without blocking", func(t *testing.T) {
+		d, err := New(m, DecodingOptions{MaxLen: 6, EndTokenID: 7, Temp: 1, TopP: 1}, alternate)
+		require.NoError(t, err)
+		assert.Equal(t, []int{a, b, a, b, a, b}, tokenIDs(decodeAll(t, m, d, []int{3})))
+	})
+
+	t.Run("with bigram blocking", func(t *testing.T) {
+		opts := DecodingOptions{MaxLen: 6, EndTokenID: 7, Temp: 1, TopP: 1, NoRepeatNGramSize: 2}
+		d, err := New(m, opts, alternate)
+		require.NoError(t, err)
+
+		ids := tokenIDs(decodeAll(t, m, d, []int{3}))
+		require.Len(t, ids, 6)
+		assert.Equal(t, []int{a, b, a}, ids[:3])
+
+		seen := make(map[[2]int]bool)
+		for i := 1; i < len(ids); i++ {
+			bigram := [2]int{ids[i-1], ids[i]}
+			assert.Falsef(t, seen[bigram], "bigram %v repeated in %v", bigram, ids)
+			seen[bigram] = true
+		}
+	})
+}
+
+func TestNoRepeatNGram_Decode_Reuse(t *testing.T) {
+	m := newFlatModel(8)
+	alternate := boostTokens(func(sequence []int) int {
+		return 1 + len(sequence)%2
+	})
+	opts := DecodingOptions{MaxLen: 6, EndTokenID: 7, Temp: 1, TopP: 1, NoRepeatNGramSize: 2}
+	d, err := New(m, opts, alternate)
+	require.NoError(t, err)
+
+	first := tokenIDs(decodeAll(t, m, d, []int{3}))
+	second := tokenIDs(decodeAll(t, m, d, []int{3}))
+	assert.Equal(t, first, second, "the second generation must not be affected by the first one")
+}
+
+func TestNew_InvalidNoRepeatNGramSize(t *testing.T) {
+	_, err := New(newFlatModel(4), DecodingOptions{Temp: 1, TopP: 1, NoRepeatNGramSize: -1})
+	assert.Error(t, err)
+}
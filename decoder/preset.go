@@ -0,0 +1,75 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package decoder
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// presets are the curated decoding options returned by Preset.
+var presets = map[string]DecodingOptions{
+	"deterministic": {MaxLen: 200, Temp: 0, TopP: 1, UseSampling: false},
+	"precise":       {MaxLen: 200, Temp: 0.5, TopK: 40, TopP: 0.7, UseSampling: true},
+	"balanced":      {MaxLen: 200, Temp: 0.8, TopP: 0.9, UseSampling: true},
+	"creative":      {MaxLen: 200, Temp: 1, TopP: 0.95, RepetitionPenalty: 1.1, UseSampling: true},
+}
+
+// Preset returns the decoding options of the preset with the given name:
+//
+//   - "deterministic": greedy decoding, which always selects the most
+//     probable token (UseSampling false, Temp 0, TopP 1);
+//   - "precise": sampling among few probable tokens (Temp 0.5, TopK 40,
+//     TopP 0.7);
+//   - "balanced": sampling with a moderate randomness (Temp 0.8, TopP 0.9);
+//   - "creative": sampling with the full randomness of the model and a mild
+//     penalty on the repetitions (Temp 1, TopP 0.95, RepetitionPenalty 1.1).
+//
+// All of them generate at most 200 tokens (MaxLen), and the other options
+// are zero, so the EndTokenID is 0, the end token of the RWKV Pile models.
+func Preset(name string) (DecodingOptions, error) {
+	opts, ok := presets[name]
+	if !ok {
+		return DecodingOptions{}, fmt.Errorf("unknown preset %q: must be one of %s", name, strings.Join(PresetNames(), ", "))
+	}
+	return opts, nil
+}
+
+// PresetNames returns the names of the presets, sorted.
+func PresetNames() []string {
+	names := make([]string, 0, len(presets))
+	for name := range presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// UnmarshalOptions decodes the decoding options from a configuration, such
+// as a YAML or JSON document, with the given unmarshal function, for example
+// yaml.Unmarshal or json.Unmarshal.
+//
+// If the configuration has a "preset" field, the options start from the
+// named Preset, and the other fields of the configuration override it.
+func UnmarshalOptions(data []byte, unmarshal func([]byte, any) error) (DecodingOptions, error) {
+	var ref struct {
+		Preset string `json:"preset" yaml:"preset"`
+	}
+	if err := unmarshal(data, &ref); err != nil {
+		return DecodingOptions{}, err
+	}
+	var opts DecodingOptions
+	if ref.Preset != "" {
+		var err error
+		if opts, err = Preset(ref.Preset); err != nil {
+			return DecodingOptions{}, err
+		}
+	}
+	if err := unmarshal(data, &opts); err != nil {
+		return DecodingOptions{}, err
+	}
+	return opts, nil
+}
@@ -0,0 +1,54 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package decoder
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPreset(t *testing.T) {
+	opts, err := Preset("deterministic")
+	require.NoError(t, err)
+	assert.False(t, opts.UseSampling)
+	assert.Equal(t, minTemperature, effectiveTemperature(opts.Temp))
+
+	// all the presets are valid
+	for _, name := range PresetNames() {
+		opts, err := Preset(name)
+		require.NoError(t, err)
+		_, err = New(newFlatModel(8), opts)
+		assert.NoError(t, err, "preset %q", name)
+	}
+
+	_, err = Preset("unknown")
+	assert.Error(t, err)
+}
+
+func TestUnmarshalOptions(t *testing.T) {
+	opts, err := UnmarshalOptions([]byte(`{"preset": "deterministic", "max_len": 10, "min_len": 2}`), json.Unmarshal)
+	require.NoError(t, err)
+	expected, err := Preset("deterministic")
+	require.NoError(t, err)
+	expected.MaxLen, expected.MinLen = 10, 2
+	assert.Equal(t, expected, opts)
+
+	opts, err = UnmarshalOptions([]byte(`{"preset": "creative", "temp": 0.7}`), json.Unmarshal)
+	require.NoError(t, err)
+	assert.Equal(t, 0.7, opts.Temp)
+	assert.Equal(t, 0.95, opts.TopP)
+	assert.True(t, opts.UseSampling)
+
+	// without a preset, the options are decoded as they are
+	opts, err = UnmarshalOptions([]byte(`{"max_len": 10}`), json.Unmarshal)
+	require.NoError(t, err)
+	assert.Equal(t, DecodingOptions{MaxLen: 10}, opts)
+
+	_, err = UnmarshalOptions([]byte(`{"preset": "unknown"}`), json.Unmarshal)
+	assert.Error(t, err)
+}
@@ -0,0 +1,42 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package decoder
+
+import (
+	"math"
+
+	"github.com/nlpodyssey/spago/mat"
+)
+
+// LogitsProcessor adjusts the logits of the next token taking into account
+// the sequence of token IDs generated so far.
+//
+// Processors are applied before the output diversity control, so that any
+// token they filter out (by setting its logit to -inf) is never considered
+// by the selection step.
+type LogitsProcessor interface {
+	// Process returns the adjusted logits for the next token.
+	// Implementations must not modify the given logits in place.
+	Process(sequence []int, logits mat.Matrix) (mat.Matrix, error)
+}
+
+// Resetter is implemented by the stateful LogitsProcessors, so that the same
+// instance can be reused for a new generation.
+type Resetter interface {
+	// Reset forgets any sequence processed so far.
+	Reset()
+}
+
+// maskLogits returns a copy of the logits where the scores of the tokens
+// for which keep returns false are set to -inf.
+func maskLogits(logits mat.Matrix, keep func(tokenID int) bool) mat.Matrix {
+	return logits.Apply(func(r, c int, v float64) float64 {
+		// logits are vectors, so one of the two indices is always zero
+		if keep(r + c) {
+			return v
+		}
+		return math.Inf(-1)
+	})
+}
@@ -0,0 +1,81 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package decoder
+
+import (
+	"github.com/nlpodyssey/spago/mat"
+)
+
+var (
+	_ LogitsProcessor = &RepetitionPenalty{}
+	_ Resetter        = &RepetitionPenalty{}
+)
+
+// RepetitionPenalty is a LogitsProcessor which discourages the generation
+// of the tokens already generated, dividing their positive logits by the
+// penalty and multiplying the negative ones, as in CTRL.
+//
+// With a positive window, only the last window tokens are penalized, so
+// that a token can be generated again once it falls out of it.
+type RepetitionPenalty struct {
+	penalty float64
+	window  int
+	// counts maps the tokens in the window to their occurrences.
+	counts map[int]int
+	// consumed is the number of tokens of the sequence already counted.
+	consumed int
+}
+
+// NewRepetitionPenalty returns a new RepetitionPenalty. A zero window means
+// that all the generated tokens are penalized.
+func NewRepetitionPenalty(penalty float64, window int) *RepetitionPenalty {
+	return &RepetitionPenalty{
+		penalty: penalty,
+		window:  window,
+		counts:  make(map[int]int),
+	}
+}
+
+// Process satisfies the LogitsProcessor interface.
+// The window is updated incrementally with the tokens added to the sequence
+// since the previous call.
+func (p *RepetitionPenalty) Process(sequence []int, logits mat.Matrix) (mat.Matrix, error) {
+	for i := p.consumed; i < len(sequence); i++ {
+		p.counts[sequence[i]]++
+		if p.window > 0 && i >= p.window {
+			p.remove(sequence[i-p.window])
+		}
+	}
+	p.consumed = len(sequence)
+
+	if len(p.counts) == 0 {
+		return logits, nil
+	}
+	return logits.Apply(func(r, c int, v float64) float64 {
+		// logits are vectors, so one of the two indices is always zero
+		if p.counts[r+c] == 0 {
+			return v
+		}
+		if v > 0 {
+			return v / p.penalty
+		}
+		return v * p.penalty
+	}), nil
+}
+
+// remove removes an occurrence of the token from the window.
+func (p *RepetitionPenalty) remove(tokenID int) {
+	if p.counts[tokenID] <= 1 {
+		delete(p.counts, tokenID)
+		return
+	}
+	p.counts[tokenID]--
+}
+
+// Reset satisfies the Resetter interface.
+func (p *RepetitionPenalty) Reset() {
+	p.counts = make(map[int]int)
+	p.consumed = 0
+}
@@ -0,0 +1,69 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package decoder
+
+import (
+	"testing"
+
+	"github.com/nlpodyssey/spago/mat"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRepetitionPenalty_Process(t *testing.T) {
+	logits := mat.NewVecDense([]float64{1, 1, 1, 1, -1, -1})
+	p := NewRepetitionPenalty(2, 2)
+
+	out, err := p.Process([]int{0, 1, 2, 4}, logits)
+	require.NoError(t, err)
+	assert.Equal(t, []float64{1, 1, 0.5, 1, -2, -1}, out.Data().F64())
+
+	// the window slides with the new tokens
+	out, err = p.Process([]int{0, 1, 2, 4, 0}, logits)
+	require.NoError(t, err)
+	assert.Equal(t, []float64{0.5, 1, 1, 1, -2, -1}, out.Data().F64())
+	assert.Equal(t, []float64{1, 1, 1, 1, -1, -1}, logits.Data().F64(), "the logits must not be modified")
+
+	// without a window, all the tokens are penalized
+	out, err = NewRepetitionPenalty(2, 0).Process([]int{0, 1, 2, 4, 0}, logits)
+	require.NoError(t, err)
+	assert.Equal(t, []float64{0.5, 0.5, 0.5, 1, -2, -1}, out.Data().F64())
+}
+
+func TestRepetitionPenalty_Decode(t *testing.T) {
+	m := newFlatModel(8)
+	// without constraints, the model would always generate the token 1,
+	// followed by 2 and 3 when it is penalized
+	ranked := processorFunc(func(_ []int, logits mat.Matrix) (mat.Matrix, error) {
+		bonus := map[int]float64{1: 10, 2: 6, 3: 3}
+		return logits.Apply(func(r, c int, v float64) float64 {
+			return v + bonus[r+c]
+		}), nil
+	})
+
+	t.Run("without window", func(t *testing.T) {
+		opts := DecodingOptions{MaxLen: 6, EndTokenID: 7, Temp: 1, TopP: 1, RepetitionPenalty: 4}
+		d, err := New(m, opts, ranked)
+		require.NoError(t, err)
+		assert.Equal(t, []int{1, 2, 3, 1, 1, 1}, tokenIDs(decodeAll(t, m, d, []int{5})))
+	})
+
+	t.Run("with window", func(t *testing.T) {
+		// a token is no longer penalized two steps after it was generated
+		opts := DecodingOptions{MaxLen: 6, EndTokenID: 7, Temp: 1, TopP: 1, RepetitionPenalty: 4, PenaltyWindow: 2}
+		d, err := New(m, opts, ranked)
+		require.NoError(t, err)
+		assert.Equal(t, []int{1, 2, 3, 1, 2, 3}, tokenIDs(decodeAll(t, m, d, []int{5})))
+		// the window is reset by a new generation
+		assert.Equal(t, []int{1, 2, 3, 1, 2, 3}, tokenIDs(decodeAll(t, m, d, []int{5})))
+	})
+}
+
+func TestNew_InvalidRepetitionPenalty(t *testing.T) {
+	_, err := New(newFlatModel(4), DecodingOptions{Temp: 1, TopP: 1, RepetitionPenalty: -1})
+	assert.Error(t, err)
+	_, err = New(newFlatModel(4), DecodingOptions{Temp: 1, TopP: 1, RepetitionPenalty: 2, PenaltyWindow: -1})
+	assert.Error(t, err)
+}
@@ -6,6 +6,7 @@ package decoder
 
 import (
 	"fmt"
+	"math"
 
 	"github.com/nlpodyssey/spago/mat"
 	"github.com/nlpodyssey/spago/mat/rand"
@@ -14,58 +15,97 @@ import (
 
 type OutputSelectionFunc func(logits mat.Matrix) (int, float64, error)
 
-func OutputSelection(sampling bool) OutputSelectionFunc {
+// OutputSelection returns the function selecting the next token from the
+// logits, whose probabilities are computed with the given temperature, as
+// with TemperedSoftmax. A zero temperature is replaced by a small one.
+// The returned function reuses its buffers, so it is not safe for
+// concurrent use.
+func OutputSelection(sampling bool, temperature float64) OutputSelectionFunc {
+	temperature = effectiveTemperature(temperature)
 	if sampling {
 		log.Trace().Msg("using multinomial sampling")
-		return MultinomialSampling()
+		return MultinomialSampling(temperature)
 	}
 	log.Trace().Msg("using greedy decoding")
-	return GreedyDecoding()
+	return GreedyDecoding(temperature)
 }
 
-func GreedyDecoding() OutputSelectionFunc {
+// GreedyDecoding selects the most probable token. The temperature doesn't
+// change the selection, only the reported probability.
+func GreedyDecoding(temperature float64) OutputSelectionFunc {
+	var scores []float64
 	return func(logits mat.Matrix) (int, float64, error) {
-		probs := logits.Softmax()
-		argmax := probs.ArgMax()
-		return argmax, probs.ScalarAtVec(argmax).F64(), nil
+		scores = copyScores(scores, logits)
+		max, sum := softmaxMaxAndSum(scores, temperature)
+		argmax := 0
+		for i, v := range scores {
+			if v > scores[argmax] {
+				argmax = i
+			}
+		}
+		return argmax, math.Exp((scores[argmax]-max)/temperature) / sum, nil
 	}
 }
 
-func MultinomialSampling() OutputSelectionFunc {
+// MultinomialSampling samples a token from the probability distribution of
+// the logits with the given temperature.
+func MultinomialSampling(temperature float64) OutputSelectionFunc {
+	var scores, probs []float64
 	return func(logits mat.Matrix) (int, float64, error) {
-		probs := logits.Softmax()
+		scores = copyScores(scores, logits)
+		probs = temperedSoftmax(probs, scores, temperature)
 		samples, err := multinomial(probs, 1)
 		if err != nil {
 			return 0, 0, err
 		}
-		return samples[0], probs.ScalarAtVec(samples[0]).F64(), nil
+		return samples[0], probs[samples[0]], nil
 	}
 }
 
 // multinomial extracts the next indices from a multinomial probability distribution.
-func multinomial(input mat.Matrix, numSamples int) ([]int, error) {
-	if numSamples > input.Size() {
-		return nil, fmt.Errorf("numSamples (%d) must be less than or equal to the size of the input (%d)", numSamples, input.Size())
+// Only the indices with a positive probability can be extracted.
+func multinomial(data []float64, numSamples int) ([]int, error) {
+	if numSamples > len(data) {
+		return nil, fmt.Errorf("numSamples (%d) must be less than or equal to the size of the input (%d)", numSamples, len(data))
+	}
+	candidates := 0
+	for _, value := range data {
+		if value > 0 {
+			candidates++
+		}
+	}
+	if numSamples > candidates {
+		return nil, fmt.Errorf("numSamples (%d) must be less than or equal to the number of candidates (%d)", numSamples, candidates)
 	}
 
 	samples := make([]int, 0, numSamples)
 	samplesMap := make(map[int]struct{}, numSamples)
 
-	data := input.Data().F64()
 	for len(samples) < numSamples {
-		p := rand.Float[float64]()
-
-		for i, value := range data {
-			p -= value
-			if p < 0 {
-				if _, alreadySampled := samplesMap[i]; !alreadySampled {
-					samplesMap[i] = struct{}{}
-					samples = append(samples, i)
-				}
-				break
-			}
+		i := sampleIndex(data, rand.Float[float64]())
+		if _, alreadySampled := samplesMap[i]; !alreadySampled {
+			samplesMap[i] = struct{}{}
+			samples = append(samples, i)
 		}
 	}
 
 	return samples, nil
 }
+
+// sampleIndex returns the index at which the cumulative probability exceeds p.
+// If the probabilities sum to less than p, because of rounding errors, it
+// returns the last index with a positive probability, rather than none.
+func sampleIndex(data []float64, p float64) int {
+	last := -1
+	for i, value := range data {
+		if value <= 0 {
+			continue
+		}
+		last = i
+		p -= value
+		if p < 0 {
+			return i
+		}
+	}
+	return last
+}
@@ -0,0 +1,62 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package decoder
+
+import (
+	"math"
+
+	"github.com/nlpodyssey/spago/mat"
+)
+
+// minTemperature replaces a zero temperature, to avoid a division by zero.
+const minTemperature = 0.01
+
+// effectiveTemperature returns the temperature, or minTemperature if it is zero.
+func effectiveTemperature(temperature float64) float64 {
+	if temperature == 0 {
+		return minTemperature
+	}
+	return temperature
+}
+
+// TemperedSoftmax returns the softmax of the logits divided by the
+// temperature, as a vector of float64 values.
+//
+// It is equivalent to logits.ProdScalar(1 / temperature).Softmax(), but the
+// maximum is subtracted before the division, so that the exponentials can't
+// overflow even at very low temperatures, and the logits are neither copied
+// nor scaled beforehand.
+func TemperedSoftmax(logits mat.Matrix, temperature float64) mat.Matrix {
+	return mat.NewVecDense(temperedSoftmax(nil, copyScores(nil, logits), temperature))
+}
+
+// temperedSoftmax is like TemperedSoftmax, but it writes the probabilities to
+// dst, reusing its capacity, and returns the resulting slice.
+func temperedSoftmax(dst, logits []float64, temperature float64) []float64 {
+	max, sum := softmaxMaxAndSum(logits, temperature)
+	invTemperature, invSum := 1/temperature, 1/sum
+	dst = dst[:0]
+	for _, v := range logits {
+		dst = append(dst, math.Exp((v-max)*invTemperature)*invSum)
+	}
+	return dst
+}
+
+// softmaxMaxAndSum returns the maximum of the logits and the normalization
+// term of their tempered softmax: the probability of the logit v is
+// exp((v - max) / temperature) / sum.
+func softmaxMaxAndSum(logits []float64, temperature float64) (max, sum float64) {
+	max = math.Inf(-1)
+	for _, v := range logits {
+		if v > max {
+			max = v
+		}
+	}
+	invTemperature := 1 / temperature
+	for _, v := range logits {
+		sum += math.Exp((v - max) * invTemperature)
+	}
+	return max, sum
+}
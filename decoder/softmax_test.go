@@ -0,0 +1,75 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package decoder
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/nlpodyssey/spago/mat"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTemperedSoftmax(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for _, logits := range []mat.Matrix{
+		randomLogits(r, 1000),
+		tiedLogits(r, 100),
+		mat.NewVecDense([]float64{math.Inf(-1), 1, 2, math.Inf(-1)}),
+	} {
+		for _, temp := range []float64{1, 0.7, 0.1, minTemperature} {
+			expected := logits.ProdScalar(1 / temp).Softmax().Data().F64()
+			actual := TemperedSoftmax(logits, temp).Data().F64()
+			assert.InDeltaSlice(t, expected, actual, 1e-6, "temperature %v", temp)
+
+			sum := 0.0
+			for _, p := range actual {
+				sum += p
+			}
+			assert.InDelta(t, 1, sum, 1e-9)
+		}
+	}
+}
+
+func TestOutputSelection_Temperature(t *testing.T) {
+	logits := mat.NewVecDense([]float32{1, 3, 2, math.MaxFloat32 / 4})
+	for _, temp := range []float64{1, 0.5, 0} {
+		// the scaled logits would overflow, but the probabilities are still finite
+		id, prob, err := OutputSelection(false, temp)(logits)
+		assert.NoError(t, err)
+		assert.Equal(t, 3, id)
+		assert.Equal(t, 1.0, prob)
+	}
+
+	logits = mat.NewVecDense([]float32{1, 3, 2})
+	expected := logits.ProdScalar(1 / 0.5).Softmax().Data().F64()
+	id, prob, err := OutputSelection(false, 0.5)(logits)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, id)
+	assert.InDelta(t, expected[1], prob, 1e-6)
+
+	id, prob, err = OutputSelection(true, 0.5)(logits)
+	assert.NoError(t, err)
+	assert.InDelta(t, expected[id], prob, 1e-6)
+}
+
+func TestMultinomial_RoundingError(t *testing.T) {
+	// the probabilities sum to less than one, so p can exceed their sum
+	data := []float64{0, 0.3, 0.3, 0, 0}
+	assert.Equal(t, 2, sampleIndex(data, 0.9))
+	assert.Equal(t, 1, sampleIndex(data, 0.1))
+
+	for i := 0; i < 10; i++ {
+		ids, err := multinomial(data, 2)
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, []int{1, 2}, ids)
+	}
+
+	_, err := multinomial(data, 3)
+	assert.Error(t, err)
+	_, err = multinomial([]float64{0, math.NaN()}, 1)
+	assert.Error(t, err)
+}
@@ -0,0 +1,148 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package decoder
+
+// stopMatcher finds the stop sequences which the generated sequence ends
+// with, incrementally: it is an Aho-Corasick automaton over the token IDs,
+// fed one token at a time, so that each step takes amortized constant time,
+// regardless of the number and the length of the stop sequences, and never
+// allocates.
+//
+// An empty stop sequence, which the decoder rejects, never matches, and
+// neither does a nil *stopMatcher.
+type stopMatcher struct {
+	sequences [][]int
+	// next maps the token IDs to the children of each state of the trie of
+	// the sequences, whose root is the state 0.
+	next []map[int]int
+	// fail is the state of the longest proper suffix of each state which is
+	// in the trie.
+	fail []int
+	// match is the index of the first sequence which is a suffix of each
+	// state, or -1.
+	match []int
+	// state is the state of the tokens fed so far.
+	state int
+	// seenIndex is the index of the first sequence matched by the tokens fed
+	// so far, at any position, or -1.
+	seenIndex int
+}
+
+// newStopMatcher returns a stopMatcher for the sequences, or nil if there
+// are none.
+func newStopMatcher(sequences [][]int) *stopMatcher {
+	if len(sequences) == 0 {
+		return nil
+	}
+	m := &stopMatcher{
+		sequences: sequences,
+		next:      []map[int]int{{}},
+		match:     []int{-1},
+		seenIndex: -1,
+	}
+	for i, seq := range sequences {
+		if len(seq) == 0 {
+			continue
+		}
+		state := 0
+		for _, id := range seq {
+			child, ok := m.next[state][id]
+			if !ok {
+				child = len(m.next)
+				m.next = append(m.next, map[int]int{})
+				m.match = append(m.match, -1)
+				m.next[state][id] = child
+			}
+			state = child
+		}
+		if m.match[state] == -1 {
+			m.match[state] = i
+		}
+	}
+	m.buildFailureLinks()
+	return m
+}
+
+// buildFailureLinks sets the failure links visiting the trie breadth-first,
+// so that the link of the parent of a state is always set before it, and
+// merges the matches of the suffixes into the match of each state.
+func (m *stopMatcher) buildFailureLinks() {
+	m.fail = make([]int, len(m.next))
+	queue := make([]int, 0, len(m.next))
+	for _, child := range m.next[0] {
+		m.mergeMatch(child, 0)
+		queue = append(queue, child)
+	}
+	for len(queue) > 0 {
+		state := queue[0]
+		queue = queue[1:]
+		for id, child := range m.next[state] {
+			m.fail[child] = m.step(m.fail[state], id)
+			m.mergeMatch(child, m.fail[child])
+			queue = append(queue, child)
+		}
+	}
+}
+
+// mergeMatch sets the match of the state to the one of its suffix, if it
+// comes first.
+func (m *stopMatcher) mergeMatch(state, suffix int) {
+	if f := m.match[suffix]; f != -1 && (m.match[state] == -1 || f < m.match[state]) {
+		m.match[state] = f
+	}
+}
+
+// step returns the state following the given one with the token.
+func (m *stopMatcher) step(state, id int) int {
+	for {
+		if child, ok := m.next[state][id]; ok {
+			return child
+		}
+		if state == 0 {
+			return 0
+		}
+		state = m.fail[state]
+	}
+}
+
+// feed advances the matcher with the next token of the sequence.
+func (m *stopMatcher) feed(id int) {
+	if m == nil {
+		return
+	}
+	m.state = m.step(m.state, id)
+	if m.seenIndex == -1 {
+		m.seenIndex = m.match[m.state]
+	}
+}
+
+// matched returns the first stop sequence, in order, which the tokens fed so
+// far end with, and its index, or -1 and nil.
+func (m *stopMatcher) matched() (int, []int) {
+	if m == nil {
+		return -1, nil
+	}
+	if i := m.match[m.state]; i != -1 {
+		return i, m.sequences[i]
+	}
+	return -1, nil
+}
+
+// seen returns the first stop sequence which the tokens fed so far contain,
+// at any position, and its index, or -1 and nil. Among the ones completed by
+// the same token, the first in order is returned.
+func (m *stopMatcher) seen() (int, []int) {
+	if m == nil || m.seenIndex == -1 {
+		return -1, nil
+	}
+	return m.seenIndex, m.sequences[m.seenIndex]
+}
+
+// reset restarts the matching from an empty sequence.
+func (m *stopMatcher) reset() {
+	if m != nil {
+		m.state, m.seenIndex = 0, -1
+	}
+}
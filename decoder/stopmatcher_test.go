@@ -0,0 +1,151 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package decoder
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// referenceFindStopSequence is the former implementation of the matching of
+// the stop sequences, comparing each of them with the end of the sequence at
+// every step.
+func referenceFindStopSequence(sequence []int, stopSequences [][]int) (int, []int) {
+	for i, stopSeq := range stopSequences {
+		if len(sequence) < len(stopSeq) {
+			continue
+		}
+
+		if reflect.DeepEqual(stopSeq, sequence[len(sequence)-len(stopSeq):]) {
+			return i, stopSeq
+		}
+	}
+	return -1, nil
+}
+
+func TestStopMatcher(t *testing.T) {
+	tests := []struct {
+		name      string
+		sequences [][]int
+		input     []int
+	}{
+		{"single", [][]int{{3}}, []int{1, 3, 2, 3}},
+		{"overlapping", [][]int{{1, 2, 1}, {2, 1, 2}}, []int{1, 2, 1, 2, 1, 2, 3, 1, 2}},
+		{"self-overlapping", [][]int{{1, 1, 2}}, []int{1, 1, 1, 1, 2, 1, 1, 2}},
+		{"nested", [][]int{{1, 2, 3, 4}, {2, 3}, {3}}, []int{1, 2, 3, 4, 2, 3, 1, 2, 4}},
+		{"suffix first", [][]int{{3}, {2, 3}}, []int{2, 3, 3}},
+		{"duplicates", [][]int{{5, 6}, {5, 6}}, []int{5, 6, 5}},
+		{"partial restart", [][]int{{1, 2, 3}}, []int{1, 2, 1, 2, 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assertSameMatches(t, tt.sequences, tt.input)
+		})
+	}
+
+	t.Run("random", func(t *testing.T) {
+		r := rand.New(rand.NewSource(1))
+		for i := 0; i < 200; i++ {
+			// a small alphabet makes the overlaps frequent
+			sequences := make([][]int, 1+r.Intn(4))
+			for j := range sequences {
+				sequences[j] = randomTokens(r, 1+r.Intn(4), 3)
+			}
+			assertSameMatches(t, sequences, randomTokens(r, 50, 3))
+		}
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		// the empty sequences never match, unlike for the reference
+		m := newStopMatcher([][]int{{}, {2, 1}, {}})
+		m.feed(1)
+		index, seq := m.matched()
+		assert.Equal(t, -1, index)
+		assert.Nil(t, seq)
+		m.feed(2)
+		m.feed(1)
+		index, seq = m.matched()
+		assert.Equal(t, 1, index)
+		assert.Equal(t, []int{2, 1}, seq)
+	})
+
+	t.Run("seen", func(t *testing.T) {
+		m := newStopMatcher([][]int{{2}, {3, 1}})
+		for _, id := range []int{1, 3, 1, 2, 4} {
+			m.feed(id)
+		}
+		_, suffix := m.matched()
+		assert.Nil(t, suffix)
+		// the sequence found first, even if it comes later in order
+		index, seq := m.seen()
+		assert.Equal(t, 1, index)
+		assert.Equal(t, []int{3, 1}, seq)
+		m.reset()
+		index, _ = m.seen()
+		assert.Equal(t, -1, index)
+	})
+
+	assert.Nil(t, newStopMatcher(nil))
+}
+
+// assertSameMatches asserts that the matcher finds the same stop sequences
+// as the reference implementation after each token of the input, before and
+// after a reset.
+func assertSameMatches(t *testing.T, sequences [][]int, input []int) {
+	t.Helper()
+	m := newStopMatcher(sequences)
+	for round := 0; round < 2; round++ {
+		for i, id := range input {
+			m.feed(id)
+			expectedIndex, expected := referenceFindStopSequence(input[:i+1], sequences)
+			index, actual := m.matched()
+			assert.Equal(t, expectedIndex, index, "sequences %v, input %v", sequences, input[:i+1])
+			assert.Equal(t, expected, actual)
+		}
+		m.reset()
+	}
+}
+
+func randomTokens(r *rand.Rand, n, vocabSize int) []int {
+	ids := make([]int, n)
+	for i := range ids {
+		ids[i] = r.Intn(vocabSize)
+	}
+	return ids
+}
+
+func BenchmarkStopSequences(b *testing.B) {
+	r := rand.New(rand.NewSource(1))
+	sequences := [][]int{{187, 187}, {50276, 187}, {23433, 27, 187}, {6066, 27}, {0}}
+	input := randomTokens(r, 1024, 50277)
+
+	b.Run("reflect", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for j := range input {
+				referenceFindStopSequence(input[:j+1], sequences)
+			}
+		}
+	})
+	b.Run("automaton", func(b *testing.B) {
+		b.ReportAllocs()
+		m := newStopMatcher(sequences)
+		for i := 0; i < b.N; i++ {
+			m.reset()
+			for _, id := range input {
+				m.feed(id)
+				m.matched()
+			}
+		}
+	})
+}
+
+func TestNew_InvalidStopMatchMode(t *testing.T) {
+	_, err := New(newFlatModel(4), DecodingOptions{Temp: 1, TopP: 1, StopMatchMode: "prefix"})
+	assert.Error(t, err)
+}
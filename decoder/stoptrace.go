@@ -0,0 +1,95 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package decoder
+
+import "fmt"
+
+// StopReason tells which condition stopped the generation.
+type StopReason string
+
+const (
+	// StopReasonMaxLen is reported when MaxLen tokens have been generated.
+	StopReasonMaxLen StopReason = "max-len"
+	// StopReasonMaxChars is reported when the text of the generated tokens
+	// has MaxChars characters.
+	StopReasonMaxChars StopReason = "max-chars"
+	// StopReasonEndToken is reported when the end token has been generated.
+	StopReasonEndToken StopReason = "end-token"
+	// StopReasonStopSequence is reported when the generated tokens match
+	// one of the StopSequencesIDs or StopSequences, according to the
+	// StopMatchMode.
+	StopReasonStopSequence StopReason = "stop-sequence"
+	// StopReasonMinTopProb is reported when the probability of the selected
+	// token is below MinTopProb.
+	StopReasonMinTopProb StopReason = "min-top-prob"
+	// StopReasonCancelled is reported when the context is done.
+	StopReasonCancelled StopReason = "cancelled"
+)
+
+// StopMatchMode tells where the stop sequences are matched in the generated
+// tokens.
+type StopMatchMode string
+
+const (
+	// StopMatchSuffix stops the generation when the generated tokens end with
+	// a stop sequence, once MinLen tokens have been generated. A stop
+	// sequence generated before is ignored.
+	StopMatchSuffix StopMatchMode = "suffix"
+	// StopMatchAnywhere stops the generation when the generated tokens
+	// contain a stop sequence, at any position, once MinLen tokens have been
+	// generated, for example to stop on a forbidden phrase generated before
+	// MinLen.
+	StopMatchAnywhere StopMatchMode = "anywhere"
+)
+
+// StopAction tells what happens to the output when a stop sequence is
+// matched.
+type StopAction string
+
+const (
+	// StopKeep stops the generation, keeping the stop sequence in the output.
+	StopKeep StopAction = "stop-keep"
+	// StopTrim stops the generation, removing the stop sequence from the
+	// output, like TrimStopSequence.
+	StopTrim StopAction = "stop-trim"
+)
+
+// StopSequence is a sequence of token IDs which stops the generation, with
+// its own action.
+type StopSequence struct {
+	// IDs are the token IDs of the sequence.
+	IDs []int `json:"ids" yaml:"ids"`
+	// Action is StopKeep (the default, when empty) or StopTrim.
+	Action StopAction `json:"action" yaml:"action"`
+}
+
+// StopTrace records why a generation stopped.
+// The zero value, with an empty Reason, means that no stop condition fired,
+// for example because the generation failed.
+type StopTrace struct {
+	// Reason is the condition which stopped the generation.
+	Reason StopReason
+	// Step is the index of the generated token which fired the condition,
+	// or the number of steps completed, if the generation was cancelled.
+	Step int
+	// StopSequenceIndex is the index of the matched stop sequence in
+	// StopSequencesIDs, followed by StopSequences, or -1 if the reason is
+	// not StopReasonStopSequence.
+	StopSequenceIndex int
+	// StopSequence is the matched stop sequence, if any.
+	StopSequence []int
+}
+
+// String returns a description of the stop condition, for the logs.
+func (t StopTrace) String() string {
+	switch t.Reason {
+	case "":
+		return "not stopped"
+	case StopReasonStopSequence:
+		return fmt.Sprintf("%s %v (#%d) at step %d", t.Reason, t.StopSequence, t.StopSequenceIndex, t.Step)
+	default:
+		return fmt.Sprintf("%s at step %d", t.Reason, t.Step)
+	}
+}
@@ -5,19 +5,25 @@
 package downloader
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/rs/zerolog/log"
 )
 
 const (
+	// DefaultEndpoint is the base URL of the Hugging Face Hub.
+	DefaultEndpoint = "https://huggingface.co"
 	// Hugging Face repository URL, in the format:
-	// "https://huggingface.co/{model_id}/resolve/{revision}/{filename}"
-	huggingFaceCoPrefix = "https://huggingface.co/%s/resolve/%s/%s"
+	// "{endpoint}/{model_id}/resolve/{revision}/{filename}"
+	huggingFaceURLFormat = "%s/%s/resolve/%s/%s"
 	// Default revision name for fetching model from Hugging Face repository
 	defaultRevision = "main"
 )
@@ -37,12 +43,22 @@ var modelsFiles = []string{
 // exists is kept and considered as already successfully downloaded. If
 // the flag is otherwise set to true, existing files will be forcefully
 // downloaded and overwritten.
-func Download(modelsDir, modelName string, overwriteIfExists bool, accessToken string) error {
+//
+// Once all the files are downloaded, their sizes and hashes are written to
+// ManifestFilename, so that the model can be checked with Verify.
+//
+// The endpoint is the base URL of the Hub, which can be replaced by a mirror.
+// If empty, DefaultEndpoint is used.
+func Download(modelsDir, modelName string, overwriteIfExists bool, accessToken, endpoint string) error {
+	if endpoint == "" {
+		endpoint = DefaultEndpoint
+	}
 	return downloader{
 		modelPath:        filepath.Join(modelsDir, modelName),
 		modelName:        modelName,
 		overwriteIfExist: overwriteIfExists,
 		accessToken:      accessToken,
+		endpoint:         strings.TrimSuffix(endpoint, "/"),
 	}.download()
 }
 
@@ -51,6 +67,7 @@ type downloader struct {
 	modelPath        string
 	modelName        string
 	accessToken      string
+	endpoint         string
 	overwriteIfExist bool
 }
 
@@ -63,8 +80,7 @@ func (d downloader) download() error {
 			return err
 		}
 	}
-	return nil
-
+	return d.writeManifest(modelsFiles)
 }
 
 func (d downloader) ensureModelPath() error {
@@ -87,16 +103,6 @@ func (d downloader) downloadFile(name string) (err error) {
 	url := d.bucketURL(name)
 	log.Debug().Str("url", url).Str("destination", fPath).Msg("downloading")
 
-	f, err := os.Create(fPath)
-	if err != nil {
-		return fmt.Errorf("error creating file %#v: %w", fPath, err)
-	}
-	defer func() {
-		if e := f.Close(); e != nil && err == nil {
-			err = fmt.Errorf("error closing file %#v: %w", fPath, e)
-		}
-	}()
-
 	resp, err := d.httpGet(url)
 	if err != nil {
 		return fmt.Errorf("error getting %#v: %w", url, err)
@@ -107,21 +113,57 @@ func (d downloader) downloadFile(name string) (err error) {
 		}
 	}()
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("%#v responded with %s", url, resp.Status)
+	if err := d.checkResponse(url, resp); err != nil {
+		return err
+	}
+	body := bufio.NewReader(resp.Body)
+	if err := checkNotHTML(url, resp, body); err != nil {
+		return err
 	}
 
+	// the file is only created once the response is known to be valid,
+	// so that a failed download is not mistaken for an existing file
+	f, err := os.Create(fPath)
+	if err != nil {
+		return fmt.Errorf("error creating file %#v: %w", fPath, err)
+	}
+	defer func() {
+		if e := f.Close(); e != nil && err == nil {
+			err = fmt.Errorf("error closing file %#v: %w", fPath, e)
+		}
+		if err != nil {
+			_ = os.Remove(fPath)
+		}
+	}()
+
 	prog := newDownloadProgress(int(resp.ContentLength))
 	prog.Start()
 	defer prog.Stop()
 
-	_, err = io.Copy(f, io.TeeReader(resp.Body, prog))
+	_, err = io.Copy(f, io.TeeReader(body, prog))
 	if err != nil {
 		return fmt.Errorf("error downloading %#v to %#v: %w", url, fPath, err)
 	}
 	return nil
 }
 
+// checkNotHTML returns an error if the response is an HTML page, as served
+// by the Hub in place of the model files in case of errors such as rate
+// limiting, sometimes with status 200.
+func checkNotHTML(url string, resp *http.Response, body *bufio.Reader) error {
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType == "text/html" {
+		return fmt.Errorf("%#v responded with an HTML page instead of the file: the download may have been rate limited or denied", url)
+	}
+	// peek errors are reported by the actual read
+	head, _ := body.Peek(512)
+	head = bytes.ToLower(bytes.TrimSpace(head))
+	if bytes.HasPrefix(head, []byte("<!doctype html")) || bytes.HasPrefix(head, []byte("<html")) {
+		return fmt.Errorf("%#v responded with an HTML page instead of the file: the download may have been rate limited or denied", url)
+	}
+	return nil
+}
+
 func (d downloader) httpGet(url string) (*http.Response, error) {
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
@@ -133,6 +175,22 @@ func (d downloader) httpGet(url string) (*http.Response, error) {
 	return http.DefaultClient.Do(req)
 }
 
+// checkResponse returns an error if the response is not successful,
+// explaining the authorization failures.
+func (d downloader) checkResponse(url string, resp *http.Response) error {
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusUnauthorized, http.StatusForbidden:
+		if d.accessToken == "" {
+			return fmt.Errorf("%#v responded with %s: the model is private or gated, an access token is required", url, resp.Status)
+		}
+		return fmt.Errorf("%#v responded with %s: the access token is invalid or not authorized to access the model", url, resp.Status)
+	default:
+		return fmt.Errorf("%#v responded with %s", url, resp.Status)
+	}
+}
+
 func (d downloader) bucketURL(fileName string) string {
-	return fmt.Sprintf(huggingFaceCoPrefix, d.modelName, defaultRevision, fileName)
+	return fmt.Sprintf(huggingFaceURLFormat, d.endpoint, d.modelName, defaultRevision, fileName)
 }
@@ -0,0 +1,156 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package downloader
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newGatedServer returns a server which only responds to the requests
+// authorized with the given token.
+func newGatedServer(t *testing.T, token string) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Header.Get("Authorization") {
+		case "":
+			w.WriteHeader(http.StatusUnauthorized)
+		case "Bearer " + token:
+			_, _ = w.Write([]byte("data"))
+		default:
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestDownloader_AccessToken(t *testing.T) {
+	srv := newGatedServer(t, "secret")
+
+	tests := []struct {
+		token string
+		err   string
+	}{
+		{token: "secret"},
+		{token: "", err: "401 Unauthorized: the model is private or gated, an access token is required"},
+		{token: "wrong", err: "403 Forbidden: the access token is invalid or not authorized to access the model"},
+	}
+	for _, tt := range tests {
+		d := downloader{accessToken: tt.token}
+		resp, err := d.httpGet(srv.URL)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+
+		err = d.checkResponse(srv.URL, resp)
+		if tt.err == "" {
+			assert.NoError(t, err)
+			continue
+		}
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), tt.err)
+	}
+}
+
+func TestDownload_Endpoint(t *testing.T) {
+	var paths []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		_, _ = w.Write([]byte(r.URL.Path))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	require.NoError(t, Download(dir, "org/model", false, "", srv.URL+"/"))
+
+	require.Len(t, paths, len(modelsFiles))
+	for i, name := range modelsFiles {
+		path := "/org/model/resolve/main/" + name
+		assert.Equal(t, path, paths[i])
+		data, err := os.ReadFile(filepath.Join(dir, "org", "model", name))
+		require.NoError(t, err)
+		assert.Equal(t, path, string(data))
+	}
+}
+
+func TestDownloader_BucketURL(t *testing.T) {
+	d := downloader{modelName: "org/model", endpoint: DefaultEndpoint}
+	assert.Equal(t, "https://huggingface.co/org/model/resolve/main/config.json", d.bucketURL("config.json"))
+
+	d.endpoint = "https://hf-mirror.com"
+	assert.Equal(t, "https://hf-mirror.com/org/model/resolve/main/config.json", d.bucketURL("config.json"))
+}
+
+func TestDownload_HTMLResponse(t *testing.T) {
+	for _, contentType := range []string{"text/html; charset=utf-8", "application/octet-stream"} {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", contentType)
+			_, _ = w.Write([]byte("\n<!DOCTYPE html>\n<html><body>Too many requests</body></html>"))
+		}))
+
+		dir := t.TempDir()
+		err := Download(dir, "org/model", false, "", srv.URL)
+		srv.Close()
+
+		require.Error(t, err, contentType)
+		assert.Contains(t, err.Error(), "responded with an HTML page instead of the file")
+		_, err = os.Stat(filepath.Join(dir, "org", "model", modelsFiles[0]))
+		assert.True(t, os.IsNotExist(err), "no file must be written")
+	}
+}
+
+func TestDownload_Manifest(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("content of " + r.URL.Path))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	require.NoError(t, Download(dir, "org/model", false, "", srv.URL))
+	modelDir := filepath.Join(dir, "org", "model")
+
+	data, err := os.ReadFile(filepath.Join(modelDir, ManifestFilename))
+	require.NoError(t, err)
+	var m Manifest
+	require.NoError(t, json.Unmarshal(data, &m))
+	require.Len(t, m.Files, len(modelsFiles))
+	content := "content of /org/model/resolve/main/config.json"
+	assert.Equal(t, ManifestEntry{
+		Size: int64(len(content)),
+		MD5:  fmt.Sprintf("%x", md5.Sum([]byte(content))),
+	}, m.Files["config.json"])
+
+	require.NoError(t, Verify(modelDir))
+
+	t.Run("tampered file", func(t *testing.T) {
+		name := filepath.Join(modelDir, "vocab.json")
+		data, err := os.ReadFile(name)
+		require.NoError(t, err)
+		data[0] = 'X'
+		require.NoError(t, os.WriteFile(name, data, 0o644))
+
+		err = Verify(modelDir)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "vocab.json has MD5")
+	})
+
+	t.Run("partial file", func(t *testing.T) {
+		require.NoError(t, os.Truncate(filepath.Join(modelDir, "merges.txt"), 3))
+		require.NoError(t, os.Remove(filepath.Join(modelDir, "pytorch_model.pt")))
+
+		err = Verify(modelDir)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "merges.txt has size 3")
+		assert.Contains(t, err.Error(), "pytorch_model.pt is missing")
+	})
+}
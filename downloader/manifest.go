@@ -0,0 +1,110 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package downloader
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ManifestFilename is the name of the file, written in the model directory
+// after a successful download, which lists the size and hash of each file.
+const ManifestFilename = "manifest.json"
+
+// Manifest lists the downloaded files of a model.
+type Manifest struct {
+	Files map[string]ManifestEntry `json:"files"`
+}
+
+// ManifestEntry describes a downloaded file.
+type ManifestEntry struct {
+	Size int64  `json:"size"`
+	MD5  string `json:"md5"`
+}
+
+// Verify checks that the files of the model in dir match the manifest written
+// by Download, returning an error which lists all the missing, incomplete or
+// modified files.
+func Verify(dir string) error {
+	data, err := os.ReadFile(filepath.Join(dir, ManifestFilename))
+	if err != nil {
+		return fmt.Errorf("error reading the manifest: %w", err)
+	}
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return fmt.Errorf("error parsing the manifest: %w", err)
+	}
+
+	var problems []string
+	for _, name := range sortedKeys(m.Files) {
+		expected := m.Files[name]
+		actual, err := newManifestEntry(filepath.Join(dir, name))
+		switch {
+		case os.IsNotExist(err):
+			problems = append(problems, fmt.Sprintf("%s is missing", name))
+		case err != nil:
+			return err
+		case actual.Size != expected.Size:
+			problems = append(problems, fmt.Sprintf("%s has size %d, expected %d", name, actual.Size, expected.Size))
+		case actual.MD5 != expected.MD5:
+			problems = append(problems, fmt.Sprintf("%s has MD5 %s, expected %s", name, actual.MD5, expected.MD5))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("the model in %#v doesn't match the manifest: %s", dir, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// writeManifest writes the manifest of the given files of the model.
+func (d downloader) writeManifest(filenames []string) error {
+	m := Manifest{Files: make(map[string]ManifestEntry, len(filenames))}
+	for _, name := range filenames {
+		entry, err := newManifestEntry(filepath.Join(d.modelPath, name))
+		if err != nil {
+			return err
+		}
+		m.Files[name] = entry
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(d.modelPath, ManifestFilename), data, 0o644); err != nil {
+		return fmt.Errorf("error writing the manifest: %w", err)
+	}
+	return nil
+}
+
+func newManifestEntry(filename string) (ManifestEntry, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return ManifestEntry{}, err
+	}
+	defer f.Close()
+
+	h := md5.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return ManifestEntry{}, fmt.Errorf("error hashing file %#v: %w", filename, err)
+	}
+	return ManifestEntry{Size: n, MD5: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
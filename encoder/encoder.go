@@ -6,6 +6,7 @@ package encoder
 
 import (
 	"context"
+	"fmt"
 
 	"github.com/nlpodyssey/rwkv"
 	"github.com/nlpodyssey/spago/ag"
@@ -32,3 +33,88 @@ func (e *Encoder) Encode(ctx context.Context, tokens []int) (Result, error) {
 		State:    s,
 	}, nil
 }
+
+// EncodeChunked is like Encode, but encodes the tokens in chunks of at most
+// chunkSize tokens, carrying the state forward. The graph of each chunk is
+// released once its values are computed, so that the memory is bounded by
+// the chunk size, rather than by the length of the prompt.
+// The returned encoding and state are detached from the graph.
+func (e *Encoder) EncodeChunked(ctx context.Context, tokens []int, chunkSize int) (Result, error) {
+	return e.EncodeChunkedFrom(ctx, nil, tokens, chunkSize)
+}
+
+// EncodeChunkedFrom is like EncodeChunked, but continues from the given
+// state, which is modified, or from the initial one if it is nil.
+// The state must be detached from any graph, since the graph of the first
+// chunk is released.
+func (e *Encoder) EncodeChunkedFrom(ctx context.Context, s rwkv.State, tokens []int, chunkSize int) (Result, error) {
+	if chunkSize <= 0 {
+		return Result{}, fmt.Errorf("invalid chunk size %d: must be > 0", chunkSize)
+	}
+	if len(tokens) == 0 {
+		return Result{}, fmt.Errorf("no tokens to encode")
+	}
+	var x ag.Node
+	for start := 0; start < len(tokens); start += chunkSize {
+		if err := ctx.Err(); err != nil {
+			return Result{}, err
+		}
+		end := start + chunkSize
+		if end > len(tokens) {
+			end = len(tokens)
+		}
+		x, s = e.encodeChunk(ctx, tokens[start:end], s)
+	}
+	return Result{Encoding: x, State: s}, nil
+}
+
+// encodeChunk encodes the tokens from the state, which is modified, and
+// returns the encoding of the last one and the new state, detached from the
+// graph, which is released.
+func (e *Encoder) encodeChunk(ctx context.Context, tokens []int, s rwkv.State) (ag.Node, rwkv.State) {
+	h, s := e.model.Encoder.ForwardSequence(e.model.EncodeTokens(ctx, tokens...), s)
+	// every node of the graph is an ancestor of the outputs or of the state,
+	// so none is still running when they are all computed
+	nodes := append([]ag.Node{}, h...)
+	for _, l := range s {
+		nodes = append(nodes, l.FfnXX, l.AttXX, l.AttAA, l.AttBB, l.AttPP)
+	}
+	for _, n := range nodes {
+		n.Value()
+	}
+	x := detach(h[len(h)-1])
+	out := make(rwkv.State, len(s))
+	for i, l := range s {
+		out[i] = &rwkv.LayerState{
+			FfnXX: detach(l.FfnXX),
+			AttXX: detach(l.AttXX),
+			AttAA: detach(l.AttAA),
+			AttBB: detach(l.AttBB),
+			AttPP: detach(l.AttPP),
+		}
+	}
+	ag.ReleaseGraph(nodes...)
+	return x, out
+}
+
+// detach returns a new variable with a copy of the value of the node.
+func detach(n ag.Node) ag.Node {
+	return ag.Var(n.Value().Clone())
+}
+
+// StateSnapshot returns a copy of the values of the state tensors, for
+// external analysis, with shape [NumLayers][5][DModel]. The five tensors of
+// each layer are FfnXX, AttXX, AttAA, AttBB and AttPP, as in rwkv.LayerState.
+func (r Result) StateSnapshot() [][][]float64 {
+	snapshot := make([][][]float64, len(r.State))
+	for i, l := range r.State {
+		snapshot[i] = [][]float64{
+			l.FfnXX.Value().Data().F64(),
+			l.AttXX.Value().Data().F64(),
+			l.AttAA.Value().Data().F64(),
+			l.AttBB.Value().Data().F64(),
+			l.AttPP.Value().Data().F64(),
+		}
+	}
+	return snapshot
+}
@@ -0,0 +1,49 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package encoder
+
+import (
+	"context"
+	"math/rand"
+	"testing"
+
+	"github.com/nlpodyssey/verbaflow/rwkvlm/rwkvlmtest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncoder_EncodeChunked(t *testing.T) {
+	m := rwkvlmtest.NewModel(rwkvlmtest.DefaultConfig, 1)
+	r := rand.New(rand.NewSource(1))
+	tokens := make([]int, 100)
+	for i := range tokens {
+		tokens[i] = r.Intn(m.Config.VocabSize)
+	}
+	e := New(m)
+	expected, err := e.Encode(context.Background(), tokens)
+	require.NoError(t, err)
+
+	for _, chunkSize := range []int{1, 7, 32, 100, 1000} {
+		actual, err := e.EncodeChunked(context.Background(), tokens, chunkSize)
+		require.NoError(t, err)
+		assert.InDeltaSlice(t, expected.Encoding.Value().Data().F64(), actual.Encoding.Value().Data().F64(), 1e-5, "chunk size %d", chunkSize)
+		actualState := actual.StateSnapshot()
+		for i, layer := range expected.StateSnapshot() {
+			for j, values := range layer {
+				assert.InDeltaSlice(t, values, actualState[i][j], 1e-5, "chunk size %d, layer %d, tensor %d", chunkSize, i, j)
+			}
+		}
+	}
+
+	_, err = e.EncodeChunked(context.Background(), tokens, 0)
+	assert.Error(t, err)
+	_, err = e.EncodeChunked(context.Background(), nil, 8)
+	assert.Error(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = e.EncodeChunked(ctx, tokens, 8)
+	assert.ErrorIs(t, err, context.Canceled)
+}
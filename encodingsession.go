@@ -0,0 +1,173 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package verbaflow
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/nlpodyssey/rwkv"
+	"github.com/nlpodyssey/spago/ag"
+	"github.com/nlpodyssey/verbaflow/decoder"
+	"github.com/nlpodyssey/verbaflow/encoder"
+)
+
+// EncodingSession encodes a prompt incrementally, as its text arrives in
+// chunks, for example from a live transcription, advancing the state of the
+// model as the tokens become certain, so that the generation doesn't have to
+// encode the whole prompt at once.
+//
+// The tokens of a word can change when the next chunk continues it, so the
+// text from the last whitespace is held back until the following text
+// confirms that the tokenization doesn't change across the boundary. Like EncodeState,
+// the prompt is encoded as is, without the beginning-of-sequence token.
+//
+// An EncodingSession is not safe for concurrent use.
+type EncodingSession struct {
+	vf  *VerbaFlow
+	ctx context.Context
+	// x is the encoding of the last encoded token, and state the state of
+	// the model after it, both detached from the graph.
+	x     ag.Node
+	state rwkv.State
+	// encoded is the number of tokens encoded so far.
+	encoded int
+	// pending is the text held back.
+	pending string
+}
+
+// NewEncodingSession returns a new EncodingSession, which encodes the text
+// with the given context.
+func (vf *VerbaFlow) NewEncodingSession(ctx context.Context) *EncodingSession {
+	return &EncodingSession{vf: vf, ctx: ctx}
+}
+
+// Feed appends the text to the prompt, encoding the tokens which can't be
+// changed by the following text.
+// The boundary is only checked when the text has whitespace, so that the
+// text held back is not tokenized again for each chunk of a long word.
+func (s *EncodingSession) Feed(text string) error {
+	s.pending += text
+	if strings.IndexFunc(text, unicode.IsSpace) < 0 {
+		return nil
+	}
+	split := lastWhitespaceRun(s.pending)
+	if split <= 0 {
+		return nil
+	}
+	head, tail := s.pending[:split], s.pending[split:]
+	tokenized, err := s.vf.TokenizePrompt(s.pending, false)
+	if err != nil {
+		return err
+	}
+	headIDs, err := s.vf.TokenizePrompt(head, false)
+	if err != nil {
+		return err
+	}
+	tailIDs, err := s.vf.TokenizePrompt(tail, false)
+	if err != nil {
+		return err
+	}
+	if !equalIDs(tokenized, append(headIDs, tailIDs...)) {
+		// the tokens cross the boundary: wait for the next one
+		return nil
+	}
+	if len(headIDs) > 0 {
+		if s.x, s.state, err = s.encode(s.state, headIDs); err != nil {
+			return err
+		}
+		s.encoded += len(headIDs)
+	}
+	s.pending = tail
+	return nil
+}
+
+// State returns the state of the model after encoding all the text fed so
+// far, including the text held back, like EncodeState.
+// The session is not affected, so it can be fed more text.
+func (s *EncodingSession) State() (rwkv.State, error) {
+	_, state, err := s.encodeAll()
+	return state, err
+}
+
+// Generate generates the continuation of all the text fed so far, including
+// the text held back, which is sent to chGen, closed at the end even in case
+// of error.
+// AddBOS is ignored, since the prompt is already encoded.
+// The session is not affected, so it can be fed more text and generate again.
+func (s *EncodingSession) Generate(chGen chan decoder.GeneratedToken, opts decoder.DecodingOptions) error {
+	x, state, err := s.encodeAll()
+	if err != nil {
+		close(chGen)
+		return err
+	}
+	d, err := s.vf.newDecoder(opts)
+	if err != nil {
+		close(chGen)
+		return err
+	}
+	nt := &ag.NodesTracker{}
+	defer nt.ReleaseNodes()
+	return d.DecodeToChannel(s.ctx, nt, encoder.Result{Encoding: x, State: state}, chGen)
+}
+
+// encodeAll returns the encoding of the last token and the state after
+// encoding the text held back on a copy of the state of the session.
+func (s *EncodingSession) encodeAll() (ag.Node, rwkv.State, error) {
+	tokenized, err := s.vf.TokenizePrompt(s.pending, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	if s.encoded == 0 && len(tokenized) == 0 {
+		return nil, nil, fmt.Errorf("the prompt can't be empty")
+	}
+	if len(tokenized) == 0 {
+		return ag.Var(s.x.Value().Clone()), detachState(s.state), nil
+	}
+	var state rwkv.State
+	if s.state != nil {
+		state = detachState(s.state)
+	}
+	return s.encode(state, tokenized)
+}
+
+// encode encodes the tokens from the state, returning the encoding of the
+// last one and the new state, detached from the graph.
+func (s *EncodingSession) encode(state rwkv.State, tokens []int) (ag.Node, rwkv.State, error) {
+	res, err := s.vf.encode(s.ctx, state, tokens)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ag.Var(res.Encoding.Value().Clone()), detachState(res.State), nil
+}
+
+// lastWhitespaceRun returns the index of the first character of the last run
+// of whitespace of the text, where the pre-tokenizers split the words, or -1.
+func lastWhitespaceRun(text string) int {
+	i := strings.LastIndexFunc(text, unicode.IsSpace)
+	for i > 0 {
+		r, size := utf8.DecodeLastRuneInString(text[:i])
+		if !unicode.IsSpace(r) {
+			break
+		}
+		i -= size
+	}
+	return i
+}
+
+func equalIDs(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,98 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package verbaflow
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nlpodyssey/spago/ag"
+	"github.com/nlpodyssey/verbaflow/decoder"
+	"github.com/nlpodyssey/verbaflow/encoder"
+	"github.com/nlpodyssey/verbaflow/rwkvlm/rwkvlmtest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncodingSession(t *testing.T) {
+	vf := newTestVerbaFlow(t)
+	// a model whose generation depends on the whole prompt
+	vf.Model = rwkvlmtest.NewModel(rwkvlmtest.DefaultConfig, 2)
+	ctx := context.Background()
+	prompt := "unrelated unrelated unrelated"
+
+	s := vf.NewEncodingSession(ctx)
+	// "unrel" alone is tokenized differently from the word "unrelated"
+	require.NoError(t, s.Feed("unrel"))
+	assert.Equal(t, 0, s.encoded)
+	require.NoError(t, s.Feed("ated unre"))
+	assert.Equal(t, 2, s.encoded)
+	require.NoError(t, s.Feed("lated unrelated"))
+	assert.Equal(t, 4, s.encoded)
+	assert.Equal(t, " unrelated", s.pending)
+
+	state, err := s.State()
+	require.NoError(t, err)
+	expected, err := vf.EncodeState(ctx, prompt)
+	require.NoError(t, err)
+	actualSnapshot := encoder.Result{State: state}.StateSnapshot()
+	for i, layer := range (encoder.Result{State: expected}).StateSnapshot() {
+		for j, values := range layer {
+			assert.InDeltaSlice(t, values, actualSnapshot[i][j], 1e-6, "layer %d, tensor %d", i, j)
+		}
+	}
+
+	opts := decoder.DecodingOptions{MaxLen: 4, MinLen: 4, EndTokenID: -1, Temp: 1, TopP: 1}
+	generate := func(gen func(chGen chan decoder.GeneratedToken) error) []int {
+		chGen := make(chan decoder.GeneratedToken, opts.MaxLen)
+		require.NoError(t, gen(chGen))
+		var ids []int
+		for g := range chGen {
+			ids = append(ids, g.TokenID)
+		}
+		return ids
+	}
+	nt := &ag.NodesTracker{}
+	defer nt.ReleaseNodes()
+	want := generate(func(chGen chan decoder.GeneratedToken) error {
+		return vf.Generate(ctx, nt, prompt, chGen, opts)
+	})
+	got := generate(func(chGen chan decoder.GeneratedToken) error {
+		return s.Generate(chGen, opts)
+	})
+	assert.Equal(t, want, got)
+
+	// the generation doesn't affect the session
+	assert.Equal(t, 4, s.encoded)
+	assert.Equal(t, want, generate(func(chGen chan decoder.GeneratedToken) error {
+		return s.Generate(chGen, opts)
+	}))
+}
+
+func TestEncodingSession_Whitespace(t *testing.T) {
+	vf := newTestVerbaFlow(t)
+	ctx := context.Background()
+
+	// the text is split at any whitespace, not only at the spaces
+	s := vf.NewEncodingSession(ctx)
+	require.NoError(t, s.Feed("unrelated\nunrel"))
+	assert.Equal(t, 2, s.encoded)
+	assert.Equal(t, "\nunrel", s.pending)
+	require.NoError(t, s.Feed("ated\t\tunrelated"))
+	assert.Equal(t, 4, s.encoded)
+	assert.Equal(t, "\t\tunrelated", s.pending)
+
+	assert.Equal(t, 9, lastWhitespaceRun("unrelated\u00a0\n"))
+	assert.Equal(t, -1, lastWhitespaceRun("unrelated"))
+}
+
+func TestEncodingSession_Empty(t *testing.T) {
+	vf := newTestVerbaFlow(t)
+	s := vf.NewEncodingSession(context.Background())
+	_, err := s.State()
+	assert.Error(t, err)
+	require.NoError(t, s.Feed(" "))
+	assert.Error(t, s.Generate(make(chan decoder.GeneratedToken, 1), decoder.DecodingOptions{MaxLen: 1}))
+}
@@ -8,24 +8,30 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"math"
 	"os"
 	"os/signal"
+	"reflect"
 	"strings"
 	"text/template"
+	"text/template/parse"
 
 	"github.com/nlpodyssey/verbaflow"
 	"github.com/nlpodyssey/verbaflow/api"
 	"github.com/nlpodyssey/verbaflow/decoder"
+	"github.com/nlpodyssey/verbaflow/service"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/urfave/cli/v2"
-	"google.golang.org/grpc"
 	"gopkg.in/yaml.v3"
 )
 
 type pTemplate struct {
 	pt   *template.Template
 	data string // the raw data of the template
+	// question reports whether the template references the Question field,
+	// in which case the input is split into passage and question.
+	question bool
 }
 
 var defaultPromptTemplate = pTemplate{
@@ -49,7 +55,12 @@ func main() {
 			if err != nil {
 				return fmt.Errorf("error reading prompt template: %w", err)
 			}
-			if err := inference(opts, promptt, c.String("endpoint")); err != nil {
+			conf := service.ClientConfig{
+				ConnectTimeout:   c.Duration("connect-timeout"),
+				KeepaliveTime:    c.Duration("keepalive-time"),
+				KeepaliveTimeout: c.Duration("keepalive-timeout"),
+			}
+			if err := inference(opts, promptt, c.String("instruction"), c.String("endpoint"), conf, c.Bool("scores")); err != nil {
 				log.Err(err).Send()
 			}
 			return nil
@@ -74,11 +85,35 @@ func main() {
 				Value:    ":50051",
 				Required: false,
 			},
+			&cli.DurationFlag{
+				Name:  "connect-timeout",
+				Usage: "the maximum time to wait for the connection to the gRPC server",
+				Value: service.DefaultClientConfig.ConnectTimeout,
+			},
+			&cli.DurationFlag{
+				Name:  "keepalive-time",
+				Usage: "the time of inactivity after which the connection is checked (min 10s)",
+				Value: service.DefaultClientConfig.KeepaliveTime,
+			},
+			&cli.DurationFlag{
+				Name:  "keepalive-timeout",
+				Usage: "the time to wait for the server to respond to a connection check before giving up",
+				Value: service.DefaultClientConfig.KeepaliveTimeout,
+			},
+			&cli.BoolFlag{
+				Name:  "scores",
+				Usage: "print the probability of each generated token after it, to inspect the confidence of the model",
+			},
 			&cli.StringFlag{
 				Name:     "promptt",
 				Usage:    `the path to the prompt template file. If not specified, the default template \n\n{{.Text}} will be used`,
 				Required: false,
 			},
+			&cli.StringFlag{
+				Name:     "instruction",
+				Usage:    "an instruction prepended to the prompt, followed by a blank line, to test different instructions on the same inputs",
+				Required: false,
+			},
 		},
 	}
 
@@ -87,23 +122,24 @@ func main() {
 	}
 }
 
-func inference(opts decoder.DecodingOptions, promptt pTemplate, endpoint string) error {
+func inference(opts decoder.DecodingOptions, promptt pTemplate, instruction, endpoint string, conf service.ClientConfig, scores bool) error {
 
 	text, err := inputTextFromStdin()
 	if err != nil {
 		return err
 	}
 
-	conn, err := grpc.Dial(endpoint, grpc.WithInsecure(), grpc.WithBlock())
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, os.Kill)
+	defer stop()
+
+	client, conn, err := service.NewClient(ctx, endpoint, conf)
 	if err != nil {
-		log.Fatal().Msgf("Failed to connect: %v", err)
+		return err
 	}
 	defer conn.Close()
 
-	client := api.NewLanguageModelClient(conn)
-
 	log.Trace().Msgf("Building prompt from template: %q", promptt.data)
-	input, err := buildInputPrompt(text, promptt.data)
+	input, err := buildInputPrompt(text, promptt.question)
 	if err != nil {
 		return err
 	}
@@ -112,6 +148,7 @@ func inference(opts decoder.DecodingOptions, promptt pTemplate, endpoint string)
 	if err != nil {
 		return err
 	}
+	prompt = prependInstruction(instruction, prompt)
 	log.Trace().Msgf("Final prompt: %q", prompt)
 
 	req := &api.TokenGenerationRequest{
@@ -119,9 +156,6 @@ func inference(opts decoder.DecodingOptions, promptt pTemplate, endpoint string)
 		DecodingParameters: decodingOptionsToGRPC(opts),
 	}
 
-	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, os.Kill)
-	defer stop()
-
 	stream, err := client.GenerateTokens(ctx, req)
 	if err != nil {
 		return fmt.Errorf("failed to call GenerateTokens: %v", err)
@@ -141,12 +175,37 @@ func inference(opts decoder.DecodingOptions, promptt pTemplate, endpoint string)
 			}
 		}
 
-		fmt.Printf(res.Token)
+		if len(res.Chunk) == 0 {
+			fmt.Print(formatToken(res, scores))
+			continue
+		}
+		for _, tok := range res.Chunk {
+			fmt.Print(formatToken(tok, scores))
+		}
 	}
 	log.Debug().Msg("Done.")
 	return nil
 }
 
+// prependInstruction returns the prompt preceded by the instruction and a
+// blank line, or the prompt as is if the instruction is empty.
+func prependInstruction(instruction, prompt string) string {
+	if instruction == "" {
+		return prompt
+	}
+	return instruction + "\n\n" + prompt
+}
+
+// formatToken returns the text of the token, followed by its probability
+// and its log-probability when scores is true and the token has them, unlike
+// the echoed prompt.
+func formatToken(tok *api.GeneratedToken, scores bool) string {
+	if !scores || tok.TokenProb == 0 {
+		return tok.Token
+	}
+	return fmt.Sprintf("%s[p=%.3f lp=%.3f]", tok.Token, tok.TokenProb, math.Log(float64(tok.TokenProb)))
+}
+
 func inputTextFromStdin() (string, error) {
 	info, err := os.Stdin.Stat()
 	if err != nil {
@@ -164,16 +223,21 @@ func inputTextFromStdin() (string, error) {
 	return input, nil
 }
 
-func buildInputPrompt(text, data string) (verbaflow.InputPrompt, error) {
-	if strings.Contains(data, "{{.Question}}") { // extractive question answering
-		log.Trace().Msgf("Splitting text into passage and question parts by \\n\\n")
-		spl := strings.Split(text, "\n\n")
-		if len(spl) != 2 {
+func buildInputPrompt(text string, question bool) (verbaflow.InputPrompt, error) {
+	if question { // extractive question answering
+		// the passage can contain blank lines, so only the last one separates it from the question
+		log.Trace().Msgf("Splitting text into passage and question parts by the last \\n\\n")
+		i := strings.LastIndex(text, "\n\n")
+		if i < 0 {
 			return verbaflow.InputPrompt{}, fmt.Errorf("required passage and question separated by \\n\\n")
 		}
+		passage, q := strings.TrimSpace(text[:i]), strings.TrimSpace(text[i+2:])
+		if passage == "" || q == "" {
+			return verbaflow.InputPrompt{}, fmt.Errorf("required non-empty passage and question separated by \\n\\n")
+		}
 		return verbaflow.InputPrompt{
-			Text:     spl[0],
-			Question: spl[1],
+			Text:     passage,
+			Question: q,
 		}, nil
 	}
 
@@ -194,8 +258,8 @@ func decodingOptionsFromFile(filepath string) (decoder.DecodingOptions, error) {
 	if err != nil {
 		return decoder.DecodingOptions{}, fmt.Errorf("error reading configuration file: %w", err)
 	}
-	var opts decoder.DecodingOptions
-	if err := yaml.Unmarshal(data, &opts); err != nil {
+	opts, err := decoder.UnmarshalOptions(data, yaml.Unmarshal)
+	if err != nil {
 		return decoder.DecodingOptions{}, fmt.Errorf("error unmarshaling configuration file: %w", err)
 	}
 	return opts, nil
@@ -205,29 +269,164 @@ func promptTemplateFromFile(filepath string) (pTemplate, error) {
 	if filepath == "" {
 		return defaultPromptTemplate, nil
 	}
-	t, err := template.ParseFiles(filepath)
+	b, err := os.ReadFile(filepath)
+	if err != nil {
+		return pTemplate{}, fmt.Errorf("error reading template file: %w", err)
+	}
+	return parsePromptTemplate(filepath, string(b))
+}
+
+// parsePromptTemplate parses the template and checks that all the fields it
+// references exist on verbaflow.InputPrompt, so that a mistake is reported
+// before any inference.
+func parsePromptTemplate(name, data string) (pTemplate, error) {
+	t, err := verbaflow.ParsePromptTemplate(name, data)
 	if err != nil {
 		return pTemplate{}, fmt.Errorf("error parsing template file: %w", err)
 	}
-	b, err := os.ReadFile(filepath) // just pass the file name
+	fields, err := templateFields(t)
 	if err != nil {
-		return pTemplate{}, fmt.Errorf("error reading template file: %w", err)
+		return pTemplate{}, fmt.Errorf("error validating template file: %w", err)
+	}
+	inputType := reflect.TypeOf(verbaflow.InputPrompt{})
+	question := false
+	for _, f := range fields {
+		if _, ok := inputType.FieldByName(f); !ok {
+			return pTemplate{}, fmt.Errorf("template %q references the unknown field %q: the available fields are %s",
+				name, f, strings.Join(inputPromptFields(), ", "))
+		}
+		question = question || f == "Question"
 	}
 	return pTemplate{
-		pt:   t,
-		data: string(b),
+		pt:       t,
+		data:     data,
+		question: question,
 	}, nil
 }
 
+// templateFields returns the names of the fields of the data referenced by
+// the template, either as {{.Field}} or {{$.Field}}, in order of appearance.
+func templateFields(t *template.Template) ([]string, error) {
+	var fields []string
+	seen := make(map[string]bool)
+	add := func(f string) {
+		if !seen[f] {
+			seen[f] = true
+			fields = append(fields, f)
+		}
+	}
+	var walk func(n parse.Node) error
+	walk = func(n parse.Node) error {
+		switch n := n.(type) {
+		case *parse.ListNode:
+			if n == nil {
+				return nil
+			}
+			for _, c := range n.Nodes {
+				if err := walk(c); err != nil {
+					return err
+				}
+			}
+		case *parse.ActionNode:
+			return walk(n.Pipe)
+		case *parse.PipeNode:
+			if n == nil {
+				return nil
+			}
+			for _, c := range n.Cmds {
+				if err := walk(c); err != nil {
+					return err
+				}
+			}
+		case *parse.CommandNode:
+			for _, c := range n.Args {
+				if err := walk(c); err != nil {
+					return err
+				}
+			}
+		case *parse.FieldNode:
+			add(n.Ident[0])
+		case *parse.VariableNode:
+			if n.Ident[0] == "$" && len(n.Ident) > 1 {
+				add(n.Ident[1])
+			}
+		case *parse.ChainNode:
+			return walk(n.Node)
+		case *parse.IfNode:
+			return walkBranch(walk, &n.BranchNode)
+		case *parse.RangeNode:
+			return walkBranch(walk, &n.BranchNode)
+		case *parse.WithNode:
+			return walkBranch(walk, &n.BranchNode)
+		case *parse.TemplateNode:
+			return fmt.Errorf("nested templates are not supported: %s", n)
+		}
+		return nil
+	}
+	if t.Tree == nil {
+		return nil, nil
+	}
+	if err := walk(t.Tree.Root); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+func walkBranch(walk func(parse.Node) error, n *parse.BranchNode) error {
+	for _, c := range []parse.Node{n.Pipe, n.List, n.ElseList} {
+		if err := walk(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func inputPromptFields() []string {
+	t := reflect.TypeOf(verbaflow.InputPrompt{})
+	names := make([]string, t.NumField())
+	for i := range names {
+		names[i] = t.Field(i).Name
+	}
+	return names
+}
+
+func stopSequencesToGRPC(sequences []decoder.StopSequence) []*api.Sequence {
+	out := make([]*api.Sequence, len(sequences))
+	for i, seq := range sequences {
+		ids := make([]int32, len(seq.IDs))
+		for j, id := range seq.IDs {
+			ids[j] = int32(id)
+		}
+		out[i] = &api.Sequence{Sequence: ids, Action: string(seq.Action)}
+	}
+	return out
+}
+
 func decodingOptionsToGRPC(opts decoder.DecodingOptions) *api.DecodingParameters {
 	return &api.DecodingParameters{
-		MaxLen:         int32(opts.MaxLen),
-		MinLen:         int32(opts.MinLen),
-		Temperature:    float32(opts.Temp),
-		TopK:           int32(opts.TopK),
-		TopP:           float32(opts.TopP),
-		UseSampling:    opts.UseSampling,
-		EndTokenId:     int32(opts.EndTokenID),
-		SkipEndTokenId: opts.SkipEndTokenID,
+		MaxLen:              int32(opts.MaxLen),
+		MinLen:              int32(opts.MinLen),
+		Temperature:         float32(opts.Temp),
+		TopK:                int32(opts.TopK),
+		TopP:                float32(opts.TopP),
+		TypicalP:            float32(opts.TypicalP),
+		Epsilon:             float32(opts.Epsilon),
+		Eta:                 float32(opts.Eta),
+		UseSampling:         opts.UseSampling,
+		EndTokenId:          int32(opts.EndTokenID),
+		StopSequences:       stopSequencesToGRPC(opts.StopSequences),
+		SkipEndTokenId:      opts.SkipEndTokenID,
+		ForceJson:           opts.ForceJSON,
+		FilterSpecialTokens: opts.FilterSpecialTokens,
+		MinTopProb:          float32(opts.MinTopProb),
+		AddBos:              opts.AddBOS,
+		EchoPrompt:          opts.EchoPrompt,
+		TrimWhitespace:      opts.TrimWhitespace,
+		CollapseNewlines:    opts.CollapseNewlines,
+		ForcedPrefix:        opts.ForcedPrefix,
+		LogitClamp:          float32(opts.LogitClamp),
+		MaxTokensPerSecond:  float32(opts.MaxTokensPerSecond),
+		JsonSchema:          opts.JSONSchema,
+		JsonSchemaRetries:   int32(opts.JSONSchemaRetries),
 	}
 }
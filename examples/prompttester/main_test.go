@@ -0,0 +1,173 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nlpodyssey/verbaflow"
+	"github.com/nlpodyssey/verbaflow/api"
+)
+
+func TestParsePromptTemplate(t *testing.T) {
+	tests := []struct {
+		data     string
+		question bool
+	}{
+		{data: "{{.Text}}", question: false},
+		{data: "Question: {{.Question}}\nContext: {{.Text}}", question: true},
+		{data: "{{if .Question}}Q: {{ .Question }}{{end}}{{.Text}}", question: true},
+		{data: "{{with $.TargetLanguage}}{{.}}{{end}}: {{.Text}}", question: false},
+		{data: "{{trim .Text}} {{.Question | default \"Why?\"}}", question: true},
+	}
+	for _, tt := range tests {
+		pt, err := parsePromptTemplate("test", tt.data)
+		if err != nil {
+			t.Fatalf("%q: unexpected error: %v", tt.data, err)
+		}
+		if pt.question != tt.question {
+			t.Errorf("%q: expected question %v, got %v", tt.data, tt.question, pt.question)
+		}
+	}
+}
+
+func TestParsePromptTemplate_UnknownField(t *testing.T) {
+	for _, data := range []string{
+		"{{.Text}} {{.Foo}}",
+		"{{if .Text}}{{$.Foo}}{{end}}",
+		"{{range .Text}}{{end}}{{printf \"%s\" .Foo}}",
+	} {
+		_, err := parsePromptTemplate("test", data)
+		if err == nil {
+			t.Fatalf("%q: expected an error", data)
+		}
+		for _, s := range []string{`"Foo"`, "Text, Question, TargetLanguage"} {
+			if !strings.Contains(err.Error(), s) {
+				t.Errorf("%q: expected the error %q to contain %s", data, err, s)
+			}
+		}
+	}
+}
+
+func TestPromptTemplateFromFile(t *testing.T) {
+	files, err := filepath.Glob("prompts/*.tmpl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		pt, err := promptTemplateFromFile(f)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", f, err)
+			continue
+		}
+		b, err := os.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := strings.Contains(string(b), ".Question"); pt.question != want {
+			t.Errorf("%s: expected question %v, got %v", f, want, pt.question)
+		}
+	}
+}
+
+func TestDecodingOptionsFromFile(t *testing.T) {
+	if _, err := decodingOptionsFromFile("config.yaml"); err != nil {
+		t.Errorf("config.yaml: unexpected error: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte("preset: deterministic\nmax_len: 10\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	opts, err := decodingOptionsFromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.MaxLen != 10 || opts.UseSampling || opts.TopP != 1 {
+		t.Errorf("expected the deterministic preset with max_len 10, got %+v", opts)
+	}
+}
+
+func TestBuildInputPrompt(t *testing.T) {
+	tests := []struct {
+		text     string
+		passage  string
+		question string
+	}{
+		{
+			text:     "The sky is blue.\n\nWhat color is the sky?",
+			passage:  "The sky is blue.",
+			question: "What color is the sky?",
+		},
+		{
+			text:     "First paragraph.\n\nSecond paragraph.\n\n\nThird paragraph.\n\nWhich paragraph is the last?",
+			passage:  "First paragraph.\n\nSecond paragraph.\n\n\nThird paragraph.",
+			question: "Which paragraph is the last?",
+		},
+	}
+	for _, tt := range tests {
+		input, err := buildInputPrompt(tt.text, true)
+		if err != nil {
+			t.Fatalf("%q: unexpected error: %v", tt.text, err)
+		}
+		if input.Text != tt.passage || input.Question != tt.question {
+			t.Errorf("%q: expected passage %q and question %q, got %q and %q",
+				tt.text, tt.passage, tt.question, input.Text, input.Question)
+		}
+	}
+
+	for _, text := range []string{"no question", "\n\nonly a question", "only a passage\n\n"} {
+		if _, err := buildInputPrompt(text, true); err == nil {
+			t.Errorf("%q: expected an error", text)
+		}
+	}
+
+	input, err := buildInputPrompt("a\n\nb", false)
+	if err != nil || input.Text != "a\n\nb" || input.Question != "" {
+		t.Errorf("unexpected input %+v (error %v)", input, err)
+	}
+}
+
+func TestPrependInstruction(t *testing.T) {
+	promptt, err := parsePromptTemplate("test", "Text: {{.Text}}\nPlaces:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	input, err := buildInputPrompt("I flew from Rome to Paris.", promptt.question)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prompt, err := verbaflow.BuildPromptFromTemplate(input, promptt.pt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	instruction := "Extract the names of the places mentioned in the text."
+	want := instruction + "\n\nText: I flew from Rome to Paris.\nPlaces:"
+	if got := prependInstruction(instruction, prompt); got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+	if got := prependInstruction("", prompt); got != prompt {
+		t.Errorf("expected the prompt %q as is, got %q", prompt, got)
+	}
+}
+
+func TestFormatToken(t *testing.T) {
+	tok := &api.GeneratedToken{Token: " blue", TokenProb: 0.5}
+	if got := formatToken(tok, false); got != " blue" {
+		t.Errorf("expected the text alone, got %q", got)
+	}
+	if got, want := formatToken(tok, true), " blue[p=0.500 lp=-0.693]"; got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+	// the echoed prompt has no score
+	prompt := &api.GeneratedToken{Token: "sky", IsPrompt: true}
+	if got := formatToken(prompt, true); got != "sky" {
+		t.Errorf("expected the text alone, got %q", got)
+	}
+}
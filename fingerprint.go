@@ -0,0 +1,57 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package verbaflow
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/nlpodyssey/verbaflow/decoder"
+)
+
+// fingerprintVersion is hashed with the generation, so that the fingerprints
+// change if their encoding does.
+const fingerprintVersion = "v1"
+
+// GenerationFingerprint returns a stable hash of the prompt and of all the
+// decoding options, for example to key a cache of the responses, or in
+// snapshot tests.
+//
+// The options are encoded by name, sorted, so the hash doesn't depend on
+// the order of the fields of DecodingOptions. The zero values are skipped,
+// so that a nil slice is equal to an empty one, and a new option doesn't
+// change the hash of the generations which don't use it.
+// The prompt is hashed as it is, since any change, even of its whitespace,
+// can change the output.
+func GenerationFingerprint(prompt string, opts decoder.DecodingOptions) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%q\n", fingerprintVersion, prompt)
+	for _, field := range encodeOptions(opts) {
+		fmt.Fprintln(h, field)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// encodeOptions returns the non-zero fields of the options as "name=value"
+// strings, sorted by name.
+func encodeOptions(opts decoder.DecodingOptions) []string {
+	v := reflect.ValueOf(opts)
+	t := v.Type()
+	fields := make([]string, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		f := v.Field(i)
+		if !t.Field(i).IsExported() || f.IsZero() || (f.Kind() == reflect.Slice && f.Len() == 0) {
+			continue
+		}
+		// the floats are printed with the shortest representation which
+		// identifies them
+		fields = append(fields, fmt.Sprintf("%s=%#v", t.Field(i).Name, f.Interface()))
+	}
+	sort.Strings(fields)
+	return fields
+}
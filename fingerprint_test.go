@@ -0,0 +1,46 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package verbaflow
+
+import (
+	"testing"
+
+	"github.com/nlpodyssey/verbaflow/decoder"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGenerationFingerprint(t *testing.T) {
+	opts := decoder.DecodingOptions{
+		MaxLen:           20,
+		EndTokenID:       0,
+		Temp:             0.7,
+		TopP:             0.9,
+		StopSequencesIDs: [][]int{{1, 2}},
+	}
+	same := opts
+	same.StopSequencesIDs = [][]int{{1, 2}}
+	fp := GenerationFingerprint("Hello", opts)
+	assert.Len(t, fp, 64)
+	assert.Equal(t, fp, GenerationFingerprint("Hello", same))
+
+	// a nil slice is equal to an empty one
+	opts.AllowedTokenIDs, same.AllowedTokenIDs = nil, []int{}
+	assert.Equal(t, GenerationFingerprint("Hello", opts), GenerationFingerprint("Hello", same))
+
+	changed := opts
+	changed.Temp = 0.8
+	assert.NotEqual(t, fp, GenerationFingerprint("Hello", changed))
+	changed = opts
+	changed.StopSequencesIDs = [][]int{{1}, {2}}
+	assert.NotEqual(t, fp, GenerationFingerprint("Hello", changed))
+	assert.NotEqual(t, fp, GenerationFingerprint("Hello ", opts))
+}
+
+func TestGenerationFingerprint_Stable(t *testing.T) {
+	// the fingerprints must not change when options are added, nor across
+	// runs, unless fingerprintVersion does
+	opts := decoder.DecodingOptions{MaxLen: 20, Temp: 1, TopP: 1}
+	assert.Equal(t, "f648ff45f3d0dc03dbb0639b5c2f184565b5d933e246d0a73bb135fcac597fae", GenerationFingerprint("Hello", opts))
+}
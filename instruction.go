@@ -0,0 +1,70 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package verbaflow
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/nlpodyssey/verbaflow/decoder"
+)
+
+// InstructionFormat is the structure expected by an instruction model,
+// which separates the prompt from the response with a prefix, and ends the
+// response where the next prompt would begin.
+type InstructionFormat struct {
+	// ResponsePrefix is appended to the prompt, so that the model starts the
+	// response, such as "\nAnswer:".
+	ResponsePrefix string `json:"response_prefix" yaml:"response_prefix"`
+	// StopMarker is the text beginning the next prompt, such as
+	// "\nQuestion:", which stops the generation, and is trimmed from the
+	// response. If it is empty, only the other stop conditions apply.
+	StopMarker string `json:"stop_marker" yaml:"stop_marker"`
+}
+
+// QuestionAnswerFormat is the format of the question answering prompts.
+var QuestionAnswerFormat = InstructionFormat{
+	ResponsePrefix: "\nAnswer:",
+	StopMarker:     "\nQuestion:",
+}
+
+// InstructionTurn is a prompt in an InstructionFormat, with the decoding
+// options stopping the generation at the end of the response.
+type InstructionTurn struct {
+	// Prompt is the instruction, ending with the response prefix.
+	Prompt string
+	// Options are the given decoding options, with the stop marker added to
+	// the StopSequences, with the StopTrim action.
+	Options decoder.DecodingOptions
+}
+
+// NewInstructionTurn returns the turn generating the response to the
+// instruction in the given format, with the given decoding options, which
+// are not modified. The response prefix is not appended again if the
+// instruction already ends with it.
+//
+// The stop marker is tokenized on its own, so it is matched as long as the
+// model generates the same tokens, which is usually the case when it begins
+// with a white space or a newline.
+func (vf *VerbaFlow) NewInstructionTurn(instruction string, f InstructionFormat, opts decoder.DecodingOptions) (*InstructionTurn, error) {
+	prompt := instruction
+	if !strings.HasSuffix(prompt, f.ResponsePrefix) {
+		prompt += f.ResponsePrefix
+	}
+	if f.StopMarker == "" {
+		return &InstructionTurn{Prompt: prompt, Options: opts}, nil
+	}
+
+	stop, err := vf.TokenizePrompt(f.StopMarker, false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to tokenize the stop marker %q: %w", f.StopMarker, err)
+	}
+	if len(stop) == 0 {
+		return nil, fmt.Errorf("invalid stop marker %q: it has no tokens", f.StopMarker)
+	}
+	stops := make([]decoder.StopSequence, 0, len(opts.StopSequences)+1)
+	opts.StopSequences = append(append(stops, opts.StopSequences...), decoder.StopSequence{IDs: stop, Action: decoder.StopTrim})
+	return &InstructionTurn{Prompt: prompt, Options: opts}, nil
+}
@@ -0,0 +1,44 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package verbaflow
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/nlpodyssey/verbaflow/decoder"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerbaFlow_NewInstructionTurn(t *testing.T) {
+	vf := newTestVerbaFlow(t)
+	format := InstructionFormat{ResponsePrefix: "\nated", StopMarker: "unrelated"}
+	opts := decoder.DecodingOptions{
+		StopSequencesIDs: [][]int{{3}},
+		StopSequences:    []decoder.StopSequence{{IDs: []int{4}}},
+	}
+
+	turn, err := vf.NewInstructionTurn("related", format, opts)
+	require.NoError(t, err)
+	assert.Equal(t, "related\nated", turn.Prompt)
+	assert.True(t, strings.HasSuffix(turn.Prompt, format.ResponsePrefix))
+	assert.Equal(t, [][]int{{3}}, turn.Options.StopSequencesIDs)
+	assert.False(t, turn.Options.TrimStopSequence, "the other stop sequences must not be trimmed")
+	assert.Equal(t, []decoder.StopSequence{{IDs: []int{4}}, {IDs: []int{11, 14}, Action: decoder.StopTrim}}, turn.Options.StopSequences)
+	assert.Len(t, opts.StopSequences, 1, "the given options must not be modified")
+
+	// the response prefix is not repeated
+	turn, err = vf.NewInstructionTurn("related\nated", format, opts)
+	require.NoError(t, err)
+	assert.Equal(t, "related\nated", turn.Prompt)
+
+	turn, err = vf.NewInstructionTurn("related", InstructionFormat{ResponsePrefix: "\nated"}, opts)
+	require.NoError(t, err)
+	assert.Equal(t, opts, turn.Options)
+
+	_, err = vf.NewInstructionTurn("related", InstructionFormat{StopMarker: "\n"}, opts)
+	assert.Error(t, err, "the stop marker has no tokens in the tiny vocabulary")
+}
@@ -6,8 +6,17 @@ package verbaflow
 
 import (
 	"bytes"
+	"embed"
 	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"text/template"
+	"time"
 )
 
 // InputPrompt is the input for the prompt generation.
@@ -17,15 +26,92 @@ type InputPrompt struct {
 	TargetLanguage string `json:"target_language,omitempty"`
 }
 
+// PromptFuncs are the helper functions available to the prompt templates
+// parsed by ParsePromptTemplate and BuildPromptFromTemplateFile:
+//   - trim removes the leading and trailing white space: {{trim .Text}}
+//   - lower and upper change the case: {{upper .TargetLanguage}}
+//   - default returns a value if the given one is empty: {{.Question | default "What is it about?"}}
+//   - join joins the given strings with a separator: {{join ", " .Text .Question}}
+var PromptFuncs = template.FuncMap{
+	"trim":    strings.TrimSpace,
+	"lower":   strings.ToLower,
+	"upper":   strings.ToUpper,
+	"default": defaultValue,
+	"join":    join,
+}
+
+func defaultValue(def, value string) string {
+	if value == "" {
+		return def
+	}
+	return value
+}
+
+func join(sep string, elems ...string) string {
+	return strings.Join(elems, sep)
+}
+
+// ParsePromptTemplate parses a prompt template, with the PromptFuncs.
+func ParsePromptTemplate(name, text string) (*template.Template, error) {
+	return template.New(name).Funcs(PromptFuncs).Parse(text)
+}
+
 // BuildPromptFromTemplateFile builds a prompt applying the given input to the template file.
+// The parsed template is cached, and the file is parsed again only when its
+// modification time or size change.
 func BuildPromptFromTemplateFile(input InputPrompt, filename string) (string, error) {
-	pt, err := template.ParseFiles(filename)
+	pt, err := templates.get(filename)
 	if err != nil {
 		return "", fmt.Errorf("unable to read the template file: %w", err)
 	}
 	return BuildPromptFromTemplate(input, pt)
 }
 
+// templates caches the templates used by BuildPromptFromTemplateFile.
+var templates = templateCache{entries: make(map[string]cachedTemplate)}
+
+// parseTemplateFile parses a template file. It is a variable so that the
+// tests can count the parsings.
+var parseTemplateFile = func(filename string) (*template.Template, error) {
+	return template.New(filepath.Base(filename)).Funcs(PromptFuncs).ParseFiles(filename)
+}
+
+// templateCache holds the parsed templates, keyed by filename.
+type templateCache struct {
+	mu      sync.Mutex
+	entries map[string]cachedTemplate
+}
+
+// cachedTemplate is a parsed template, with the state of the file it was
+// parsed from.
+type cachedTemplate struct {
+	pt      *template.Template
+	modTime time.Time
+	size    int64
+}
+
+// get returns the template parsed from the file, parsing it again if the file
+// changed since the cached parsing.
+func (c *templateCache) get(filename string) (*template.Template, error) {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[filename]; ok && e.modTime.Equal(info.ModTime()) && e.size == info.Size() {
+		return e.pt, nil
+	}
+	pt, err := parseTemplateFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	c.entries[filename] = cachedTemplate{pt: pt, modTime: info.ModTime(), size: info.Size()}
+	return pt, nil
+}
+
 // BuildPromptFromTemplate builds a prompt applying the given input to the template.
 func BuildPromptFromTemplate(input InputPrompt, pt *template.Template) (string, error) {
 	result := new(bytes.Buffer)
@@ -35,3 +121,38 @@ func BuildPromptFromTemplate(input InputPrompt, pt *template.Template) (string,
 	}
 	return result.String(), nil
 }
+
+// builtinTemplates holds the curated prompt templates, in the RWKV
+// question-answer format.
+//
+//go:embed templates/*.tmpl
+var builtinTemplates embed.FS
+
+// BuiltinTemplateNames returns the sorted names of the built-in prompt
+// templates: "instruction", "qa", "summarization" and "translation".
+func BuiltinTemplateNames() []string {
+	entries, err := fs.ReadDir(builtinTemplates, "templates")
+	if err != nil {
+		panic(err) // the directory is embedded at build time
+	}
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		names = append(names, strings.TrimSuffix(e.Name(), ".tmpl"))
+	}
+	sort.Strings(names)
+	return names
+}
+
+// BuiltinTemplate returns the built-in prompt template with the given name,
+// parsed with the PromptFuncs, so that it can be used without external files:
+//   - instruction: the Text is the instruction to follow
+//   - qa: the Question is asked about the Text (default "What is it about?")
+//   - translation: the Text is translated to the TargetLanguage (default "English")
+//   - summarization: the Text is summarized
+func BuiltinTemplate(name string) (*template.Template, error) {
+	data, err := builtinTemplates.ReadFile(path.Join("templates", name+".tmpl"))
+	if err != nil {
+		return nil, fmt.Errorf("unknown built-in template %q: must be one of %s", name, strings.Join(BuiltinTemplateNames(), ", "))
+	}
+	return ParsePromptTemplate(name, string(data))
+}
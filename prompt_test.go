@@ -0,0 +1,95 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package verbaflow
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildPromptFromTemplateFile_Cache(t *testing.T) {
+	parsings := 0
+	parse := parseTemplateFile
+	parseTemplateFile = func(filename string) (*template.Template, error) {
+		parsings++
+		return parse(filename)
+	}
+	t.Cleanup(func() { parseTemplateFile = parse })
+
+	filename := filepath.Join(t.TempDir(), "prompt.tmpl")
+	writeTemplate := func(text string, modTime time.Time) {
+		require.NoError(t, os.WriteFile(filename, []byte(text), 0o644))
+		require.NoError(t, os.Chtimes(filename, modTime, modTime))
+	}
+	input := InputPrompt{Text: "text", Question: "question"}
+	modTime := time.Now().Add(-time.Hour)
+
+	writeTemplate("Q: {{.Question}}", modTime)
+	for i := 0; i < 2; i++ {
+		prompt, err := BuildPromptFromTemplateFile(input, filename)
+		require.NoError(t, err)
+		assert.Equal(t, "Q: question", prompt)
+	}
+	assert.Equal(t, 1, parsings)
+
+	writeTemplate("T: {{.Text}}", modTime.Add(time.Minute))
+	prompt, err := BuildPromptFromTemplateFile(input, filename)
+	require.NoError(t, err)
+	assert.Equal(t, "T: text", prompt)
+	assert.Equal(t, 2, parsings)
+
+	require.NoError(t, os.Remove(filename))
+	_, err = BuildPromptFromTemplateFile(input, filename)
+	assert.Error(t, err)
+}
+
+func TestBuildPromptFromTemplate_Funcs(t *testing.T) {
+	pt, err := ParsePromptTemplate("qa", `{{trim .Text}}
+Q: {{.Question | default "What is it about?"}}
+{{upper .TargetLanguage}} {{join ", " "a" "b"}}`)
+	require.NoError(t, err)
+
+	prompt, err := BuildPromptFromTemplate(InputPrompt{Text: "  a passage\n", TargetLanguage: "it"}, pt)
+	require.NoError(t, err)
+	assert.Equal(t, "a passage\nQ: What is it about?\nIT a, b", prompt)
+
+	prompt, err = BuildPromptFromTemplate(InputPrompt{Text: "text", Question: "Why?"}, pt)
+	require.NoError(t, err)
+	assert.Equal(t, "text\nQ: Why?\n a, b", prompt)
+}
+
+func TestBuiltinTemplate(t *testing.T) {
+	assert.Equal(t, []string{"instruction", "qa", "summarization", "translation"}, BuiltinTemplateNames())
+
+	input := InputPrompt{Text: " Je suis un homme.\n", Question: "Who is it?", TargetLanguage: "Italian"}
+	expected := map[string]string{
+		"instruction":   "\nQ: Je suis un homme.\n\nA:",
+		"qa":            "\nQ: Je suis un homme.\n\nWho is it?\n\nA:",
+		"summarization": "\nQ: Summarize the following text in a few sentences: Je suis un homme.\n\nA:",
+		"translation":   "\nQ: Translate the following text to Italian: Je suis un homme.\n\nA:",
+	}
+	for _, name := range BuiltinTemplateNames() {
+		pt, err := BuiltinTemplate(name)
+		require.NoError(t, err, name)
+		prompt, err := BuildPromptFromTemplate(input, pt)
+		require.NoError(t, err, name)
+		assert.Equal(t, expected[name], prompt, name)
+	}
+
+	pt, err := BuiltinTemplate("translation")
+	require.NoError(t, err)
+	prompt, err := BuildPromptFromTemplate(InputPrompt{Text: "Ciao"}, pt)
+	require.NoError(t, err)
+	assert.Equal(t, "\nQ: Translate the following text to English: Ciao\n\nA:", prompt)
+
+	_, err = BuiltinTemplate("poetry")
+	assert.ErrorContains(t, err, "instruction, qa, summarization, translation")
+}
@@ -0,0 +1,245 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rwkvlm
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/nlpodyssey/rwkv"
+	"github.com/nlpodyssey/spago/ag"
+	"github.com/nlpodyssey/spago/nn"
+)
+
+// one is the constant used by the RWKV mixes, like in the rwkv package.
+var one = ag.Scalar(1.0)
+
+// StepTokens is like StepToken for many independent sequences, each with its
+// own token and state, and returns their outputs and states in the same
+// order. The products with the weight matrices, which dominate the cost of a
+// step, are computed once for all of them, as a product of matrices.
+//
+// The outputs are computed before returning, and the graph of each sequence
+// is cut at the batched products, so that it can be released on its own,
+// like the graph of StepToken.
+func (m *Model) StepTokens(tokens []int, states []rwkv.State) ([]ag.Node, []rwkv.State) {
+	xs := make([]ag.Node, len(tokens))
+	out := make([]rwkv.State, len(tokens))
+	for i, token := range tokens {
+		xs[i] = m.Embeddings.EncodeToken(token)
+		out[i] = states[i]
+		if len(out[i]) == 0 {
+			out[i] = rwkv.NewState(m.Encoder.Config)
+		}
+	}
+	for i, layer := range m.Encoder.Layers {
+		ls := make([]*rwkv.LayerState, len(xs))
+		for j, s := range out {
+			ls[j] = s[i]
+		}
+		xs = forwardLayerBatch(layer, xs, ls)
+		if (i+1)%m.Encoder.Config.RescaleLayer == 0 {
+			xs = mapNodes(xs, func(_ int, x ag.Node) ag.Node {
+				return ag.ProdScalar(x, ag.Scalar(0.5))
+			})
+		}
+	}
+	for _, x := range xs {
+		x.Value()
+	}
+	return xs, out
+}
+
+// forwardLayerBatch is like rwkv.Layer.ForwardSingle for many sequences.
+func forwardLayerBatch(layer *rwkv.Layer, xs []ag.Node, states []*rwkv.LayerState) []ag.Node {
+	if layer.ID == 0 {
+		xs = mapNodes(xs, func(_ int, x ag.Node) ag.Node {
+			return layer.LN0.Forward(x)[0]
+		})
+	}
+
+	// time mix
+	tm := layer.TimeMix
+	xa := mapNodes(xs, func(_ int, x ag.Node) ag.Node {
+		return layer.LN1.Forward(x)[0]
+	})
+	mix := func(w nn.Param, prev func(s *rwkv.LayerState) ag.Node) []ag.Node {
+		return mapNodes(xa, func(j int, x ag.Node) ag.Node {
+			return ag.Add(ag.Prod(w, x), ag.Prod(ag.ReverseSub(w, one), prev(states[j])))
+		})
+	}
+	attXX := func(s *rwkv.LayerState) ag.Node { return s.AttXX }
+	k := mulBatch(tm.Key, mix(tm.TimeMixK, attXX))
+	v := mulBatch(tm.Value, mix(tm.TimeMixV, attXX))
+	r := mulBatch(tm.Receptance, mix(tm.TimeMixR, attXX))
+	wkv := mapNodes(xa, func(j int, _ ag.Node) ag.Node {
+		s := states[j]
+		ww := ag.Add(k[j], tm.TimeFirst)
+		p := ag.Max(s.AttPP, ww)
+		e1 := ag.Exp(ag.Sub(s.AttPP, p))
+		e2 := ag.Exp(ag.Sub(ww, p))
+		a := ag.Add(ag.Prod(e1, s.AttAA), ag.Prod(e2, v[j]))
+		b := ag.Add(ag.Prod(e1, s.AttBB), e2)
+		return ag.Prod(ag.Sigmoid(r[j]), ag.Div(a, b))
+	})
+	att := mulBatch(tm.Output, wkv)
+	for j, s := range states {
+		ww := ag.Add(s.AttPP, tm.TimeDecay)
+		p := ag.Max(ww, k[j])
+		e1 := ag.Exp(ag.Sub(ww, p))
+		e2 := ag.Exp(ag.Sub(k[j], p))
+		s.AttXX = xa[j]
+		s.AttAA = ag.Add(ag.Prod(e1, s.AttAA), ag.Prod(e2, v[j]))
+		s.AttBB = ag.Add(ag.Prod(e1, s.AttBB), e2)
+		s.AttPP = p
+	}
+	xs = mapNodes(xs, func(j int, x ag.Node) ag.Node {
+		return ag.Add(x, att[j])
+	})
+
+	// channel mix
+	cm := layer.ChanMix
+	xc := mapNodes(xs, func(_ int, x ag.Node) ag.Node {
+		return layer.LN2.Forward(x)[0]
+	})
+	mix = func(w nn.Param, prev func(s *rwkv.LayerState) ag.Node) []ag.Node {
+		return mapNodes(xc, func(j int, x ag.Node) ag.Node {
+			return ag.Add(ag.Prod(x, w), ag.Prod(ag.ReverseSub(w, one), prev(states[j])))
+		})
+	}
+	ffnXX := func(s *rwkv.LayerState) ag.Node { return s.FfnXX }
+	ck := mulBatch(cm.Key, mix(cm.TimeMixK, ffnXX))
+	cr := mulBatch(cm.Receptance, mix(cm.TimeMixR, ffnXX))
+	for j, s := range states {
+		s.FfnXX = xc[j]
+	}
+	kv := mulBatch(cm.Value, mapNodes(ck, func(_ int, k ag.Node) ag.Node {
+		return ag.Square(ag.ReLU(k))
+	}))
+	return mapNodes(xs, func(j int, x ag.Node) ag.Node {
+		return ag.Add(x, ag.Prod(ag.Sigmoid(cr[j]), kv[j]))
+	})
+}
+
+// mulBatch returns the products of the weights with each of the vectors,
+// computed as a single product of matrices. The results are new variables,
+// detached from the graph of the vectors.
+func mulBatch(w nn.Param, xs []ag.Node) []ag.Node {
+	if len(xs) == 1 {
+		return []ag.Node{ag.Var(ag.Mul(w, xs[0]).Value())}
+	}
+	inputs := mapNodes(xs, func(_ int, x ag.Node) ag.Node {
+		return ag.Var(x.Value())
+	})
+	y := ag.Mul(w, ag.T(ag.Stack(inputs...)))
+	defer ag.ReleaseGraph(y)
+	return mapNodes(xs, func(j int, _ ag.Node) ag.Node {
+		return ag.Var(y.Value().ExtractColumn(j))
+	})
+}
+
+func mapNodes(xs []ag.Node, fn func(i int, x ag.Node) ag.Node) []ag.Node {
+	ys := make([]ag.Node, len(xs))
+	for i, x := range xs {
+		ys[i] = fn(i, x)
+	}
+	return ys
+}
+
+// Batcher runs the steps of the generations running concurrently on the same
+// model together, with StepTokens, to improve the throughput.
+//
+// The first step of a batch waits up to the window for the others, or until
+// the batch is full, then it runs the whole batch. Hence, each step can be
+// delayed by the window, which should be much shorter than a step.
+// It is safe for concurrent use.
+type Batcher struct {
+	model    *Model
+	window   time.Duration
+	maxBatch int
+
+	mu sync.Mutex
+	// current is the batch collecting the steps, or nil.
+	current *stepBatch
+}
+
+// stepBatch is a batch of steps.
+type stepBatch struct {
+	requests []*stepRequest
+	// full is closed when the batch is full.
+	full chan struct{}
+}
+
+// stepRequest is a step waiting in a batch.
+type stepRequest struct {
+	token int
+	state rwkv.State
+	x     ag.Node
+	done  chan struct{}
+}
+
+// NewBatcher returns a Batcher of the steps on the model, running at most
+// maxBatch steps together, or any number if it is not positive.
+func NewBatcher(m *Model, window time.Duration, maxBatch int) *Batcher {
+	return &Batcher{
+		model:    m,
+		window:   window,
+		maxBatch: maxBatch,
+	}
+}
+
+// StepToken is like Model.StepToken, but runs the step in a batch with the
+// steps requested by other goroutines in the meantime.
+func (b *Batcher) StepToken(_ context.Context, token int, s rwkv.State) (ag.Node, rwkv.State) {
+	req := &stepRequest{token: token, state: s, done: make(chan struct{})}
+	b.mu.Lock()
+	if b.current == nil {
+		b.current = &stepBatch{full: make(chan struct{})}
+	}
+	batch := b.current
+	batch.requests = append(batch.requests, req)
+	leader := len(batch.requests) == 1
+	if b.maxBatch > 0 && len(batch.requests) == b.maxBatch {
+		close(batch.full)
+		b.current = nil
+	}
+	b.mu.Unlock()
+
+	if !leader {
+		<-req.done
+		return req.x, req.state
+	}
+
+	timer := time.NewTimer(b.window)
+	select {
+	case <-timer.C:
+	case <-batch.full:
+		timer.Stop()
+	}
+	b.mu.Lock()
+	if b.current == batch {
+		b.current = nil
+	}
+	requests := batch.requests
+	b.mu.Unlock()
+
+	b.run(requests)
+	return req.x, req.state
+}
+
+// run runs the steps, and wakes up the goroutines waiting for them.
+func (b *Batcher) run(requests []*stepRequest) {
+	tokens := make([]int, len(requests))
+	states := make([]rwkv.State, len(requests))
+	for i, req := range requests {
+		tokens[i], states[i] = req.token, req.state
+	}
+	xs, states := b.model.StepTokens(tokens, states)
+	for i, req := range requests {
+		req.x, req.state = xs[i], states[i]
+		close(req.done)
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rwkvlm_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nlpodyssey/rwkv"
+	"github.com/nlpodyssey/spago/ag"
+	"github.com/nlpodyssey/verbaflow/rwkvlm"
+	"github.com/nlpodyssey/verbaflow/rwkvlm/rwkvlmtest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// batchSequences are independent sequences, of different lengths.
+var batchSequences = [][]int{{1, 2, 3, 4}, {15, 3, 3, 9}, {7}, {2, 2, 2, 2}}
+
+func TestModel_StepTokens(t *testing.T) {
+	m := rwkvlmtest.NewModel(rwkvlmtest.DefaultConfig, 1)
+	ctx := context.Background()
+
+	stepStates := make([]rwkv.State, len(batchSequences))
+	batchStates := make([]rwkv.State, len(batchSequences))
+	for step := 0; step < 4; step++ {
+		var tokens []int
+		var indices []int
+		for i, seq := range batchSequences {
+			if step < len(seq) {
+				tokens = append(tokens, seq[step])
+				indices = append(indices, i)
+			}
+		}
+		states := make([]rwkv.State, len(indices))
+		for j, i := range indices {
+			states[j] = batchStates[i]
+		}
+		xs, states := m.StepTokens(tokens, states)
+		require.Len(t, xs, len(tokens))
+
+		for j, i := range indices {
+			var expected ag.Node
+			expected, stepStates[i] = m.StepToken(ctx, tokens[j], stepStates[i])
+			batchStates[i] = states[j]
+			assert.InDeltaSlice(t, expected.Value().Data().F64(), xs[j].Value().Data().F64(), 1e-5, "step %d, sequence %d", step, i)
+			assertStatesInDelta(t, stateValues(stepStates[i]), stateValues(batchStates[i]), 1e-5)
+		}
+	}
+}
+
+func assertStatesInDelta(t *testing.T, expected, actual [][][]float64, delta float64) {
+	t.Helper()
+	require.Equal(t, len(expected), len(actual))
+	for i := range expected {
+		require.Equal(t, len(expected[i]), len(actual[i]))
+		for j := range expected[i] {
+			assert.InDeltaSlice(t, expected[i][j], actual[i][j], delta, "layer %d, tensor %d", i, j)
+		}
+	}
+}
+
+func TestBatcher_StepToken(t *testing.T) {
+	m := rwkvlmtest.NewModel(rwkvlmtest.DefaultConfig, 1)
+	ctx := context.Background()
+	b := rwkvlm.NewBatcher(m, 10*time.Millisecond, 3)
+
+	var wg sync.WaitGroup
+	outputs := make([][][]float64, len(batchSequences))
+	for i, seq := range batchSequences {
+		wg.Add(1)
+		go func(i int, seq []int) {
+			defer wg.Done()
+			var s rwkv.State
+			for _, token := range seq {
+				var x ag.Node
+				x, s = b.StepToken(ctx, token, s)
+				outputs[i] = append(outputs[i], x.Value().Data().F64())
+			}
+		}(i, seq)
+	}
+	wg.Wait()
+
+	for i, seq := range batchSequences {
+		var s rwkv.State
+		require.Len(t, outputs[i], len(seq))
+		for j, token := range seq {
+			var expected ag.Node
+			expected, s = m.StepToken(ctx, token, s)
+			assert.InDeltaSlice(t, expected.Value().Data().F64(), outputs[i][j], 1e-5, "sequence %d, token %d", i, j)
+		}
+	}
+}
+
+func BenchmarkModel_StepTokens(b *testing.B) {
+	conf := rwkvlmtest.DefaultConfig
+	conf.DModel = 256
+	m := rwkvlmtest.NewModel(conf, 1)
+	ctx := context.Background()
+	const batchSize = 8
+	tokens := make([]int, batchSize)
+
+	b.Run("serial", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, token := range tokens {
+				x, _ := m.StepToken(ctx, token, nil)
+				ag.ReleaseGraph(ag.WaitForValue(x))
+			}
+		}
+	})
+	b.Run("batched", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			xs, _ := m.StepTokens(tokens, make([]rwkv.State, batchSize))
+			ag.ReleaseGraph(xs...)
+		}
+	})
+}
@@ -6,11 +6,12 @@ package rwkvlm
 
 import (
 	"fmt"
-	"math"
+	"io"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/nlpodyssey/gopickle/pytorch"
 	"github.com/nlpodyssey/gopickle/types"
@@ -44,10 +45,36 @@ type ConverterConfig struct {
 	EmbeddingRepoPath string
 	// If true, overwrite the model file if it already exists (default "false")
 	OverwriteIfExist bool
+	// If true, each block is written to the model file as soon as it is
+	// converted, instead of keeping the whole converted model in memory (default "false")
+	Streaming bool
+	// The number of blocks converted concurrently. It is ignored when
+	// Streaming is true, since the blocks are written in order (default 1)
+	Workers int
+	// If not nil, the progress of the conversion is sent to this channel,
+	// which must be consumed while the conversion runs. It is not closed at the end.
+	ProgressChan chan<- ConvertProgress
+}
+
+// Stages of the conversion reported by ConvertProgress.
+const (
+	ConvertStageEmbeddings = "embeddings"
+	ConvertStageLinear     = "linear"
+	ConvertStageBlocks     = "blocks"
+)
+
+// ConvertProgress reports the progress of a stage of the conversion:
+// Current out of Total items of the stage have been converted.
+type ConvertProgress struct {
+	Stage   string
+	Current int
+	Total   int
 }
 
 // ConvertPickledModelToRWKVLM converts a PyTorch model to a RWKVLM model.
 // It expects a configuration file "config.json" in the same directory as the model file containing the model configuration.
+// T is the type of the converted parameters: float64 is slower, but it can help
+// to tell precision issues apart from conversion problems.
 func ConvertPickledModelToRWKVLM[T float.DType](config ConverterConfig) error {
 	if config.PyModelFilename == "" {
 		config.PyModelFilename = DefaultPyModelFilename
@@ -71,10 +98,16 @@ func ConvertPickledModelToRWKVLM[T float.DType](config ConverterConfig) error {
 	if err != nil {
 		return fmt.Errorf("failed to load config file %q: %w", configFilename, err)
 	}
+	if modelConfig.RescaleInWeights && modelConfig.RescaleLayer <= 0 {
+		return fmt.Errorf("invalid rescale_layer value: %d. Must be > 0 when rescale_in_weights is true", modelConfig.RescaleLayer)
+	}
 
 	inFilename := filepath.Join(config.ModelDir, config.PyModelFilename)
 	embRepoPath := filepath.Join(config.ModelDir, config.EmbeddingRepoPath)
 	conv := newConverter[T](modelConfig, inFilename, outputFilename, embRepoPath)
+	conv.streaming = config.Streaming
+	conv.progress = config.ProgressChan
+	conv.workers = config.Workers
 	err = conv.run()
 	if err != nil {
 		return fmt.Errorf("model conversion failed: %w", err)
@@ -93,6 +126,9 @@ type converter[T float.DType] struct {
 	outFilename string
 	embRepoPath string
 	params      paramsMap
+	streaming   bool
+	progress    chan<- ConvertProgress
+	workers     int
 }
 
 func newConverter[T float.DType](conf Config, inFilename, outFilename, embRepoPath string) *converter[T] {
@@ -110,8 +146,11 @@ func (c *converter[T]) run() error {
 		c.convEmbeddings,
 		c.convLinear,
 		c.convRootLayerNorm,
-		c.convBlocks,
-		c.dumpModel,
+	}
+	if c.streaming {
+		funcs = append(funcs, c.convAndDumpBlocks)
+	} else {
+		funcs = append(funcs, c.convBlocks, c.dumpModel)
 	}
 	for _, fn := range funcs {
 		if err := fn(); err != nil {
@@ -121,6 +160,13 @@ func (c *converter[T]) run() error {
 	return nil
 }
 
+// reportProgress sends the progress to the progress channel, if any.
+func (c *converter[T]) reportProgress(stage string, current, total int) {
+	if c.progress != nil {
+		c.progress <- ConvertProgress{Stage: stage, Current: current, Total: total}
+	}
+}
+
 func (c *converter[T]) dumpModel() (err error) {
 	return Dump(c.model, c.outFilename)
 }
@@ -156,13 +202,18 @@ func (c *converter[T]) convEmbeddings() error {
 		return fmt.Errorf("expected embedding vectors to match configured size %d, actual %d", dm, vecs[0].Size())
 	}
 
-	return c.withEmbRepo(func(repo store.Repository) {
+	err = c.withEmbRepo(func(repo store.Repository) {
 		embs := c.newEmbeddings(repo)
 		for i, vec := range vecs {
 			embs.Tokens.EmbeddingFast(i).ReplaceValue(vec)
 		}
 		c.model.Embeddings = embs
 	})
+	if err != nil {
+		return err
+	}
+	c.reportProgress(ConvertStageEmbeddings, 1, 1)
+	return nil
 }
 
 func (c *converter[T]) newEmbeddings(repo store.Repository) *Embeddings {
@@ -209,44 +260,144 @@ func (c *converter[T]) convLinear() error {
 	}
 
 	c.model.Linear = nn.NewParam(m)
+	c.reportProgress(ConvertStageLinear, 1, 1)
 	return nil
 }
 
 func (c *converter[T]) convBlocks() error {
-	allBlocksParams := c.params.fetchPrefixed("blocks.")
-	numBlocks, err := countBlocks(allBlocksParams)
+	blocksParams, err := c.fetchBlocksParams()
 	if err != nil {
 		return err
 	}
-	if numBlocks == 0 {
-		return fmt.Errorf("no blocks/layers found in parameters")
+
+	conf := c.model.Config.encoderConfig()
+
+	layers := make([]*rwkv.Layer, len(blocksParams))
+	if c.workers > 1 {
+		err = c.convBlocksConcurrently(conf, blocksParams, layers)
+	} else {
+		for i := range layers {
+			layers[i], err = c.convBlock(i, conf, blocksParams[i])
+			if err != nil {
+				err = fmt.Errorf("failed to convert block/layer %d: %w", i, err)
+				break
+			}
+			c.reportProgress(ConvertStageBlocks, i+1, len(layers))
+		}
 	}
-	if hl := c.model.Config.NumHiddenLayers; hl == 0 {
-		c.model.Config.NumHiddenLayers = numBlocks
-	} else if hl != numBlocks {
-		return fmt.Errorf("expected %d blocks/layers, actual %d", hl, numBlocks)
+	if err != nil {
+		return err
 	}
 
-	conf := rwkv.Config{
-		DModel:       c.model.Config.DModel,
-		NumLayers:    c.model.Config.NumHiddenLayers,
-		RescaleLayer: c.model.Config.RescaleLayer,
+	c.model.Encoder = &rwkv.Model{
+		Config: conf,
+		Layers: layers,
 	}
+	return nil
+}
 
-	layers := make([]*rwkv.Layer, numBlocks)
-	for i := range layers {
-		blockParams := allBlocksParams.fetchPrefixed(fmt.Sprintf("%d.", i))
-		layers[i], err = c.convBlock(i, conf, blockParams)
+// convBlocksConcurrently converts the blocks into layers using a pool of
+// c.workers goroutines. Each block has its own params map, so the workers
+// don't share any mutable state. In case of errors, the one of the lowest
+// block is returned.
+func (c *converter[T]) convBlocksConcurrently(conf rwkv.Config, blocksParams []paramsMap, layers []*rwkv.Layer) error {
+	errs := make([]error, len(blocksParams))
+	jobs := make(chan int)
+
+	var mu sync.Mutex
+	done := 0
+
+	var wg sync.WaitGroup
+	for w := 0; w < c.workers && w < len(blocksParams); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				layers[i], errs[i] = c.convBlock(i, conf, blocksParams[i])
+				if errs[i] != nil {
+					continue
+				}
+				// the progress is reported while holding the lock, so that
+				// the counts are sent in order
+				mu.Lock()
+				done++
+				c.reportProgress(ConvertStageBlocks, done, len(blocksParams))
+				mu.Unlock()
+			}
+		}()
+	}
+	for i := range blocksParams {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	for i, err := range errs {
 		if err != nil {
 			return fmt.Errorf("failed to convert block/layer %d: %w", i, err)
 		}
 	}
+	return nil
+}
 
-	c.model.Encoder = &rwkv.Model{
-		Config: conf,
-		Layers: layers,
+// convAndDumpBlocks is like convBlocks followed by dumpModel, but each block
+// is written to the model file right after its conversion, so that only one
+// converted block at a time is kept in memory, and the source tensors are
+// released as soon as possible.
+func (c *converter[T]) convAndDumpBlocks() error {
+	blocksParams, err := c.fetchBlocksParams()
+	if err != nil {
+		return err
 	}
-	return nil
+
+	conf := c.model.Config.encoderConfig()
+	c.model.Encoder = &rwkv.Model{Config: conf}
+
+	return writeDumpFile(c.outFilename, func(w io.Writer) error {
+		encoder := newChunkEncoder(w)
+		// the encoder has no layers yet, so these are all the chunks before them
+		for _, chunk := range getChunksForGobEncoding(c.model) {
+			if err := encoder.encode(chunk); err != nil {
+				return err
+			}
+		}
+		for i := range blocksParams {
+			layer, err := c.convBlock(i, conf, blocksParams[i])
+			if err != nil {
+				return fmt.Errorf("failed to convert block/layer %d: %w", i, err)
+			}
+			blocksParams[i] = nil
+			if err := encoder.encode(layer); err != nil {
+				return fmt.Errorf("failed to encode block/layer %d: %w", i, err)
+			}
+			c.reportProgress(ConvertStageBlocks, i+1, len(blocksParams))
+		}
+		return nil
+	})
+}
+
+// fetchBlocksParams returns the params of each block, setting the number
+// of hidden layers in the model configuration if it is not set yet.
+func (c *converter[T]) fetchBlocksParams() ([]paramsMap, error) {
+	allBlocksParams := c.params.fetchPrefixed("blocks.")
+	numBlocks, err := countBlocks(allBlocksParams)
+	if err != nil {
+		return nil, err
+	}
+	if numBlocks == 0 {
+		return nil, fmt.Errorf("no blocks/layers found in parameters")
+	}
+	if hl := c.model.Config.NumHiddenLayers; hl == 0 {
+		c.model.Config.NumHiddenLayers = numBlocks
+	} else if hl != numBlocks {
+		return nil, fmt.Errorf("expected %d blocks/layers, actual %d", hl, numBlocks)
+	}
+
+	blocksParams := make([]paramsMap, numBlocks)
+	for i := range blocksParams {
+		blocksParams[i] = allBlocksParams.fetchPrefixed(fmt.Sprintf("%d.", i))
+	}
+	return blocksParams, nil
 }
 
 func (c *converter[T]) convBlock(id int, conf rwkv.Config, params paramsMap) (_ *rwkv.Layer, err error) {
@@ -286,7 +437,7 @@ func (c *converter[T]) convBlock(id int, conf rwkv.Config, params paramsMap) (_
 
 func (c *converter[T]) convChanMix(id int, params paramsMap) (*rwkv.ChannelMix, error) {
 	dm := c.model.Config.DModel
-	outScale := math.Pow(2, float64(id/c.model.Config.RescaleLayer))
+	outScale := c.model.Config.weightsScale(id)
 
 	key, err := c.fetchParamToMatrix(params, "key.weight", [2]int{dm * 4, dm})
 	if err != nil {
@@ -327,7 +478,7 @@ func (c *converter[T]) convChanMix(id int, params paramsMap) (*rwkv.ChannelMix,
 
 func (c *converter[T]) convTimeMix(id int, conf rwkv.Config, params paramsMap) (*rwkv.TimeMix, error) {
 	dm := c.model.Config.DModel
-	outScale := math.Pow(2, float64(id/c.model.Config.RescaleLayer))
+	outScale := c.model.Config.weightsScale(id)
 
 	key, err := c.fetchParamToMatrix(params, "key.weight", [2]int{dm, dm})
 	if err != nil {
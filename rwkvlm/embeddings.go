@@ -36,3 +36,12 @@ func NewEmbeddings[T float.DType](c emb.Config, repo store.Repository) *Embeddin
 func (m *Embeddings) Encode(tokens []int) []ag.Node {
 	return m.Tokens.Encode(tokens)
 }
+
+// EncodeToken is like Encode, but for a single token, avoiding the
+// allocations needed to handle a sequence.
+func (m *Embeddings) EncodeToken(token int) ag.Node {
+	if e, ok := m.Tokens.Embedding(token); ok {
+		return e
+	}
+	return m.Tokens.ZeroEmbedding
+}
@@ -6,30 +6,51 @@ package rwkvlm
 
 import (
 	"bufio"
+	"compress/gzip"
 	"encoding/gob"
+	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 
+	"github.com/klauspost/compress/zstd"
 	"github.com/nlpodyssey/rwkv"
 	"github.com/nlpodyssey/spago/nn"
 	"github.com/nlpodyssey/spago/nn/normalization/layernorm"
 )
 
 func gobEncode(obj *Model, w io.Writer) error {
-	bw := bufio.NewWriter(w)
-	encoder := gob.NewEncoder(bw)
-
+	encoder := newChunkEncoder(w)
 	for _, chunk := range getChunksForGobEncoding(obj) {
-		if err := encoder.Encode(chunk); err != nil {
-			return err
-		}
-		if err := bw.Flush(); err != nil {
+		if err := encoder.encode(chunk); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// chunkEncoder encodes the chunks of a model one at a time, flushing each
+// one to the underlying writer.
+type chunkEncoder struct {
+	bw      *bufio.Writer
+	encoder *gob.Encoder
+}
+
+func newChunkEncoder(w io.Writer) *chunkEncoder {
+	bw := bufio.NewWriter(w)
+	return &chunkEncoder{
+		bw:      bw,
+		encoder: gob.NewEncoder(bw),
+	}
+}
+
+func (e *chunkEncoder) encode(chunk any) error {
+	if err := e.encoder.Encode(chunk); err != nil {
+		return err
+	}
+	return e.bw.Flush()
+}
+
 func getChunksForGobEncoding(obj *Model) []interface{} {
 	chunks := []interface{}{
 		obj.Config,
@@ -46,7 +67,7 @@ func getChunksForGobEncoding(obj *Model) []interface{} {
 
 // loadFromFile uses Gob to deserialize objects files to memory.
 // See gobDecoding for further details.
-func loadFromFile(filename string) (*Model, error) {
+func loadFromFile(filename string) (_ *Model, err error) {
 	f, err := os.Open(filename)
 	if err != nil {
 		return nil, err
@@ -56,9 +77,50 @@ func loadFromFile(filename string) (*Model, error) {
 			err = e
 		}
 	}()
-	return gobDecoding(f)
+	r, err := newDecompressor(filename, f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize the decompression of model file %q: %w", filename, err)
+	}
+	defer r.Close()
+	return LoadReader(r)
 }
 
+// newCompressor wraps w with the compressor matching the extension of
+// the file name, if any.
+func newCompressor(filename string, w io.Writer) (io.WriteCloser, error) {
+	switch filepath.Ext(filename) {
+	case ".gz":
+		return gzip.NewWriter(w), nil
+	case ".zst":
+		return zstd.NewWriter(w)
+	default:
+		return nopWriteCloser{w}, nil
+	}
+}
+
+// newDecompressor wraps r with the decompressor matching the extension of
+// the file name, if any.
+func newDecompressor(filename string, r io.Reader) (io.ReadCloser, error) {
+	switch filepath.Ext(filename) {
+	case ".gz":
+		return gzip.NewReader(r)
+	case ".zst":
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	default:
+		return io.NopCloser(r), nil
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
 func gobDecoding(r io.Reader) (*Model, error) {
 	obj := &Model{
 		LN:      &layernorm.Model{},
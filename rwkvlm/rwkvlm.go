@@ -9,6 +9,8 @@ import (
 	"encoding/gob"
 	"encoding/json"
 	"fmt"
+	"io"
+	"math"
 	"os"
 	"path/filepath"
 
@@ -48,8 +50,20 @@ type Config struct {
 	//
 	// When converting a torch model, it can be left zero, letting the
 	// process deduce the value automatically.
-	VocabSize           int    `json:"vocab_size"`
-	RescaleLayer        int    `json:"rescale_layer"`
+	VocabSize int `json:"vocab_size"`
+	// RescaleLayer is the number of layers after which the activations are
+	// halved, when RescaleInWeights is true.
+	RescaleLayer int `json:"rescale_layer"`
+	// RescaleInWeights enables the rescaling used to prevent overflows with
+	// low precision types. It is made of two parts which must always be
+	// applied together: the converter divides the output weights of the
+	// layer i by 2^(i/RescaleLayer), and the encoder halves the activations
+	// every RescaleLayer layers at runtime.
+	// Thanks to the final layer normalization, the predictions are the same
+	// (within numerical tolerance) either way.
+	//
+	// When false, neither is applied and RescaleLayer is ignored.
+	RescaleInWeights    bool   `json:"rescale_in_weights"`
 	EmbeddingsStoreName string `json:"embeddings_store_name"`
 }
 
@@ -72,16 +86,36 @@ func init() {
 	gob.Register(&Model{})
 }
 
+// encoderConfig returns the configuration of the RWKV encoder.
+// Without RescaleInWeights, the runtime rescaling is disabled by setting the
+// rescale layer beyond the last one.
+func (c Config) encoderConfig() rwkv.Config {
+	rescaleLayer := c.NumHiddenLayers + 1
+	if c.RescaleInWeights {
+		rescaleLayer = c.RescaleLayer
+	}
+	return rwkv.Config{
+		DModel:       c.DModel,
+		NumLayers:    c.NumHiddenLayers,
+		RescaleLayer: rescaleLayer,
+	}
+}
+
+// weightsScale returns the factor by which the output weights of the
+// layer with the given ID are divided.
+func (c Config) weightsScale(id int) float64 {
+	if !c.RescaleInWeights {
+		return 1
+	}
+	return math.Pow(2, float64(id/c.RescaleLayer))
+}
+
 func New[T float.DType](c Config, repo store.Repository) *Model {
 	return &Model{
-		Config: c,
-		Encoder: rwkv.New[T](rwkv.Config{
-			DModel:       c.DModel,
-			NumLayers:    c.NumHiddenLayers,
-			RescaleLayer: c.RescaleLayer,
-		}),
-		LN:     layernorm.New[T](c.DModel, 1e-6),
-		Linear: nn.NewParam(mat.NewEmptyDense[T](c.VocabSize, c.DModel)),
+		Config:  c,
+		Encoder: rwkv.New[T](c.encoderConfig()),
+		LN:      layernorm.New[T](c.DModel, 1e-6),
+		Linear:  nn.NewParam(mat.NewEmptyDense[T](c.VocabSize, c.DModel)),
 		Embeddings: NewEmbeddings[T](embeddings.Config{
 			Size:      c.DModel,
 			StoreName: c.EmbeddingsStoreName,
@@ -90,18 +124,55 @@ func New[T float.DType](c Config, repo store.Repository) *Model {
 	}
 }
 
-// Load loads a pre-trained model from the given path.
+// Load loads a pre-trained model from the file DefaultOutputFilename
+// in the given directory.
 func Load(dir string) (*Model, error) {
-	m, err := loadFromFile(filepath.Join(dir, DefaultOutputFilename))
+	return LoadFile(filepath.Join(dir, DefaultOutputFilename))
+}
+
+// LoadFile loads a pre-trained model from the given file path.
+// The file is decompressed if its name ends with ".gz" or ".zst".
+func LoadFile(path string) (*Model, error) {
+	m, err := loadFromFile(path)
 	if err != nil {
 		return nil, err
 	}
 	return m, nil
 }
 
+// LoadReader loads a pre-trained model from r, which must provide the
+// uncompressed data written by DumpWriter, so that a model can be loaded from
+// any source, like an object storage or an embedded asset.
+// The embeddings are not part of the data: see ApplyEmbeddings.
+func LoadReader(r io.Reader) (*Model, error) {
+	m, err := gobDecoding(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode model: %w", err)
+	}
+	return m, nil
+}
+
+// DumpWriter writes the Model to w, uncompressed. See gobEncode for further
+// details.
+func DumpWriter(obj *Model, w io.Writer) error {
+	if err := gobEncode(obj, w); err != nil {
+		return fmt.Errorf("failed to encode model dump: %w", err)
+	}
+	return nil
+}
+
 // Dump saves the Model to a file.
-// See gobEncode for further details.
+// The file is compressed with gzip or zstd if its name ends with ".gz" or
+// ".zst" respectively. See gobEncode for further details.
 func Dump(obj *Model, filename string) error {
+	return writeDumpFile(filename, func(w io.Writer) error {
+		return gobEncode(obj, w)
+	})
+}
+
+// writeDumpFile creates the file, letting encode write the model to it,
+// compressing the data if the file name requires it.
+func writeDumpFile(filename string, encode func(w io.Writer) error) (err error) {
 	f, err := os.Create(filename)
 	if err != nil {
 		return fmt.Errorf("failed to open model dump file %q for writing: %w", filename, err)
@@ -111,9 +182,16 @@ func Dump(obj *Model, filename string) error {
 			err = fmt.Errorf("failed to close model dump file %q: %w", filename, e)
 		}
 	}()
-	if err = gobEncode(obj, f); err != nil {
+	w, err := newCompressor(filename, f)
+	if err != nil {
+		return fmt.Errorf("failed to initialize the compression of model dump file %q: %w", filename, err)
+	}
+	if err = encode(w); err != nil {
 		return fmt.Errorf("failed to encode model dump: %w", err)
 	}
+	if err = w.Close(); err != nil {
+		return fmt.Errorf("failed to compress model dump file %q: %w", filename, err)
+	}
 	return nil
 }
 
@@ -137,6 +215,13 @@ func (m *Model) Encode(ctx context.Context, s rwkv.State, tokens ...int) (ag.Nod
 	return m.EncodeEmbeddings(ctx, s, m.Embeddings.Encode(tokens))
 }
 
+// StepToken encodes a single token considering the last state, like Encode
+// with one token, without the overhead of handling a sequence.
+// It is the common case of the decoding, which feeds one token at a time.
+func (m *Model) StepToken(_ context.Context, token int, s rwkv.State) (ag.Node, rwkv.State) {
+	return m.Encoder.ForwardSingle(m.Embeddings.EncodeToken(token), s)
+}
+
 // EncodeTokens returns the embeddings of the given tokens.
 func (m *Model) EncodeTokens(_ context.Context, tokens ...int) []ag.Node {
 	return m.Embeddings.Encode(tokens)
@@ -0,0 +1,361 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rwkvlm_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/nlpodyssey/rwkv"
+	"github.com/nlpodyssey/spago/ag"
+	"github.com/nlpodyssey/spago/embeddings/store/diskstore"
+	"github.com/nlpodyssey/spago/mat"
+	"github.com/nlpodyssey/spago/nn"
+	"github.com/nlpodyssey/verbaflow/rwkvlm"
+	"github.com/nlpodyssey/verbaflow/rwkvlm/rwkvlmtest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadFile(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, rwkvlmtest.WriteTorchModel(dir, rwkvlmtest.DefaultConfig, 1))
+
+	for _, name := range []string{"model-a.bin", "model-b.bin"} {
+		err := rwkvlm.ConvertPickledModelToRWKVLM[float32](rwkvlm.ConverterConfig{
+			ModelDir:        dir,
+			GoModelFilename: name,
+		})
+		require.NoError(t, err)
+	}
+
+	for _, name := range []string{"model-a.bin", "model-b.bin"} {
+		m, err := rwkvlm.LoadFile(filepath.Join(dir, name))
+		require.NoError(t, err, name)
+		assert.Equal(t, rwkvlmtest.DefaultConfig.DModel, m.Config.DModel)
+		assert.Equal(t, rwkvlmtest.DefaultConfig.NumHiddenLayers, m.Config.NumHiddenLayers)
+		assert.Equal(t, rwkvlmtest.DefaultConfig.VocabSize, m.Config.VocabSize)
+	}
+
+	_, err := rwkvlm.Load(dir)
+	assert.Error(t, err, "the default model file was never written")
+}
+
+func TestConfig_RescaleInWeights(t *testing.T) {
+	conf := rwkvlmtest.DefaultConfig
+	conf.NumHiddenLayers = 5
+	conf.RescaleLayer = 2
+
+	predict := func(rescale bool) []float64 {
+		conf := conf
+		conf.RescaleInWeights = rescale
+
+		dir := t.TempDir()
+		require.NoError(t, rwkvlmtest.WriteTorchModel(dir, conf, 1))
+		require.NoError(t, rwkvlm.ConvertPickledModelToRWKVLM[float32](rwkvlm.ConverterConfig{ModelDir: dir}))
+
+		m := loadWithEmbeddings(t, dir)
+		assert.Equal(t, rescale, m.Config.RescaleInWeights)
+
+		x, _ := m.Encode(context.Background(), nil, 1, 2, 3, 4)
+		return m.Predict(x).Value().Data().F64()
+	}
+
+	rescaled := predict(true)
+	plain := predict(false)
+	require.Len(t, rescaled, len(plain))
+	for i := range plain {
+		assert.InDelta(t, plain[i], rescaled[i], 1e-3, "logit %d", i)
+	}
+}
+
+func TestModel_StepToken(t *testing.T) {
+	m := rwkvlmtest.NewModel(rwkvlmtest.DefaultConfig, 1)
+	ctx := context.Background()
+
+	var encodeState, stepState rwkv.State
+	for _, token := range []int{1, 2, 3, 15, 3} {
+		var expected, actual ag.Node
+		expected, encodeState = m.Encode(ctx, encodeState, token)
+		actual, stepState = m.StepToken(ctx, token, stepState)
+
+		assert.Equal(t, expected.Value().Data().F64(), actual.Value().Data().F64(), "token %d", token)
+		assert.Equal(t, stateValues(encodeState), stateValues(stepState), "token %d", token)
+	}
+}
+
+// stateValues returns the values of the state tensors of each layer.
+func stateValues(s rwkv.State) [][][]float64 {
+	values := make([][][]float64, len(s))
+	for i, l := range s {
+		for _, n := range []ag.Node{l.FfnXX, l.AttXX, l.AttAA, l.AttBB, l.AttPP} {
+			values[i] = append(values[i], n.Value().Data().F64())
+		}
+	}
+	return values
+}
+
+func BenchmarkModel_StepToken(b *testing.B) {
+	m := rwkvlmtest.NewModel(rwkvlmtest.DefaultConfig, 1)
+	ctx := context.Background()
+
+	b.Run("Encode", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			x, _ := m.Encode(ctx, nil, 3)
+			ag.ReleaseGraph(ag.WaitForValue(x))
+		}
+	})
+	b.Run("StepToken", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			x, _ := m.StepToken(ctx, 3, nil)
+			ag.ReleaseGraph(ag.WaitForValue(x))
+		}
+	})
+}
+
+func TestConvertPickledModelToRWKVLM_Float64(t *testing.T) {
+	f32Dir, f64Dir := t.TempDir(), t.TempDir()
+	require.NoError(t, rwkvlmtest.WriteTorchModel(f32Dir, rwkvlmtest.DefaultConfig, 1))
+	require.NoError(t, rwkvlmtest.WriteTorchModel(f64Dir, rwkvlmtest.DefaultConfig, 1))
+	require.NoError(t, rwkvlm.ConvertPickledModelToRWKVLM[float32](rwkvlm.ConverterConfig{ModelDir: f32Dir}))
+	require.NoError(t, rwkvlm.ConvertPickledModelToRWKVLM[float64](rwkvlm.ConverterConfig{ModelDir: f64Dir}))
+
+	f32 := loadWithEmbeddings(t, f32Dir)
+	f64 := loadWithEmbeddings(t, f64Dir)
+
+	for _, tokens := range [][]int{{1}, {1, 2, 3}, {5, 4, 3, 2, 1}} {
+		x32, _ := f32.Encode(context.Background(), nil, tokens...)
+		x64, _ := f64.Encode(context.Background(), nil, tokens...)
+		logits32 := f32.Predict(x32).Value()
+		logits64 := f64.Predict(x64).Value()
+
+		assert.IsType(t, &mat.Dense[float32]{}, logits32)
+		assert.IsType(t, &mat.Dense[float64]{}, logits64)
+		assert.Equal(t, logits32.ArgMax(), logits64.ArgMax(), "tokens %v", tokens)
+	}
+}
+
+// loadWithEmbeddings loads the model converted in dir, along with its embeddings.
+func loadWithEmbeddings(t *testing.T, dir string) *rwkvlm.Model {
+	t.Helper()
+	m, err := rwkvlm.Load(dir)
+	require.NoError(t, err)
+
+	repo, err := diskstore.NewRepository(filepath.Join(dir, rwkvlm.DefaultEmbeddingRepoPath), diskstore.ReadOnlyMode)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = repo.Close() })
+	require.NoError(t, m.ApplyEmbeddings(repo))
+	return m
+}
+
+func TestDump_Compression(t *testing.T) {
+	m := rwkvlmtest.NewModel(rwkvlmtest.DefaultConfig, 1)
+	expected := paramValues(m)
+	require.NotEmpty(t, expected)
+
+	for _, name := range []string{"model.bin", "model.bin.gz", "model.bin.zst"} {
+		t.Run(name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), name)
+			require.NoError(t, rwkvlm.Dump(m, filename))
+
+			loaded, err := rwkvlm.LoadFile(filename)
+			require.NoError(t, err)
+			assert.Equal(t, m.Config, loaded.Config)
+			assert.Equal(t, expected, paramValues(loaded))
+		})
+	}
+
+	t.Run("wrong extension", func(t *testing.T) {
+		dir := t.TempDir()
+		require.NoError(t, rwkvlm.Dump(m, filepath.Join(dir, "model.bin")))
+		require.NoError(t, os.Rename(filepath.Join(dir, "model.bin"), filepath.Join(dir, "model.bin.gz")))
+		_, err := rwkvlm.LoadFile(filepath.Join(dir, "model.bin.gz"))
+		assert.Error(t, err)
+	})
+}
+
+func TestDumpWriter(t *testing.T) {
+	m := rwkvlmtest.NewModel(rwkvlmtest.DefaultConfig, 1)
+	expected := paramValues(m)
+
+	var buf bytes.Buffer
+	require.NoError(t, rwkvlm.DumpWriter(m, &buf))
+	loaded, err := rwkvlm.LoadReader(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, m.Config, loaded.Config)
+	assert.Equal(t, expected, paramValues(loaded))
+
+	_, err = rwkvlm.LoadReader(bytes.NewReader([]byte("not a model")))
+	assert.Error(t, err)
+}
+
+// paramValues returns the values of all the parameters of the model, by name.
+func paramValues(m *rwkvlm.Model) map[string][]float64 {
+	values := make(map[string][]float64)
+	nn.ForEachParam(m, func(param nn.Param, name string, _ nn.ParamsType) {
+		values[fmt.Sprintf("%s#%d", name, len(values))] = param.Value().Data().F64()
+	})
+	return values
+}
+
+func TestConvertPickledModelToRWKVLM_Streaming(t *testing.T) {
+	conf := rwkvlmtest.DefaultConfig
+	conf.NumHiddenLayers = 4
+
+	convert := func(streaming bool) *rwkvlm.Model {
+		dir := t.TempDir()
+		require.NoError(t, rwkvlmtest.WriteTorchModel(dir, conf, 1))
+		require.NoError(t, rwkvlm.ConvertPickledModelToRWKVLM[float32](rwkvlm.ConverterConfig{
+			ModelDir:  dir,
+			Streaming: streaming,
+		}))
+		m, err := rwkvlm.Load(dir)
+		require.NoError(t, err)
+		return m
+	}
+
+	expected := convert(false)
+	actual := convert(true)
+	assert.Equal(t, expected.Config, actual.Config)
+	assert.Equal(t, expected.Encoder.Config, actual.Encoder.Config)
+	assert.Len(t, actual.Encoder.Layers, conf.NumHiddenLayers)
+	assert.Equal(t, paramValues(expected), paramValues(actual))
+}
+
+func TestConvertPickledModelToRWKVLM_Workers(t *testing.T) {
+	conf := rwkvlmtest.DefaultConfig
+	conf.NumHiddenLayers = 6
+
+	convert := func(workers int) []byte {
+		dir := t.TempDir()
+		require.NoError(t, rwkvlmtest.WriteTorchModel(dir, conf, 1))
+		require.NoError(t, rwkvlm.ConvertPickledModelToRWKVLM[float32](rwkvlm.ConverterConfig{
+			ModelDir: dir,
+			Workers:  workers,
+		}))
+		data, err := os.ReadFile(filepath.Join(dir, rwkvlm.DefaultOutputFilename))
+		require.NoError(t, err)
+		return data
+	}
+
+	expected := convert(1)
+	for _, workers := range []int{2, 4, 8} {
+		assert.Equal(t, expected, convert(workers), "workers: %d", workers)
+	}
+}
+
+func BenchmarkConvertPickledModelToRWKVLM(b *testing.B) {
+	conf := rwkvlm.Config{
+		DModel:          256,
+		NumHiddenLayers: 16,
+		VocabSize:       512,
+	}
+	dir := b.TempDir()
+	require.NoError(b, rwkvlmtest.WriteTorchModel(dir, conf, 1))
+
+	for _, streaming := range []bool{false, true} {
+		b.Run(fmt.Sprintf("streaming=%v", streaming), func(b *testing.B) {
+			// float64 parameters are twice as large as the source ones,
+			// making the memory held by the converted blocks more evident
+			var peak uint64
+			for i := 0; i < b.N; i++ {
+				p := peakHeapAlloc(func() {
+					err := rwkvlm.ConvertPickledModelToRWKVLM[float64](rwkvlm.ConverterConfig{
+						ModelDir:         dir,
+						OverwriteIfExist: true,
+						Streaming:        streaming,
+					})
+					require.NoError(b, err)
+				})
+				if p > peak {
+					peak = p
+				}
+			}
+			b.ReportMetric(float64(peak), "peak-heap-bytes")
+		})
+	}
+}
+
+// peakHeapAlloc runs fn, returning the highest heap allocation observed
+// meanwhile.
+func peakHeapAlloc(fn func()) uint64 {
+	runtime.GC()
+	var peak uint64
+	sample := func() {
+		var ms runtime.MemStats
+		runtime.ReadMemStats(&ms)
+		if ms.HeapAlloc > peak {
+			peak = ms.HeapAlloc
+		}
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				sample()
+			}
+		}
+	}()
+	fn()
+	close(done)
+	<-stopped
+	sample()
+	return peak
+}
+
+func TestConvertPickledModelToRWKVLM_Progress(t *testing.T) {
+	conf := rwkvlmtest.DefaultConfig
+	conf.NumHiddenLayers = 3
+
+	for _, cc := range []rwkvlm.ConverterConfig{{}, {Streaming: true}, {Workers: 2}} {
+		dir := t.TempDir()
+		require.NoError(t, rwkvlmtest.WriteTorchModel(dir, conf, 1))
+
+		progress := make(chan rwkvlm.ConvertProgress)
+		done := make(chan error, 1)
+		cc.ModelDir = dir
+		cc.ProgressChan = progress
+		go func() {
+			done <- rwkvlm.ConvertPickledModelToRWKVLM[float32](cc)
+		}()
+
+		var events []rwkvlm.ConvertProgress
+	Collect:
+		for {
+			select {
+			case p := <-progress:
+				events = append(events, p)
+			case err := <-done:
+				require.NoError(t, err)
+				break Collect
+			}
+		}
+
+		expected := []rwkvlm.ConvertProgress{
+			{Stage: rwkvlm.ConvertStageEmbeddings, Current: 1, Total: 1},
+			{Stage: rwkvlm.ConvertStageLinear, Current: 1, Total: 1},
+		}
+		for i := 1; i <= conf.NumHiddenLayers; i++ {
+			expected = append(expected, rwkvlm.ConvertProgress{Stage: rwkvlm.ConvertStageBlocks, Current: i, Total: conf.NumHiddenLayers})
+		}
+		assert.Equal(t, expected, events, "streaming: %v, workers: %d", cc.Streaming, cc.Workers)
+	}
+}
@@ -0,0 +1,50 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package rwkvlmtest provides utilities for testing code that depends on
+// RWKV language models, without requiring a pre-trained model.
+package rwkvlmtest
+
+import (
+	"math/rand"
+
+	"github.com/nlpodyssey/spago/embeddings/store/memstore"
+	"github.com/nlpodyssey/spago/mat"
+	"github.com/nlpodyssey/spago/nn"
+	"github.com/nlpodyssey/verbaflow/rwkvlm"
+)
+
+// DefaultConfig is the configuration of a tiny model, suitable for tests.
+var DefaultConfig = rwkvlm.Config{
+	DModel:          8,
+	NumHiddenLayers: 2,
+	VocabSize:       16,
+	RescaleLayer:    6,
+}
+
+// NewModel returns a new float32 model with the given configuration, whose
+// parameters and token embeddings are initialized with small pseudo-random
+// values drawn from the given seed.
+// The embeddings are kept in memory.
+func NewModel(conf rwkvlm.Config, seed int64) *rwkvlm.Model {
+	m := rwkvlm.New[float32](conf, memstore.NewRepository())
+	r := rand.New(rand.NewSource(seed))
+
+	nn.ForEachParam(m, func(param nn.Param, _ string, _ nn.ParamsType) {
+		v := param.Value()
+		param.ReplaceValue(mat.NewDense[float32](v.Rows(), v.Columns(), randomData(r, v.Size())))
+	})
+	for id := 0; id < conf.VocabSize; id++ {
+		m.Embeddings.Tokens.EmbeddingFast(id).ReplaceValue(mat.NewVecDense(randomData(r, conf.DModel)))
+	}
+	return m
+}
+
+func randomData(r *rand.Rand, size int) []float32 {
+	data := make([]float32, size)
+	for i := range data {
+		data[i] = r.Float32()*2 - 1
+	}
+	return data
+}
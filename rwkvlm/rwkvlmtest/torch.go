@@ -0,0 +1,196 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rwkvlmtest
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+
+	"github.com/nlpodyssey/verbaflow/rwkvlm"
+)
+
+// WriteTorchModel writes to dir a "config.json" file with the given
+// configuration, and a "pytorch_model.pt" file with the parameters of a RWKV
+// model of the same size, as produced by PyTorch from a BFloat16 state dict.
+// The parameters are initialized with small pseudo-random values drawn from
+// the given seed.
+//
+// The files can be used to test the conversion of a model to the RWKVLM format.
+func WriteTorchModel(dir string, conf rwkvlm.Config, seed int64) error {
+	configData, err := json.Marshal(conf)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "config.json"), configData, 0o644); err != nil {
+		return err
+	}
+
+	r := rand.New(rand.NewSource(seed))
+	var params []torchParam
+	add := func(name string, size ...int) {
+		numel := 1
+		for _, s := range size {
+			numel *= s
+		}
+		params = append(params, torchParam{name: name, size: size, data: randomData(r, numel)})
+	}
+
+	dm, vs := conf.DModel, conf.VocabSize
+	add("emb.weight", vs, dm)
+	for i := 0; i < conf.NumHiddenLayers; i++ {
+		p := fmt.Sprintf("blocks.%d.", i)
+		if i == 0 {
+			add(p+"ln0.weight", dm)
+			add(p+"ln0.bias", dm)
+		}
+		add(p+"ln1.weight", dm)
+		add(p+"ln1.bias", dm)
+		add(p+"ln2.weight", dm)
+		add(p+"ln2.bias", dm)
+		add(p+"att.time_decay", dm)
+		add(p+"att.time_first", dm)
+		add(p+"att.time_mix_k", 1, 1, dm)
+		add(p+"att.time_mix_v", 1, 1, dm)
+		add(p+"att.time_mix_r", 1, 1, dm)
+		add(p+"att.key.weight", dm, dm)
+		add(p+"att.value.weight", dm, dm)
+		add(p+"att.receptance.weight", dm, dm)
+		add(p+"att.output.weight", dm, dm)
+		add(p+"ffn.time_mix_k", 1, 1, dm)
+		add(p+"ffn.time_mix_r", 1, 1, dm)
+		add(p+"ffn.key.weight", dm*4, dm)
+		add(p+"ffn.receptance.weight", dm, dm)
+		add(p+"ffn.value.weight", dm, dm*4)
+	}
+	add("ln_out.weight", dm)
+	add("ln_out.bias", dm)
+	add("head.weight", vs, dm)
+
+	return writeTorchFile(filepath.Join(dir, rwkvlm.DefaultPyModelFilename), params)
+}
+
+type torchParam struct {
+	name string
+	size []int
+	data []float32
+}
+
+// writeTorchFile writes the params in the zip-based format of torch.save.
+func writeTorchFile(filename string, params []torchParam) (err error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if e := f.Close(); e != nil && err == nil {
+			err = e
+		}
+	}()
+
+	zw := zip.NewWriter(f)
+	write := func(name string, data []byte) error {
+		// like torch.save, the records are not compressed
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: "archive/" + name, Method: zip.Store})
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		return err
+	}
+
+	if err := write("data.pkl", pickleStateDict(params)); err != nil {
+		return err
+	}
+	for i, p := range params {
+		if err := write(fmt.Sprintf("data/%d", i), bfloat16Bytes(p.data)); err != nil {
+			return err
+		}
+	}
+	if err := write("version", []byte("3\n")); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// pickleStateDict returns the pickle (protocol 2) of an OrderedDict mapping
+// each param name to a tensor, whose storage is the record "data/<index>".
+func pickleStateDict(params []torchParam) []byte {
+	var b bytes.Buffer
+	global := func(module, name string) {
+		b.WriteString("c" + module + "\n" + name + "\n")
+	}
+	str := func(s string) {
+		b.WriteByte('X')
+		_ = binary.Write(&b, binary.LittleEndian, uint32(len(s)))
+		b.WriteString(s)
+	}
+	integer := func(v int) {
+		b.WriteByte('J')
+		_ = binary.Write(&b, binary.LittleEndian, int32(v))
+	}
+	tuple := func(values []int) {
+		b.WriteByte('(')
+		for _, v := range values {
+			integer(v)
+		}
+		b.WriteByte('t')
+	}
+	emptyOrderedDict := func() {
+		global("collections", "OrderedDict")
+		b.WriteString(")R")
+	}
+
+	b.WriteString("\x80\x02")
+	emptyOrderedDict()
+	b.WriteByte('(')
+	for i, p := range params {
+		str(p.name)
+		global("torch._utils", "_rebuild_tensor_v2")
+		b.WriteByte('(')
+		// persistent ID of the storage
+		b.WriteByte('(')
+		str("storage")
+		global("torch", "BFloat16Storage")
+		str(fmt.Sprintf("%d", i))
+		str("cpu")
+		integer(len(p.data))
+		b.WriteString("tQ")
+		// storage offset, size, stride, requires grad, backward hooks
+		integer(0)
+		tuple(p.size)
+		tuple(contiguousStride(p.size))
+		b.WriteByte('\x89')
+		emptyOrderedDict()
+		b.WriteString("tR")
+	}
+	b.WriteString("u.")
+	return b.Bytes()
+}
+
+func contiguousStride(size []int) []int {
+	stride := make([]int, len(size))
+	s := 1
+	for i := len(size) - 1; i >= 0; i-- {
+		stride[i] = s
+		s *= size[i]
+	}
+	return stride
+}
+
+// bfloat16Bytes truncates the values to BFloat16, in little-endian order.
+func bfloat16Bytes(data []float32) []byte {
+	out := make([]byte, len(data)*2)
+	for i, v := range data {
+		binary.LittleEndian.PutUint16(out[i*2:], uint16(math.Float32bits(v)>>16))
+	}
+	return out
+}
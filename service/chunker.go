@@ -0,0 +1,96 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"time"
+
+	"github.com/nlpodyssey/verbaflow/api"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// chunker sends the tokens to the stream, batching them in the chunk of a
+// single message when requested, to reduce the per-message overhead.
+// A chunk is sent when it has size tokens, or when interval has passed since
+// its first token, whichever comes first. Without limits, each token is sent
+// in its own message.
+type chunker struct {
+	stream   tokenStream
+	size     int
+	interval time.Duration
+	pending  []*api.GeneratedToken
+	timer    *time.Timer
+	// generated is the number of generated tokens sent or pending, excluding
+	// the ones of the prompt.
+	generated int
+}
+
+// tokenStream is the sending side of a stream of generated tokens, common to
+// the GenerateTokens and GenerateContinue methods.
+type tokenStream interface {
+	Send(*api.GeneratedToken) error
+}
+
+// newChunker returns a chunker configured by the decoding parameters.
+func newChunker(stream tokenStream, dp *api.DecodingParameters) (*chunker, error) {
+	if dp.GetChunkSize() < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid chunk size %d: must be >= 0", dp.GetChunkSize())
+	}
+	if dp.GetFlushIntervalMs() < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid flush interval %d: must be >= 0", dp.GetFlushIntervalMs())
+	}
+	return &chunker{
+		stream:   stream,
+		size:     int(dp.GetChunkSize()),
+		interval: time.Duration(dp.GetFlushIntervalMs()) * time.Millisecond,
+	}, nil
+}
+
+// enabled reports whether the tokens are batched.
+func (c *chunker) enabled() bool {
+	return c.size > 1 || c.interval > 0
+}
+
+// send sends the token, or adds it to the pending chunk.
+func (c *chunker) send(token *api.GeneratedToken) error {
+	if !token.GetIsPrompt() {
+		c.generated++
+	}
+	if !c.enabled() {
+		return c.stream.Send(token)
+	}
+	c.pending = append(c.pending, token)
+	if len(c.pending) == 1 && c.interval > 0 {
+		c.timer = time.NewTimer(c.interval)
+	}
+	if c.size > 0 && len(c.pending) >= c.size {
+		return c.flush()
+	}
+	return nil
+}
+
+// due returns a channel which receives when the pending chunk must be
+// flushed because of the interval, or nil if there is no such deadline.
+func (c *chunker) due() <-chan time.Time {
+	if c.timer == nil {
+		return nil
+	}
+	return c.timer.C
+}
+
+// flush sends the pending chunk, if any.
+func (c *chunker) flush() error {
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	if len(c.pending) == 0 {
+		return nil
+	}
+	chunk := c.pending
+	c.pending = nil
+	return c.stream.Send(&api.GeneratedToken{Chunk: chunk})
+}
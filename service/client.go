@@ -0,0 +1,68 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/nlpodyssey/verbaflow/api"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
+)
+
+// minKeepaliveTime is the minimum keepalive interval allowed by gRPC:
+// clients pinging more often are adjusted to it.
+const minKeepaliveTime = 10 * time.Second
+
+// ClientConfig contains the connection settings of a LanguageModel client.
+type ClientConfig struct {
+	// ConnectTimeout is the maximum time to wait for the connection to be
+	// established. Zero means no timeout.
+	ConnectTimeout time.Duration
+	// KeepaliveTime is the time after which, if no activity is seen, the
+	// client pings the server to check the connection is still alive.
+	// It can't be lower than 10 seconds.
+	KeepaliveTime time.Duration
+	// KeepaliveTimeout is the time the client waits for the ping ack before
+	// considering the connection dead.
+	KeepaliveTimeout time.Duration
+}
+
+// DefaultClientConfig is the ClientConfig used by the example clients when no
+// other value is specified.
+var DefaultClientConfig = ClientConfig{
+	ConnectTimeout:   10 * time.Second,
+	KeepaliveTime:    30 * time.Second,
+	KeepaliveTimeout: 10 * time.Second,
+}
+
+// NewClient connects to the LanguageModel server at the given address.
+// The returned connection must be closed by the caller.
+//
+// Once the connection is established, a server which stops responding is
+// detected within KeepaliveTime plus KeepaliveTimeout, and the pending calls
+// fail with an Unavailable error instead of hanging.
+func NewClient(ctx context.Context, address string, conf ClientConfig) (api.LanguageModelClient, *grpc.ClientConn, error) {
+	if conf.ConnectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, conf.ConnectTimeout)
+		defer cancel()
+	}
+	conn, err := grpc.DialContext(ctx, address,
+		grpc.WithInsecure(),
+		grpc.WithBlock(),
+		grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                conf.KeepaliveTime,
+			Timeout:             conf.KeepaliveTimeout,
+			PermitWithoutStream: true,
+		}),
+	)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to connect to %s: %w", address, err)
+	}
+	return api.NewLanguageModelClient(conn), conn, nil
+}
@@ -0,0 +1,150 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nlpodyssey/verbaflow/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestNewClient_DeadConnection(t *testing.T) {
+	if testing.Short() {
+		t.Skip("the keepalive window is at least 10 seconds")
+	}
+
+	srv := grpc.NewServer()
+	api.RegisterLanguageModelServer(srv, stalledServer{})
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() { _ = srv.Serve(lis) }()
+	defer srv.Stop()
+
+	proxy := newBlackholeProxy(t, lis.Addr().String())
+
+	conf := ClientConfig{
+		ConnectTimeout:   time.Second,
+		KeepaliveTime:    minKeepaliveTime,
+		KeepaliveTimeout: time.Second,
+	}
+	client, conn, err := NewClient(context.Background(), proxy.address(), conf)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	stream, err := client.GenerateTokens(context.Background(), &api.TokenGenerationRequest{})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.NoError(t, err)
+
+	// the server stops responding, without closing the connection
+	proxy.blackhole.Store(true)
+	start := time.Now()
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := stream.Recv()
+		errCh <- err
+	}()
+	window := conf.KeepaliveTime + conf.KeepaliveTimeout
+	select {
+	case err := <-errCh:
+		assert.Equal(t, codes.Unavailable, status.Code(err))
+		assert.Less(t, time.Since(start), window+2*time.Second)
+	case <-time.After(window + 5*time.Second):
+		t.Fatal("the dead connection was not detected")
+	}
+}
+
+func TestNewClient_ConnectTimeout(t *testing.T) {
+	// a listener which never completes the gRPC handshake
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer lis.Close()
+
+	conf := DefaultClientConfig
+	conf.ConnectTimeout = 200 * time.Millisecond
+	start := time.Now()
+	_, _, err = NewClient(context.Background(), lis.Addr().String(), conf)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), 2*time.Second)
+}
+
+// stalledServer sends a single token, then waits until the call is cancelled.
+type stalledServer struct {
+	api.UnimplementedLanguageModelServer
+}
+
+func (stalledServer) GenerateTokens(_ *api.TokenGenerationRequest, stream api.LanguageModel_GenerateTokensServer) error {
+	if err := stream.Send(&api.GeneratedToken{Token: "x"}); err != nil {
+		return err
+	}
+	<-stream.Context().Done()
+	return stream.Context().Err()
+}
+
+// blackholeProxy forwards the TCP connections to a target address, silently
+// dropping all the traffic once blackhole is set.
+type blackholeProxy struct {
+	lis       net.Listener
+	target    string
+	blackhole atomic.Bool
+}
+
+func newBlackholeProxy(t *testing.T, target string) *blackholeProxy {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	p := &blackholeProxy{lis: lis, target: target}
+	t.Cleanup(func() { _ = lis.Close() })
+	go p.serve()
+	return p
+}
+
+func (p *blackholeProxy) address() string {
+	return p.lis.Addr().String()
+}
+
+func (p *blackholeProxy) serve() {
+	for {
+		conn, err := p.lis.Accept()
+		if err != nil {
+			return
+		}
+		target, err := net.Dial("tcp", p.target)
+		if err != nil {
+			_ = conn.Close()
+			continue
+		}
+		go p.forward(target, conn)
+		go p.forward(conn, target)
+	}
+}
+
+func (p *blackholeProxy) forward(dst io.WriteCloser, src io.ReadCloser) {
+	defer dst.Close()
+	defer src.Close()
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buf)
+		if err != nil {
+			return
+		}
+		if p.blackhole.Load() {
+			continue
+		}
+		if _, err := dst.Write(buf[:n]); err != nil {
+			return
+		}
+	}
+}
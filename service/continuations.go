@@ -0,0 +1,93 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+
+	"github.com/nlpodyssey/verbaflow"
+)
+
+// defaultMaxContinuations is the default number of continuations kept by
+// the server for the resumable generations.
+const defaultMaxContinuations = 16
+
+// continuationCache keeps the continuations of the resumable generations,
+// by ID, discarding the oldest ones when it is full, since each of them holds
+// a whole state of the model.
+type continuationCache struct {
+	mu       sync.Mutex
+	capacity int
+	items    map[string]savedContinuation
+	// order contains the IDs of the items, from the oldest one.
+	order []string
+}
+
+// newContinuationCache returns a cache keeping at most capacity continuations.
+func newContinuationCache(capacity int) *continuationCache {
+	return &continuationCache{
+		capacity: capacity,
+		items:    make(map[string]savedContinuation, capacity),
+	}
+}
+
+// savedContinuation is a continuation with the model which generated it.
+type savedContinuation struct {
+	// model is the name of the model, empty for the default one.
+	model string
+	// vf is the model when the continuation was saved: if it was evicted
+	// since, the continuation is not valid anymore.
+	vf   *verbaflow.VerbaFlow
+	cont *verbaflow.Continuation
+}
+
+// put adds the continuation, returning its new ID.
+func (c *continuationCache) put(cont savedContinuation) (string, error) {
+	id, err := newContinuationID()
+	if err != nil {
+		return "", err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.order) >= c.capacity {
+		delete(c.items, c.order[0])
+		c.order = c.order[1:]
+	}
+	c.items[id] = cont
+	c.order = append(c.order, id)
+	return id, nil
+}
+
+// take removes the continuation with the given ID and returns it, so that it
+// is never used by two requests at the same time.
+func (c *continuationCache) take(id string) (savedContinuation, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cont, ok := c.items[id]
+	if !ok {
+		return savedContinuation{}, false
+	}
+	delete(c.items, id)
+	for i, v := range c.order {
+		if v == id {
+			c.order = append(c.order[:i], c.order[i+1:]...)
+			break
+		}
+	}
+	return cont, true
+}
+
+// newContinuationID returns a random ID, which can't be guessed by the
+// other clients.
+func newContinuationID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate the continuation ID: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,33 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"testing"
+
+	"github.com/nlpodyssey/verbaflow"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestContinuationCache(t *testing.T) {
+	c := newContinuationCache(2)
+	conts := []*verbaflow.Continuation{{}, {}, {}}
+	var ids []string
+	for _, cont := range conts {
+		id, err := c.put(savedContinuation{cont: cont})
+		require.NoError(t, err)
+		ids = append(ids, id)
+	}
+	// the oldest continuation is discarded
+	_, ok := c.take(ids[0])
+	assert.False(t, ok)
+	saved, ok := c.take(ids[2])
+	assert.True(t, ok)
+	assert.Same(t, conts[2], saved.cont)
+	_, ok = c.take(ids[2])
+	assert.False(t, ok)
+	assert.Equal(t, []string{ids[1]}, c.order)
+}
@@ -0,0 +1,117 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"github.com/nlpodyssey/verbaflow/api"
+	"github.com/nlpodyssey/verbaflow/decoder"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// DefaultDecodingOptions returns the decoding options which the fields of the
+// requests take when they are not set: at most 200 tokens, with temperature 1
+// and top-p 1, which don't alter the distribution of the model. The other
+// options are zero, which disables them.
+func DefaultDecodingOptions() decoder.DecodingOptions {
+	return decoder.DecodingOptions{
+		MaxLen: 200,
+		Temp:   1,
+		TopP:   1,
+	}
+}
+
+// WithDefaultDecodingOptions sets the decoding options which the fields of
+// the requests take when they are not set, instead of DefaultDecodingOptions.
+// A field is not set when it is zero and not listed in its zero_fields.
+// Only the options with a DecodingParameters field are used.
+func WithDefaultDecodingOptions(opts decoder.DecodingOptions) ServerOption {
+	return func(s *Server) {
+		s.defaults = decodingOptionsToGRPC(opts)
+	}
+}
+
+// withDefaults returns a copy of the decoding parameters, which can be nil,
+// with the default value of each field which is not set.
+func withDefaults(dp, defaults *api.DecodingParameters) (*api.DecodingParameters, error) {
+	out := &api.DecodingParameters{}
+	if dp != nil {
+		out = proto.Clone(dp).(*api.DecodingParameters)
+	}
+	m := out.ProtoReflect()
+	fields := m.Descriptor().Fields()
+	explicit := make(map[protoreflect.Name]bool, len(out.GetZeroFields()))
+	for _, name := range out.GetZeroFields() {
+		if fields.ByName(protoreflect.Name(name)) == nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid zero_fields: unknown field %q", name)
+		}
+		explicit[protoreflect.Name(name)] = true
+	}
+	// only the fields which are not zero are set in the defaults
+	defaults.ProtoReflect().Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		if !m.Has(fd) && !explicit[fd.Name()] {
+			m.Set(fd, v)
+		}
+		return true
+	})
+	return out, nil
+}
+
+// decodingOptionsToGRPC is the inverse of grpcToDecodingOptions.
+func decodingOptionsToGRPC(opts decoder.DecodingOptions) *api.DecodingParameters {
+	return &api.DecodingParameters{
+		MaxLen:              int32(opts.MaxLen),
+		MinLen:              int32(opts.MinLen),
+		StopSequences:       stopSequencesToGRPC(opts),
+		EndTokenId:          int32(opts.EndTokenID),
+		SkipEndTokenId:      opts.SkipEndTokenID,
+		ForceJson:           opts.ForceJSON,
+		FilterSpecialTokens: opts.FilterSpecialTokens,
+		MaxChars:            int32(opts.MaxChars),
+		MinTopProb:          float32(opts.MinTopProb),
+		Temperature:         float32(opts.Temp),
+		TopK:                int32(opts.TopK),
+		TopP:                float32(opts.TopP),
+		TypicalP:            float32(opts.TypicalP),
+		Epsilon:             float32(opts.Epsilon),
+		Eta:                 float32(opts.Eta),
+		UseSampling:         opts.UseSampling,
+		AddBos:              opts.AddBOS,
+		EchoPrompt:          opts.EchoPrompt,
+		TrimWhitespace:      opts.TrimWhitespace,
+		CollapseNewlines:    opts.CollapseNewlines,
+		ForcedPrefix:        opts.ForcedPrefix,
+		LogitClamp:          float32(opts.LogitClamp),
+		MaxTokensPerSecond:  float32(opts.MaxTokensPerSecond),
+		JsonSchema:          opts.JSONSchema,
+		JsonSchemaRetries:   int32(opts.JSONSchemaRetries),
+	}
+}
+
+// stopSequencesToGRPC returns the StopSequencesIDs, with the action of
+// TrimStopSequence, followed by the StopSequences.
+func stopSequencesToGRPC(opts decoder.DecodingOptions) []*api.Sequence {
+	var out []*api.Sequence
+	add := func(ids []int, action decoder.StopAction) {
+		seq := &api.Sequence{Sequence: make([]int32, len(ids)), Action: string(action)}
+		for i, id := range ids {
+			seq.Sequence[i] = int32(id)
+		}
+		out = append(out, seq)
+	}
+	for _, ids := range opts.StopSequencesIDs {
+		if opts.TrimStopSequence {
+			add(ids, decoder.StopTrim)
+		} else {
+			add(ids, decoder.StopKeep)
+		}
+	}
+	for _, seq := range opts.StopSequences {
+		add(seq.IDs, seq.Action)
+	}
+	return out
+}
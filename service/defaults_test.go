@@ -0,0 +1,92 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nlpodyssey/verbaflow/api"
+	"github.com/nlpodyssey/verbaflow/decoder"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestWithDefaults(t *testing.T) {
+	defaults := decodingOptionsToGRPC(DefaultDecodingOptions())
+
+	for _, dp := range []*api.DecodingParameters{nil, {}} {
+		out, err := withDefaults(dp, defaults)
+		require.NoError(t, err)
+		opts, err := grpcToDecodingOptions(out)
+		require.NoError(t, err)
+		assert.Equal(t, DefaultDecodingOptions(), opts)
+	}
+
+	dp := &api.DecodingParameters{MaxLen: 5, TopK: 3, ZeroFields: []string{"temperature"}}
+	out, err := withDefaults(dp, defaults)
+	require.NoError(t, err)
+	expected := DefaultDecodingOptions()
+	expected.MaxLen, expected.TopK, expected.Temp = 5, 3, 0
+	opts, err := grpcToDecodingOptions(out)
+	require.NoError(t, err)
+	assert.Equal(t, expected, opts)
+	// the request is not modified
+	assert.Equal(t, float32(0), dp.TopP)
+
+	_, err = withDefaults(&api.DecodingParameters{ZeroFields: []string{"temp"}}, defaults)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestDecodingOptionsToGRPC(t *testing.T) {
+	opts := decoder.DecodingOptions{
+		MaxLen: 1,
+		MinLen: 2,
+		StopSequences: []decoder.StopSequence{
+			{IDs: []int{1, 2}, Action: decoder.StopKeep},
+			{IDs: []int{3}, Action: decoder.StopTrim},
+		},
+		EndTokenID:          3,
+		SkipEndTokenID:      true,
+		ForceJSON:           true,
+		FilterSpecialTokens: true,
+		MaxChars:            4,
+		MinTopProb:          0.125,
+		Temp:                0.5,
+		TopK:                5,
+		TopP:                0.25,
+		TypicalP:            0.75,
+		Epsilon:             0.0625,
+		Eta:                 0.03125,
+		UseSampling:         true,
+		AddBOS:              true,
+		EchoPrompt:          true,
+		TrimWhitespace:      true,
+		CollapseNewlines:    true,
+		ForcedPrefix:        "prefix",
+		LogitClamp:          6,
+		MaxTokensPerSecond:  7,
+		JSONSchema:          "{}",
+		JSONSchemaRetries:   8,
+	}
+	actual, err := grpcToDecodingOptions(decodingOptionsToGRPC(opts))
+	require.NoError(t, err)
+	assert.Equal(t, opts, actual)
+
+	_, err = grpcToDecodingOptions(&api.DecodingParameters{StopSequences: []*api.Sequence{{}}})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestServer_GenerateTokens_DefaultDecodingOptions(t *testing.T) {
+	defaults := DefaultDecodingOptions()
+	defaults.MaxLen, defaults.EndTokenID = 3, -1
+	s := newTestServer(t, WithDefaultDecodingOptions(defaults))
+
+	stream := &recordingStream{ctx: context.Background()}
+	require.NoError(t, s.GenerateTokens(&api.TokenGenerationRequest{Prompt: "unrelated"}, stream))
+	assert.Len(t, stream.sent, 3)
+}
@@ -0,0 +1,224 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// jsonSchema is the subset of JSON Schema used to validate the generated
+// outputs: the type, enum, const, properties, required, additionalProperties,
+// items, and the bounds of the numbers, strings and arrays. The other
+// keywords are ignored.
+type jsonSchema struct {
+	Type                 jsonSchemaTypes        `json:"type"`
+	Enum                 []any                  `json:"enum"`
+	Const                *any                   `json:"const"`
+	Properties           map[string]*jsonSchema `json:"properties"`
+	Required             []string               `json:"required"`
+	AdditionalProperties *bool                  `json:"additionalProperties"`
+	Items                *jsonSchema            `json:"items"`
+	Minimum              *float64               `json:"minimum"`
+	Maximum              *float64               `json:"maximum"`
+	MinLength            *int                   `json:"minLength"`
+	MaxLength            *int                   `json:"maxLength"`
+	MinItems             *int                   `json:"minItems"`
+	MaxItems             *int                   `json:"maxItems"`
+}
+
+// jsonSchemaTypes is the type keyword, which is either a type name or a list
+// of them.
+type jsonSchemaTypes []string
+
+// UnmarshalJSON satisfies the json.Unmarshaler interface.
+func (t *jsonSchemaTypes) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		*t = jsonSchemaTypes{name}
+		return nil
+	}
+	var names []string
+	if err := json.Unmarshal(data, &names); err != nil {
+		return fmt.Errorf("invalid type: must be a string or an array of strings")
+	}
+	*t = names
+	return nil
+}
+
+// parseJSONSchema parses the schema.
+func parseJSONSchema(text string) (*jsonSchema, error) {
+	s := new(jsonSchema)
+	if err := json.Unmarshal([]byte(text), s); err != nil {
+		return nil, fmt.Errorf("invalid JSON schema: %w", err)
+	}
+	return s, nil
+}
+
+// validate returns an error if the text is not a JSON value matching the
+// schema.
+func (s *jsonSchema) validate(text string) error {
+	dec := json.NewDecoder(strings.NewReader(text))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return fmt.Errorf("invalid JSON: %w", err)
+	}
+	if dec.More() {
+		return fmt.Errorf("invalid JSON: unexpected data after the value")
+	}
+	return s.validateValue("$", v)
+}
+
+func (s *jsonSchema) validateValue(path string, v any) error {
+	if len(s.Type) > 0 && !s.hasType(v) {
+		return fmt.Errorf("%s: expected %s, got %s", path, strings.Join(s.Type, " or "), jsonTypeName(v))
+	}
+	if s.Const != nil && !jsonEqual(v, *s.Const) {
+		return fmt.Errorf("%s: must be %v", path, *s.Const)
+	}
+	if s.Enum != nil && !jsonContains(s.Enum, v) {
+		return fmt.Errorf("%s: must be one of %v", path, s.Enum)
+	}
+	switch v := v.(type) {
+	case json.Number:
+		f, _ := v.Float64()
+		if s.Minimum != nil && f < *s.Minimum {
+			return fmt.Errorf("%s: must be >= %v", path, *s.Minimum)
+		}
+		if s.Maximum != nil && f > *s.Maximum {
+			return fmt.Errorf("%s: must be <= %v", path, *s.Maximum)
+		}
+	case string:
+		n := utf8.RuneCountInString(v)
+		if s.MinLength != nil && n < *s.MinLength {
+			return fmt.Errorf("%s: must have at least %d characters", path, *s.MinLength)
+		}
+		if s.MaxLength != nil && n > *s.MaxLength {
+			return fmt.Errorf("%s: must have at most %d characters", path, *s.MaxLength)
+		}
+	case []any:
+		if s.MinItems != nil && len(v) < *s.MinItems {
+			return fmt.Errorf("%s: must have at least %d items", path, *s.MinItems)
+		}
+		if s.MaxItems != nil && len(v) > *s.MaxItems {
+			return fmt.Errorf("%s: must have at most %d items", path, *s.MaxItems)
+		}
+		if s.Items != nil {
+			for i, item := range v {
+				if err := s.Items.validateValue(fmt.Sprintf("%s[%d]", path, i), item); err != nil {
+					return err
+				}
+			}
+		}
+	case map[string]any:
+		return s.validateObject(path, v)
+	}
+	return nil
+}
+
+func (s *jsonSchema) validateObject(path string, obj map[string]any) error {
+	for _, name := range s.Required {
+		if _, ok := obj[name]; !ok {
+			return fmt.Errorf("%s: missing required property %q", path, name)
+		}
+	}
+	names := make([]string, 0, len(obj))
+	for name := range obj {
+		names = append(names, name)
+	}
+	// the properties are checked in order, so that the errors are stable
+	sort.Strings(names)
+	for _, name := range names {
+		prop, ok := s.Properties[name]
+		if !ok {
+			if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+				return fmt.Errorf("%s: unexpected property %q", path, name)
+			}
+			continue
+		}
+		if err := prop.validateValue(path+"."+name, obj[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *jsonSchema) hasType(v any) bool {
+	name := jsonTypeName(v)
+	for _, t := range s.Type {
+		if t == name || (t == "number" && name == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonTypeName returns the JSON Schema type of the decoded value. The numbers
+// without a fractional part are integers.
+func jsonTypeName(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case json.Number:
+		if f, err := v.Float64(); err == nil && f == math.Trunc(f) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+// jsonContains reports whether the values contain v.
+func jsonContains(values []any, v any) bool {
+	for _, e := range values {
+		if jsonEqual(e, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonEqual reports whether the decoded values are equal, regardless of how
+// their numbers are written.
+func jsonEqual(a, b any) bool {
+	return reflect.DeepEqual(jsonNormalize(a), jsonNormalize(b))
+}
+
+// jsonNormalize returns the decoded value with the numbers as float64, like
+// json.Unmarshal decodes them without UseNumber.
+func jsonNormalize(v any) any {
+	switch v := v.(type) {
+	case json.Number:
+		f, _ := v.Float64()
+		return f
+	case []any:
+		out := make([]any, len(v))
+		for i, e := range v {
+			out[i] = jsonNormalize(e)
+		}
+		return out
+	case map[string]any:
+		out := make(map[string]any, len(v))
+		for k, e := range v {
+			out[k] = jsonNormalize(e)
+		}
+		return out
+	default:
+		return v
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nlpodyssey/verbaflow/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const testSchema = `{
+	"type": "object",
+	"properties": {
+		"place": {"type": "string", "minLength": 1},
+		"lat": {"type": "number", "minimum": -90, "maximum": 90},
+		"kind": {"enum": ["city", "country"]},
+		"tags": {"type": "array", "items": {"type": "string"}, "maxItems": 2}
+	},
+	"required": ["place", "lat"],
+	"additionalProperties": false
+}`
+
+func TestJSONSchema_Validate(t *testing.T) {
+	schema, err := parseJSONSchema(testSchema)
+	require.NoError(t, err)
+	tests := []struct {
+		text  string
+		valid bool
+	}{
+		{`{"place": "Rome", "lat": 41.9}`, true},
+		{` {"place": "Rome", "lat": 41, "kind": "city", "tags": ["capital"]} `, true},
+		{`{"place": "Rome", "lat": 41.9`, false},
+		{`{"place": "Rome", "lat": 41.9} {}`, false},
+		{`{"place": "Rome"}`, false},
+		{`{"place": "", "lat": 41.9}`, false},
+		{`{"place": "Rome", "lat": 91}`, false},
+		{`{"place": "Rome", "lat": "41.9"}`, false},
+		{`{"place": "Rome", "lat": 41.9, "kind": "town"}`, false},
+		{`{"place": "Rome", "lat": 41.9, "tags": ["a", 1]}`, false},
+		{`{"place": "Rome", "lat": 41.9, "tags": ["a", "b", "c"]}`, false},
+		{`{"place": "Rome", "lat": 41.9, "lon": 12.5}`, false},
+		{`["Rome"]`, false},
+	}
+	for _, tt := range tests {
+		err := schema.validate(tt.text)
+		if tt.valid {
+			assert.NoError(t, err, tt.text)
+		} else {
+			assert.Error(t, err, tt.text)
+		}
+	}
+
+	_, err = parseJSONSchema(`{"type": 1}`)
+	assert.Error(t, err)
+}
+
+func TestStreamValidJSON(t *testing.T) {
+	schema, err := parseJSONSchema(testSchema)
+	require.NoError(t, err)
+	// each generation emits the tokens of the next output
+	newGenerate := func(outputs ...[]string) (func(out *chunker) error, *int) {
+		calls := 0
+		return func(out *chunker) error {
+			for _, token := range outputs[calls] {
+				if err := out.send(&api.GeneratedToken{Token: token}); err != nil {
+					return err
+				}
+			}
+			calls++
+			return out.flush()
+		}, &calls
+	}
+	invalid := []string{`{"place"`, `: "Rome"}`}
+	valid := []string{`{"place"`, `: "Rome", `, `"lat": 41.9}`}
+
+	stream := &recordingStream{ctx: context.Background()}
+	chunks, err := newChunker(stream, &api.DecodingParameters{})
+	require.NoError(t, err)
+	generate, calls := newGenerate(invalid, valid)
+	require.NoError(t, streamValidJSON(context.Background(), schema, 1, chunks, generate))
+	assert.Equal(t, 2, *calls)
+	// only the tokens of the valid output are sent
+	require.Len(t, stream.sent, len(valid))
+	for i, token := range valid {
+		assert.Equal(t, token, stream.sent[i].GetToken())
+	}
+
+	stream = &recordingStream{ctx: context.Background()}
+	chunks, err = newChunker(stream, &api.DecodingParameters{})
+	require.NoError(t, err)
+	generate, calls = newGenerate(invalid, invalid, valid)
+	err = streamValidJSON(context.Background(), schema, 1, chunks, generate)
+	assert.Equal(t, 2, *calls)
+	assert.Empty(t, stream.sent)
+	st := status.Convert(err)
+	assert.Equal(t, codes.Aborted, st.Code())
+	require.Len(t, st.Details(), 1)
+	assert.Equal(t, jsonSchemaMismatchReason, st.Details()[0].(*errdetails.ErrorInfo).GetReason())
+}
@@ -0,0 +1,85 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"context"
+	"sync"
+
+	"google.golang.org/grpc/status"
+)
+
+// generationLimiter limits the number of generations running at once, making
+// the others wait for a slot in FIFO order, and counts both of them.
+type generationLimiter struct {
+	// max is the maximum number of generations running at once, or zero.
+	max int
+
+	mu       sync.Mutex
+	inFlight int
+	// waiting are the generations waiting for a slot, which is handed over
+	// by closing their channel.
+	waiting []chan struct{}
+}
+
+// newGenerationLimiter returns a generationLimiter running at most max
+// generations at once, or any number if it is not positive.
+func newGenerationLimiter(max int) *generationLimiter {
+	if max < 0 {
+		max = 0
+	}
+	return &generationLimiter{max: max}
+}
+
+// acquire waits for a slot, returning the function which releases it, or an
+// error with the status of the context if it is done before.
+func (l *generationLimiter) acquire(ctx context.Context) (func(), error) {
+	l.mu.Lock()
+	if l.max == 0 || l.inFlight < l.max {
+		l.inFlight++
+		l.mu.Unlock()
+		return l.release, nil
+	}
+	ready := make(chan struct{})
+	l.waiting = append(l.waiting, ready)
+	l.mu.Unlock()
+
+	select {
+	case <-ready:
+		return l.release, nil
+	case <-ctx.Done():
+	}
+	l.mu.Lock()
+	for i, ch := range l.waiting {
+		if ch == ready {
+			l.waiting = append(l.waiting[:i], l.waiting[i+1:]...)
+			l.mu.Unlock()
+			return nil, status.FromContextError(ctx.Err()).Err()
+		}
+	}
+	l.mu.Unlock()
+	// the slot was handed over in the meantime
+	l.release()
+	return nil, status.FromContextError(ctx.Err()).Err()
+}
+
+// release releases a slot, handing it over to the first waiting generation.
+func (l *generationLimiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.waiting) > 0 {
+		close(l.waiting[0])
+		l.waiting = l.waiting[1:]
+		return
+	}
+	l.inFlight--
+}
+
+// load returns the number of generations running and waiting for a slot.
+func (l *generationLimiter) load() (inFlight, queued int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.inFlight, len(l.waiting)
+}
@@ -0,0 +1,110 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nlpodyssey/verbaflow/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestGenerationLimiter(t *testing.T) {
+	l := newGenerationLimiter(1)
+	ctx := context.Background()
+	release, err := l.acquire(ctx)
+	require.NoError(t, err)
+
+	// the waiting generations get the slot in order
+	acquired := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		go func(i int) {
+			release, err := l.acquire(ctx)
+			if err == nil {
+				acquired <- i
+				release()
+			}
+		}(i)
+		require.Eventually(t, func() bool {
+			_, queued := l.load()
+			return queued == i+1
+		}, time.Second, time.Millisecond)
+	}
+	release()
+	assert.Equal(t, 0, <-acquired)
+	assert.Equal(t, 1, <-acquired)
+	inFlight, queued := l.load()
+	assert.Equal(t, 0, inFlight)
+	assert.Equal(t, 0, queued)
+
+	// without a maximum, the generations never wait
+	l = newGenerationLimiter(0)
+	for i := 0; i < 3; i++ {
+		_, err := l.acquire(ctx)
+		require.NoError(t, err)
+	}
+	inFlight, _ = l.load()
+	assert.Equal(t, 3, inFlight)
+}
+
+func TestServer_GetLoad(t *testing.T) {
+	// the generations hold their slot until unblocked
+	unblock := make(chan struct{})
+	hook := func(int, string) error {
+		<-unblock
+		return nil
+	}
+	s := newTestServer(t, WithMaxConcurrentGenerations(2), WithTokenHook(hook))
+	load := func() *api.Load {
+		l, err := s.GetLoad(context.Background(), &api.LoadRequest{})
+		require.NoError(t, err)
+		return l
+	}
+	assert.Equal(t, int32(2), load().MaxConcurrent)
+
+	const n = 5
+	ctxs := make([]context.Context, n)
+	cancels := make([]context.CancelFunc, n)
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		ctxs[i], cancels[i] = context.WithCancel(context.Background())
+		defer cancels[i]()
+		go func(ctx context.Context) {
+			req := &api.TokenGenerationRequest{
+				Prompt:             "unrelated",
+				DecodingParameters: &api.DecodingParameters{MaxLen: 2, Temperature: 1, TopP: 1, EndTokenId: -1},
+			}
+			errs <- s.GenerateTokens(req, &recordingStream{ctx: ctx})
+		}(ctxs[i])
+		// the requests are submitted in order
+		require.Eventually(t, func() bool {
+			l := load()
+			return l.InFlight+l.Queued == int32(i+1)
+		}, time.Second, time.Millisecond)
+	}
+	l := load()
+	assert.Equal(t, int32(2), l.InFlight)
+	assert.Equal(t, int32(3), l.Queued)
+
+	// a cancelled request leaves the queue
+	cancels[n-1]()
+	assert.Equal(t, codes.Canceled, status.Code(<-errs))
+	l = load()
+	assert.Equal(t, int32(2), l.InFlight)
+	assert.Equal(t, int32(2), l.Queued)
+
+	close(unblock)
+	for i := 0; i < n-1; i++ {
+		assert.NoError(t, <-errs)
+	}
+	l = load()
+	assert.Equal(t, int32(0), l.InFlight)
+	assert.Equal(t, int32(0), l.Queued)
+}
@@ -0,0 +1,78 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"context"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// LogLevelMetadataKey is the key of the gRPC metadata setting the log level
+// of a single request, such as "trace", regardless of the level of the
+// server. It allows to inspect the decoding of a problematic request without
+// flooding the logs with the details of all the others.
+const LogLevelMetadataKey = "x-verbaflow-log-level"
+
+// ClientIDMetadataKey is the key of the gRPC metadata identifying the
+// client, which the server logs with each of its requests.
+const ClientIDMetadataKey = "x-client-id"
+
+// clientIDKey is the key of the client ID in the context of a request.
+type clientIDKey struct{}
+
+// ClientIDFromContext returns the ID of the client of the request of the
+// context, from the ClientIDMetadataKey metadata, if it was set.
+func ClientIDFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(clientIDKey{}).(string)
+	return id, ok
+}
+
+// clientIDStreamInterceptor puts the client ID of the ClientIDMetadataKey
+// metadata, if any, in the context of the stream.
+func clientIDStreamInterceptor(srv any, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	md, _ := metadata.FromIncomingContext(ss.Context())
+	values := md.Get(ClientIDMetadataKey)
+	if len(values) == 0 || values[len(values)-1] == "" {
+		return handler(srv, ss)
+	}
+	ctx := context.WithValue(ss.Context(), clientIDKey{}, values[len(values)-1])
+	return handler(srv, &contextStream{ServerStream: ss, ctx: ctx})
+}
+
+// contextStream is a grpc.ServerStream with a different context.
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+// Context returns the context of the stream.
+func (s *contextStream) Context() context.Context {
+	return s.ctx
+}
+
+// requestLogger returns the logger of the request of the context: the global
+// logger, with the level from the LogLevelMetadataKey metadata, if any, and
+// the client ID, if known.
+func requestLogger(ctx context.Context) (*zerolog.Logger, error) {
+	logger := log.Logger
+	md, _ := metadata.FromIncomingContext(ctx)
+	if values := md.Get(LogLevelMetadataKey); len(values) > 0 {
+		level, err := zerolog.ParseLevel(values[len(values)-1])
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid %s metadata: %v", LogLevelMetadataKey, err)
+		}
+		logger = logger.Level(level)
+	}
+	if id, ok := ClientIDFromContext(ctx); ok {
+		logger = logger.With().Str("client_id", id).Logger()
+	}
+	return &logger, nil
+}
@@ -0,0 +1,67 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"strings"
+	"unicode"
+
+	"github.com/nlpodyssey/verbaflow/decoder"
+)
+
+// outputNormalizer normalizes the whitespace of the generated text, token by
+// token, so that it can be streamed.
+type outputNormalizer struct {
+	trimWhitespace   bool
+	collapseNewlines bool
+	// started tells whether any non-whitespace character has been emitted.
+	started bool
+	// pending contains the whitespace held back when trimming, since it
+	// is removed if nothing else follows it.
+	pending strings.Builder
+	// lastNewline tells whether the last character was a newline.
+	lastNewline bool
+}
+
+// newOutputNormalizer returns the normalizer required by the decoding
+// options, or nil if the text must be streamed as is.
+func newOutputNormalizer(opts decoder.DecodingOptions) *outputNormalizer {
+	if !opts.TrimWhitespace && !opts.CollapseNewlines {
+		return nil
+	}
+	return &outputNormalizer{
+		trimWhitespace:   opts.TrimWhitespace,
+		collapseNewlines: opts.CollapseNewlines,
+	}
+}
+
+// normalize returns the normalized text of the next token. When trimming,
+// the leading whitespace is removed, while the other whitespace is held back
+// until a non-whitespace character follows it, so that the trailing one is
+// never emitted.
+func (n *outputNormalizer) normalize(text string) string {
+	var sb strings.Builder
+	for _, r := range text {
+		if n.collapseNewlines && r == '\n' && n.lastNewline {
+			continue
+		}
+		n.lastNewline = r == '\n'
+		if !n.trimWhitespace {
+			sb.WriteRune(r)
+			continue
+		}
+		if unicode.IsSpace(r) {
+			if n.started {
+				n.pending.WriteRune(r)
+			}
+			continue
+		}
+		n.started = true
+		sb.WriteString(n.pending.String())
+		n.pending.Reset()
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
@@ -0,0 +1,49 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"testing"
+
+	"github.com/nlpodyssey/verbaflow/decoder"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOutputNormalizer(t *testing.T) {
+	tokens := []string{"\n", " ", "Hello", "\n", "\n\n", "world", " ", "\n", "\n", "!", " ", "\n", "\n"}
+	tests := []struct {
+		name     string
+		opts     decoder.DecodingOptions
+		expected string
+	}{
+		{
+			name:     "trim",
+			opts:     decoder.DecodingOptions{TrimWhitespace: true},
+			expected: "Hello\n\n\nworld \n\n!",
+		},
+		{
+			name:     "collapse",
+			opts:     decoder.DecodingOptions{CollapseNewlines: true},
+			expected: "\n Hello\nworld \n! \n",
+		},
+		{
+			name:     "trim and collapse",
+			opts:     decoder.DecodingOptions{TrimWhitespace: true, CollapseNewlines: true},
+			expected: "Hello\nworld \n!",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := newOutputNormalizer(tt.opts)
+			var out string
+			for _, tok := range tokens {
+				out += n.normalize(tok)
+			}
+			assert.Equal(t, tt.expected, out)
+		})
+	}
+
+	assert.Nil(t, newOutputNormalizer(decoder.DecodingOptions{}), "the raw output is not normalized")
+}
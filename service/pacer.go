@@ -0,0 +1,56 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// pacer limits the rate at which the tokens are sent, waiting for a tick of
+// its ticker before each of them.
+type pacer struct {
+	ticker *time.Ticker
+}
+
+// newPacer returns a pacer allowing at most rate tokens per second, or nil
+// if rate is zero, for no limit.
+func newPacer(rate float64) (*pacer, error) {
+	if rate < 0 || math.IsNaN(rate) || math.IsInf(rate, 0) {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid max tokens per second %v: must be >= 0", rate)
+	}
+	if rate == 0 {
+		return nil, nil
+	}
+	interval := time.Duration(float64(time.Second) / rate)
+	if interval <= 0 {
+		return nil, nil
+	}
+	return &pacer{ticker: time.NewTicker(interval)}, nil
+}
+
+// wait waits until the next token can be sent, or the context is done.
+func (p *pacer) wait(ctx context.Context) error {
+	if p == nil {
+		return nil
+	}
+	select {
+	case <-p.ticker.C:
+		return nil
+	case <-ctx.Done():
+		return status.FromContextError(ctx.Err()).Err()
+	}
+}
+
+// stop releases the resources of the pacer.
+func (p *pacer) stop() {
+	if p != nil {
+		p.ticker.Stop()
+	}
+}
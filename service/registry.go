@@ -0,0 +1,237 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nlpodyssey/verbaflow"
+	"github.com/rs/zerolog/log"
+)
+
+// minEvictionInterval is the minimum interval between two checks of the
+// idle models.
+const minEvictionInterval = time.Second
+
+// Registry maps the names of the models served by a Server to the models,
+// which the requests select with their model field.
+//
+// A model can be registered already loaded, or with a loader which loads it
+// on its first request. With an idle TTL, the latter are closed when they are
+// not used for longer, and loaded again on the next request.
+// It is safe for concurrent use.
+type Registry struct {
+	mu      sync.RWMutex
+	entries map[string]*registryEntry
+	// idleTTL is the time after which an unused lazy model is evicted, if
+	// positive.
+	idleTTL time.Duration
+	// now returns the current time. It is a field so that the tests can
+	// control the clock.
+	now func() time.Time
+}
+
+// registryEntry is a model of the registry.
+type registryEntry struct {
+	// mu guards the other fields, and is held while the model is loaded.
+	mu sync.Mutex
+	// load loads the model, or is nil if the model was registered loaded,
+	// in which case it is never evicted.
+	load func() (*verbaflow.VerbaFlow, error)
+	// vf is the model, or nil if it is not loaded.
+	vf *verbaflow.VerbaFlow
+	// inUse is the number of the generations using the model, which can't
+	// be evicted until they are done.
+	inUse    int
+	lastUsed time.Time
+}
+
+// RegistryOption configures a Registry.
+type RegistryOption func(*Registry)
+
+// WithIdleTTL makes the registry close the lazy models which are not used
+// for longer than ttl, to free their memory. Zero means that the models are
+// never evicted.
+func WithIdleTTL(ttl time.Duration) RegistryOption {
+	return func(r *Registry) {
+		r.idleTTL = ttl
+	}
+}
+
+// NewRegistry returns a new empty Registry.
+func NewRegistry(opts ...RegistryOption) *Registry {
+	r := &Registry{
+		entries: make(map[string]*registryEntry),
+		now:     time.Now,
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// Register adds the loaded model with the given name, which must be
+// non-empty and not already registered.
+func (r *Registry) Register(name string, vf *verbaflow.VerbaFlow) error {
+	if vf == nil {
+		return fmt.Errorf("invalid model %q: must not be nil", name)
+	}
+	return r.add(name, &registryEntry{vf: vf})
+}
+
+// RegisterLazy adds the model with the given name, which must be non-empty
+// and not already registered, loading it with the load function on its
+// first request.
+func (r *Registry) RegisterLazy(name string, load func() (*verbaflow.VerbaFlow, error)) error {
+	if load == nil {
+		return fmt.Errorf("invalid loader of model %q: must not be nil", name)
+	}
+	return r.add(name, &registryEntry{load: load})
+}
+
+func (r *Registry) add(name string, e *registryEntry) error {
+	if name == "" {
+		return fmt.Errorf("invalid model name: must not be empty")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.entries[name]; ok {
+		return fmt.Errorf("model %q already registered", name)
+	}
+	r.entries[name] = e
+	return nil
+}
+
+// ErrUnknownModel is returned by Registry.Acquire for a model which is not
+// registered.
+var ErrUnknownModel = errors.New("unknown model")
+
+// Acquire returns the model with the given name, loading it if needed, and
+// a function to call when it is not used anymore: until then, the model is
+// not evicted.
+func (r *Registry) Acquire(name string) (*verbaflow.VerbaFlow, func(), error) {
+	e, ok := r.entry(name)
+	if !ok {
+		return nil, nil, fmt.Errorf("%w %q", ErrUnknownModel, name)
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.vf == nil {
+		log.Debug().Msgf("Loading model %q...", name)
+		vf, err := e.load()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to load model %q: %w", name, err)
+		}
+		e.vf = vf
+	}
+	return e.vf, r.use(e), nil
+}
+
+// use marks the model of the entry as in use, returning the function which
+// releases it. It must be called with e.mu held.
+func (r *Registry) use(e *registryEntry) func() {
+	e.inUse++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			e.mu.Lock()
+			defer e.mu.Unlock()
+			e.inUse--
+			e.lastUsed = r.now()
+		})
+	}
+}
+
+func (r *Registry) entry(name string) (*registryEntry, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	e, ok := r.entries[name]
+	return e, ok
+}
+
+// Names returns the sorted names of the registered models.
+func (r *Registry) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	names := make([]string, 0, len(r.entries))
+	for name := range r.entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// evictIdle closes the lazy models which are not in use, and have not been
+// used for longer than the idle TTL.
+func (r *Registry) evictIdle() {
+	if r.idleTTL <= 0 {
+		return
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	now := r.now()
+	for name, e := range r.entries {
+		e.mu.Lock()
+		if e.load != nil && e.vf != nil && e.inUse == 0 && now.Sub(e.lastUsed) > r.idleTTL {
+			log.Debug().Msgf("Evicting model %q, idle since %v", name, e.lastUsed)
+			if err := e.vf.Close(); err != nil {
+				log.Err(err).Msgf("failed to close model %q", name)
+			}
+			e.vf = nil
+		}
+		e.mu.Unlock()
+	}
+}
+
+// evictIdleLoop evicts the idle models periodically, until the context is
+// done.
+func (r *Registry) evictIdleLoop(ctx context.Context) {
+	if r.idleTTL <= 0 {
+		return
+	}
+	interval := r.idleTTL / 2
+	if interval < minEvictionInterval {
+		interval = minEvictionInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.evictIdle()
+		}
+	}
+}
+
+// loaded calls fn on each loaded model, keeping it from being evicted, but
+// without loading the others.
+func (r *Registry) loaded(fn func(name string, vf *verbaflow.VerbaFlow) error) error {
+	for _, name := range r.Names() {
+		e, _ := r.entry(name)
+		e.mu.Lock()
+		vf := e.vf
+		var release func()
+		if vf != nil {
+			release = r.use(e)
+		}
+		e.mu.Unlock()
+		if vf == nil {
+			continue
+		}
+		err := fn(name, vf)
+		release()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nlpodyssey/verbaflow"
+	"github.com/nlpodyssey/verbaflow/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestServer_GenerateTokens_Registry(t *testing.T) {
+	vfA, vfB := newTestVerbaFlow(t, 1), newTestVerbaFlow(t, 2)
+	r := NewRegistry()
+	require.NoError(t, r.Register("a", vfA))
+	require.NoError(t, r.Register("b", vfB))
+	assert.Error(t, r.Register("a", vfB))
+	assert.Error(t, r.Register("", vfB))
+	assert.Equal(t, []string{"a", "b"}, r.Names())
+
+	dp := &api.DecodingParameters{MaxLen: 5, Temperature: 1, TopP: 1, EndTokenId: -1}
+	// expected returns the tokens generated by the model
+	expected := func(vf *verbaflow.VerbaFlow) []string {
+		stream := &recordingStream{ctx: context.Background()}
+		require.NoError(t, NewServer(vf).GenerateTokens(&api.TokenGenerationRequest{Prompt: "unrelated", DecodingParameters: dp}, stream))
+		return sentTokens(stream.sent)
+	}
+	tokensA, tokensB := expected(vfA), expected(vfB)
+	require.NotEqual(t, tokensA, tokensB)
+
+	s := NewServer(nil, WithRegistry(r))
+	for model, want := range map[string][]string{"a": tokensA, "b": tokensB} {
+		stream := &recordingStream{ctx: context.Background()}
+		req := &api.TokenGenerationRequest{Prompt: "unrelated", Model: model, DecodingParameters: dp}
+		require.NoError(t, s.GenerateTokens(req, stream))
+		assert.Equal(t, want, sentTokens(stream.sent), model)
+	}
+
+	err := s.GenerateTokens(&api.TokenGenerationRequest{Prompt: "unrelated", Model: "c", DecodingParameters: dp}, &recordingStream{ctx: context.Background()})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	err = s.GenerateTokens(&api.TokenGenerationRequest{Prompt: "unrelated", DecodingParameters: dp}, &recordingStream{ctx: context.Background()})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// the requests without a model name use the default model
+	s = NewServer(vfB, WithRegistry(r))
+	stream := &recordingStream{ctx: context.Background()}
+	require.NoError(t, s.GenerateTokens(&api.TokenGenerationRequest{Prompt: "unrelated", DecodingParameters: dp}, stream))
+	assert.Equal(t, tokensB, sentTokens(stream.sent))
+}
+
+func TestRegistry_IdleEviction(t *testing.T) {
+	loads := 0
+	load := func() (*verbaflow.VerbaFlow, error) {
+		loads++
+		return newTestVerbaFlow(t, 1), nil
+	}
+	now := time.Unix(0, 0)
+	r := NewRegistry(WithIdleTTL(time.Minute))
+	r.now = func() time.Time { return now }
+	require.NoError(t, r.RegisterLazy("lazy", load))
+	loaded := func() bool {
+		e, _ := r.entry("lazy")
+		return e.vf != nil
+	}
+	assert.False(t, loaded())
+
+	s := NewServer(nil, WithRegistry(r))
+	req := &api.TokenGenerationRequest{
+		Prompt:             "unrelated",
+		Model:              "lazy",
+		DecodingParameters: &api.DecodingParameters{MaxLen: 3, Temperature: 1, TopP: 1, EndTokenId: -1},
+	}
+	generate := func() []string {
+		stream := &recordingStream{ctx: context.Background()}
+		require.NoError(t, s.GenerateTokens(req, stream))
+		return sentTokens(stream.sent)
+	}
+
+	// the model is loaded on the first request
+	expected := generate()
+	assert.Len(t, expected, 3)
+	assert.Equal(t, 1, loads)
+	now = now.Add(30 * time.Second)
+	r.evictIdle()
+	assert.True(t, loaded())
+
+	// the idle model is evicted after the TTL, and reloaded on the next request
+	now = now.Add(time.Minute)
+	r.evictIdle()
+	assert.False(t, loaded())
+	assert.Equal(t, expected, generate())
+	assert.Equal(t, 2, loads)
+
+	// a busy model is not evicted
+	_, release, err := r.Acquire("lazy")
+	require.NoError(t, err)
+	now = now.Add(time.Hour)
+	r.evictIdle()
+	assert.True(t, loaded())
+	release()
+	r.evictIdle()
+	assert.True(t, loaded(), "the TTL starts when the model is released")
+	now = now.Add(2 * time.Minute)
+	r.evictIdle()
+	assert.False(t, loaded())
+
+	_, _, err = r.Acquire("unknown")
+	assert.ErrorIs(t, err, ErrUnknownModel)
+}
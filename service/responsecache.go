@@ -0,0 +1,100 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/nlpodyssey/verbaflow"
+	"github.com/nlpodyssey/verbaflow/api"
+	"github.com/nlpodyssey/verbaflow/decoder"
+)
+
+// responseCache keeps the tokens of the last deterministic generations, by
+// key, discarding the least recently used ones when it is full.
+type responseCache struct {
+	mu       sync.Mutex
+	capacity int
+	// order contains the cachedResponse items, from the most recently used.
+	order *list.List
+	items map[string]*list.Element
+	// hits is the number of responses found in the cache, which are replayed
+	// instead of running the model.
+	hits int
+}
+
+// cachedResponse are the generated tokens of a request.
+type cachedResponse struct {
+	key    string
+	tokens []decoder.GeneratedToken
+}
+
+// newResponseCache returns a cache keeping at most capacity responses.
+func newResponseCache(capacity int) *responseCache {
+	return &responseCache{
+		capacity: capacity,
+		order:    list.New(),
+		items:    make(map[string]*list.Element, capacity),
+	}
+}
+
+// get returns the tokens cached with the key, if any.
+func (c *responseCache) get(key string) ([]decoder.GeneratedToken, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	c.hits++
+	return e.Value.(*cachedResponse).tokens, true
+}
+
+// put caches the tokens with the key.
+func (c *responseCache) put(key string, tokens []decoder.GeneratedToken) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.items[key]; ok {
+		e.Value.(*cachedResponse).tokens = tokens
+		c.order.MoveToFront(e)
+		return
+	}
+	for c.order.Len() >= c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*cachedResponse).key)
+	}
+	c.items[key] = c.order.PushFront(&cachedResponse{key: key, tokens: tokens})
+}
+
+// cacheable reports whether the response to the request can be cached,
+// because the generation is deterministic and doesn't need the model
+// state afterwards.
+func cacheable(dp *api.DecodingParameters, opts decoder.DecodingOptions) bool {
+	return !opts.UseSampling && opts.MaxTokensPerSecond == 0 && !dp.GetResumable()
+}
+
+// responseKey returns the key of the response of the model to the prompt,
+// preceded by the system prompt.
+func responseKey(model, system, prompt string, opts decoder.DecodingOptions) string {
+	return verbaflow.GenerationFingerprint(fmt.Sprintf("%q\n%q\n%q", model, system, prompt), opts)
+}
+
+// replayTokens puts the cached tokens into chGen, closing it at the end,
+// like a generation.
+func replayTokens(ctx context.Context, tokens []decoder.GeneratedToken, chGen chan decoder.GeneratedToken) error {
+	buf := decoder.ChannelBuffer(chGen)
+	defer buf.Close()
+	for _, gen := range tokens {
+		if err := buf.Put(ctx, gen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nlpodyssey/verbaflow/api"
+	"github.com/nlpodyssey/verbaflow/decoder"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestResponseCache(t *testing.T) {
+	c := newResponseCache(2)
+	c.put("a", []decoder.GeneratedToken{{TokenID: 1}})
+	c.put("b", []decoder.GeneratedToken{{TokenID: 2}})
+	_, ok := c.get("a")
+	assert.True(t, ok)
+	// the least recently used response is discarded
+	c.put("c", []decoder.GeneratedToken{{TokenID: 3}})
+	_, ok = c.get("b")
+	assert.False(t, ok)
+	tokens, ok := c.get("a")
+	assert.True(t, ok)
+	assert.Equal(t, 1, tokens[0].TokenID)
+	_, ok = c.get("c")
+	assert.True(t, ok)
+}
+
+func TestServer_GenerateTokens_ResponseCache(t *testing.T) {
+	s := newTestServer(t, WithResponseCache(2))
+	newRequest := func(prompt string, sampling bool) *api.TokenGenerationRequest {
+		return &api.TokenGenerationRequest{
+			Prompt: prompt,
+			DecodingParameters: &api.DecodingParameters{
+				MaxLen:      5,
+				Temperature: 1,
+				TopP:        1,
+				EndTokenId:  -1,
+				UseSampling: sampling,
+				ChunkSize:   2,
+			},
+		}
+	}
+	generate := func(req *api.TokenGenerationRequest) ([]*api.GeneratedToken, error) {
+		stream := &recordingStream{ctx: context.Background()}
+		err := s.GenerateTokens(req, stream)
+		return stream.sent, err
+	}
+
+	expected, err := generate(newRequest("unrelated", false))
+	require.NoError(t, err)
+	_, err = generate(newRequest("related", true))
+	require.NoError(t, err)
+	assert.Equal(t, 0, s.responses.hits)
+
+	// the same deterministic request is replayed from the cache
+	actual, err := generate(newRequest("unrelated", false))
+	require.NoError(t, err)
+	assert.Equal(t, 1, s.responses.hits)
+	assert.True(t, proto.Equal(&api.GeneratedToken{Chunk: expected}, &api.GeneratedToken{Chunk: actual}))
+
+	// the generations with sampling are not cached
+	_, err = generate(newRequest("related", true))
+	require.NoError(t, err)
+	_, err = generate(newRequest("other", false))
+	require.NoError(t, err)
+	assert.Equal(t, 1, s.responses.hits)
+}
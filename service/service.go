@@ -6,36 +6,226 @@ package service
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
+	"strings"
+	"sync"
+	"text/template"
 	"time"
 
 	"github.com/nlpodyssey/spago/ag"
 	"github.com/nlpodyssey/verbaflow"
 	"github.com/nlpodyssey/verbaflow/api"
 	"github.com/nlpodyssey/verbaflow/decoder"
+	"github.com/nlpodyssey/verbaflow/rwkvlm"
+	"github.com/nlpodyssey/verbaflow/tokenizer"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/health"
 	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/status"
 )
 
+// streamBufferSize is the number of generated tokens which can be waiting to
+// be sent to the client. When it is reached, the generation is paused.
+const streamBufferSize = 8
+
 type Server struct {
 	api.UnimplementedLanguageModelServer
+	// vf is the default model, used by the requests without a model name.
+	// It can be nil if the models are in the registry.
 	vf         *verbaflow.VerbaFlow
+	registry   *Registry
 	health     *health.Server
 	grpcServer *grpc.Server
+	// maxPromptTokens is the maximum number of tokens of a prompt, if positive.
+	maxPromptTokens int
+	// validateOnStart enables the startup validation of the model.
+	validateOnStart bool
+	// maxContinuations is the number of continuations kept for the
+	// resumable generations, zero to disable them.
+	maxContinuations int
+	continuations    *continuationCache
+	// tokenHook is invoked on each generated token, if not nil.
+	tokenHook TokenHook
+	// systemPrompt is prepended to the prompts, if not nil.
+	systemPrompt *template.Template
+	// systemPromptErr is the error parsing the system prompt, reported by Start.
+	systemPromptErr error
+	// responses caches the deterministic generations, if not nil.
+	responses *responseCache
+	// generationTimeout is the maximum duration of a generation, if positive.
+	generationTimeout time.Duration
+	// sessions keeps the generations which survive the interruption of the
+	// stream, if not nil.
+	sessions *sessionStore
+	// defaults are the values of the decoding parameters which are not set.
+	defaults *api.DecodingParameters
+	// batchWindow and maxBatch configure the continuous batching of the
+	// steps of the concurrent generations, if batchWindow is positive.
+	batchWindow time.Duration
+	maxBatch    int
+	// batchersMu guards the setting of the batchers of the models.
+	batchersMu sync.Mutex
+	// maxConcurrent is the maximum number of generations running at once,
+	// if positive.
+	maxConcurrent int
+	limiter       *generationLimiter
+}
+
+// ServerOption configures a Server.
+type ServerOption func(*Server)
+
+// WithMaxPromptTokens limits the number of tokens of the prompts, rejecting
+// the requests exceeding it. Zero means no limit.
+func WithMaxPromptTokens(n int) ServerOption {
+	return func(s *Server) {
+		s.maxPromptTokens = n
+	}
+}
+
+// WithMaxContinuations sets the number of continuations of the resumable
+// generations kept by the server, discarding the oldest ones, since each of
+// them holds a whole state of the model. Zero disables the resumable
+// generations. The default is defaultMaxContinuations.
+func WithMaxContinuations(n int) ServerOption {
+	return func(s *Server) {
+		s.maxContinuations = n
+	}
+}
+
+// TokenHook is invoked by the server on each generated token, with the text
+// about to be sent to the client, for example to log or moderate the output.
+// Returning an error aborts the generation.
+type TokenHook func(tokenID int, text string) error
+
+// WithTokenHook sets a hook invoked on each generated token, before it is
+// sent. If the hook returns an error, the stream ends with it, if it is a
+// gRPC status error, or with an Aborted status otherwise, and the token is
+// not sent.
+func WithTokenHook(hook TokenHook) ServerOption {
+	return func(s *Server) {
+		s.tokenHook = hook
+	}
+}
+
+// WithSystemPrompt sets a system prompt prepended to the prompt of every
+// request, unless the request sets its own. It is a prompt template, parsed
+// with verbaflow.ParsePromptTemplate, rendered with the prompt of the request
+// as the Text of the InputPrompt. An invalid template makes Start fail.
+func WithSystemPrompt(text string) ServerOption {
+	return func(s *Server) {
+		s.systemPrompt, s.systemPromptErr = verbaflow.ParsePromptTemplate("system", text)
+	}
+}
+
+// WithRegistry makes the models of the registry available to the requests
+// which select them with their model field. The model passed to NewServer
+// remains the default one, used by the requests without a model name.
+func WithRegistry(r *Registry) ServerOption {
+	return func(s *Server) {
+		s.registry = r
+	}
+}
+
+// WithResponseCache makes the server cache the tokens of the last size
+// deterministic generations, which don't use sampling nor throttling, so
+// that an identical request is served without running the model.
+// Zero disables the cache.
+func WithResponseCache(size int) ServerOption {
+	return func(s *Server) {
+		s.responses = nil
+		if size > 0 {
+			s.responses = newResponseCache(size)
+		}
+	}
+}
+
+// WithGenerationTimeout limits the duration of each generation: when it is
+// exceeded, the generation is cancelled and the stream ends with a
+// DeadlineExceeded status, so that a stuck generation can't hold the stream
+// indefinitely. Zero means no limit.
+func WithGenerationTimeout(d time.Duration) ServerOption {
+	return func(s *Server) {
+		s.generationTimeout = d
+	}
+}
+
+// WithSessions enables the sessions: the generation of a request with the
+// session field set continues when its stream is interrupted, and the client
+// can reattach to it with ResumeSession until ttl after its end.
+// Zero disables the sessions.
+func WithSessions(ttl time.Duration) ServerOption {
+	return func(s *Server) {
+		s.sessions = nil
+		if ttl > 0 {
+			s.sessions = newSessionStore(ttl)
+		}
+	}
+}
+
+// WithContinuousBatching makes the concurrent generations on the same model
+// run their steps together, up to maxBatch at a time, or any number if it is
+// not positive, which improves the throughput under load. The first step of
+// a batch waits up to window for the others, so each step can be delayed by
+// it. Zero disables the batching.
+func WithContinuousBatching(window time.Duration, maxBatch int) ServerOption {
+	return func(s *Server) {
+		s.batchWindow, s.maxBatch = window, maxBatch
+	}
+}
+
+// WithMaxConcurrentGenerations limits the number of generations running at
+// once: the others wait for their turn, in order, until their stream is
+// cancelled. The running and the waiting ones are reported by GetLoad.
+// Zero means no limit.
+func WithMaxConcurrentGenerations(n int) ServerOption {
+	return func(s *Server) {
+		s.maxConcurrent = n
+	}
+}
+
+// WithStartupValidation makes Start generate a single token before reporting
+// the service as SERVING. If the generation fails, for example because the
+// model predicts NaN logits, the error is logged and the service is reported
+// as NOT_SERVING.
+func WithStartupValidation() ServerOption {
+	return func(s *Server) {
+		s.validateOnStart = true
+	}
 }
 
-func NewServer(vf *verbaflow.VerbaFlow) *Server {
-	return &Server{
+func NewServer(vf *verbaflow.VerbaFlow, opts ...ServerOption) *Server {
+	// allow the keepalive pings of the clients created with NewClient
+	enforcement := keepalive.EnforcementPolicy{
+		MinTime:             minKeepaliveTime,
+		PermitWithoutStream: true,
+	}
+	s := &Server{
 		vf:         vf,
 		health:     health.NewServer(),
-		grpcServer: grpc.NewServer(),
+		grpcServer: grpc.NewServer(grpc.KeepaliveEnforcementPolicy(enforcement), grpc.StreamInterceptor(clientIDStreamInterceptor)),
+
+		maxContinuations: defaultMaxContinuations,
+		defaults:         decodingOptionsToGRPC(DefaultDecodingOptions()),
 	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.continuations = newContinuationCache(s.maxContinuations)
+	s.limiter = newGenerationLimiter(s.maxConcurrent)
+	return s
 }
 
 func (s *Server) Start(ctx context.Context, address string) error {
+	if s.systemPromptErr != nil {
+		return fmt.Errorf("invalid system prompt: %w", s.systemPromptErr)
+	}
 	lis, err := net.Listen("tcp", address)
 	if err != nil {
 		return fmt.Errorf("failed to listen: %w", err)
@@ -44,12 +234,70 @@ func (s *Server) Start(ctx context.Context, address string) error {
 	grpc_health_v1.RegisterHealthServer(s.grpcServer, s.health)
 	api.RegisterLanguageModelServer(s.grpcServer, s)
 
-	s.health.SetServingStatus(api.LanguageModel_ServiceDesc.ServiceName, grpc_health_v1.HealthCheckResponse_SERVING)
+	s.setInitialServingStatus(ctx)
 
 	go s.shutDownServerWhenContextIsDone(ctx)
+	if s.registry != nil {
+		go s.registry.evictIdleLoop(ctx)
+	}
 	return s.grpcServer.Serve(lis)
 }
 
+// setInitialServingStatus reports the service as SERVING, unless the startup
+// validation is enabled and fails.
+func (s *Server) setInitialServingStatus(ctx context.Context) {
+	serving := grpc_health_v1.HealthCheckResponse_SERVING
+	if s.validateOnStart {
+		if err := s.validateModels(ctx); err != nil {
+			log.Err(err).Msg("startup validation failed, the service is not serving")
+			serving = grpc_health_v1.HealthCheckResponse_NOT_SERVING
+		}
+	}
+	s.health.SetServingStatus(api.LanguageModel_ServiceDesc.ServiceName, serving)
+}
+
+// validateModels validates the default model and the loaded models of the
+// registry, without loading the lazy ones.
+func (s *Server) validateModels(ctx context.Context) error {
+	if s.vf != nil {
+		if err := validateModel(ctx, s.vf); err != nil {
+			return err
+		}
+	}
+	if s.registry == nil {
+		return nil
+	}
+	return s.registry.loaded(func(name string, vf *verbaflow.VerbaFlow) error {
+		if err := validateModel(ctx, vf); err != nil {
+			return fmt.Errorf("model %q: %w", name, err)
+		}
+		return nil
+	})
+}
+
+// validateModel generates a single token after the beginning-of-sequence one,
+// which fails if the model predicts non-finite logits.
+func validateModel(ctx context.Context, vf *verbaflow.VerbaFlow) error {
+	nt := &ag.NodesTracker{}
+	defer nt.ReleaseNodes()
+
+	opts := decoder.DecodingOptions{
+		MaxLen:     1,
+		EndTokenID: -1,
+		Temp:       1,
+		TopP:       1,
+		AddBOS:     true,
+	}
+	chGen := make(chan decoder.GeneratedToken, opts.MaxLen)
+	if err := vf.Generate(ctx, nt, "", chGen, opts); err != nil {
+		return err
+	}
+	if len(chGen) != opts.MaxLen {
+		return fmt.Errorf("expected %d generated token, got %d", opts.MaxLen, len(chGen))
+	}
+	return nil
+}
+
 // shutDownServerWhenContextIsDone shuts down the server when the context is done.
 func (s *Server) shutDownServerWhenContextIsDone(ctx context.Context) {
 	<-ctx.Done()
@@ -61,64 +309,731 @@ func (s *Server) shutDownServerWhenContextIsDone(ctx context.Context) {
 
 // GenerateTokens implements the GenerateTokens method of the LanguageModel service.
 func (s *Server) GenerateTokens(req *api.TokenGenerationRequest, stream api.LanguageModel_GenerateTokensServer) error {
-	ctx := stream.Context()
-	log.Debug().Msgf("Received request from", ctx.Value("client"))
-
-	opts := grpcToDecodingOptions(req.GetDecodingParameters())
+	logger, err := requestLogger(stream.Context())
+	if err != nil {
+		return err
+	}
+	// the decoder logs its trace with the logger of the context
+	ctx := logger.WithContext(stream.Context())
+	logger.Debug().Msg("Received request")
 
-	// chGen is a channel that will receive the generated tokens
-	chGen := make(chan decoder.GeneratedToken, opts.MaxLen)
-	errCh := make(chan error)
+	if !req.GetSession() {
+		return s.generateTokens(ctx, req, stream)
+	}
+	if s.sessions == nil {
+		return status.Errorf(codes.FailedPrecondition, "sessions are disabled on this server")
+	}
+	// the generation is not cancelled with the stream, so that the client
+	// can reattach to it, but when the session expires
+	genCtx, cancel := context.WithCancel(logger.WithContext(context.Background()))
+	id, sess, err := s.sessions.create(cancel)
+	if err != nil {
+		cancel()
+		return err
+	}
+	if err := stream.Send(&api.GeneratedToken{SessionId: id}); err != nil {
+		return err
+	}
 	go func() {
+		defer cancel()
+		sess.finish(s.generateTokens(genCtx, req, sess))
+	}()
+	return sess.follow(ctx, stream, 0)
+}
+
+// ResumeSession implements the ResumeSession method of the LanguageModel service.
+func (s *Server) ResumeSession(req *api.SessionRequest, stream api.LanguageModel_ResumeSessionServer) error {
+	logger, err := requestLogger(stream.Context())
+	if err != nil {
+		return err
+	}
+	ctx := logger.WithContext(stream.Context())
+	logger.Debug().Msg("Received session request")
+
+	if s.sessions == nil {
+		return status.Errorf(codes.FailedPrecondition, "sessions are disabled on this server")
+	}
+	sess, ok := s.sessions.get(req.GetSessionId())
+	if !ok {
+		return status.Errorf(codes.NotFound, "session %q not found: it may have expired", req.GetSessionId())
+	}
+	return sess.follow(ctx, stream, int(req.GetOffset()))
+}
+
+// GetLoad implements the GetLoad method of the LanguageModel service.
+func (s *Server) GetLoad(_ context.Context, _ *api.LoadRequest) (*api.Load, error) {
+	inFlight, queued := s.limiter.load()
+	return &api.Load{
+		InFlight:      int32(inFlight),
+		Queued:        int32(queued),
+		MaxConcurrent: int32(s.limiter.max),
+	}, nil
+}
+
+// generateTokens generates the tokens of the request, sending them to the
+// stream.
+func (s *Server) generateTokens(ctx context.Context, req *api.TokenGenerationRequest, stream tokenStream) error {
+	logger := zerolog.Ctx(ctx)
+	// the slot is taken before the model, so that the generations waiting
+	// for one don't keep their model loaded
+	releaseSlot, err := s.limiter.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer releaseSlot()
+	vf, release, err := s.acquireModel(req.GetModel())
+	if err != nil {
+		return err
+	}
+	defer release()
+	start := time.Now()
+	dp, err := withDefaults(req.GetDecodingParameters(), s.defaults)
+	if err != nil {
+		return err
+	}
+	opts, err := grpcToDecodingOptions(dp)
+	if err != nil {
+		return err
+	}
+	if err := validateDecodingOptions(opts); err != nil {
+		return err
+	}
+	if err := s.checkResumable(dp); err != nil {
+		return err
+	}
+	chunks, err := newChunker(stream, dp)
+	if err != nil {
+		return err
+	}
+	schema, err := requestJSONSchema(opts)
+	if err != nil {
+		return err
+	}
+
+	system, err := s.renderSystemPrompt(req)
+	if err != nil {
+		return err
+	}
+	// the system prompt is encoded on its own, so that the tokens of the
+	// prompt of the request are the same with or without it
+	tokenized, err := vf.TokenizePrompt(system, opts.AddBOS)
+	if err != nil {
+		return err
+	}
+	userTokenized, err := vf.TokenizePrompt(req.GetPrompt(), false)
+	if err != nil {
+		return err
+	}
+	tokenized = append(tokenized, userTokenized...)
+	if s.maxPromptTokens > 0 && len(tokenized) > s.maxPromptTokens {
+		return status.Errorf(codes.InvalidArgument, "the prompt has %d tokens, but at most %d are allowed", len(tokenized), s.maxPromptTokens)
+	}
+	if opts.EchoPrompt {
+		// the system prompt and the beginning-of-sequence token are not echoed
+		if err := echoPrompt(vf, userTokenized, chunks); err != nil {
+			return err
+		}
+	}
+
+	var cont *verbaflow.Continuation
+	generate := func(ctx context.Context, chGen chan decoder.GeneratedToken) error {
+		if dp.GetResumable() {
+			var err error
+			cont, err = vf.GenerateResumable(ctx, tokenized, chGen, opts)
+			return err
+		}
 		// free the computational graph after the generation is finished
 		nt := &ag.NodesTracker{}
 		defer nt.ReleaseNodes()
+		return vf.GenerateFromTokens(ctx, nt, tokenized, chGen, opts)
+	}
+
+	var cacheKey string
+	var generated *[]decoder.GeneratedToken
+	if s.responses != nil && cacheable(dp, opts) {
+		cacheKey = responseKey(req.GetModel(), system, req.GetPrompt(), opts)
+		if tokens, ok := s.responses.get(cacheKey); ok {
+			logger.Debug().Msg("Serving the response from the cache")
+			generate = func(ctx context.Context, chGen chan decoder.GeneratedToken) error {
+				return replayTokens(ctx, tokens, chGen)
+			}
+		} else {
+			generated = new([]decoder.GeneratedToken)
+		}
+	}
+
+	// the timeout covers all the attempts of a JSON generation
+	err = s.withGenerationTimeout(ctx, func(ctx context.Context) error {
+		return streamValidJSON(ctx, schema, opts.JSONSchemaRetries, chunks, func(out *chunker) error {
+			if generated != nil {
+				*generated = (*generated)[:0]
+			}
+			return s.streamTokens(ctx, vf, opts, out, generated, generate)
+		})
+	})
+	if err != nil {
+		return err
+	}
+	if generated != nil {
+		s.responses.put(cacheKey, *generated)
+	}
+	var saved *savedContinuation
+	if cont != nil {
+		saved = &savedContinuation{model: req.GetModel(), vf: vf, cont: cont}
+	}
+	if err := s.sendLast(stream, dp, saved, generationStats(len(tokenized), chunks.generated, start)); err != nil {
+		return err
+	}
+
+	logger.Debug().Msg("Done.")
+	return nil
+}
+
+// GenerateContinue implements the GenerateContinue method of the LanguageModel service.
+func (s *Server) GenerateContinue(req *api.ContinuationRequest, stream api.LanguageModel_GenerateContinueServer) error {
+	logger, err := requestLogger(stream.Context())
+	if err != nil {
+		return err
+	}
+	ctx := logger.WithContext(stream.Context())
+	logger.Debug().Msg("Received continuation request")
+
+	start := time.Now()
+	dp, err := withDefaults(req.GetDecodingParameters(), s.defaults)
+	if err != nil {
+		return err
+	}
+	opts, err := grpcToDecodingOptions(dp)
+	if err != nil {
+		return err
+	}
+	if err := validateDecodingOptions(opts); err != nil {
+		return err
+	}
+	if err := s.checkResumable(dp); err != nil {
+		return err
+	}
+	if req.GetAdditionalLen() <= 0 {
+		return status.Errorf(codes.InvalidArgument, "invalid additional length %d: must be > 0", req.GetAdditionalLen())
+	}
+	chunks, err := newChunker(stream, dp)
+	if err != nil {
+		return err
+	}
+
+	saved, ok := s.continuations.take(req.GetContinuationId())
+	if !ok {
+		return status.Errorf(codes.NotFound, "continuation %q not found: it may have been used already or discarded", req.GetContinuationId())
+	}
+	releaseSlot, err := s.limiter.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer releaseSlot()
+	vf, release, err := s.acquireModel(saved.model)
+	if err != nil {
+		return err
+	}
+	defer release()
+	if vf != saved.vf {
+		return status.Errorf(codes.FailedPrecondition, "continuation %q is not valid anymore: its model was unloaded", req.GetContinuationId())
+	}
+	cont := saved.cont
+	err = s.withGenerationTimeout(ctx, func(ctx context.Context) error {
+		return s.streamTokens(ctx, vf, opts, chunks, nil, func(ctx context.Context, chGen chan decoder.GeneratedToken) error {
+			return vf.GenerateContinue(ctx, cont, int(req.GetAdditionalLen()), chGen, opts)
+		})
+	})
+	if err != nil {
+		return err
+	}
+	var next *savedContinuation
+	if dp.GetResumable() {
+		next = &saved
+	}
+	if err := s.sendLast(stream, dp, next, generationStats(0, chunks.generated, start)); err != nil {
+		return err
+	}
+
+	logger.Debug().Msg("Done.")
+	return nil
+}
+
+// validateDecodingOptions checks the decoding options of a request, so that
+// the invalid ones are rejected before the generation starts.
+func validateDecodingOptions(opts decoder.DecodingOptions) error {
+	if err := opts.Validate(); err != nil {
+		return status.Errorf(codes.InvalidArgument, "invalid decoding parameters: %v", err)
+	}
+	return nil
+}
+
+// withGenerationTimeout runs fn with a context which is done when the
+// generation timeout elapses, if it is set, turning the error it causes into
+// a DeadlineExceeded status. The time waiting for a slot and loading the
+// model doesn't count for it.
+func (s *Server) withGenerationTimeout(ctx context.Context, fn func(ctx context.Context) error) error {
+	if s.generationTimeout <= 0 {
+		return fn(ctx)
+	}
+	timeoutCtx, cancel := context.WithTimeout(ctx, s.generationTimeout)
+	defer cancel()
+	err := fn(timeoutCtx)
+	if err != nil && ctx.Err() == nil && errors.Is(timeoutCtx.Err(), context.DeadlineExceeded) {
+		zerolog.Ctx(ctx).Debug().Msgf("Generation timed out after %v", s.generationTimeout)
+		return status.Errorf(codes.DeadlineExceeded, "generation timed out after %v", s.generationTimeout)
+	}
+	return err
+}
+
+// streamTokens runs the generate function in the background, sending the
+// tokens it puts into chGen, generated by the model vf, to the chunks.
+// If record is not nil, the tokens are also appended to it.
+// The generation is always finished when it returns, so that the model can
+// be released.
+func (s *Server) streamTokens(ctx context.Context, vf *verbaflow.VerbaFlow, opts decoder.DecodingOptions, chunks *chunker, record *[]decoder.GeneratedToken, generate func(ctx context.Context, chGen chan decoder.GeneratedToken) error) error {
+	logger := zerolog.Ctx(ctx)
+	pace, err := newPacer(opts.MaxTokensPerSecond)
+	if err != nil {
+		return err
+	}
+	defer pace.stop()
+	// the generation is cancelled if the tokens can't be sent, so that it
+	// never stays blocked on chGen
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-		log.Trace().Msgf("Decoding...")
+	// chGen is a channel that will receive the generated tokens.
+	chGen := decoder.NewChannelBuffer(streamBufferSize)
+	// errCh receives the error of the generation, and is then closed, so
+	// that it can be read again after sendTokens received it
+	errCh := make(chan error, 1)
+	go func() {
+		defer close(errCh)
+		logger.Trace().Msgf("Decoding...")
 		start := time.Now()
-		errCh <- s.vf.Generate(ctx, nt, req.GetPrompt(), chGen, opts)
-		log.Trace().Msgf("Inference time: %.2f seconds", time.Since(start).Seconds())
+		errCh <- generate(ctx, chGen)
+		logger.Trace().Msgf("Inference time: %.2f seconds", time.Since(start).Seconds())
 	}()
 
+	err = s.sendTokens(ctx, vf, opts, chunks, pace, record, chGen, errCh)
+	if err != nil {
+		cancel()
+		<-errCh
+	} else {
+		err = <-errCh
+	}
+	return err
+}
+
+// sendTokens sends the tokens received from chGen to the chunks, at the pace
+// of the pacer, until it is closed. It returns early if the generation fails,
+// as reported by errCh, or the context is done.
+//
+// The tokens whose text is not certain yet, such as the ones ending with an
+// incomplete rune, are held back until a following token completes it, and
+// then sent together, the last one with the whole text. The text of the
+// tokens still held back at the end is flushed as is.
+func (s *Server) sendTokens(ctx context.Context, vf *verbaflow.VerbaFlow, opts decoder.DecodingOptions, chunks *chunker, pace *pacer, record *[]decoder.GeneratedToken, chGen chan decoder.GeneratedToken, errCh <-chan error) error {
+	normalizer := newOutputNormalizer(opts)
+	detokenizer := tokenizer.NewDetokenizer(vf.Tokenizer)
+
+	var special map[int]bool
+	if opts.FilterSpecialTokens {
+		special = controlTokenSet(vf.Tokenizer.ControlTokens())
+	}
 	checkWriteConditions := func(tokenID int) bool {
-		return !(tokenID == opts.EndTokenID && opts.SkipEndTokenID)
+		return !(tokenID == opts.EndTokenID && opts.SkipEndTokenID) && !special[tokenID]
 	}
 
-	for gen := range chGen {
-		if !checkWriteConditions(gen.TokenID) {
-			continue
+	var held []decoder.GeneratedToken
+	sendHeld := func(text string) error {
+		for i, gen := range held {
+			token := ""
+			if i == len(held)-1 {
+				token = text
+			}
+			if err := s.sendToken(ctx, gen, token, normalizer, pace, chunks); err != nil {
+				return err
+			}
 		}
-		token, err := s.vf.TokenByID(gen.TokenID)
-		if err != nil {
-			return fmt.Errorf("failed to reconstruct text for token ID %d", gen.TokenID)
+		held = held[:0]
+		return nil
+	}
+
+	for {
+		select {
+		case gen, ok := <-chGen:
+			if !ok {
+				text, err := detokenizer.Flush()
+				if err != nil {
+					return fmt.Errorf("failed to reconstruct the text of the generated tokens: %w", err)
+				}
+				if err := sendHeld(text); err != nil {
+					return err
+				}
+				return chunks.flush()
+			}
+			if record != nil {
+				*record = append(*record, gen)
+			}
+			if !checkWriteConditions(gen.TokenID) {
+				continue
+			}
+			held = append(held, gen)
+			// the decoder already sets the text, possibly trimmed, when
+			// MaxChars is used, holding back the incomplete runes as well
+			text := gen.Text
+			if opts.MaxChars <= 0 {
+				var err error
+				if text, err = detokenizer.Add(gen.TokenID); err != nil {
+					return fmt.Errorf("failed to reconstruct text for token ID %d", gen.TokenID)
+				}
+			}
+			if text == "" {
+				continue
+			}
+			if err := sendHeld(text); err != nil {
+				return err
+			}
+		case <-chunks.due():
+			if err := chunks.flush(); err != nil {
+				return err
+			}
+		case err := <-errCh:
+			if err != nil {
+				return err
+			}
+			// the generation succeeded: the rest of the tokens is in chGen
+			errCh = nil
+		case <-ctx.Done():
+			return ctx.Err()
 		}
-		if err = stream.Send(&api.GeneratedToken{
-			Token: token,
-			Score: float32(gen.SumNegLogProbs),
-		}); err != nil {
+	}
+}
+
+// requestJSONSchema returns the parsed JSONSchema of the options, or nil if
+// it is not set.
+func requestJSONSchema(opts decoder.DecodingOptions) (*jsonSchema, error) {
+	if opts.JSONSchema == "" {
+		return nil, nil
+	}
+	if opts.JSONSchemaRetries < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid JSON schema retries %d: must be >= 0", opts.JSONSchemaRetries)
+	}
+	schema, err := parseJSONSchema(opts.JSONSchema)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+	return schema, nil
+}
+
+// streamValidJSON calls generate, which sends the generated tokens to the
+// given chunker. Without a schema, the chunker is the one of the stream.
+// Otherwise, the tokens are held back until the text is validated, and the
+// generation is repeated, at most retries times, while it doesn't match.
+func streamValidJSON(ctx context.Context, schema *jsonSchema, retries int, chunks *chunker, generate func(out *chunker) error) error {
+	if schema == nil {
+		return generate(chunks)
+	}
+	var err error
+	for attempt := 0; attempt <= retries; attempt++ {
+		held := &heldTokens{}
+		if err := generate(&chunker{stream: held}); err != nil {
+			return err
+		}
+		if err = schema.validate(held.text()); err == nil {
+			return held.sendTo(chunks)
+		}
+		zerolog.Ctx(ctx).Debug().Msgf("The output does not match the JSON schema (attempt %d): %v", attempt+1, err)
+	}
+	return jsonSchemaMismatch(retries+1, err)
+}
+
+// jsonSchemaMismatchReason is the reason of the ErrorInfo detail of the
+// status returned when the output doesn't match the JSON schema, which
+// distinguishes it from the other errors.
+const jsonSchemaMismatchReason = "JSON_SCHEMA_MISMATCH"
+
+// jsonSchemaMismatch returns the status error reporting that the output of
+// all the attempts didn't match the JSON schema, the last one because of err.
+func jsonSchemaMismatch(attempts int, err error) error {
+	st := status.Newf(codes.Aborted, "the output does not match the JSON schema after %d attempts: %v", attempts, err)
+	detailed, derr := st.WithDetails(&errdetails.ErrorInfo{
+		Reason: jsonSchemaMismatchReason,
+		Domain: api.LanguageModel_ServiceDesc.ServiceName,
+	})
+	if derr != nil {
+		return st.Err()
+	}
+	return detailed.Err()
+}
+
+// heldTokens is a tokenStream keeping the messages, to send them later.
+type heldTokens struct {
+	messages []*api.GeneratedToken
+}
+
+// Send satisfies the tokenStream interface.
+func (h *heldTokens) Send(msg *api.GeneratedToken) error {
+	h.messages = append(h.messages, msg)
+	return nil
+}
+
+// text returns the concatenated text of the tokens.
+func (h *heldTokens) text() string {
+	var sb strings.Builder
+	for _, msg := range h.messages {
+		sb.WriteString(msg.GetToken())
+	}
+	return sb.String()
+}
+
+// sendTo sends the tokens to the chunks, flushing them at the end.
+func (h *heldTokens) sendTo(chunks *chunker) error {
+	for _, msg := range h.messages {
+		if err := chunks.send(msg); err != nil {
 			return err
 		}
 	}
+	return chunks.flush()
+}
 
-	err := <-errCh
+// renderSystemPrompt returns the system prompt for the request: its own, if
+// set, or the one of the server, if any.
+func (s *Server) renderSystemPrompt(req *api.TokenGenerationRequest) (string, error) {
+	pt := s.systemPrompt
+	switch {
+	case req.SystemPrompt == nil && s.systemPromptErr != nil:
+		return "", status.Errorf(codes.Internal, "invalid system prompt: %v", s.systemPromptErr)
+	case req.SystemPrompt != nil && req.GetSystemPrompt() == "":
+		pt = nil
+	case req.SystemPrompt != nil:
+		var err error
+		if pt, err = verbaflow.ParsePromptTemplate("system", req.GetSystemPrompt()); err != nil {
+			return "", status.Errorf(codes.InvalidArgument, "invalid system prompt: %v", err)
+		}
+	}
+	if pt == nil {
+		return "", nil
+	}
+	system, err := verbaflow.BuildPromptFromTemplate(verbaflow.InputPrompt{Text: req.GetPrompt()}, pt)
 	if err != nil {
+		return "", status.Errorf(codes.InvalidArgument, "failed to render the system prompt: %v", err)
+	}
+	return system, nil
+}
+
+// sendToken sends the generated token with the given text, normalized, after
+// running the token hook, at the pace of the pacer.
+func (s *Server) sendToken(ctx context.Context, gen decoder.GeneratedToken, token string, normalizer *outputNormalizer, pace *pacer, chunks *chunker) error {
+	if normalizer != nil {
+		token = normalizer.normalize(token)
+	}
+	if err := s.runTokenHook(gen.TokenID, token); err != nil {
 		return err
 	}
+	if err := pace.wait(ctx); err != nil {
+		return err
+	}
+	return chunks.send(generatedTokenToGRPC(token, gen))
+}
+
+// acquireModel returns the model with the given name, or the default one if the
+// name is empty, and the function releasing it when the request is done.
+func (s *Server) acquireModel(name string) (*verbaflow.VerbaFlow, func(), error) {
+	if name == "" {
+		if s.vf == nil {
+			return nil, nil, status.Errorf(codes.InvalidArgument, "the model is required: the server has no default model")
+		}
+		s.setBatcher(s.vf)
+		return s.vf, func() {}, nil
+	}
+	if s.registry == nil {
+		return nil, nil, status.Errorf(codes.NotFound, "model %q not found", name)
+	}
+	vf, release, err := s.registry.Acquire(name)
+	if errors.Is(err, ErrUnknownModel) {
+		return nil, nil, status.Errorf(codes.NotFound, "model %q not found", name)
+	}
+	if err != nil {
+		return nil, nil, status.Errorf(codes.Unavailable, "%v", err)
+	}
+	s.setBatcher(vf)
+	return vf, release, nil
+}
+
+// setBatcher sets the batcher of the model, if the continuous batching is
+// enabled and the model has none yet. The models reloaded by the registry
+// get a new one.
+func (s *Server) setBatcher(vf *verbaflow.VerbaFlow) {
+	if s.batchWindow <= 0 {
+		return
+	}
+	s.batchersMu.Lock()
+	defer s.batchersMu.Unlock()
+	if vf.Batcher == nil {
+		vf.Batcher = rwkvlm.NewBatcher(vf.Model, s.batchWindow, s.maxBatch)
+	}
+}
+
+// runTokenHook invokes the token hook, if any, converting its error to a
+// gRPC status.
+func (s *Server) runTokenHook(tokenID int, text string) error {
+	if s.tokenHook == nil {
+		return nil
+	}
+	err := s.tokenHook(tokenID, text)
+	if err == nil {
+		return nil
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	return status.Errorf(codes.Aborted, "generation aborted by the token hook at token ID %d: %v", tokenID, err)
+}
+
+// checkResumable returns an error if the generation is resumable, but the
+// server keeps no continuations.
+func (s *Server) checkResumable(dp *api.DecodingParameters) error {
+	if dp.GetResumable() && s.maxContinuations <= 0 {
+		return status.Errorf(codes.FailedPrecondition, "resumable generations are disabled on this server")
+	}
+	return nil
+}
+
+// sendLast sends the last message of the stream, if any: with the ID of the
+// continuation, which is saved, if it is not nil, and with the stats, if they
+// are requested.
+func (s *Server) sendLast(stream tokenStream, dp *api.DecodingParameters, cont *savedContinuation, stats *api.GenerationStats) error {
+	msg := &api.GeneratedToken{}
+	if cont != nil {
+		id, err := s.continuations.put(*cont)
+		if err != nil {
+			return err
+		}
+		msg.ContinuationId = id
+	}
+	if dp.GetReturnStats() {
+		msg.Stats = stats
+	}
+	if msg.ContinuationId == "" && msg.Stats == nil {
+		return nil
+	}
+	return stream.Send(msg)
+}
+
+// generationStats returns the stats of a generation started at the given
+// time.
+func generationStats(promptTokens, generatedTokens int, start time.Time) *api.GenerationStats {
+	elapsed := time.Since(start)
+	stats := &api.GenerationStats{
+		PromptTokens:    int32(promptTokens),
+		GeneratedTokens: int32(generatedTokens),
+		TotalTimeMs:     float32(elapsed.Seconds() * 1000),
+	}
+	if elapsed > 0 {
+		stats.TokensPerSecond = float32(float64(generatedTokens) / elapsed.Seconds())
+	}
+	return stats
+}
+
+// controlTokenSet returns the set of the IDs of the control tokens.
+func controlTokenSet(ids tokenizer.ControlTokensIDs) map[int]bool {
+	set := map[int]bool{
+		ids.EosTokenID:          true,
+		ids.BosTokenID:          true,
+		ids.PadTokenID:          true,
+		ids.DecoderStartTokenID: true,
+	}
+	for id := range ids.ExtraSpecialTokenIDs {
+		set[id] = true
+	}
+	return set
+}
 
-	log.Debug().Msg("Done.")
+// echoPrompt sends the tokens of the prompt, marked as such.
+// Their text is reconstructed like the one of the generated tokens, so a
+// token ending with an incomplete rune is sent with an empty text, and the
+// one completing it with the whole rune.
+func echoPrompt(vf *verbaflow.VerbaFlow, tokenized []int, chunks *chunker) error {
+	detokenizer := tokenizer.NewDetokenizer(vf.Tokenizer)
+	for i, id := range tokenized {
+		token, err := detokenizer.Add(id)
+		if err != nil {
+			return fmt.Errorf("failed to reconstruct text for token ID %d", id)
+		}
+		if i == len(tokenized)-1 {
+			rest, err := detokenizer.Flush()
+			if err != nil {
+				return fmt.Errorf("failed to reconstruct the text of the prompt: %w", err)
+			}
+			token += rest
+		}
+		if err := chunks.send(&api.GeneratedToken{Token: token, IsPrompt: true}); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func grpcToDecodingOptions(dp *api.DecodingParameters) decoder.DecodingOptions {
-	return decoder.DecodingOptions{
-		MaxLen:           int(dp.MaxLen),
-		MinLen:           int(dp.MinLen),
-		StopSequencesIDs: nil,
-		EndTokenID:       int(dp.EndTokenId),
-		SkipEndTokenID:   dp.SkipEndTokenId,
-		Temp:             float64(dp.Temperature),
-		TopK:             int(dp.TopK),
-		TopP:             float64(dp.TopP),
-		UseSampling:      dp.UseSampling,
+func generatedTokenToGRPC(token string, gen decoder.GeneratedToken) *api.GeneratedToken {
+	return &api.GeneratedToken{
+		Token:             token,
+		Score:             float32(gen.SumNegLogProbs),
+		CumulativeLogprob: float32(-gen.SumNegLogProbs),
+		TokenProb:         float32(gen.TokenProb),
+	}
+}
+
+func grpcToStopSequences(sequences []*api.Sequence) ([]decoder.StopSequence, error) {
+	if len(sequences) == 0 {
+		return nil, nil
 	}
+	out := make([]decoder.StopSequence, len(sequences))
+	for i, seq := range sequences {
+		if len(seq.GetSequence()) == 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid stop sequence %d: it is empty", i)
+		}
+		ids := make([]int, len(seq.GetSequence()))
+		for j, id := range seq.GetSequence() {
+			ids[j] = int(id)
+		}
+		out[i] = decoder.StopSequence{IDs: ids, Action: decoder.StopAction(seq.GetAction())}
+	}
+	return out, nil
+}
+
+func grpcToDecodingOptions(dp *api.DecodingParameters) (decoder.DecodingOptions, error) {
+	stops, err := grpcToStopSequences(dp.StopSequences)
+	if err != nil {
+		return decoder.DecodingOptions{}, err
+	}
+	return decoder.DecodingOptions{
+		MaxLen:              int(dp.MaxLen),
+		MinLen:              int(dp.MinLen),
+		StopSequences:       stops,
+		EndTokenID:          int(dp.EndTokenId),
+		SkipEndTokenID:      dp.SkipEndTokenId,
+		ForceJSON:           dp.ForceJson,
+		FilterSpecialTokens: dp.FilterSpecialTokens,
+		MaxChars:            int(dp.MaxChars),
+		MinTopProb:          float64(dp.MinTopProb),
+		Temp:                float64(dp.Temperature),
+		TopK:                int(dp.TopK),
+		TopP:                float64(dp.TopP),
+		TypicalP:            float64(dp.TypicalP),
+		Epsilon:             float64(dp.Epsilon),
+		Eta:                 float64(dp.Eta),
+		UseSampling:         dp.UseSampling,
+		AddBOS:              dp.AddBos,
+		EchoPrompt:          dp.EchoPrompt,
+		TrimWhitespace:      dp.TrimWhitespace,
+		CollapseNewlines:    dp.CollapseNewlines,
+		ForcedPrefix:        dp.ForcedPrefix,
+		LogitClamp:          float64(dp.LogitClamp),
+		MaxTokensPerSecond:  float64(dp.MaxTokensPerSecond),
+		JSONSchema:          dp.JsonSchema,
+		JSONSchemaRetries:   int(dp.JsonSchemaRetries),
+	}, nil
 }
@@ -0,0 +1,884 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nlpodyssey/spago/ag"
+	"github.com/nlpodyssey/spago/mat/float"
+	"github.com/nlpodyssey/verbaflow"
+	"github.com/nlpodyssey/verbaflow/api"
+	"github.com/nlpodyssey/verbaflow/decoder"
+	"github.com/nlpodyssey/verbaflow/rwkvlm/rwkvlmtest"
+	"github.com/nlpodyssey/verbaflow/tokenizer"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestGeneratedTokenToGRPC(t *testing.T) {
+	steps := []decoder.GeneratedToken{
+		{TokenID: 1, SumNegLogProbs: 0.5, TokenProb: 0.6},
+		{TokenID: 2, SumNegLogProbs: 0.5, TokenProb: 1},
+		{TokenID: 3, SumNegLogProbs: 2.5, TokenProb: 0.1},
+	}
+	prev := float32(0)
+	for _, gen := range steps {
+		out := generatedTokenToGRPC("x", gen)
+		assert.Equal(t, "x", out.Token)
+		assert.Equal(t, float32(gen.TokenProb), out.TokenProb)
+		assert.Greater(t, out.TokenProb, float32(0))
+		assert.LessOrEqual(t, out.TokenProb, float32(1))
+		assert.Equal(t, -out.Score, out.CumulativeLogprob)
+		assert.LessOrEqual(t, out.CumulativeLogprob, prev)
+		prev = out.CumulativeLogprob
+	}
+}
+
+func TestServer_GenerateTokens_EchoPrompt(t *testing.T) {
+	s := newTestServer(t)
+
+	req := &api.TokenGenerationRequest{
+		Prompt: "unrelated",
+		DecodingParameters: &api.DecodingParameters{
+			MaxLen:      3,
+			Temperature: 1,
+			TopP:        1,
+			EndTokenId:  -1,
+			AddBos:      true,
+			EchoPrompt:  true,
+		},
+	}
+	stream := &recordingStream{ctx: context.Background()}
+	require.NoError(t, s.GenerateTokens(req, stream))
+
+	// the prompt is made of two tokens, the beginning-of-sequence one is not echoed
+	require.Len(t, stream.sent, 2+3)
+	var prompt string
+	for _, tok := range stream.sent[:2] {
+		assert.True(t, tok.IsPrompt)
+		prompt += tok.Token
+	}
+	assert.Equal(t, "unrelated", prompt)
+	for _, tok := range stream.sent[2:] {
+		assert.False(t, tok.IsPrompt)
+		assert.Greater(t, tok.TokenProb, float32(0))
+	}
+
+	req.DecodingParameters.EchoPrompt = false
+	stream = &recordingStream{ctx: context.Background()}
+	require.NoError(t, s.GenerateTokens(req, stream))
+	require.Len(t, stream.sent, 3)
+	assert.False(t, stream.sent[0].IsPrompt)
+}
+
+func TestServer_GenerateTokens_Chunking(t *testing.T) {
+	s := newTestServer(t)
+
+	req := &api.TokenGenerationRequest{
+		Prompt: "unrelated",
+		DecodingParameters: &api.DecodingParameters{
+			MaxLen:      20,
+			Temperature: 1,
+			TopP:        1,
+			EndTokenId:  -1,
+			ChunkSize:   5,
+		},
+	}
+	stream := &recordingStream{ctx: context.Background()}
+	require.NoError(t, s.GenerateTokens(req, stream))
+
+	require.Len(t, stream.sent, 20/5)
+	for _, msg := range stream.sent {
+		assert.Empty(t, msg.Token)
+		require.Len(t, msg.Chunk, 5)
+		for _, tok := range msg.Chunk {
+			assert.Greater(t, tok.TokenProb, float32(0))
+		}
+	}
+
+	// a partial chunk is flushed at the end of the generation
+	req.DecodingParameters.ChunkSize = 8
+	stream = &recordingStream{ctx: context.Background()}
+	require.NoError(t, s.GenerateTokens(req, stream))
+	require.Len(t, stream.sent, 3)
+	assert.Len(t, stream.sent[2].Chunk, 4)
+
+	req.DecodingParameters.ChunkSize = -1
+	err := s.GenerateTokens(req, &recordingStream{ctx: context.Background()})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+// recordingStream is a LanguageModel_GenerateTokensServer which records the
+// sent tokens.
+type recordingStream struct {
+	grpc.ServerStream
+	ctx  context.Context
+	sent []*api.GeneratedToken
+}
+
+func (s *recordingStream) Send(tok *api.GeneratedToken) error {
+	s.sent = append(s.sent, tok)
+	return nil
+}
+
+func (s *recordingStream) Context() context.Context {
+	return s.ctx
+}
+
+// newTestVerbaFlow returns a VerbaFlow with the tokenizer of the tiny model
+// and a random model initialized with the seed.
+func newTestVerbaFlow(t *testing.T, seed int64) *verbaflow.VerbaFlow {
+	t.Helper()
+	tk, err := tokenizer.Load("../testdata/tiny-model")
+	require.NoError(t, err)
+	return &verbaflow.VerbaFlow{
+		Model:     rwkvlmtest.NewModel(rwkvlmtest.DefaultConfig, seed),
+		Tokenizer: tk,
+	}
+}
+
+// newTestServer returns a Server of the model of newTestVerbaFlow, with the
+// given options.
+func newTestServer(t *testing.T, opts ...ServerOption) *Server {
+	t.Helper()
+	return NewServer(newTestVerbaFlow(t, 1), opts...)
+}
+
+func TestServer_GenerateTokens_MaxPromptTokens(t *testing.T) {
+	vf := newTestVerbaFlow(t, 1)
+	req := &api.TokenGenerationRequest{
+		Prompt: "unrelated unrelated",
+		DecodingParameters: &api.DecodingParameters{
+			MaxLen:      1,
+			Temperature: 1,
+			TopP:        1,
+			EndTokenId:  -1,
+		},
+	}
+
+	stream := &recordingStream{ctx: context.Background()}
+	err := NewServer(vf, WithMaxPromptTokens(3)).GenerateTokens(req, stream)
+	require.Error(t, err)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.Contains(t, err.Error(), "the prompt has 4 tokens, but at most 3 are allowed")
+	assert.Empty(t, stream.sent)
+
+	stream = &recordingStream{ctx: context.Background()}
+	require.NoError(t, NewServer(vf, WithMaxPromptTokens(4)).GenerateTokens(req, stream))
+	assert.Len(t, stream.sent, 1)
+}
+
+func TestServer_GenerateTokens_TokenHook(t *testing.T) {
+	vf := newTestVerbaFlow(t, 1)
+	req := &api.TokenGenerationRequest{
+		Prompt: "unrelated",
+		DecodingParameters: &api.DecodingParameters{
+			MaxLen:      5,
+			Temperature: 1,
+			TopP:        1,
+			EndTokenId:  -1,
+		},
+	}
+	banned, err := vf.TokenByID(13)
+	require.NoError(t, err)
+
+	var seen []int
+	hook := func(tokenID int, text string) error {
+		seen = append(seen, tokenID)
+		if text == banned {
+			return fmt.Errorf("banned token %q", text)
+		}
+		return nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream := &recordingStream{ctx: ctx}
+	err = NewServer(vf, WithTokenHook(hook)).GenerateTokens(req, stream)
+	require.Error(t, err)
+	assert.Equal(t, codes.Aborted, status.Code(err))
+	assert.Contains(t, err.Error(), "generation aborted by the token hook at token ID 13")
+	assert.Equal(t, []int{2, 13}, seen)
+	require.Len(t, stream.sent, 1, "the banned token must not be sent")
+
+	// a status error is returned as it is
+	hook = func(tokenID int, text string) error {
+		return status.Error(codes.PermissionDenied, "denied")
+	}
+	err = NewServer(vf, WithTokenHook(hook)).GenerateTokens(req, &recordingStream{ctx: ctx})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func TestServer_GenerateTokens_SystemPrompt(t *testing.T) {
+	vf := newTestVerbaFlow(t, 1)
+	s := NewServer(vf, WithSystemPrompt("{{if .Text}}related {{end}}"), WithMaxPromptTokens(3))
+	newRequest := func() *api.TokenGenerationRequest {
+		return &api.TokenGenerationRequest{
+			Prompt: "unrelated",
+			DecodingParameters: &api.DecodingParameters{
+				MaxLen:      1,
+				Temperature: 1,
+				TopP:        1,
+				EndTokenId:  -1,
+				AddBos:      true,
+				EchoPrompt:  true,
+			},
+		}
+	}
+
+	system, err := s.renderSystemPrompt(newRequest())
+	require.NoError(t, err)
+	assert.Equal(t, "related ", system)
+	systemTokens, err := vf.TokenizePrompt(system, true)
+	require.NoError(t, err)
+	userTokens, err := vf.TokenizePrompt("unrelated", false)
+	require.NoError(t, err)
+	expected := append(systemTokens, userTokens...)
+
+	// the system prompt tokens are counted, but not echoed
+	stream := &recordingStream{ctx: context.Background()}
+	err = s.GenerateTokens(newRequest(), stream)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.Contains(t, err.Error(), fmt.Sprintf("the prompt has %d tokens", len(expected)))
+
+	s.maxPromptTokens = 0
+	stream = &recordingStream{ctx: context.Background()}
+	require.NoError(t, s.GenerateTokens(newRequest(), stream))
+	require.Len(t, stream.sent, len(userTokens)+1)
+	assert.Equal(t, "unrelated", stream.sent[0].Token+stream.sent[1].Token)
+
+	// the system prompt tokens are encoded ahead of the user prompt
+	nt := &ag.NodesTracker{}
+	defer nt.ReleaseNodes()
+	opts := decoder.DecodingOptions{MaxLen: 1, EndTokenID: -1, Temp: 1, TopP: 1}
+	chGen := make(chan decoder.GeneratedToken, 1)
+	require.NoError(t, vf.GenerateFromTokens(context.Background(), nt, expected, chGen, opts))
+	assert.Equal(t, float32((<-chGen).TokenProb), stream.sent[2].TokenProb)
+
+	// a request can replace or disable the system prompt
+	req := newRequest()
+	req.SystemPrompt = proto.String("")
+	system, err = s.renderSystemPrompt(req)
+	require.NoError(t, err)
+	assert.Empty(t, system)
+	req.SystemPrompt = proto.String("{{upper .Text}}: ")
+	system, err = s.renderSystemPrompt(req)
+	require.NoError(t, err)
+	assert.Equal(t, "UNRELATED: ", system)
+	req.SystemPrompt = proto.String("{{.Text")
+	_, err = s.renderSystemPrompt(req)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// an invalid system prompt of the server makes Start fail
+	s = NewServer(vf, WithSystemPrompt("{{.Unknown"))
+	err = s.Start(context.Background(), "127.0.0.1:0")
+	assert.ErrorContains(t, err, "invalid system prompt")
+}
+
+func TestServer_StartupValidation(t *testing.T) {
+	servingStatus := func(s *Server) grpc_health_v1.HealthCheckResponse_ServingStatus {
+		res, err := s.health.Check(context.Background(), &grpc_health_v1.HealthCheckRequest{
+			Service: api.LanguageModel_ServiceDesc.ServiceName,
+		})
+		require.NoError(t, err)
+		return res.Status
+	}
+
+	s := newTestServer(t, WithStartupValidation())
+	s.setInitialServingStatus(context.Background())
+	assert.Equal(t, grpc_health_v1.HealthCheckResponse_SERVING, servingStatus(s))
+
+	broken := newTestVerbaFlow(t, 1)
+	broken.Model.Linear.Value().SetScalar(3, 0, float.Interface(math.NaN()))
+	s = NewServer(broken, WithStartupValidation())
+	s.setInitialServingStatus(context.Background())
+	assert.Equal(t, grpc_health_v1.HealthCheckResponse_NOT_SERVING, servingStatus(s))
+
+	// without validation, the broken model is reported as serving
+	s = NewServer(broken)
+	s.setInitialServingStatus(context.Background())
+	assert.Equal(t, grpc_health_v1.HealthCheckResponse_SERVING, servingStatus(s))
+}
+
+func TestServer_GenerateTokens_LogLevel(t *testing.T) {
+	var logs bytes.Buffer
+	defer func(l zerolog.Logger) { log.Logger = l }(log.Logger)
+	log.Logger = zerolog.New(&logs).Level(zerolog.InfoLevel)
+
+	s := newTestServer(t)
+	req := &api.TokenGenerationRequest{
+		Prompt: "unrelated",
+		DecodingParameters: &api.DecodingParameters{
+			MaxLen:      2,
+			Temperature: 1,
+			TopP:        1,
+			EndTokenId:  -1,
+		},
+	}
+
+	require.NoError(t, s.GenerateTokens(req, &recordingStream{ctx: context.Background()}))
+	assert.Empty(t, logs.String())
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(LogLevelMetadataKey, "trace"))
+	require.NoError(t, s.GenerateTokens(req, &recordingStream{ctx: ctx}))
+	assert.Contains(t, logs.String(), "Reached max length (2)")
+	assert.Contains(t, logs.String(), "Generated token IDs")
+
+	// the level of the other requests is unchanged
+	logs.Reset()
+	require.NoError(t, s.GenerateTokens(req, &recordingStream{ctx: context.Background()}))
+	assert.Empty(t, logs.String())
+
+	ctx = metadata.NewIncomingContext(context.Background(), metadata.Pairs(LogLevelMetadataKey, "verbose"))
+	err := s.GenerateTokens(req, &recordingStream{ctx: ctx})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestServer_GenerateTokens_ClientID(t *testing.T) {
+	var logs bytes.Buffer
+	defer func(l zerolog.Logger) { log.Logger = l }(log.Logger)
+	log.Logger = zerolog.New(&logs).Level(zerolog.DebugLevel)
+
+	s := newTestServer(t)
+	req := &api.TokenGenerationRequest{
+		Prompt: "unrelated",
+		DecodingParameters: &api.DecodingParameters{
+			MaxLen:      1,
+			Temperature: 1,
+			TopP:        1,
+			EndTokenId:  -1,
+		},
+	}
+	generate := func(ctx context.Context) {
+		err := clientIDStreamInterceptor(s, &recordingStream{ctx: ctx}, &grpc.StreamServerInfo{}, func(_ any, ss grpc.ServerStream) error {
+			id, ok := ClientIDFromContext(ss.Context())
+			assert.Equal(t, ok, id != "")
+			return s.GenerateTokens(req, &recordingStream{ctx: ss.Context()})
+		})
+		require.NoError(t, err)
+	}
+
+	generate(metadata.NewIncomingContext(context.Background(), metadata.Pairs(ClientIDMetadataKey, "client-42")))
+	assert.Contains(t, logs.String(), `"client_id":"client-42"`)
+	assert.Contains(t, logs.String(), "Received request")
+
+	logs.Reset()
+	generate(context.Background())
+	assert.Contains(t, logs.String(), "Received request")
+	assert.NotContains(t, logs.String(), "client_id")
+}
+
+func TestServer_GenerateContinue(t *testing.T) {
+	s := NewServer(newTestVerbaFlow(t, 2))
+	dp := &api.DecodingParameters{
+		MaxLen:      6,
+		Temperature: 1,
+		TopP:        1,
+		EndTokenId:  -1,
+		AddBos:      true,
+	}
+	stream := &recordingStream{ctx: context.Background()}
+	require.NoError(t, s.GenerateTokens(&api.TokenGenerationRequest{Prompt: "unrelated", DecodingParameters: dp}, stream))
+	expected := sentTokens(stream.sent)
+	require.Len(t, expected, 6)
+
+	resumable := proto.Clone(dp).(*api.DecodingParameters)
+	resumable.MaxLen, resumable.Resumable = 2, true
+	stream = &recordingStream{ctx: context.Background()}
+	require.NoError(t, s.GenerateTokens(&api.TokenGenerationRequest{Prompt: "unrelated", DecodingParameters: resumable}, stream))
+	require.Len(t, stream.sent, 2+1)
+	last := stream.sent[2]
+	require.NotEmpty(t, last.ContinuationId)
+	assert.Empty(t, last.Token)
+	actual := sentTokens(stream.sent[:2])
+
+	// a resumable continuation returns a new ID
+	stream = &recordingStream{ctx: context.Background()}
+	req := &api.ContinuationRequest{ContinuationId: last.ContinuationId, AdditionalLen: 3, DecodingParameters: resumable}
+	require.NoError(t, s.GenerateContinue(req, stream))
+	require.Len(t, stream.sent, 3+1)
+	actual = append(actual, sentTokens(stream.sent[:3])...)
+	next := stream.sent[3].ContinuationId
+	assert.NotEqual(t, last.ContinuationId, next)
+
+	// a continuation can be used only once
+	err := s.GenerateContinue(req, &recordingStream{ctx: context.Background()})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	stream = &recordingStream{ctx: context.Background()}
+	req = &api.ContinuationRequest{ContinuationId: next, AdditionalLen: 1, DecodingParameters: dp}
+	require.NoError(t, s.GenerateContinue(req, stream))
+	require.Len(t, stream.sent, 1)
+	actual = append(actual, sentTokens(stream.sent)...)
+	assert.Equal(t, expected, actual)
+
+	s = NewServer(s.vf, WithMaxContinuations(0))
+	err = s.GenerateTokens(&api.TokenGenerationRequest{Prompt: "unrelated", DecodingParameters: resumable}, &recordingStream{ctx: context.Background()})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
+
+// sentTokens returns the text of the tokens of the messages.
+func sentTokens(msgs []*api.GeneratedToken) []string {
+	var out []string
+	for _, msg := range msgs {
+		out = append(out, msg.Token)
+	}
+	return out
+}
+
+func TestServer_GenerateTokens_ReturnStats(t *testing.T) {
+	s := newTestServer(t)
+	req := &api.TokenGenerationRequest{
+		Prompt: "unrelated",
+		DecodingParameters: &api.DecodingParameters{
+			MaxLen:      4,
+			Temperature: 1,
+			TopP:        1,
+			EndTokenId:  -1,
+			AddBos:      true,
+			EchoPrompt:  true,
+			ReturnStats: true,
+		},
+	}
+
+	stream := &recordingStream{ctx: context.Background()}
+	require.NoError(t, s.GenerateTokens(req, stream))
+	require.NotEmpty(t, stream.sent)
+	last := stream.sent[len(stream.sent)-1]
+	stats := last.GetStats()
+	require.NotNil(t, stats)
+	assert.Empty(t, last.GetToken())
+	generated := 0
+	for _, msg := range stream.sent[:len(stream.sent)-1] {
+		assert.Nil(t, msg.GetStats())
+		if !msg.GetIsPrompt() {
+			generated++
+		}
+	}
+	assert.Equal(t, 4, generated)
+	assert.Equal(t, int32(generated), stats.GetGeneratedTokens())
+	// the beginning-of-sequence token and the two of the prompt
+	assert.Equal(t, int32(3), stats.GetPromptTokens())
+	assert.Greater(t, stats.GetTotalTimeMs(), float32(0))
+	assert.Greater(t, stats.GetTokensPerSecond(), float32(0))
+
+	// the tokens of the chunks are counted, and the continuation is in the
+	// same message
+	req.DecodingParameters.EchoPrompt = false
+	req.DecodingParameters.ChunkSize = 3
+	req.DecodingParameters.Resumable = true
+	stream = &recordingStream{ctx: context.Background()}
+	require.NoError(t, s.GenerateTokens(req, stream))
+	require.Len(t, stream.sent, 3)
+	last = stream.sent[2]
+	assert.NotEmpty(t, last.GetContinuationId())
+	assert.Equal(t, int32(4), last.GetStats().GetGeneratedTokens())
+
+	req.DecodingParameters.ReturnStats = false
+	stream = &recordingStream{ctx: context.Background()}
+	require.NoError(t, s.GenerateTokens(req, stream))
+	for _, msg := range stream.sent {
+		assert.Nil(t, msg.GetStats())
+	}
+}
+
+func TestServer_GenerateTokens_StopSequences(t *testing.T) {
+	s := newTestServer(t)
+	newRequest := func(stops ...*api.Sequence) *api.TokenGenerationRequest {
+		return &api.TokenGenerationRequest{
+			Prompt: "unrelated",
+			DecodingParameters: &api.DecodingParameters{
+				MaxLen:        6,
+				Temperature:   1,
+				TopP:          1,
+				EndTokenId:    -1,
+				StopSequences: stops,
+			},
+		}
+	}
+	generate := func(req *api.TokenGenerationRequest) []string {
+		stream := &recordingStream{ctx: context.Background()}
+		require.NoError(t, s.GenerateTokens(req, stream))
+		var tokens []string
+		for _, tok := range stream.sent {
+			tokens = append(tokens, tok.GetToken())
+		}
+		return tokens
+	}
+
+	// the greedy output, and the first two tokens of it, as stop sequence
+	out := generate(newRequest())
+	require.Len(t, out, 6)
+	ids, err := s.vf.Tokenizer.Tokenize(out[0] + out[1])
+	require.NoError(t, err)
+	stop := make([]int32, len(ids))
+	for i, id := range ids {
+		stop[i] = int32(id)
+	}
+
+	kept := generate(newRequest(&api.Sequence{Sequence: stop, Action: string(decoder.StopKeep)}))
+	assert.Equal(t, out[:2], kept)
+	trimmed := generate(newRequest(&api.Sequence{Sequence: stop, Action: string(decoder.StopTrim)}))
+	assert.Empty(t, strings.Join(trimmed, ""))
+}
+
+func TestServer_GenerateTokens_InvalidParameters(t *testing.T) {
+	s := newTestServer(t, WithSessions(time.Minute))
+
+	// the generation fails before decoding, and the error comes back
+	// promptly, with or without a session
+	for _, dp := range []*api.DecodingParameters{
+		{MaxLen: 3, Temperature: 2, TopP: 1},
+		{MaxLen: 3, Temperature: 1, TopP: 2},
+		{MaxLen: 3, Temperature: 1, TopP: 1, MinTopProb: 2},
+		{MaxLen: 3, Temperature: 1, TopP: 1, StopSequences: []*api.Sequence{{Sequence: []int32{1}, Action: "bogus"}}},
+		{MaxLen: 3, Temperature: 1, TopP: 1, StopSequences: []*api.Sequence{{Sequence: []int32{1}}, {}}},
+	} {
+		for _, session := range []bool{false, true} {
+			req := &api.TokenGenerationRequest{Prompt: "unrelated", Session: session, DecodingParameters: dp}
+			errs := make(chan error, 1)
+			go func() {
+				errs <- s.GenerateTokens(req, &recordingStream{ctx: context.Background()})
+			}()
+			select {
+			case err := <-errs:
+				assert.Error(t, err, "%v, session %t", dp, session)
+			case <-time.After(5 * time.Second):
+				t.Fatalf("the generation with %v, session %t, didn't return", dp, session)
+			}
+		}
+	}
+}
+
+func TestServer_GenerateTokens_InvalidDecodingOptions(t *testing.T) {
+	s := newTestServer(t)
+
+	for _, dp := range []*api.DecodingParameters{
+		{MaxLen: 3, Temperature: 1, TopP: 1, MinTopProb: 2},
+		{MaxLen: 3, Temperature: 1, TopP: 1, StopSequences: []*api.Sequence{{Sequence: []int32{1}, Action: "bogus"}}},
+	} {
+		stream := &recordingStream{ctx: context.Background()}
+		err := s.GenerateTokens(&api.TokenGenerationRequest{Prompt: "unrelated", DecodingParameters: dp}, stream)
+		assert.Equal(t, codes.InvalidArgument, status.Code(err), "%v", dp)
+		// nothing is streamed
+		assert.Empty(t, stream.sent)
+	}
+}
+
+func TestServer_GenerateTokens_MaxTokensPerSecond(t *testing.T) {
+	s := newTestServer(t)
+	newRequest := func(maxLen int, rate float32) *api.TokenGenerationRequest {
+		return &api.TokenGenerationRequest{
+			Prompt: "unrelated",
+			DecodingParameters: &api.DecodingParameters{
+				MaxLen:             int32(maxLen),
+				Temperature:        1,
+				TopP:               1,
+				EndTokenId:         -1,
+				MaxTokensPerSecond: rate,
+			},
+		}
+	}
+
+	const n, rate = 10, 50
+	stream := &recordingStream{ctx: context.Background()}
+	start := time.Now()
+	require.NoError(t, s.GenerateTokens(newRequest(n, rate), stream))
+	assert.Len(t, stream.sent, n)
+	assert.GreaterOrEqual(t, time.Since(start), time.Duration(0.9*n/rate*float64(time.Second)))
+
+	// the cancellation stops the wait immediately
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start = time.Now()
+	err := s.GenerateTokens(newRequest(n, 0.5), &recordingStream{ctx: ctx})
+	assert.Equal(t, codes.Canceled, status.Code(err))
+	assert.Less(t, time.Since(start), time.Second)
+
+	err = s.GenerateTokens(newRequest(n, -1), &recordingStream{ctx: context.Background()})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestServer_GenerateTokens_ContinuousBatching(t *testing.T) {
+	vf := newTestVerbaFlow(t, 1)
+	newRequest := func(prompt string) *api.TokenGenerationRequest {
+		return &api.TokenGenerationRequest{
+			Prompt: prompt,
+			DecodingParameters: &api.DecodingParameters{
+				MaxLen:      5,
+				Temperature: 1,
+				TopP:        1,
+				EndTokenId:  -1,
+			},
+		}
+	}
+	generate := func(s *Server, prompt string) ([]string, error) {
+		stream := &recordingStream{ctx: context.Background()}
+		err := s.GenerateTokens(newRequest(prompt), stream)
+		tokens := make([]string, len(stream.sent))
+		for i, tok := range stream.sent {
+			tokens[i] = tok.Token
+		}
+		return tokens, err
+	}
+
+	prompts := []string{"unrelated", "related", "other"}
+	// the same model, without the batcher set by the batching server
+	serial := NewServer(&verbaflow.VerbaFlow{Model: vf.Model, Tokenizer: vf.Tokenizer})
+	expected := make([][]string, len(prompts))
+	for i, prompt := range prompts {
+		var err error
+		expected[i], err = generate(serial, prompt)
+		require.NoError(t, err)
+	}
+
+	s := NewServer(vf, WithContinuousBatching(10*time.Millisecond, 2))
+	actual := make([][]string, len(prompts))
+	errs := make([]error, len(prompts))
+	done := make(chan struct{})
+	for i, prompt := range prompts {
+		go func(i int, prompt string) {
+			actual[i], errs[i] = generate(s, prompt)
+			done <- struct{}{}
+		}(i, prompt)
+	}
+	for range prompts {
+		<-done
+	}
+	require.NotNil(t, vf.Batcher)
+	for i := range prompts {
+		require.NoError(t, errs[i])
+		assert.Equal(t, expected[i], actual[i], prompts[i])
+	}
+}
+
+func TestServer_WithGenerationTimeout(t *testing.T) {
+	vf := newTestVerbaFlow(t, 1)
+	s := NewServer(vf, WithGenerationTimeout(50*time.Millisecond))
+
+	// the generation sends a token, and then never finishes on its own
+	stuck := func(ctx context.Context, chGen chan decoder.GeneratedToken) error {
+		defer close(chGen)
+		chGen <- decoder.GeneratedToken{TokenID: 11}
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	stream := &recordingStream{ctx: context.Background()}
+	chunks, err := newChunker(stream, &api.DecodingParameters{})
+	require.NoError(t, err)
+	opts := decoder.DecodingOptions{EndTokenID: -1}
+	streamStuck := func(ctx context.Context) error {
+		return s.streamTokens(ctx, vf, opts, chunks, nil, stuck)
+	}
+	start := time.Now()
+	err = s.withGenerationTimeout(context.Background(), streamStuck)
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Len(t, stream.sent, 1)
+
+	// the cancellation by the client is not reported as a timeout
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = s.withGenerationTimeout(ctx, streamStuck)
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+// disconnectingStream is a recordingStream which fails after limit messages,
+// like the stream of a client whose connection drops.
+type disconnectingStream struct {
+	recordingStream
+	limit int
+}
+
+func (s *disconnectingStream) Send(tok *api.GeneratedToken) error {
+	if len(s.sent) >= s.limit {
+		return status.Error(codes.Unavailable, "connection lost")
+	}
+	return s.recordingStream.Send(tok)
+}
+
+func TestServer_ResumeSession(t *testing.T) {
+	s := newTestServer(t, WithSessions(time.Minute))
+	newRequest := func(session bool) *api.TokenGenerationRequest {
+		return &api.TokenGenerationRequest{
+			Prompt:  "unrelated",
+			Session: session,
+			DecodingParameters: &api.DecodingParameters{
+				MaxLen:      8,
+				Temperature: 1,
+				TopP:        1,
+				EndTokenId:  -1,
+			},
+		}
+	}
+
+	expected := &recordingStream{ctx: context.Background()}
+	require.NoError(t, s.GenerateTokens(newRequest(false), expected))
+
+	// the stream drops after the session ID and two tokens
+	first := &disconnectingStream{recordingStream: recordingStream{ctx: context.Background()}, limit: 3}
+	err := s.GenerateTokens(newRequest(true), first)
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	require.Len(t, first.sent, 3)
+	id := first.sent[0].GetSessionId()
+	require.NotEmpty(t, id)
+
+	resumed := &recordingStream{ctx: context.Background()}
+	require.NoError(t, s.ResumeSession(&api.SessionRequest{SessionId: id, Offset: 2}, resumed))
+	actual := append(first.sent[1:], resumed.sent...)
+	assert.True(t, proto.Equal(&api.GeneratedToken{Chunk: expected.sent}, &api.GeneratedToken{Chunk: actual}))
+
+	// the session expires after the TTL since the end of the generation
+	s.sessions.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	err = s.ResumeSession(&api.SessionRequest{SessionId: id}, &recordingStream{ctx: context.Background()})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestServer_ResumeSession_Expired(t *testing.T) {
+	s := newTestServer(t, WithSessions(time.Minute))
+	req := &api.TokenGenerationRequest{
+		Prompt:  "unrelated",
+		Session: true,
+		DecodingParameters: &api.DecodingParameters{
+			MaxLen:      1 << 20,
+			Temperature: 1,
+			TopP:        1,
+			EndTokenId:  -1,
+		},
+	}
+
+	// the client leaves after the session ID and a token
+	stream := &disconnectingStream{recordingStream: recordingStream{ctx: context.Background()}, limit: 2}
+	err := s.GenerateTokens(req, stream)
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	id := stream.sent[0].GetSessionId()
+	sess, ok := s.sessions.get(id)
+	require.True(t, ok)
+
+	// nobody follows the session for longer than the TTL, so its
+	// generation is cancelled
+	s.sessions.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	_, ok = s.sessions.get(id)
+	assert.False(t, ok)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = sess.follow(ctx, &recordingStream{ctx: ctx}, 0)
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+// bytesTokenizer reconstructs the text concatenating the bytes of the
+// tokens, which can split the runes.
+type bytesTokenizer struct {
+	tokenizer.Tokenizer
+	vocabulary []string
+}
+
+func (t bytesTokenizer) ReconstructText(ids []int) (string, error) {
+	var sb strings.Builder
+	for _, id := range ids {
+		sb.WriteString(t.vocabulary[id])
+	}
+	return sb.String(), nil
+}
+
+func TestServer_StreamTokens_HeldBackText(t *testing.T) {
+	// "è" is "\xc3\xa8", split between two tokens
+	tk := bytesTokenizer{vocabulary: []string{"perch", "\xc3", "\xa8", " no", "\xe2"}}
+	vf := &verbaflow.VerbaFlow{Tokenizer: tk}
+	s := NewServer(vf)
+	ids := []int{0, 1, 2, 3, 4}
+	batch, err := tk.ReconstructText(ids)
+	require.NoError(t, err)
+
+	for _, maxChars := range []int{0, 100} {
+		var generated []decoder.GeneratedToken
+		for _, id := range ids {
+			generated = append(generated, decoder.GeneratedToken{TokenID: id})
+		}
+		if maxChars > 0 {
+			// the decoder sets the text, holding back the incomplete runes
+			for i, text := range []string{"perch", "", "è", " no", "\xe2"} {
+				generated[i].Text = text
+			}
+		}
+
+		stream := &recordingStream{ctx: context.Background()}
+		chunks, err := newChunker(stream, &api.DecodingParameters{})
+		require.NoError(t, err)
+		opts := decoder.DecodingOptions{EndTokenID: -1, MaxChars: maxChars}
+		err = s.streamTokens(context.Background(), vf, opts, chunks, nil, func(ctx context.Context, chGen chan decoder.GeneratedToken) error {
+			return replayTokens(ctx, generated, chGen)
+		})
+		require.NoError(t, err)
+
+		// the token with the first byte of "è" is held back, and sent with an
+		// empty text, while the incomplete rune at the end is flushed as is
+		require.Len(t, stream.sent, len(ids))
+		var texts []string
+		for _, tok := range stream.sent {
+			texts = append(texts, tok.GetToken())
+		}
+		assert.Equal(t, []string{"perch", "", "è", " no", "\xe2"}, texts, "MaxChars %d", maxChars)
+		assert.Equal(t, batch, strings.Join(texts, ""))
+	}
+}
+
+func TestEchoPrompt_SplitRune(t *testing.T) {
+	tk := bytesTokenizer{vocabulary: []string{"perch", "\xc3", "\xa8", " no", "\xe2"}}
+	stream := &recordingStream{ctx: context.Background()}
+	chunks, err := newChunker(stream, &api.DecodingParameters{})
+	require.NoError(t, err)
+	require.NoError(t, echoPrompt(&verbaflow.VerbaFlow{Tokenizer: tk}, []int{0, 1, 2, 3, 4}, chunks))
+
+	var texts []string
+	for _, tok := range stream.sent {
+		assert.True(t, tok.IsPrompt)
+		texts = append(texts, tok.GetToken())
+	}
+	assert.Equal(t, []string{"perch", "", "è", " no", "\xe2"}, texts)
+}
+
+func TestServer_StreamTokens_FilterSpecialTokens(t *testing.T) {
+	vf := newTestVerbaFlow(t, 1)
+	s := NewServer(vf)
+	special := vf.Tokenizer.ControlTokens().BosTokenID
+	var generated []decoder.GeneratedToken
+	for _, id := range []int{special, 11, special, 14} {
+		generated = append(generated, decoder.GeneratedToken{TokenID: id})
+	}
+	stream := func(filter bool) []string {
+		stream := &recordingStream{ctx: context.Background()}
+		chunks, err := newChunker(stream, &api.DecodingParameters{})
+		require.NoError(t, err)
+		opts, err := grpcToDecodingOptions(&api.DecodingParameters{EndTokenId: -1, FilterSpecialTokens: filter})
+		require.NoError(t, err)
+		err = s.streamTokens(context.Background(), vf, opts, chunks, nil, func(ctx context.Context, chGen chan decoder.GeneratedToken) error {
+			return replayTokens(ctx, generated, chGen)
+		})
+		require.NoError(t, err)
+		var texts []string
+		for _, tok := range stream.sent {
+			texts = append(texts, tok.GetToken())
+		}
+		return texts
+	}
+
+	assert.Len(t, stream(false), len(generated))
+	assert.Equal(t, "unrelated", strings.Join(stream(true), ""))
+}
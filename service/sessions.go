@@ -0,0 +1,184 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/nlpodyssey/verbaflow/api"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// sessionStore keeps the sessions, whose generations survive the
+// interruption of the streams of their clients, by ID. A session is
+// discarded when nobody has followed it for longer than the TTL, and its
+// generation, if still running, is cancelled.
+type sessionStore struct {
+	mu    sync.Mutex
+	ttl   time.Duration
+	items map[string]*session
+	// now returns the current time. It is a field so that the tests can
+	// control the clock.
+	now func() time.Time
+}
+
+// newSessionStore returns a store keeping the unfollowed sessions for ttl.
+func newSessionStore(ttl time.Duration) *sessionStore {
+	return &sessionStore{
+		ttl:   ttl,
+		items: make(map[string]*session),
+		now:   time.Now,
+	}
+}
+
+// create adds a new session, returning its ID. The cancel function is
+// called when the session expires, to stop its generation.
+func (st *sessionStore) create(cancel context.CancelFunc) (string, *session, error) {
+	id, err := newContinuationID()
+	if err != nil {
+		return "", nil, err
+	}
+	sess := &session{
+		updated: make(chan struct{}),
+		idle:    st.now(),
+		cancel:  cancel,
+		now:     st.now,
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.removeExpired()
+	st.items[id] = sess
+	return id, sess, nil
+}
+
+// get returns the session with the given ID, if it is not expired.
+func (st *sessionStore) get(id string) (*session, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.removeExpired()
+	sess, ok := st.items[id]
+	return sess, ok
+}
+
+// removeExpired removes the sessions not followed for longer than the TTL,
+// cancelling their generations. It must be called with st.mu held.
+func (st *sessionStore) removeExpired() {
+	now := st.now()
+	for id, sess := range st.items {
+		if sess.expired(now, st.ttl) {
+			delete(st.items, id)
+			sess.cancel()
+		}
+	}
+}
+
+// session records the messages of a generation, which any number of
+// clients can follow, from any offset.
+// It implements tokenStream, so that the generation sends its messages to it.
+type session struct {
+	mu       sync.Mutex
+	messages []*api.GeneratedToken
+	done     bool
+	err      error
+	// followers is the number of clients following the session, and idle
+	// the time since when nobody does, or since the end of the generation.
+	followers int
+	idle      time.Time
+	// updated is closed, and replaced, when a message is added or the
+	// generation is finished.
+	updated chan struct{}
+	cancel  context.CancelFunc
+	now     func() time.Time
+}
+
+// Send records the message.
+func (s *session) Send(msg *api.GeneratedToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages = append(s.messages, msg)
+	s.notify()
+	return nil
+}
+
+// finish records the end of the generation, with its error.
+func (s *session) finish(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.done, s.err, s.idle = true, err, s.now()
+	s.notify()
+}
+
+// notify wakes up the followers. It must be called with s.mu held.
+func (s *session) notify() {
+	close(s.updated)
+	s.updated = make(chan struct{})
+}
+
+// read returns the messages from the given offset, whether the generation
+// is finished, with its error, and a channel which is closed on the next
+// update.
+func (s *session) read(offset int) ([]*api.GeneratedToken, bool, error, <-chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var messages []*api.GeneratedToken
+	if offset < len(s.messages) {
+		messages = s.messages[offset:]
+	}
+	return messages, s.done, s.err, s.updated
+}
+
+func (s *session) expired(now time.Time, ttl time.Duration) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.followers == 0 && now.Sub(s.idle) > ttl
+}
+
+// attach records a new follower of the session.
+func (s *session) attach() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.followers++
+}
+
+// detach records that a follower left the session.
+func (s *session) detach() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.followers--
+	if s.followers == 0 {
+		s.idle = s.now()
+	}
+}
+
+// follow sends the messages of the session to the stream, from the given
+// offset, until the generation is finished, returning its error, or the
+// context is done.
+func (s *session) follow(ctx context.Context, stream tokenStream, offset int) error {
+	if offset < 0 {
+		return status.Errorf(codes.InvalidArgument, "invalid offset %d: must be >= 0", offset)
+	}
+	s.attach()
+	defer s.detach()
+	for {
+		messages, done, err, updated := s.read(offset)
+		for _, msg := range messages {
+			if err := stream.Send(msg); err != nil {
+				return err
+			}
+		}
+		offset += len(messages)
+		if done {
+			return err
+		}
+		select {
+		case <-updated:
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		}
+	}
+}
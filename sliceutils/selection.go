@@ -0,0 +1,107 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sliceutils
+
+import "sort"
+
+// Select rearranges data so that the element at index k is the one that
+// would be there if data were sorted, with no greater elements before it
+// and no smaller elements after it. It takes O(n) time on average.
+func Select(data sort.Interface, k int) {
+	lo, hi := 0, data.Len()-1
+	for lo < hi {
+		medianToLo(data, lo, hi)
+		p := partition(data, lo, hi)
+		switch {
+		case k < p:
+			hi = p - 1
+		case k > p:
+			lo = p + 1
+		default:
+			return
+		}
+	}
+}
+
+// PartialSort rearranges data so that its first k elements are the k
+// smallest ones, in sorted order. The order of the other elements is
+// unspecified. It takes O(n + k*log(k)) time on average.
+func PartialSort(data sort.Interface, k int) {
+	if n := data.Len(); k >= n {
+		k = n
+	} else {
+		Select(data, k)
+	}
+	heapSort(data, k)
+}
+
+// medianToLo moves the median of the first, middle and last elements of
+// data[lo:hi+1] to lo, to be used as pivot.
+func medianToLo(data sort.Interface, lo, hi int) {
+	mid := int(uint(lo+hi) >> 1)
+	if data.Less(mid, lo) {
+		data.Swap(mid, lo)
+	}
+	if data.Less(hi, mid) {
+		data.Swap(hi, mid)
+		if data.Less(mid, lo) {
+			data.Swap(mid, lo)
+		}
+	}
+	data.Swap(lo, mid)
+}
+
+// partition moves the pivot data[lo] to its final position within
+// data[lo:hi+1], with no greater elements before it and no smaller elements
+// after it, and returns the position. The elements equal to the pivot are
+// spread on both sides, so that many duplicates don't degrade the selection.
+func partition(data sort.Interface, lo, hi int) int {
+	i, j := lo+1, hi
+	for {
+		for i <= j && data.Less(i, lo) {
+			i++
+		}
+		for i <= j && data.Less(lo, j) {
+			j--
+		}
+		if i > j {
+			break
+		}
+		data.Swap(i, j)
+		i++
+		j--
+	}
+	data.Swap(lo, j)
+	return j
+}
+
+// heapSort sorts the first n elements of data.
+func heapSort(data sort.Interface, n int) {
+	for i := (n - 1) / 2; i >= 0; i-- {
+		siftDown(data, i, n)
+	}
+	for i := n - 1; i > 0; i-- {
+		data.Swap(0, i)
+		siftDown(data, 0, i)
+	}
+}
+
+// siftDown implements the heap property on data[root:n].
+func siftDown(data sort.Interface, root, n int) {
+	for {
+		child := 2*root + 1
+		if child >= n {
+			return
+		}
+		if child+1 < n && data.Less(child, child+1) {
+			child++
+		}
+		if !data.Less(root, child) {
+			return
+		}
+		data.Swap(root, child)
+		root = child
+	}
+}
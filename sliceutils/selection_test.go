@@ -0,0 +1,61 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sliceutils
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSelect(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for _, size := range []int{1, 2, 3, 10, 101} {
+		for _, distinct := range []int{2, 1000} {
+			values := make([]int, size)
+			for i := range values {
+				values[i] = r.Intn(distinct)
+			}
+			sorted := append([]int(nil), values...)
+			sort.Ints(sorted)
+
+			for k := 0; k < size; k++ {
+				data := append([]int(nil), values...)
+				Select(sort.IntSlice(data), k)
+				assert.Equal(t, sorted[k], data[k], "size %d, k %d", size, k)
+				for i, v := range data {
+					if i < k {
+						assert.LessOrEqual(t, v, data[k])
+					} else {
+						assert.GreaterOrEqual(t, v, data[k])
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestPartialSort(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	values := make([]int, 200)
+	for i := range values {
+		values[i] = r.Intn(50)
+	}
+	sorted := append([]int(nil), values...)
+	sort.Ints(sorted)
+
+	for _, k := range []int{0, 1, 7, 100, 199, 200, 300} {
+		data := append([]int(nil), values...)
+		PartialSort(sort.IntSlice(data), k)
+		n := k
+		if n > len(data) {
+			n = len(data)
+		}
+		assert.Equal(t, sorted[:n], data[:n], "k %d", k)
+		assert.ElementsMatch(t, values, data)
+	}
+}
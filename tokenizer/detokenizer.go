@@ -0,0 +1,77 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tokenizer
+
+import "unicode/utf8"
+
+// Detokenizer reconstructs the text of a stream of tokens incrementally,
+// emitting the text of each token only once it is certain.
+//
+// The text of a token can depend on the next ones: for example, a rune whose
+// bytes are split between two tokens can't be rendered until the second one
+// arrives. Hence, the text which ends with an incomplete rune is held back,
+// so that the concatenation of the emitted texts is always the text
+// reconstructed from the whole sequence, without transient mojibake.
+type Detokenizer struct {
+	tk Tokenizer
+	// ids contains the last tokens whose text has been emitted, which
+	// provide the context of the following ones, and the tokens held back.
+	ids []int
+	// emitted is the number of tokens of ids whose text has been emitted.
+	emitted int
+}
+
+// NewDetokenizer returns a new Detokenizer reconstructing the text with the
+// tokenizer.
+func NewDetokenizer(tk Tokenizer) *Detokenizer {
+	return &Detokenizer{tk: tk}
+}
+
+// Add adds the next token of the stream, returning the text which became
+// certain, which is empty if the token is held back.
+func (d *Detokenizer) Add(id int) (string, error) {
+	d.ids = append(d.ids, id)
+	text, err := d.pending()
+	if err != nil || text == "" || !complete(text) {
+		return "", err
+	}
+	// only the last emitted tokens are kept as context
+	d.ids = append(d.ids[:0], d.ids[d.emitted:]...)
+	d.emitted = len(d.ids)
+	return text, nil
+}
+
+// Flush returns the text of the tokens held back, even if it is not certain,
+// at the end of the stream. The Detokenizer is reset.
+func (d *Detokenizer) Flush() (string, error) {
+	text, err := d.pending()
+	d.ids, d.emitted = d.ids[:0], 0
+	return text, err
+}
+
+// pending returns the text of the tokens held back, reconstructed together
+// with the context, since the text of a token can depend on the ones before
+// it too.
+func (d *Detokenizer) pending() (string, error) {
+	prefix, err := d.tk.ReconstructText(d.ids[:d.emitted])
+	if err != nil {
+		return "", err
+	}
+	text, err := d.tk.ReconstructText(d.ids)
+	if err != nil {
+		return "", err
+	}
+	if len(text) <= len(prefix) {
+		return "", nil
+	}
+	return text[len(prefix):], nil
+}
+
+// complete reports whether the text doesn't end with an incomplete or
+// invalid rune, which could be completed by the next tokens.
+func complete(text string) bool {
+	r, size := utf8.DecodeLastRuneInString(text)
+	return r != utf8.RuneError || size > 1
+}
@@ -0,0 +1,58 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tokenizer
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// bytesTokenizer reconstructs the text concatenating the bytes of the
+// tokens, which can split the runes.
+type bytesTokenizer struct {
+	Tokenizer
+	vocabulary []string
+}
+
+func (t bytesTokenizer) ReconstructText(ids []int) (string, error) {
+	var sb strings.Builder
+	for _, id := range ids {
+		sb.WriteString(t.vocabulary[id])
+	}
+	return sb.String(), nil
+}
+
+func TestDetokenizer(t *testing.T) {
+	// "é" is "\xc3\xa9", "€" is "\xe2\x82\xac"
+	tk := bytesTokenizer{vocabulary: []string{"caf", "\xc3", "\xa9", " 5", "\xe2", "\x82", "\xac", "\xe2\x82"}}
+	tests := []struct {
+		ids      []int
+		expected []string
+	}{
+		{[]int{0, 1, 2, 3, 4, 5, 6}, []string{"caf", "", "é", " 5", "", "", "€"}},
+		{[]int{0, 1}, []string{"caf", ""}},
+		{[]int{7, 6, 0}, []string{"", "€", "caf"}},
+	}
+	for _, tt := range tests {
+		d := NewDetokenizer(tk)
+		var actual []string
+		for _, id := range tt.ids {
+			text, err := d.Add(id)
+			require.NoError(t, err)
+			actual = append(actual, text)
+		}
+		assert.Equal(t, tt.expected, actual)
+
+		// the held back text is flushed at the end
+		rest, err := d.Flush()
+		require.NoError(t, err)
+		batch, err := tk.ReconstructText(tt.ids)
+		require.NoError(t, err)
+		assert.Equal(t, batch, strings.Join(actual, "")+rest)
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bpetokenizer
+
+import (
+	"container/list"
+	"sync"
+)
+
+// encodingCache keeps the token IDs of the last tokenized texts, discarding
+// the least recently used ones when it is full. It is safe for concurrent
+// use. A nil *encodingCache caches nothing.
+type encodingCache struct {
+	mu       sync.Mutex
+	capacity int
+	// order contains the entries, from the most recently used one.
+	order *list.List
+	items map[string]*list.Element
+	// hits and misses count the lookups, the misses being the texts which
+	// had to be tokenized.
+	hits, misses int
+}
+
+type cacheEntry struct {
+	text string
+	ids  []int
+}
+
+// newEncodingCache returns a cache keeping at most capacity texts, or nil if
+// capacity is not positive.
+func newEncodingCache(capacity int) *encodingCache {
+	if capacity <= 0 {
+		return nil
+	}
+	return &encodingCache{
+		capacity: capacity,
+		order:    list.New(),
+		items:    make(map[string]*list.Element, capacity),
+	}
+}
+
+// get returns a copy of the token IDs of the text, if they are cached.
+func (c *encodingCache) get(text string) ([]int, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.items[text]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.order.MoveToFront(e)
+	return append([]int(nil), e.Value.(*cacheEntry).ids...), true
+}
+
+// put caches a copy of the token IDs of the text.
+func (c *encodingCache) put(text string, ids []int) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.items[text]; ok {
+		c.order.MoveToFront(e)
+		return
+	}
+	for c.order.Len() >= c.capacity {
+		oldest := c.order.Back()
+		delete(c.items, oldest.Value.(*cacheEntry).text)
+		c.order.Remove(oldest)
+	}
+	c.items[text] = c.order.PushFront(&cacheEntry{text: text, ids: append([]int(nil), ids...)})
+}
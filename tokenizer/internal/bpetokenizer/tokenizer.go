@@ -5,14 +5,21 @@
 package bpetokenizer
 
 import (
+	"bufio"
+	"encoding/json"
 	"fmt"
+	"io"
+	"os"
 	"path/filepath"
 	"strings"
+	"unicode"
 
+	"github.com/dlclark/regexp2"
 	"github.com/nlpodyssey/gotokenizers/encodings"
 	"github.com/nlpodyssey/gotokenizers/models"
 	"github.com/nlpodyssey/gotokenizers/models/bpemodel"
 	"github.com/nlpodyssey/gotokenizers/normalizedstring"
+	"github.com/nlpodyssey/gotokenizers/normalizers"
 	"github.com/nlpodyssey/gotokenizers/pretokenizedstring"
 	"github.com/nlpodyssey/gotokenizers/pretokenizers/bytelevelpretokenizer"
 	"github.com/nlpodyssey/gotokenizers/vocabulary"
@@ -27,15 +34,23 @@ const (
 	defaultPrefixSpaceEnabled      = false
 	defaultOffsetsTrimmingEnabled  = true
 	defaultUnknownFusionEnabled    = false
+	defaultAppendEOS               = false
 )
 
 // BPETokenizer is a higher-level tokenizer, which includes byte-level pre-tokenization.
 type BPETokenizer struct {
+	normalizer           normalizers.Normalizer // optional
 	preTokenizer         *bytelevelpretokenizer.ByteLevelPreTokenizer
+	splittingRegexp      *regexp2.Regexp // the regexp of the preTokenizer
+	addPrefixSpace       bool            // the prefix space setting of the preTokenizer
 	model                *bpemodel.BPEModel
 	vocab                *vocabulary.Vocabulary
+	mergeCount           int
 	extraSpecialTokenIDs map[int]string
 	ControlTokenIDs      ControlTokensIDs
+	// AppendEOS makes Tokenize append the ControlTokenIDs.EosTokenID.
+	AppendEOS bool
+	cache     *encodingCache
 
 	StripPaddingTokensDuringTextReconstruction bool
 }
@@ -48,15 +63,57 @@ type ControlTokensIDs struct {
 	ExtraSpecialTokenIDs map[int]string
 }
 
-// Load returns a BPETokenizer from a file.
+// Names of the files read by Load.
+const (
+	VocabularyFilename = "vocab.json"
+	MergesFilename     = "merges.txt"
+)
+
+// Options configures the tokenization of a BPETokenizer.
+type Options struct {
+	// AddPrefixSpace adds a space at the beginning of the text, unless it
+	// already starts with one, so that the first word is tokenized like a
+	// word in the middle of a sentence.
+	AddPrefixSpace bool
+	// AppendEOS makes Tokenize append the end-of-sequence token, as resolved
+	// in the ControlTokenIDs when tokenizing.
+	AppendEOS bool
+	// CacheSize is the number of texts whose token IDs are cached by
+	// Tokenize, discarding the least recently used ones, so that identical
+	// texts, like a system prompt, are not tokenized again. Zero disables
+	// the cache.
+	CacheSize int
+}
+
+// DefaultOptions returns the options used by Load.
+func DefaultOptions() Options {
+	return Options{
+		AddPrefixSpace: defaultPrefixSpaceEnabled,
+		AppendEOS:      defaultAppendEOS,
+	}
+}
+
+// Load returns a BPETokenizer from the files in path, with the DefaultOptions.
+// The tokenizer is read from the TokenizerFilename, if it exists, otherwise
+// from the VocabularyFilename and the MergesFilename with default settings.
 func Load(path string, controlTokensIDs ControlTokensIDs) (*BPETokenizer, error) {
-	vocabularyFilename := filepath.Join(path, "vocab.json")
+	return LoadWithOptions(path, controlTokensIDs, DefaultOptions())
+}
+
+// LoadWithOptions is like Load, but with the given options.
+func LoadWithOptions(path string, controlTokensIDs ControlTokensIDs, opts Options) (*BPETokenizer, error) {
+	tokenizerFilename := filepath.Join(path, TokenizerFilename)
+	if _, err := os.Stat(tokenizerFilename); err == nil {
+		return loadTokenizerJSON(tokenizerFilename, controlTokensIDs, opts)
+	}
+
+	vocabularyFilename := filepath.Join(path, VocabularyFilename)
 	vocab, err := vocabulary.FromJSONFile(vocabularyFilename)
 	if err != nil {
 		return nil, fmt.Errorf("loading vocabulary from file %s: %w", vocabularyFilename, err)
 	}
 
-	mergesFilename := filepath.Join(path, "merges.txt")
+	mergesFilename := filepath.Join(path, MergesFilename)
 	merges, err := bpemodel.MergeMapFromFile(
 		mergesFilename,
 		vocab,
@@ -66,9 +123,36 @@ func Load(path string, controlTokensIDs ControlTokensIDs) (*BPETokenizer, error)
 		return nil, fmt.Errorf("loading merges from file %s: %w", mergesFilename, err)
 	}
 
+	return newTokenizer(vocab, merges, controlTokensIDs, opts), nil
+}
+
+// LoadFromReaders is like LoadWithOptions, but reads the vocabulary and the
+// merges from the readers, in the formats of the VocabularyFilename and the
+// MergesFilename, so that the tokenizer can be loaded from any source, like
+// an embedded asset. The IDs of the vocabulary must go from zero to the
+// number of terms.
+func LoadFromReaders(vocab, merges io.Reader, controlTokensIDs ControlTokensIDs, opts Options) (*BPETokenizer, error) {
+	var termToID map[string]int
+	if err := json.NewDecoder(vocab).Decode(&termToID); err != nil {
+		return nil, fmt.Errorf("loading vocabulary: %w", err)
+	}
+	v, err := vocabularyFromMap(termToID)
+	if err != nil {
+		return nil, fmt.Errorf("loading vocabulary: %w", err)
+	}
+	m, err := mergeMapFromReader(merges, v, len(defaultContinuingSubwordPrefix))
+	if err != nil {
+		return nil, fmt.Errorf("loading merges: %w", err)
+	}
+	return newTokenizer(v, m, controlTokensIDs, opts), nil
+}
+
+// newTokenizer returns a BPETokenizer with the vocabulary and the merges,
+// and the default settings.
+func newTokenizer(vocab *vocabulary.Vocabulary, merges *bpemodel.MergeMap, controlTokensIDs ControlTokensIDs, opts Options) *BPETokenizer {
 	preTokenizer := bytelevelpretokenizer.New(
 		bytelevelpretokenizer.DefaultSplittingRegexp,
-		defaultPrefixSpaceEnabled,
+		opts.AddPrefixSpace,
 		defaultOffsetsTrimmingEnabled,
 	)
 
@@ -85,27 +169,103 @@ func Load(path string, controlTokensIDs ControlTokensIDs) (*BPETokenizer, error)
 
 	t := &BPETokenizer{
 		preTokenizer:    preTokenizer,
+		splittingRegexp: bytelevelpretokenizer.DefaultSplittingRegexp,
+		addPrefixSpace:  opts.AddPrefixSpace,
 		model:           model,
 		vocab:           vocab,
+		mergeCount:      len(*merges),
 		ControlTokenIDs: controlTokensIDs,
+		AppendEOS:       opts.AppendEOS,
+		cache:           newEncodingCache(opts.CacheSize),
 		StripPaddingTokensDuringTextReconstruction: false,
 	}
 	if controlTokensIDs.ExtraSpecialTokenIDs != nil {
 		t.SetExtraSpecialTokens(controlTokensIDs.ExtraSpecialTokenIDs)
 	}
+	return t
+}
+
+// mergeMapFromReader reads the merges like bpemodel.MergeMapFromFile.
+func mergeMapFromReader(r io.Reader, vocab *vocabulary.Vocabulary, prefixLength int) (*bpemodel.MergeMap, error) {
+	m := bpemodel.NewMergeMap()
+	scanner := bufio.NewScanner(r)
+	for lineCount, rank := 1, 0; scanner.Scan(); lineCount++ {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#version") {
+			continue
+		}
+		terms := strings.Split(line, " ")
+		if len(terms) != 2 {
+			return nil, fmt.Errorf("line %d: malformed merges", lineCount)
+		}
+		if err := addMerge(m, vocab, rank, terms[0], terms[1], prefixLength); err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineCount, err)
+		}
+		rank++
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
 
-	return t, nil
+// addMerge adds the merge of the left and right terms, with the given rank.
+func addMerge(m *bpemodel.MergeMap, vocab *vocabulary.Vocabulary, rank int, left, right string, prefixLength int) error {
+	leftID, ok := vocab.GetID(left)
+	if !ok {
+		return fmt.Errorf("left merge token is out of vocabulary")
+	}
+	rightID, ok := vocab.GetID(right)
+	if !ok {
+		return fmt.Errorf("right merge token is out of vocabulary")
+	}
+	if len(right) < prefixLength {
+		return fmt.Errorf("right merge token is shorter than the continuing subword prefix")
+	}
+	mergedID, ok := vocab.GetID(left + right[prefixLength:])
+	if !ok {
+		return fmt.Errorf("merged token is out of vocabulary")
+	}
+	m.Set(leftID, rightID, bpemodel.MergeValue{Rank: rank, ID: mergedID})
+	return nil
 }
 
 func (t *BPETokenizer) SetExtraSpecialTokens(extra map[int]string) {
 	t.extraSpecialTokenIDs = extra
 }
 
+// TokenID returns the ID of the given token, reporting whether it is part
+// of the vocabulary.
+func (t *BPETokenizer) TokenID(token string) (int, bool) {
+	return t.vocab.GetID(token)
+}
+
+// ControlTokens returns the IDs of the control tokens.
+func (t *BPETokenizer) ControlTokens() ControlTokensIDs {
+	return t.ControlTokenIDs
+}
+
+// VocabularySize returns the number of tokens in the vocabulary.
+func (t *BPETokenizer) VocabularySize() int {
+	return t.vocab.Size()
+}
+
+// MergeCount returns the number of merges of the BPE model.
+func (t *BPETokenizer) MergeCount() int {
+	return t.mergeCount
+}
+
 // Encode converts a text into an encoded tokens representation useful for Transformer architectures.
 // It tokenizes using byte-level pre-tokenization and BPE tokenization.
 func (t *BPETokenizer) Encode(text string) (*encodings.Encoding, error) {
 	pts := pretokenizedstring.FromString(text)
 
+	if t.normalizer != nil {
+		if err := pts.Normalize(t.normalizer.Normalize); err != nil {
+			return nil, fmt.Errorf("BPETokenizer Normalize for %s: %w", text, err)
+		}
+	}
+
 	err := t.preTokenizer.PreTokenize(pts)
 	if err != nil {
 		return nil, fmt.Errorf("BPETokenizer PreTokenize for %s: %w", text, err)
@@ -127,15 +287,124 @@ func (t *BPETokenizer) Encode(text string) (*encodings.Encoding, error) {
 	return encoding, nil
 }
 
-// Tokenize returns the token IDs of the input text applying the EOS pad token.
+// EncodeToken returns the token IDs of a single word, like Tokenize, but
+// faster: when the word has no white space and the pre-tokenization would
+// keep it whole, the normalized string and the offsets are skipped, and the
+// word is passed directly to the model. Otherwise, it falls back to the full
+// tokenization. The end-of-sequence token is never appended.
+// It is meant for the precomputation of stop sequences and constrained
+// decoding.
+func (t *BPETokenizer) EncodeToken(word string) ([]int, error) {
+	if !t.isSingleWord(word) {
+		return t.tokenize(word)
+	}
+	if t.addPrefixSpace {
+		word = " " + word
+	}
+	tokens, err := t.model.Tokenize(byteLevel(word))
+	if err != nil {
+		return nil, fmt.Errorf("BPETokenizer EncodeToken for %s: %w", word, err)
+	}
+	ids := make([]int, len(tokens))
+	for i, tok := range tokens {
+		ids[i] = tok.ID
+	}
+	return ids, nil
+}
+
+// isSingleWord reports whether the word is non-empty, has no white space,
+// needs no normalization, and would be kept whole by the pre-tokenization.
+func (t *BPETokenizer) isSingleWord(word string) bool {
+	if word == "" || t.normalizer != nil || strings.IndexFunc(word, unicode.IsSpace) >= 0 {
+		return false
+	}
+	if t.addPrefixSpace {
+		word = " " + word
+	}
+	m, err := t.splittingRegexp.FindStringMatch(word)
+	return err == nil && m != nil && m.Index == 0 && m.Length == len([]rune(word))
+}
+
+// byteLevel maps each byte of the text to a printable rune, like the
+// byte-level pre-tokenizer.
+func byteLevel(text string) string {
+	var sb strings.Builder
+	sb.Grow(len(text) * 2)
+	for i := 0; i < len(text); i++ {
+		sb.WriteRune(byteToRune[text[i]])
+	}
+	return sb.String()
+}
+
+// byteToRune is the byte-to-rune mapping of the byte-level pre-tokenizer:
+// the printable bytes map to themselves, the others to runes from U+0100.
+var byteToRune [0x100]rune
+
+// runeToByte is the inverse of byteToRune.
+var runeToByte = make(map[rune]byte, 0x100)
+
+func init() {
+	n := 0
+	for i := range byteToRune {
+		if (i >= '!' && i <= '~') || (i >= 0xA1 && i <= 0xAC) || (i >= 0xAE && i <= 0xFF) {
+			byteToRune[i] = rune(i)
+		} else {
+			byteToRune[i] = rune(0x100 + n)
+			n++
+		}
+		runeToByte[byteToRune[i]] = byte(i)
+	}
+}
+
+// Tokenize returns the token IDs of the input text, followed by the
+// end-of-sequence token if AppendEOS is set.
 func (t *BPETokenizer) Tokenize(text string) ([]int, error) {
+	ids, err := t.tokenize(text)
+	if err != nil {
+		return nil, err
+	}
+	if t.AppendEOS {
+		ids = append(ids, t.ControlTokenIDs.EosTokenID)
+	}
+	return ids, nil
+}
+
+// TokenizeWithoutEOS returns the token IDs of the input text, without the
+// end-of-sequence token, regardless of AppendEOS.
+func (t *BPETokenizer) TokenizeWithoutEOS(text string) ([]int, error) {
+	return t.tokenize(text)
+}
+
+// tokenize returns the token IDs of the input text, from the cache if
+// possible.
+func (t *BPETokenizer) tokenize(text string) ([]int, error) {
+	if ids, ok := t.cache.get(text); ok {
+		return ids, nil
+	}
 	encoded, err := t.Encode(text)
 	if err != nil {
 		return nil, err
 	}
+	t.cache.put(text, encoded.IDs)
 	return encoded.IDs, nil
 }
 
+// TokenFrequencies tokenizes all the texts, returning the number of
+// occurrences of each token ID.
+func (t *BPETokenizer) TokenFrequencies(texts []string) (map[int]int, error) {
+	freq := make(map[int]int)
+	for _, text := range texts {
+		ids, err := t.Tokenize(text)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			freq[id]++
+		}
+	}
+	return freq, nil
+}
+
 // ReconstructText returns the text of the input token IDs removing the padding token.
 func (t *BPETokenizer) ReconstructText(tokenIds []int) (string, error) {
 	if !t.StripPaddingTokensDuringTextReconstruction {
@@ -156,8 +425,22 @@ func (t *BPETokenizer) ReconstructText(tokenIds []int) (string, error) {
 	return t.internalDetokenize(stripPaddingTokensFn(tokenIds)), nil
 }
 
-// Detokenize flatten and merges a list of ids into a single string.
-// TODO: handle proper detokenization
+// RoundTrip returns the text reconstructed from the tokenization of the given
+// text, without the end-of-sequence token. It is the text itself for any
+// well-formed UTF-8 text, unless the tokenizer normalizes it, or adds a
+// prefix space. The text with invalid UTF-8 sequences can't be tokenized.
+func (t *BPETokenizer) RoundTrip(text string) (string, error) {
+	ids, err := t.tokenize(text)
+	if err != nil {
+		return "", err
+	}
+	return t.internalDetokenize(ids), nil
+}
+
+// internalDetokenize concatenates the texts of the tokens, mapping the runes
+// of the byte-level vocabulary back to the bytes they stand for, so that the
+// runes split across many tokens are rebuilt. The extra special tokens are
+// written as they are.
 func (t *BPETokenizer) internalDetokenize(ids []int) string {
 	var sb strings.Builder
 	for _, id := range ids {
@@ -167,11 +450,14 @@ func (t *BPETokenizer) internalDetokenize(ids []int) string {
 		}
 
 		if s, ok := t.vocab.GetString(id); ok {
-			sb.WriteString(s)
+			for _, r := range s {
+				if b, ok := runeToByte[r]; ok {
+					sb.WriteByte(b)
+				} else {
+					sb.WriteRune(r)
+				}
+			}
 		}
 	}
-	out := sb.String()
-	out = strings.Replace(out, "Ġ", " ", -1)
-	out = strings.Replace(out, "Ċ", "\n", -1)
-	return out
+	return sb.String()
 }
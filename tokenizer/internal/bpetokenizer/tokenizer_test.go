@@ -5,7 +5,13 @@
 package bpetokenizer
 
 import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"unicode/utf8"
 )
 
 func TestNew(t *testing.T) {
@@ -17,3 +23,315 @@ func TestNew(t *testing.T) {
 		t.Fatal("expected *BPETokenizer, actual nil")
 	}
 }
+
+func TestBPETokenizer_TokenFrequencies(t *testing.T) {
+	tokenizer, err := Load("testdata/dummy-roberta-model", ControlTokensIDs{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	corpus := []string{"unrelated", "related", "unrelatedrelated", "ate"}
+
+	freq, err := tokenizer.TokenFrequencies(corpus)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedTotal := 0
+	for _, text := range corpus {
+		ids, err := tokenizer.Tokenize(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectedTotal += len(ids)
+	}
+	total := 0
+	for _, n := range freq {
+		total += n
+	}
+	if total != expectedTotal {
+		t.Errorf("expected %d tokens in total, actual %d", expectedTotal, total)
+	}
+	if freq[14] != 2 {
+		t.Errorf("expected token 14 (\"related\") to occur 2 times, actual %d", freq[14])
+	}
+}
+
+func TestLoadWithOptions_AddPrefixSpace(t *testing.T) {
+	tests := []struct {
+		addPrefixSpace bool
+		text           string
+		expected       []int
+	}{
+		// "un" (12) "related" (15) "Ġrelated" (18)
+		{addPrefixSpace: false, text: "unrelated related", expected: []int{12, 15, 18}},
+		// "Ġunrelated" (17) "Ġrelated" (18)
+		{addPrefixSpace: true, text: "unrelated related", expected: []int{17, 18}},
+		// the space is not added twice
+		{addPrefixSpace: true, text: " unrelated related", expected: []int{17, 18}},
+	}
+	for _, tt := range tests {
+		tokenizer, err := LoadWithOptions("testdata/prefix-space-model", ControlTokensIDs{}, Options{AddPrefixSpace: tt.addPrefixSpace})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids, err := tokenizer.Tokenize(tt.text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(ids, tt.expected) {
+			t.Errorf("prefix space %v, %q: expected %v, actual %v", tt.addPrefixSpace, tt.text, tt.expected, ids)
+		}
+	}
+}
+
+func TestLoad_TokenizerJSON(t *testing.T) {
+	tokenizer, err := Load("testdata/tokenizer-json-model", ControlTokensIDs{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids, err := tokenizer.Tokenize("Unrelated related")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the text is lowercased and split in chunks of up to four non-space characters:
+	// "un" "re" | "l" "at" "e" | "d" | "Ġ" "rel" "a" | "t" "ed"
+	expected := []int{12, 9, 4, 10, 3, 7, 8, 14, 5, 6, 11}
+	if !reflect.DeepEqual(ids, expected) {
+		t.Errorf("expected %v, actual %v", expected, ids)
+	}
+	text, err := tokenizer.ReconstructText(ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text != "unrelated related" {
+		t.Errorf("expected %q, actual %q", "unrelated related", text)
+	}
+}
+
+func TestLoad_TokenizerJSON_ByteLevel(t *testing.T) {
+	data, err := os.ReadFile("testdata/tokenizer-json-model/tokenizer.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// replace the normalizer and the pre-tokenizer with a plain ByteLevel one
+	conf := string(data)
+	start := strings.Index(conf, `"normalizer"`)
+	end := strings.Index(conf, `"post_processor"`)
+	conf = conf[:start] + `"normalizer": null, "pre_tokenizer": {"type": "ByteLevel", "add_prefix_space": true, "trim_offsets": true, "use_regex": true},` + conf[end:]
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, TokenizerFilename), []byte(conf), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tokenizer, err := Load(dir, ControlTokensIDs{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids, err := tokenizer.Tokenize("unrelated related")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// like LoadWithOptions with the prefix space, from the vocabulary and merges files
+	if expected := []int{17, 18}; !reflect.DeepEqual(ids, expected) {
+		t.Errorf("expected %v, actual %v", expected, ids)
+	}
+}
+
+func TestBPETokenizer_EncodeToken(t *testing.T) {
+	words := []string{"unrelated", "related", "ated", "d", "a'd", "related,", "ünrelated", "42", "unrelated related", " related", ""}
+	for _, model := range []string{"prefix-space-model", "tokenizer-json-model"} {
+		for _, addPrefixSpace := range []bool{false, true} {
+			tokenizer, err := LoadWithOptions(filepath.Join("testdata", model), ControlTokensIDs{}, Options{AddPrefixSpace: addPrefixSpace})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, word := range words {
+				expected, err := tokenizer.Tokenize(word)
+				if err != nil {
+					t.Fatal(err)
+				}
+				actual, err := tokenizer.EncodeToken(word)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(expected) == 0 && len(actual) == 0 {
+					continue
+				}
+				if !reflect.DeepEqual(actual, expected) {
+					t.Errorf("%s, prefix space %v, %q: expected %v, actual %v", model, addPrefixSpace, word, expected, actual)
+				}
+			}
+		}
+	}
+}
+
+func BenchmarkBPETokenizer_EncodeToken(b *testing.B) {
+	tokenizer, err := Load("testdata/prefix-space-model", ControlTokensIDs{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, bc := range []struct {
+		name string
+		fn   func(string) ([]int, error)
+	}{
+		{"Tokenize", tokenizer.Tokenize},
+		{"EncodeToken", tokenizer.EncodeToken},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := bc.fn("unrelated"); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestBPETokenizer_Tokenize_AppendEOS(t *testing.T) {
+	const eos = 99 // the vocabulary has no special tokens, any ID will do
+	for _, appendEOS := range []bool{false, true} {
+		tokenizer, err := LoadWithOptions("testdata/prefix-space-model", ControlTokensIDs{EosTokenID: eos}, Options{AppendEOS: appendEOS})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := []int{12, 15, 18}
+		if appendEOS {
+			expected = append(expected, eos)
+		}
+		ids, err := tokenizer.Tokenize("unrelated related")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(ids, expected) {
+			t.Errorf("append EOS %v: expected %v, actual %v", appendEOS, expected, ids)
+		}
+		ids, err = tokenizer.TokenizeWithoutEOS("unrelated related")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := expected[:3]; !reflect.DeepEqual(ids, expected) {
+			t.Errorf("append EOS %v: TokenizeWithoutEOS expected %v, actual %v", appendEOS, expected, ids)
+		}
+		ids, err = tokenizer.EncodeToken("unrelated")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := []int{12, 15}; !reflect.DeepEqual(ids, expected) {
+			t.Errorf("append EOS %v: EncodeToken expected %v, actual %v", appendEOS, expected, ids)
+		}
+	}
+}
+
+func TestBPETokenizer_Tokenize_Cache(t *testing.T) {
+	uncached, err := Load("testdata/dummy-roberta-model", ControlTokensIDs{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cached, err := LoadWithOptions("testdata/dummy-roberta-model", ControlTokensIDs{}, Options{CacheSize: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uncached.cache != nil {
+		t.Fatal("expected no cache by default")
+	}
+
+	texts := []string{"unrelated", "related", "unrelated", "ate", "related", "unrelated"}
+	for _, text := range texts {
+		expected, err := uncached.Tokenize(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual, err := cached.Tokenize(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(expected, actual) {
+			t.Errorf("%q: expected %v, actual %v", text, expected, actual)
+		}
+		// the cached IDs can't be modified through the returned slice
+		actual[0] = -1
+	}
+	// only the second "unrelated" is a hit: "ate" evicts "related", whose
+	// tokenization evicts "unrelated" in turn
+	if cached.cache.hits != 1 || cached.cache.misses != 5 {
+		t.Errorf("expected 1 hit and 5 misses, actual %d and %d", cached.cache.hits, cached.cache.misses)
+	}
+}
+
+func TestBPETokenizer_VocabularySize_MergeCount(t *testing.T) {
+	const dir = "testdata/dummy-roberta-model"
+	tokenizer, err := Load(dir, ControlTokensIDs{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, VocabularyFilename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var vocab map[string]int
+	if err := json.Unmarshal(data, &vocab); err != nil {
+		t.Fatal(err)
+	}
+	if n := tokenizer.VocabularySize(); n != len(vocab) {
+		t.Errorf("expected vocabulary size %d, actual %d", len(vocab), n)
+	}
+
+	data, err = os.ReadFile(filepath.Join(dir, MergesFilename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	merges := 0
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		if !strings.HasPrefix(line, "#version") {
+			merges++
+		}
+	}
+	if n := tokenizer.MergeCount(); n != merges {
+		t.Errorf("expected %d merges, actual %d", merges, n)
+	}
+}
+
+func TestBPETokenizer_ReconstructText_ByteLevel(t *testing.T) {
+	tokenizer, err := Load("testdata/byte-level-model", ControlTokensIDs{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// "é" is a single token, "€" is split into a token for each byte
+	for _, text := range []string{"the café", "5 €", "in\nthe\ttext"} {
+		ids, err := tokenizer.Tokenize(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual, err := tokenizer.ReconstructText(ids)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual != text {
+			t.Errorf("expected %q, actual %q", text, actual)
+		}
+	}
+}
+
+func FuzzRoundTrip(f *testing.F) {
+	tokenizer, err := Load("testdata/byte-level-model", ControlTokensIDs{})
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, text := range []string{"", "the", " the  text\n", "café", "5 €", "日本語", "👍🏽", "á", "\x00\x7f"} {
+		f.Add(text)
+	}
+	f.Fuzz(func(t *testing.T, text string) {
+		if !utf8.ValidString(text) {
+			t.Skip("the pre-tokenizer fails on invalid UTF-8")
+		}
+		actual, err := tokenizer.RoundTrip(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual != text {
+			t.Errorf("expected %q, actual %q", text, actual)
+		}
+	})
+}
@@ -0,0 +1,302 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bpetokenizer
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/dlclark/regexp2"
+	"github.com/nlpodyssey/gotokenizers/models/bpemodel"
+	"github.com/nlpodyssey/gotokenizers/normalizers"
+	"github.com/nlpodyssey/gotokenizers/normalizers/lowercasenormalizer"
+	"github.com/nlpodyssey/gotokenizers/normalizers/sequencenormalizer"
+	"github.com/nlpodyssey/gotokenizers/normalizers/stripnormalizer"
+	"github.com/nlpodyssey/gotokenizers/pretokenizers/bytelevelpretokenizer"
+	"github.com/nlpodyssey/gotokenizers/vocabulary"
+)
+
+// TokenizerFilename is the name of the unified file of the Hugging Face
+// tokenizers. When it exists, Load reads the tokenizer from it, instead of
+// the VocabularyFilename and the MergesFilename.
+const TokenizerFilename = "tokenizer.json"
+
+// wholeTextRegexp matches the whole text, for the byte-level pre-tokenizers
+// which don't split it.
+var wholeTextRegexp = regexp2.MustCompile(`(?s).+`, regexp2.None)
+
+// tokenizerConfig is the part of a tokenizer.json file used by BPETokenizer.
+type tokenizerConfig struct {
+	Normalizer   *normalizerConfig   `json:"normalizer"`
+	PreTokenizer *preTokenizerConfig `json:"pre_tokenizer"`
+	Model        modelConfig         `json:"model"`
+}
+
+type normalizerConfig struct {
+	Type string `json:"type"`
+	// Normalizers is set by the Sequence normalizer.
+	Normalizers []normalizerConfig `json:"normalizers"`
+	// Left and Right are set by the Strip normalizer.
+	Left  bool `json:"left"`
+	Right bool `json:"right"`
+}
+
+type preTokenizerConfig struct {
+	Type string `json:"type"`
+	// Pretokenizers is set by the Sequence pre-tokenizer.
+	Pretokenizers []preTokenizerConfig `json:"pretokenizers"`
+	// AddPrefixSpace, TrimOffsets and UseRegex are set by the ByteLevel
+	// pre-tokenizer.
+	AddPrefixSpace bool  `json:"add_prefix_space"`
+	TrimOffsets    *bool `json:"trim_offsets"`
+	UseRegex       *bool `json:"use_regex"`
+	// Pattern, Behavior and Invert are set by the Split pre-tokenizer.
+	Pattern struct {
+		Regex  *string `json:"Regex"`
+		String *string `json:"String"`
+	} `json:"pattern"`
+	Behavior string `json:"behavior"`
+	Invert   bool   `json:"invert"`
+}
+
+type modelConfig struct {
+	Type                    string            `json:"type"`
+	Dropout                 *float64          `json:"dropout"`
+	UnkToken                *string           `json:"unk_token"`
+	ContinuingSubwordPrefix *string           `json:"continuing_subword_prefix"`
+	EndOfWordSuffix         *string           `json:"end_of_word_suffix"`
+	FuseUnk                 bool              `json:"fuse_unk"`
+	Vocab                   map[string]int    `json:"vocab"`
+	Merges                  []json.RawMessage `json:"merges"`
+}
+
+// loadTokenizerJSON returns a BPETokenizer configured by a tokenizer.json
+// file. The prefix space is added if either the file or the options enable it.
+//
+// Only the configurations of the byte-level BPE tokenizers are supported.
+// The NFC normalizer is accepted, but not applied: the text is expected to
+// be already composed, as it usually is.
+func loadTokenizerJSON(filename string, controlTokensIDs ControlTokensIDs, opts Options) (*BPETokenizer, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("loading tokenizer from file %s: %w", filename, err)
+	}
+	var conf tokenizerConfig
+	if err := json.Unmarshal(data, &conf); err != nil {
+		return nil, fmt.Errorf("parsing tokenizer file %s: %w", filename, err)
+	}
+
+	normalizer, err := conf.Normalizer.build()
+	if err != nil {
+		return nil, fmt.Errorf("tokenizer file %s: %w", filename, err)
+	}
+	splittingRegexp, addPrefixSpace, trimOffsets, err := conf.PreTokenizer.build(opts)
+	if err != nil {
+		return nil, fmt.Errorf("tokenizer file %s: %w", filename, err)
+	}
+	model, vocab, err := conf.Model.build()
+	if err != nil {
+		return nil, fmt.Errorf("tokenizer file %s: %w", filename, err)
+	}
+
+	t := &BPETokenizer{
+		normalizer:      normalizer,
+		preTokenizer:    bytelevelpretokenizer.New(splittingRegexp, addPrefixSpace, trimOffsets),
+		splittingRegexp: splittingRegexp,
+		addPrefixSpace:  addPrefixSpace,
+		model:           model,
+		vocab:           vocab,
+		mergeCount:      len(conf.Model.Merges),
+		ControlTokenIDs: controlTokensIDs,
+		AppendEOS:       opts.AppendEOS,
+		cache:           newEncodingCache(opts.CacheSize),
+		StripPaddingTokensDuringTextReconstruction: false,
+	}
+	if controlTokensIDs.ExtraSpecialTokenIDs != nil {
+		t.SetExtraSpecialTokens(controlTokensIDs.ExtraSpecialTokenIDs)
+	}
+	return t, nil
+}
+
+// build returns the normalizer, or nil if there is none.
+func (c *normalizerConfig) build() (normalizers.Normalizer, error) {
+	if c == nil {
+		return nil, nil
+	}
+	switch c.Type {
+	case "Lowercase":
+		return lowercasenormalizer.NewLowerCaseNormalizer(), nil
+	case "Strip":
+		return stripnormalizer.NewStripNormalizer(c.Left, c.Right), nil
+	case "NFC":
+		return nil, nil
+	case "Sequence":
+		var seq []normalizers.Normalizer
+		for i := range c.Normalizers {
+			n, err := c.Normalizers[i].build()
+			if err != nil {
+				return nil, err
+			}
+			if n != nil {
+				seq = append(seq, n)
+			}
+		}
+		if len(seq) == 0 {
+			return nil, nil
+		}
+		return sequencenormalizer.NewSequenceNormalizer(seq), nil
+	default:
+		return nil, fmt.Errorf("unsupported normalizer %q", c.Type)
+	}
+}
+
+// build returns the settings of the byte-level pre-tokenizer: the splitting
+// regexp, whether the prefix space is added, and whether the offsets are
+// trimmed. The configuration is either a ByteLevel pre-tokenizer, or a
+// Sequence of a Split one, isolating the matches of a pattern, followed by a
+// ByteLevel one which doesn't split the text further. Without a
+// configuration, the default settings are returned.
+func (c *preTokenizerConfig) build(opts Options) (*regexp2.Regexp, bool, bool, error) {
+	if c == nil {
+		return bytelevelpretokenizer.DefaultSplittingRegexp, opts.AddPrefixSpace, defaultOffsetsTrimmingEnabled, nil
+	}
+
+	var split *regexp2.Regexp
+	byteLevel := c
+	if c.Type == "Sequence" {
+		if len(c.Pretokenizers) != 2 || c.Pretokenizers[0].Type != "Split" {
+			return nil, false, false, fmt.Errorf("unsupported sequence of pre-tokenizers: only Split followed by ByteLevel is supported")
+		}
+		var err error
+		if split, err = c.Pretokenizers[0].splitRegexp(); err != nil {
+			return nil, false, false, err
+		}
+		byteLevel = &c.Pretokenizers[1]
+	}
+	if byteLevel.Type != "ByteLevel" {
+		return nil, false, false, fmt.Errorf("unsupported pre-tokenizer %q", byteLevel.Type)
+	}
+
+	re := wholeTextRegexp
+	if byteLevel.UseRegex == nil || *byteLevel.UseRegex {
+		if split != nil {
+			return nil, false, false, fmt.Errorf("unsupported ByteLevel pre-tokenizer splitting the text after Split")
+		}
+		re = bytelevelpretokenizer.DefaultSplittingRegexp
+	} else if split != nil {
+		re = split
+	}
+	trimOffsets := defaultOffsetsTrimmingEnabled
+	if byteLevel.TrimOffsets != nil {
+		trimOffsets = *byteLevel.TrimOffsets
+	}
+	return re, byteLevel.AddPrefixSpace || opts.AddPrefixSpace, trimOffsets, nil
+}
+
+// splitRegexp returns the pattern of a Split pre-tokenizer.
+func (c *preTokenizerConfig) splitRegexp() (*regexp2.Regexp, error) {
+	if c.Behavior != "Isolated" || c.Invert {
+		return nil, fmt.Errorf("unsupported Split pre-tokenizer with behavior %q and invert %v: only isolated matches are supported", c.Behavior, c.Invert)
+	}
+	var pattern string
+	switch {
+	case c.Pattern.Regex != nil:
+		pattern = *c.Pattern.Regex
+	case c.Pattern.String != nil:
+		pattern = regexp2.Escape(*c.Pattern.String)
+	default:
+		return nil, fmt.Errorf("missing pattern of the Split pre-tokenizer")
+	}
+	re, err := regexp2.Compile(pattern, regexp2.None)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern of the Split pre-tokenizer: %w", err)
+	}
+	return re, nil
+}
+
+// build returns the BPE model and its vocabulary.
+func (c *modelConfig) build() (*bpemodel.BPEModel, *vocabulary.Vocabulary, error) {
+	if c.Type != "BPE" {
+		return nil, nil, fmt.Errorf("unsupported model %q: only BPE is supported", c.Type)
+	}
+	vocab, err := vocabularyFromMap(c.Vocab)
+	if err != nil {
+		return nil, nil, err
+	}
+	prefix := stringOr(c.ContinuingSubwordPrefix, defaultContinuingSubwordPrefix)
+	merges, err := mergeMapFromList(c.Merges, vocab, len(prefix))
+	if err != nil {
+		return nil, nil, err
+	}
+	dropout := defaultDropout
+	if c.Dropout != nil {
+		dropout = *c.Dropout
+	}
+	model := bpemodel.New(
+		vocab,
+		merges,
+		defaultCacheCapacity,
+		dropout,
+		stringOr(c.UnkToken, defaultUnknownToken),
+		prefix,
+		stringOr(c.EndOfWordSuffix, defaultEndOfWordSuffix),
+		c.FuseUnk,
+	)
+	return model, vocab, nil
+}
+
+// vocabularyFromMap returns the vocabulary of the given terms, whose IDs must
+// go from zero to the number of terms, as the vocabulary assigns them in
+// order of insertion.
+func vocabularyFromMap(termToID map[string]int) (*vocabulary.Vocabulary, error) {
+	terms := make([]string, 0, len(termToID))
+	for term := range termToID {
+		terms = append(terms, term)
+	}
+	sort.Slice(terms, func(i, j int) bool {
+		return termToID[terms[i]] < termToID[terms[j]]
+	})
+	vocab := vocabulary.NewVocabulary()
+	for i, term := range terms {
+		if termToID[term] != i {
+			return nil, fmt.Errorf("unsupported vocabulary: the IDs are not contiguous from 0, %q has ID %d", term, termToID[term])
+		}
+		vocab.AddTerm(term)
+	}
+	return vocab, nil
+}
+
+// mergeMapFromList returns the merges listed in a tokenizer.json file, either
+// as "left right" strings or as ["left", "right"] pairs, like
+// bpemodel.MergeMapFromFile does for a merges file.
+func mergeMapFromList(list []json.RawMessage, vocab *vocabulary.Vocabulary, prefixLength int) (*bpemodel.MergeMap, error) {
+	m := bpemodel.NewMergeMap()
+	for rank, raw := range list {
+		var terms []string
+		var s string
+		if err := json.Unmarshal(raw, &s); err == nil {
+			terms = strings.Split(s, " ")
+		} else if err := json.Unmarshal(raw, &terms); err != nil {
+			return nil, fmt.Errorf("merge %d: malformed merge %s", rank, raw)
+		}
+		if len(terms) != 2 {
+			return nil, fmt.Errorf("merge %d: malformed merge %s", rank, raw)
+		}
+		if err := addMerge(m, vocab, rank, terms[0], terms[1], prefixLength); err != nil {
+			return nil, fmt.Errorf("merge %d: %w", rank, err)
+		}
+	}
+	return m, nil
+}
+
+func stringOr(s *string, def string) string {
+	if s == nil {
+		return def
+	}
+	return *s
+}
@@ -4,21 +4,106 @@
 
 package tokenizer
 
-import "github.com/nlpodyssey/verbaflow/tokenizer/internal/bpetokenizer"
+import (
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/nlpodyssey/verbaflow/tokenizer/internal/bpetokenizer"
+)
+
+// EndOfTextToken is the special token used by the RWKV Pile models as
+// beginning-of-sequence, end-of-sequence and padding token.
+const EndOfTextToken = "<|endoftext|>"
+
+// ControlTokensIDs contains the IDs of the control tokens.
+type ControlTokensIDs = bpetokenizer.ControlTokensIDs
 
 // Tokenizer is the interface that wraps the basic tokenizers methods.
 type Tokenizer interface {
-	// Tokenize returns the sequence of token IDs for the given text.
+	// Tokenize returns the sequence of token IDs for the given text,
+	// followed by the end-of-sequence token if Options.AppendEOS is set.
 	Tokenize(text string) ([]int, error)
+	// TokenizeWithoutEOS is like Tokenize, but it never appends the
+	// end-of-sequence token, for example for a prompt to continue.
+	TokenizeWithoutEOS(text string) ([]int, error)
+	// EncodeToken is like Tokenize, but faster for a single word, and it
+	// never appends the end-of-sequence token.
+	EncodeToken(word string) ([]int, error)
 	// ReconstructText returns the text corresponding to the given sequence of token IDs.
 	ReconstructText(ids []int) (string, error)
+	// RoundTrip returns the text reconstructed from the tokenization of the
+	// given text, which is the text itself unless the tokenizer normalizes
+	// it or adds a prefix space.
+	RoundTrip(text string) (string, error)
+	// TokenFrequencies returns the number of occurrences of each token ID
+	// in the tokenization of the given texts.
+	TokenFrequencies(texts []string) (map[int]int, error)
+	// ControlTokens returns the IDs of the control tokens.
+	ControlTokens() ControlTokensIDs
+	// VocabularySize returns the number of tokens in the vocabulary.
+	VocabularySize() int
+	// MergeCount returns the number of merges of the BPE model.
+	MergeCount() int
+}
+
+// Files returns the names of the files, relative to the path, read by Load:
+// the unified tokenizer.json file of the Hugging Face tokenizers, if it
+// exists, otherwise the vocabulary and the merges.
+func Files(path string) []string {
+	if _, err := os.Stat(filepath.Join(path, bpetokenizer.TokenizerFilename)); err == nil {
+		return []string{bpetokenizer.TokenizerFilename}
+	}
+	return []string{bpetokenizer.VocabularyFilename, bpetokenizer.MergesFilename}
 }
 
-// Load loads a tokenizer from the given path.
+// Options configures the tokenization.
+type Options = bpetokenizer.Options
+
+// DefaultOptions returns the options used by Load.
+func DefaultOptions() Options {
+	return bpetokenizer.DefaultOptions()
+}
+
+// Load loads a tokenizer from the given path, with the DefaultOptions.
+// The settings of the tokenizer are read from the tokenizer.json file, if it
+// exists, otherwise the vocabulary and merges files are read with default
+// settings.
+//
+// The control tokens are resolved to the ID of the EndOfTextToken, when it
+// is part of the vocabulary, otherwise they default to zero.
 func Load(path string) (Tokenizer, error) {
-	tk, err := bpetokenizer.Load(path, bpetokenizer.ControlTokensIDs{})
+	return LoadWithOptions(path, DefaultOptions())
+}
+
+// LoadWithOptions is like Load, but with the given options.
+func LoadWithOptions(path string, opts Options) (Tokenizer, error) {
+	tk, err := bpetokenizer.LoadWithOptions(path, bpetokenizer.ControlTokensIDs{}, opts)
 	if err != nil {
 		return nil, err
 	}
-	return tk, nil
+	return withEndOfTextControlTokens(tk), nil
+}
+
+// LoadFromReaders is like LoadWithOptions, but reads the vocabulary and the
+// merges from the readers, in the formats of the vocab.json and merges.txt
+// files, so that the tokenizer can be loaded from any source, like an
+// embedded asset.
+func LoadFromReaders(vocab, merges io.Reader, opts Options) (Tokenizer, error) {
+	tk, err := bpetokenizer.LoadFromReaders(vocab, merges, bpetokenizer.ControlTokensIDs{}, opts)
+	if err != nil {
+		return nil, err
+	}
+	return withEndOfTextControlTokens(tk), nil
+}
+
+// withEndOfTextControlTokens resolves the control tokens to the ID of the
+// EndOfTextToken, if it is part of the vocabulary.
+func withEndOfTextControlTokens(tk *bpetokenizer.BPETokenizer) *bpetokenizer.BPETokenizer {
+	if id, ok := tk.TokenID(EndOfTextToken); ok {
+		tk.ControlTokenIDs.BosTokenID = id
+		tk.ControlTokenIDs.EosTokenID = id
+		tk.ControlTokenIDs.PadTokenID = id
+	}
+	return tk
 }
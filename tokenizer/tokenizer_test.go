@@ -0,0 +1,43 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tokenizer
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadFromReaders(t *testing.T) {
+	const dir = "internal/bpetokenizer/testdata/dummy-roberta-model"
+	expected, err := Load(dir)
+	require.NoError(t, err)
+
+	vocab, err := os.Open(filepath.Join(dir, "vocab.json"))
+	require.NoError(t, err)
+	defer vocab.Close()
+	merges, err := os.Open(filepath.Join(dir, "merges.txt"))
+	require.NoError(t, err)
+	defer merges.Close()
+	actual, err := LoadFromReaders(vocab, merges, DefaultOptions())
+	require.NoError(t, err)
+
+	assert.Equal(t, expected.VocabularySize(), actual.VocabularySize())
+	assert.Equal(t, expected.ControlTokens(), actual.ControlTokens())
+	for _, text := range []string{"Hello world!", "I'm the root of the tree", "  rare  tokens\n"} {
+		expectedIDs, err := expected.Tokenize(text)
+		require.NoError(t, err)
+		actualIDs, err := actual.Tokenize(text)
+		require.NoError(t, err)
+		assert.Equal(t, expectedIDs, actualIDs, text)
+	}
+
+	_, err = LoadFromReaders(strings.NewReader(`{"a": 0}`), strings.NewReader("a b\n"), DefaultOptions())
+	assert.Error(t, err, "the merge is out of vocabulary")
+}
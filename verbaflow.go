@@ -9,8 +9,12 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/nlpodyssey/rwkv"
 	"github.com/nlpodyssey/spago/ag"
 	"github.com/nlpodyssey/spago/embeddings/store/diskstore"
 	"github.com/nlpodyssey/verbaflow/decoder"
@@ -22,22 +26,91 @@ import (
 
 // VerbaFlow is the core struct of the library.
 type VerbaFlow struct {
-	Model          *rwkvlm.Model
-	Tokenizer      tokenizer.Tokenizer
-	embeddingsRepo *diskstore.Repository
+	Model     *rwkvlm.Model
+	Tokenizer tokenizer.Tokenizer
+	// Batcher, if set, runs the steps of the generations running
+	// concurrently together, to improve the throughput.
+	Batcher *rwkvlm.Batcher
+	// EncodeChunkSize, if positive, makes the prompts be encoded in chunks of
+	// at most this number of tokens, releasing the graph of each chunk, so
+	// that the memory doesn't grow with the length of the prompt.
+	EncodeChunkSize int
+	embeddingsRepo  *diskstore.Repository
+
+	vocabularyOnce sync.Once
+	vocabulary     []string
+	vocabularyErr  error
+}
+
+// LoadOptions configures how the model is loaded and executed.
+//
+// The execution settings are process-global: they are applied by Load and
+// affect every model in the process, including the ones loaded before.
+type LoadOptions struct {
+	// AddPrefixSpace makes the tokenizer add a space at the beginning of the
+	// prompts, as expected by some models (default: false).
+	// Unlike the other settings, it only affects the loaded model.
+	AddPrefixSpace bool
+	// TokenizerCacheSize is the number of texts whose tokenization is
+	// cached, like the system prompts, which are often identical across the
+	// requests (default: 0, no cache). It only affects the loaded model.
+	TokenizerCacheSize int
+	// EncodeChunkSize sets the EncodeChunkSize of the loaded model
+	// (default: 0, the prompt is encoded at once).
+	EncodeChunkSize int
+	// NumThreads is the maximum number of CPUs running the computation
+	// simultaneously, as set by runtime.GOMAXPROCS (default: unchanged).
+	NumThreads int
+	// SyncExecution makes each operation of the computational graph run
+	// to completion before the next one starts, instead of in its own
+	// goroutine. It is slower, but makes the execution easier to profile
+	// and debug (default: unchanged).
+	SyncExecution bool
+}
+
+// apply applies the process-global settings which are set, so that loading
+// another model without them doesn't reset the ones applied before.
+func (o LoadOptions) apply() {
+	if o.NumThreads > 0 {
+		runtime.GOMAXPROCS(o.NumThreads)
+	}
+	if o.SyncExecution {
+		ag.SetDebugMode(true)
+	}
 }
 
 // Load loads a VerbaFlow model from the given directory.
-func Load(modelDir string) (*VerbaFlow, error) {
-	tk, err := tokenizer.Load(modelDir)
+func Load(modelDir string, opts LoadOptions) (*VerbaFlow, error) {
+	return LoadFile(modelDir, rwkvlm.DefaultOutputFilename, opts)
+}
+
+// LoadFile is like Load, but reads the model from the given file name,
+// relative to modelDir, instead of rwkvlm.DefaultOutputFilename.
+// This allows selecting one of many converted models in the same directory.
+func LoadFile(modelDir, modelFile string, opts LoadOptions) (*VerbaFlow, error) {
+	if opts.NumThreads < 0 {
+		return nil, fmt.Errorf("invalid number of threads %d: must be >= 0", opts.NumThreads)
+	}
+	if opts.TokenizerCacheSize < 0 {
+		return nil, fmt.Errorf("invalid tokenizer cache size %d: must be >= 0", opts.TokenizerCacheSize)
+	}
+	if opts.EncodeChunkSize < 0 {
+		return nil, fmt.Errorf("invalid encode chunk size %d: must be >= 0", opts.EncodeChunkSize)
+	}
+	opts.apply()
+
+	if err := checkModelDir(modelDir, modelFile); err != nil {
+		return nil, fmt.Errorf("%w. Please ensure that the model has been successfully downloaded and converted before trying again", err)
+	}
+	tk, err := tokenizer.LoadWithOptions(modelDir, tokenizer.Options{
+		AddPrefixSpace: opts.AddPrefixSpace,
+		CacheSize:      opts.TokenizerCacheSize,
+	})
 	if err != nil {
 		return nil, err
 	}
-	model, err := rwkvlm.Load(modelDir)
+	model, err := rwkvlm.LoadFile(filepath.Join(modelDir, modelFile))
 	if err != nil {
-		if os.IsNotExist(err) {
-			return nil, fmt.Errorf("error: unable to find the model file or directory '%s'. Please ensure that the model has been successfully downloaded and converted before trying again", modelDir)
-		}
 		return nil, err
 	}
 	embeddingsRepo, err := diskstore.NewRepository(filepath.Join(modelDir, rwkvlm.DefaultEmbeddingRepoPath), diskstore.ReadOnlyMode)
@@ -46,48 +119,251 @@ func Load(modelDir string) (*VerbaFlow, error) {
 	}
 	err = model.ApplyEmbeddings(embeddingsRepo)
 	if err != nil {
+		_ = embeddingsRepo.Close()
 		return nil, fmt.Errorf("failed to apply embeddings: %w", err)
 	}
+	if err = checkVocabularySize(model, tk); err != nil {
+		_ = embeddingsRepo.Close()
+		return nil, err
+	}
 	return &VerbaFlow{
-		Model:          model,
-		Tokenizer:      tk,
-		embeddingsRepo: embeddingsRepo,
+		Model:           model,
+		Tokenizer:       tk,
+		EncodeChunkSize: opts.EncodeChunkSize,
+		embeddingsRepo:  embeddingsRepo,
 	}, nil
 }
 
+// RequiredFiles returns the names of the files and directories, relative to
+// the model directory, needed by Load: the tokenizer files, the converted
+// model and its embeddings. The source files of the conversion are not needed.
+func RequiredFiles(dir string) []string {
+	return requiredFiles(dir, rwkvlm.DefaultOutputFilename)
+}
+
+func requiredFiles(dir, modelFile string) []string {
+	return append(tokenizer.Files(dir), modelFile, rwkvlm.DefaultEmbeddingRepoPath)
+}
+
+// CheckModelDir checks that dir contains all the RequiredFiles, returning an
+// error which lists the missing ones otherwise.
+func CheckModelDir(dir string) error {
+	return checkModelDir(dir, rwkvlm.DefaultOutputFilename)
+}
+
+func checkModelDir(dir, modelFile string) error {
+	var missing []string
+	for _, name := range requiredFiles(dir, modelFile) {
+		_, err := os.Stat(filepath.Join(dir, name))
+		switch {
+		case os.IsNotExist(err):
+			missing = append(missing, name)
+		case err != nil:
+			return err
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("the model directory %q is incomplete, missing: %s", dir, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// checkVocabularySize checks that the vocabulary size of the model
+// configuration agrees with the rows of the linear layer and the number
+// of embeddings, and that every token of the tokenizer is known to the model.
+// The model vocabulary can be larger than the tokenizer's, since it is often
+// padded, but it can't be smaller.
+func checkVocabularySize(model *rwkvlm.Model, tk tokenizer.Tokenizer) error {
+	vs := model.Config.VocabSize
+	if rows := model.Linear.Value().Rows(); rows != vs {
+		return fmt.Errorf("vocabulary size mismatch: the model configuration has %d tokens, but the linear layer has %d rows", vs, rows)
+	}
+	if n := model.Embeddings.Tokens.Count(); n != vs {
+		return fmt.Errorf("vocabulary size mismatch: the model configuration has %d tokens, but there are %d embeddings", vs, n)
+	}
+	if n := tk.VocabularySize(); n > vs {
+		return fmt.Errorf("vocabulary size mismatch: the tokenizer has %d tokens, but the model configuration only %d", n, vs)
+	}
+	return nil
+}
+
 // Close closes the model resources.
 func (vf *VerbaFlow) Close() error {
+	if vf.embeddingsRepo == nil {
+		// not loaded from a directory
+		return nil
+	}
 	return vf.embeddingsRepo.Close()
 }
 
 // Generate generates a text from the given prompt.
-// The "out" channel is used to stream the generated text.
+// The "out" channel is used to stream the generated text, and it is closed at
+// the end, even in case of error.
 // The generated text will be at most `maxTokens` long (in addition to the prompt).
 func (vf *VerbaFlow) Generate(ctx context.Context, nt *ag.NodesTracker, prompt string, chGen chan decoder.GeneratedToken, opts decoder.DecodingOptions) error {
 	log.Trace().Msgf("Tokenizing prompt: %q", prompt)
-	tokenized, err := vf.Tokenizer.Tokenize(prompt)
+	tokenized, err := vf.TokenizePrompt(prompt, opts.AddBOS)
 	if err != nil {
+		close(chGen)
 		return err
 	}
+	return vf.GenerateFromTokens(ctx, nt, tokenized, chGen, opts)
+}
 
+// GenerateFromTokens is like Generate, but takes an already tokenized prompt.
+func (vf *VerbaFlow) GenerateFromTokens(ctx context.Context, nt *ag.NodesTracker, tokenized []int, chGen chan decoder.GeneratedToken, opts decoder.DecodingOptions) error {
 	log.Trace().Msgf("Preprocessing %d token IDs: %v", len(tokenized), tokenized)
 	start := time.Now()
-	encoderOutput, err := encoder.New(vf.Model).Encode(ctx, tokenized)
+	encoderOutput, err := vf.encode(ctx, nil, tokenized)
 	if err != nil {
+		close(chGen)
 		return err
 	}
 	log.Trace().Msgf("Preprocessing took %s", time.Since(start))
 
 	log.Trace().Msg("Generating...")
-	d, err := decoder.New(vf.Model, opts)
+	d, err := vf.newDecoder(opts)
 	if err != nil {
+		close(chGen)
 		return err
 	}
 
-	return d.Decode(ctx, nt, encoderOutput, chGen)
+	return d.DecodeToChannel(ctx, nt, encoderOutput, chGen)
+}
+
+// EncodeState returns the state of the model after encoding the given prompt,
+// as is, without the beginning-of-sequence token. It is meant for probing
+// and interpretability work: see encoder.Result.StateSnapshot for the layout.
+// The state is detached from the graph that computed it, so it can also be
+// passed to Model.Encode to continue from the prompt.
+func (vf *VerbaFlow) EncodeState(ctx context.Context, prompt string) (rwkv.State, error) {
+	tokenized, err := vf.TokenizePrompt(prompt, false)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokenized) == 0 {
+		return nil, fmt.Errorf("the prompt can't be empty")
+	}
+	res, err := vf.encode(ctx, nil, tokenized)
+	if err != nil {
+		return nil, err
+	}
+	return detachState(res.State), nil
+}
+
+// encode encodes the tokens from the state, which is modified, or from the
+// initial one if it is nil. The tokens are encoded in chunks if
+// EncodeChunkSize is set, in which case the result is detached from the
+// graph, and so must be the state.
+func (vf *VerbaFlow) encode(ctx context.Context, state rwkv.State, tokens []int) (encoder.Result, error) {
+	if vf.EncodeChunkSize > 0 {
+		return encoder.New(vf.Model).EncodeChunkedFrom(ctx, state, tokens, vf.EncodeChunkSize)
+	}
+	x, s := vf.Model.Encode(ctx, state, tokens...)
+	return encoder.Result{Encoding: ag.WaitForValue(x), State: s}, nil
+}
+
+// NextTokenDistribution returns the probabilities of each token of the
+// vocabulary to follow the given prompt, as is, without the
+// beginning-of-sequence token. It is meant for classification, scoring and
+// calibration, where the whole distribution is needed, and not a generation.
+func (vf *VerbaFlow) NextTokenDistribution(ctx context.Context, prompt string) ([]float64, error) {
+	tokenized, err := vf.TokenizePrompt(prompt, false)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokenized) == 0 {
+		return nil, fmt.Errorf("the prompt can't be empty")
+	}
+	x, s := vf.Model.Encode(ctx, nil, tokenized...)
+	logits := vf.Model.Predict(x)
+	probs := decoder.TemperedSoftmax(logits.Value(), 1).Data().F64()
+	// the whole graph is released, so the state must be computed too
+	waitForValues(x, s)
+	nodes := []ag.Node{logits}
+	for _, layer := range s {
+		nodes = append(nodes, layer.FfnXX, layer.AttXX, layer.AttAA, layer.AttBB, layer.AttPP)
+	}
+	ag.ReleaseGraph(nodes...)
+	return probs, nil
+}
+
+// TokenizePrompt returns the token IDs of the given prompt.
+// If addBOS is true, the beginning-of-sequence token is prepended.
+func (vf *VerbaFlow) TokenizePrompt(prompt string, addBOS bool) ([]int, error) {
+	// the generation must continue the prompt, so it is never terminated by
+	// the end-of-sequence token of a tokenizer configured with AppendEOS
+	tokenized, err := vf.Tokenizer.TokenizeWithoutEOS(prompt)
+	if err != nil {
+		return nil, err
+	}
+	if addBOS {
+		tokenized = append([]int{vf.Tokenizer.ControlTokens().BosTokenID}, tokenized...)
+	}
+	return tokenized, nil
 }
 
 // TokenByID returns the token string for the given token ID.
 func (vf *VerbaFlow) TokenByID(id int) (string, error) {
 	return vf.Tokenizer.ReconstructText([]int{id})
 }
+
+// newDecoder returns a decoder with the logits processors, the vocabulary and
+// the forced prefix required by the decoding options.
+func (vf *VerbaFlow) newDecoder(opts decoder.DecodingOptions) (*decoder.Decoder, error) {
+	processors, err := vf.logitsProcessors(opts)
+	if err != nil {
+		return nil, err
+	}
+	d, err := decoder.New(vf.Model, opts, processors...)
+	if err != nil {
+		return nil, err
+	}
+	d.SetBatcher(vf.Batcher)
+	if opts.ForcedPrefix != "" {
+		prefix, err := vf.TokenizePrompt(opts.ForcedPrefix, false)
+		if err != nil {
+			return nil, fmt.Errorf("failed to tokenize the forced prefix: %w", err)
+		}
+		d.SetForcedPrefix(prefix)
+	}
+	if opts.MaxChars > 0 {
+		vocab, err := vf.Vocabulary()
+		if err != nil {
+			return nil, err
+		}
+		d.SetVocabulary(vocab)
+	}
+	return d, nil
+}
+
+// logitsProcessors returns the logits processors required by the decoding options.
+func (vf *VerbaFlow) logitsProcessors(opts decoder.DecodingOptions) ([]decoder.LogitsProcessor, error) {
+	var processors []decoder.LogitsProcessor
+	if opts.ForceJSON {
+		vocab, err := vf.Vocabulary()
+		if err != nil {
+			return nil, err
+		}
+		processors = append(processors, decoder.NewJSONConstraint(vocab, opts.EndTokenID))
+	}
+	return processors, nil
+}
+
+// Vocabulary returns the text of each token, indexed by token ID.
+// It is computed once, on the first call.
+func (vf *VerbaFlow) Vocabulary() ([]string, error) {
+	vf.vocabularyOnce.Do(func() {
+		vocab := make([]string, vf.Model.Config.VocabSize)
+		for id := range vocab {
+			token, err := vf.TokenByID(id)
+			if err != nil {
+				vf.vocabularyErr = fmt.Errorf("failed to reconstruct text for token ID %d: %w", id, err)
+				return
+			}
+			vocab[id] = token
+		}
+		vf.vocabulary = vocab
+	})
+	return vf.vocabulary, vf.vocabularyErr
+}
@@ -0,0 +1,368 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package verbaflow
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/nlpodyssey/rwkv"
+	"github.com/nlpodyssey/spago/ag"
+	"github.com/nlpodyssey/spago/mat"
+	"github.com/nlpodyssey/verbaflow/decoder"
+	"github.com/nlpodyssey/verbaflow/encoder"
+	"github.com/nlpodyssey/verbaflow/rwkvlm"
+	"github.com/nlpodyssey/verbaflow/rwkvlm/rwkvlmtest"
+	"github.com/nlpodyssey/verbaflow/tokenizer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testModelDir = "testdata/tiny-model"
+
+// newTestVerbaFlow returns a VerbaFlow made of a tiny random model and the
+// tokenizer from testModelDir, whose vocabularies have the same size.
+func newTestVerbaFlow(t *testing.T) *VerbaFlow {
+	t.Helper()
+	tk, err := tokenizer.Load(testModelDir)
+	require.NoError(t, err)
+	return &VerbaFlow{
+		Model:     rwkvlmtest.NewModel(rwkvlmtest.DefaultConfig, 1),
+		Tokenizer: tk,
+	}
+}
+
+func TestVerbaFlow_TokenizePrompt(t *testing.T) {
+	vf := newTestVerbaFlow(t)
+	bos := vf.Tokenizer.ControlTokens().BosTokenID
+	require.Equal(t, 15, bos, "BOS must be resolved to the end-of-text token")
+
+	tokenized, err := vf.TokenizePrompt("unrelated", false)
+	require.NoError(t, err)
+	assert.Equal(t, []int{11, 14}, tokenized)
+
+	tokenized, err = vf.TokenizePrompt("unrelated", true)
+	require.NoError(t, err)
+	assert.Equal(t, []int{bos, 11, 14}, tokenized)
+
+	// the end-of-sequence token is never appended to the prompts
+	vf.Tokenizer, err = tokenizer.LoadWithOptions(testModelDir, tokenizer.Options{AppendEOS: true})
+	require.NoError(t, err)
+	tokenized, err = vf.TokenizePrompt("unrelated", true)
+	require.NoError(t, err)
+	assert.Equal(t, []int{bos, 11, 14}, tokenized)
+
+	// a prompt whose last token has the ID of the end-of-sequence token is
+	// kept whole, as when the control tokens default to zero
+	vf.Tokenizer = eosTokenizer{Tokenizer: vf.Tokenizer, eos: 14}
+	tokenized, err = vf.TokenizePrompt("unrelated", false)
+	require.NoError(t, err)
+	assert.Equal(t, []int{11, 14}, tokenized)
+}
+
+// eosTokenizer is a tokenizer with the given end-of-sequence token.
+type eosTokenizer struct {
+	tokenizer.Tokenizer
+	eos int
+}
+
+func (t eosTokenizer) ControlTokens() tokenizer.ControlTokensIDs {
+	ids := t.Tokenizer.ControlTokens()
+	ids.EosTokenID = t.eos
+	return ids
+}
+
+func TestVerbaFlow_Generate_InvalidOptions(t *testing.T) {
+	vf := newTestVerbaFlow(t)
+	ctx := context.Background()
+	opts := decoder.DecodingOptions{MaxLen: 3, Temp: 2, TopP: 1}
+
+	// chGen is closed even if the generation fails before decoding
+	assertClosed := func(chGen chan decoder.GeneratedToken) {
+		_, ok := <-chGen
+		assert.False(t, ok)
+	}
+	nt := &ag.NodesTracker{}
+	defer nt.ReleaseNodes()
+	chGen := make(chan decoder.GeneratedToken, opts.MaxLen)
+	assert.Error(t, vf.Generate(ctx, nt, "unrelated", chGen, opts))
+	assertClosed(chGen)
+
+	chGen = make(chan decoder.GeneratedToken, opts.MaxLen)
+	_, err := vf.GenerateResumable(ctx, []int{11, 14}, chGen, opts)
+	assert.Error(t, err)
+	assertClosed(chGen)
+
+	chGen = make(chan decoder.GeneratedToken, opts.MaxLen)
+	assert.Error(t, vf.GenerateContinue(ctx, nil, 1, chGen, opts))
+	assertClosed(chGen)
+
+	chGen = make(chan decoder.GeneratedToken, opts.MaxLen)
+	assert.Error(t, vf.NewEncodingSession(ctx).Generate(chGen, opts))
+	assertClosed(chGen)
+}
+
+func TestCheckVocabularySize(t *testing.T) {
+	vf := newTestVerbaFlow(t)
+	require.NoError(t, checkVocabularySize(vf.Model, vf.Tokenizer))
+
+	t.Run("tokenizer larger than the model", func(t *testing.T) {
+		conf := rwkvlmtest.DefaultConfig
+		conf.VocabSize = 8
+		err := checkVocabularySize(rwkvlmtest.NewModel(conf, 1), vf.Tokenizer)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "the tokenizer has 16 tokens")
+	})
+
+	t.Run("padded model vocabulary", func(t *testing.T) {
+		conf := rwkvlmtest.DefaultConfig
+		conf.VocabSize = 20
+		assert.NoError(t, checkVocabularySize(rwkvlmtest.NewModel(conf, 1), vf.Tokenizer))
+	})
+
+	t.Run("linear layer mismatch", func(t *testing.T) {
+		m := rwkvlmtest.NewModel(rwkvlmtest.DefaultConfig, 1)
+		m.Linear.ReplaceValue(mat.NewEmptyDense[float32](15, m.Config.DModel))
+		err := checkVocabularySize(m, vf.Tokenizer)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "the linear layer has 15 rows")
+	})
+
+	t.Run("embeddings mismatch", func(t *testing.T) {
+		m := rwkvlmtest.NewModel(rwkvlmtest.DefaultConfig, 1)
+		m.Embeddings.Tokens.EmbeddingFast(16).ReplaceValue(mat.NewEmptyVecDense[float32](m.Config.DModel))
+		err := checkVocabularySize(m, vf.Tokenizer)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "there are 17 embeddings")
+	})
+}
+
+// newTestModelDir returns a directory containing the converted tiny random
+// model and the tokenizer from testModelDir.
+func newTestModelDir(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	for _, name := range []string{"vocab.json", "merges.txt"} {
+		data, err := os.ReadFile(filepath.Join(testModelDir, name))
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), data, 0o644))
+	}
+	require.NoError(t, rwkvlmtest.WriteTorchModel(dir, rwkvlmtest.DefaultConfig, 1))
+	require.NoError(t, rwkvlm.ConvertPickledModelToRWKVLM[float32](rwkvlm.ConverterConfig{ModelDir: dir}))
+	return dir
+}
+
+func TestLoad_SyncExecution(t *testing.T) {
+	dir := newTestModelDir(t)
+	// the options are process-global, so they are restored at the end
+	threads := runtime.GOMAXPROCS(0)
+	t.Cleanup(func() {
+		runtime.GOMAXPROCS(threads)
+		ag.SetDebugMode(false)
+	})
+
+	generate := func(opts LoadOptions) []int {
+		vf, err := Load(dir, opts)
+		require.NoError(t, err)
+		defer vf.Close()
+
+		dopts := decoder.DecodingOptions{
+			MaxLen:     8,
+			MinLen:     8,
+			EndTokenID: vf.Tokenizer.ControlTokens().EosTokenID,
+			Temp:       1,
+			TopP:       1,
+		}
+		nt := &ag.NodesTracker{}
+		defer nt.ReleaseNodes()
+		chGen := make(chan decoder.GeneratedToken, dopts.MaxLen)
+		require.NoError(t, vf.Generate(context.Background(), nt, "unrelated", chGen, dopts))
+		var ids []int
+		for gen := range chGen {
+			ids = append(ids, gen.TokenID)
+		}
+		return ids
+	}
+
+	expected := generate(LoadOptions{})
+	require.Len(t, expected, 8)
+	assert.Equal(t, expected, generate(LoadOptions{SyncExecution: true, NumThreads: 1}))
+
+	// loading without the options keeps the ones applied before
+	vf, err := Load(dir, LoadOptions{})
+	require.NoError(t, err)
+	require.NoError(t, vf.Close())
+	assert.Equal(t, 1, runtime.GOMAXPROCS(0))
+}
+
+func TestLoad_InvalidNumThreads(t *testing.T) {
+	_, err := Load(newTestModelDir(t), LoadOptions{NumThreads: -1})
+	assert.Error(t, err)
+}
+
+func TestCheckModelDir(t *testing.T) {
+	dir := newTestModelDir(t)
+	require.NoError(t, CheckModelDir(dir))
+
+	require.NoError(t, os.Remove(filepath.Join(dir, "merges.txt")))
+	require.NoError(t, os.Remove(filepath.Join(dir, rwkvlm.DefaultOutputFilename)))
+	err := CheckModelDir(dir)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "missing: merges.txt, spago_model.bin")
+
+	_, err = Load(dir, LoadOptions{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "missing: merges.txt, spago_model.bin")
+}
+
+func TestVerbaFlow_EncodeState(t *testing.T) {
+	vf := newTestVerbaFlow(t)
+	conf := vf.Model.Config
+
+	s, err := vf.EncodeState(context.Background(), "unrelated")
+	require.NoError(t, err)
+	snapshot := encoder.Result{State: s}.StateSnapshot()
+	require.Len(t, snapshot, conf.NumHiddenLayers)
+	for _, layer := range snapshot {
+		require.Len(t, layer, 5)
+		for _, values := range layer {
+			assert.Len(t, values, conf.DModel)
+		}
+	}
+
+	_, err = vf.EncodeState(context.Background(), "")
+	assert.Error(t, err)
+}
+
+func TestVerbaFlow_EncodeChunkSize(t *testing.T) {
+	vf := newTestVerbaFlow(t)
+	vf.Model = rwkvlmtest.NewModel(rwkvlmtest.DefaultConfig, 2)
+	ctx := context.Background()
+	prompt := "unrelated unrelated unrelated"
+	opts := decoder.DecodingOptions{MaxLen: 4, MinLen: 4, EndTokenID: -1, Temp: 1, TopP: 1}
+	run := func() (rwkv.State, []int, []int) {
+		state, err := vf.EncodeState(ctx, prompt)
+		require.NoError(t, err)
+		tokenized, err := vf.TokenizePrompt(prompt, false)
+		require.NoError(t, err)
+		collect := func(chGen chan decoder.GeneratedToken) []int {
+			var ids []int
+			for g := range chGen {
+				ids = append(ids, g.TokenID)
+			}
+			return ids
+		}
+		nt := &ag.NodesTracker{}
+		defer nt.ReleaseNodes()
+		chGen := make(chan decoder.GeneratedToken, opts.MaxLen)
+		require.NoError(t, vf.GenerateFromTokens(ctx, nt, tokenized, chGen, opts))
+		generated := collect(chGen)
+		chGen = make(chan decoder.GeneratedToken, opts.MaxLen)
+		_, err = vf.GenerateResumable(ctx, tokenized, chGen, opts)
+		require.NoError(t, err)
+		return state, generated, collect(chGen)
+	}
+
+	// the chunks encode the same prompt as a whole
+	expectedState, expected, expectedResumable := run()
+	require.Len(t, expected, opts.MaxLen)
+	vf.EncodeChunkSize = 2
+	state, generated, resumable := run()
+	assert.Equal(t, expected, generated)
+	assert.Equal(t, expectedResumable, resumable)
+	actualSnapshot := encoder.Result{State: state}.StateSnapshot()
+	for i, layer := range (encoder.Result{State: expectedState}).StateSnapshot() {
+		for j, values := range layer {
+			assert.InDeltaSlice(t, values, actualSnapshot[i][j], 1e-6, "layer %d, tensor %d", i, j)
+		}
+	}
+}
+
+func TestVerbaFlow_NextTokenDistribution(t *testing.T) {
+	vf := newTestVerbaFlow(t)
+
+	probs, err := vf.NextTokenDistribution(context.Background(), "unrelated")
+	require.NoError(t, err)
+	require.Len(t, probs, vf.Model.Config.VocabSize)
+	sum := 0.0
+	for _, p := range probs {
+		assert.GreaterOrEqual(t, p, 0.0)
+		sum += p
+	}
+	assert.InDelta(t, 1, sum, 1e-6)
+
+	// the prediction follows the last token of the prompt
+	x, _ := vf.Model.Encode(context.Background(), nil, 11, 14)
+	assert.Equal(t, vf.Model.Predict(x).Value().ArgMax(), argMax(probs))
+
+	_, err = vf.NextTokenDistribution(context.Background(), "")
+	assert.Error(t, err)
+}
+
+func argMax(values []float64) int {
+	best := 0
+	for i, v := range values {
+		if v > values[best] {
+			best = i
+		}
+	}
+	return best
+}
+
+func TestVerbaFlow_Generate_ForcedPrefix(t *testing.T) {
+	vf := newTestVerbaFlow(t)
+	vf.Model = rwkvlmtest.NewModel(rwkvlmtest.DefaultConfig, 2)
+	opts := decoder.DecodingOptions{
+		MaxLen:     6,
+		EndTokenID: -1,
+		Temp:       1,
+		TopP:       1,
+		AddBOS:     true,
+	}
+	generate := func(tokenized []int, opts decoder.DecodingOptions) []decoder.GeneratedToken {
+		nt := &ag.NodesTracker{}
+		defer nt.ReleaseNodes()
+		chGen := make(chan decoder.GeneratedToken, opts.MaxLen)
+		require.NoError(t, vf.GenerateFromTokens(context.Background(), nt, tokenized, chGen, opts))
+		var out []decoder.GeneratedToken
+		for gen := range chGen {
+			out = append(out, gen)
+		}
+		return out
+	}
+
+	prompt, err := vf.TokenizePrompt("unrelated", opts.AddBOS)
+	require.NoError(t, err)
+	prefix, err := vf.TokenizePrompt("unrelated", false)
+	require.NoError(t, err)
+	require.Greater(t, len(prefix), 1)
+
+	forced := opts
+	forced.ForcedPrefix = "unrelated"
+	out := generate(prompt, forced)
+	require.Len(t, out, opts.MaxLen)
+	var ids []int
+	for i, gen := range out {
+		ids = append(ids, gen.TokenID)
+		if i < len(prefix) {
+			assert.Equal(t, 1.0, gen.TokenProb)
+		}
+	}
+	text, err := vf.Tokenizer.ReconstructText(ids[:len(prefix)])
+	require.NoError(t, err)
+	assert.Equal(t, "unrelated", text)
+
+	// the state advances as if the prefix was part of the prompt
+	expected := opts
+	expected.MaxLen -= len(prefix)
+	var expectedIDs []int
+	for _, gen := range generate(append(prompt, prefix...), expected) {
+		expectedIDs = append(expectedIDs, gen.TokenID)
+	}
+	assert.Equal(t, expectedIDs, ids[len(prefix):])
+}